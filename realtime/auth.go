@@ -1,8 +1,6 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -11,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -23,10 +22,62 @@ type Claims struct {
 	LastName  string `json:"lastName"`
 	Exp       int64  `json:"exp"`
 	Iat       int64  `json:"iat"`
+	Nbf       int64  `json:"nbf,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+
+	// Required on connect tickets (see ticket.go); checked against
+	// JWT_AUDIENCE on access tokens when set.
+	Aud audience `json:"aud,omitempty"`
+	Jti string   `json:"jti,omitempty"`
+
+	// Set on service-account tokens only (see service_account.go).
+	Kind       string   `json:"kind,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	EventTypes []string `json:"eventTypes,omitempty"`
+}
+
+// audience is a JWT aud claim, which may be a string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("aud must be a string or a list of strings")
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
 }
 
 type Auth struct {
+	// jwtSecret is the single key used until a keyset is loaded.
 	jwtSecret []byte
+	// keys, once set, replaces jwtSecret (see keyset.go).
+	keys atomic.Pointer[jwtKeyset]
+	// jwks verifies RS256/ES256 tokens when configured (see jwks.go).
+	jwks *jwksCache
+	// origins, when set, restricts cookie-authenticated browser requests
+	// to allowed origins (see origin.go).
+	origins *originAllowList
+
+	// policy is the header and registered-claim policy (see jwt.go).
+	policy jwtPolicy
+
+	// tickets remembers redeemed connect tickets until they expire.
+	tickets ticketStore
 }
 
 // Sentinel errors returned by AuthorizeTopic. They map 1:1 to wire error codes.
@@ -56,27 +107,87 @@ func (a *Auth) ValidateFromCookie(r *http.Request) (*Claims, error) {
 	return a.validateJWT(cookie.Value)
 }
 
+// bearerToken returns the token of an Authorization: Bearer header. Other
+// schemes (Basic from a proxy, say) are ignored, so the request falls back
+// to the ticket or cookie as if the header were absent.
+func bearerToken(r *http.Request) (string, bool) {
+	return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// ValidateRequest authenticates an HTTP request by its Authorization:
+// Bearer header, falling back to the access token cookie. A bad Bearer
+// token is rejected rather than falling back.
+func (a *Auth) ValidateRequest(r *http.Request) (*Claims, error) {
+	if token, ok := bearerToken(r); ok {
+		return a.validateJWT(token)
+	}
+	return a.ValidateFromCookie(r)
+}
+
+// ValidateHandshake authenticates a connection handshake: a Bearer header,
+// else a connect ticket in the ticket query parameter, else the cookie.
+// The ticket is removed from r.URL once read, so nothing downstream logs it.
+func (a *Auth) ValidateHandshake(r *http.Request) (*Claims, error) {
+	if token, ok := bearerToken(r); ok {
+		return a.validateJWT(token)
+	}
+	q := r.URL.Query()
+	if q.Has(connectTicketParam) {
+		ticket := q.Get(connectTicketParam)
+		q.Del(connectTicketParam)
+		r.URL.RawQuery = q.Encode()
+		return a.RedeemTicket(ticket, time.Now())
+	}
+	return a.ValidateFromCookie(r)
+}
+
+// validateJWT validates an access token (user or service account).
+// Connect tickets are refused here so they stay single-use, and so are the
+// relay's own internal tokens.
 func (a *Auth) validateJWT(token string) (*Claims, error) {
+	claims, err := a.parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case claims.Aud.contains(connectTicketAudience):
+		return nil, fmt.Errorf("connect ticket used as access token")
+	case claims.Aud.contains(realtimeInternalAudience):
+		return nil, fmt.Errorf("internal token used as access token")
+	case a.policy.audience != "" && !claims.Aud.contains(a.policy.audience):
+		return nil, fmt.Errorf("token audience mismatch")
+	}
+	return claims, nil
+}
+
+// parseJWT checks a token's header, signature, issuer and time claims
+// and returns its claims, which must name a user.
+func (a *Auth) parseJWT(token string) (*Claims, error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
 		return nil, fmt.Errorf("invalid token format")
 	}
 
+	header, err := parseJWTHeader(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	// HS256 may still be allowed by the claims; that is settled below.
+	if !a.policy.allowsAlg(header.Alg) && header.Alg != algHS256 {
+		return nil, fmt.Errorf("alg %q not accepted", header.Alg)
+	}
+
 	headerAndPayload := parts[0] + "." + parts[1]
-	signature, err := base64URLDecode(parts[2])
+	signature, err := decodeJWTSegment(parts[2])
 	if err != nil {
 		return nil, fmt.Errorf("invalid signature encoding: %w", err)
 	}
 
-	mac := hmac.New(sha256.New, a.jwtSecret)
-	mac.Write([]byte(headerAndPayload))
-	expectedSig := mac.Sum(nil)
-
-	if !hmac.Equal(signature, expectedSig) {
-		return nil, fmt.Errorf("invalid signature")
+	if err := a.verifySignature(header, []byte(headerAndPayload), signature); err != nil {
+		return nil, err
 	}
 
-	payloadBytes, err := base64URLDecode(parts[1])
+	payloadBytes, err := decodeJWTSegment(parts[1])
 	if err != nil {
 		return nil, fmt.Errorf("invalid payload encoding: %w", err)
 	}
@@ -86,27 +197,64 @@ func (a *Auth) validateJWT(token string) (*Claims, error) {
 		return nil, fmt.Errorf("invalid payload JSON: %w", err)
 	}
 
-	if claims.Exp > 0 && time.Now().Unix() > claims.Exp {
-		return nil, fmt.Errorf("token expired")
+	if err := a.policy.checkTimes(&claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if a.policy.issuer != "" && claims.Iss != a.policy.issuer {
+		return nil, fmt.Errorf("token issuer mismatch")
 	}
 
 	if claims.UserID == "" {
 		return nil, fmt.Errorf("missing userId in token")
 	}
 
+	if err := claims.checkKind(); err != nil {
+		return nil, err
+	}
+
+	if !a.policy.allowsClaims(header.Alg, &claims) {
+		return nil, fmt.Errorf("alg %q not accepted", header.Alg)
+	}
+
 	return &claims, nil
 }
 
+// verifySignature checks sig with the key family header.Alg calls for:
+// the shared keyset for HS256, JWKS for the asymmetric algorithms.
+func (a *Auth) verifySignature(header *jwtHeader, input, sig []byte) error {
+	if header.Alg == algHS256 {
+		return a.keyset().verify(header.Kid, input, sig)
+	}
+	if a.jwks == nil {
+		return fmt.Errorf("no JWKS configured for %s", header.Alg)
+	}
+	return a.jwks.verify(header.Alg, header.Kid, input, sig)
+}
+
+// keyset returns the keys tokens are verified and signed with.
+func (a *Auth) keyset() *jwtKeyset {
+	if ks := a.keys.Load(); ks != nil {
+		return ks
+	}
+	return singleJWTKeyset(a.jwtSecret)
+}
+
 // MintInternalJWT issues a short-lived HS256 bearer token for calling the
 // Next.js authorize endpoint. The token carries aud="realtime-internal" and
 // the user's identity; the authorize endpoint rejects tokens without this
 // audience, so the endpoint cannot be exercised with a stolen browser cookie.
+// It is signed with the keyset's signing key and names its kid, if any.
 func (a *Auth) MintInternalJWT(claims *Claims) (string, error) {
 	if claims == nil || claims.UserID == "" {
 		return "", fmt.Errorf("cannot mint internal JWT without userId")
 	}
 	now := time.Now()
+	kid, key := a.keyset().signingKey()
 	header := map[string]string{"alg": "HS256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
 	payload := map[string]any{
 		"userId": claims.UserID,
 		"aud":    realtimeInternalAudience,
@@ -123,10 +271,7 @@ func (a *Auth) MintInternalJWT(claims *Claims) (string, error) {
 	}
 	signingInput := base64URLEncode(hBytes) + "." + base64URLEncode(pBytes)
 
-	mac := hmac.New(sha256.New, a.jwtSecret)
-	mac.Write([]byte(signingInput))
-	sig := mac.Sum(nil)
-
+	sig := hmacSHA256(key, []byte(signingInput))
 	return signingInput + "." + base64URLEncode(sig), nil
 }
 
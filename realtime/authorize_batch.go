@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// authorizeBatchMaxTopics caps the topics in one batched authorize
+	// request; a batch that fills up is sent without waiting for the window.
+	authorizeBatchMaxTopics = MaxTopicsPerSession
+
+	// authorizeBatchRetryAfter is how long the relay sticks to one call per
+	// topic after the Next.js app turned out not to have the batch endpoint.
+	authorizeBatchRetryAfter = 5 * time.Minute
+)
+
+// authorizeBatchStats counts batched authorize requests (batches), the
+// topics they carried (topics), authorize calls that joined a batch already
+// waiting for the same user (coalesced), and batches sent as single calls
+// because the batch endpoint is missing (fallbacks).
+var authorizeBatchStats = expvar.NewMap("authorize_batch")
+
+// errBatchUnsupported is returned by AuthorizeTopics when the Next.js app
+// answers the batch endpoint with 404 or 405.
+var errBatchUnsupported = errors.New("batch authorize endpoint not available")
+
+// authzResult is the outcome of authorizing one topic.
+type authzResult struct {
+	Permission string
+	Err        error
+}
+
+// AuthorizeTopics is the batched form of AuthorizeTopic: one POST to
+// /api/realtime/authorize/batch with {"topics": [...]}, answered with
+// {"results": {"<topic>": {"permission": "editor"} | {"error": "forbidden"}}}.
+// Per-topic errors are forbidden, not_found or bad_request, mapped to the
+// same sentinels as the single endpoint. A failure of the request as a whole
+// is returned as the error.
+func AuthorizeTopics(apiBase string, topics []string, internalJWT string) (map[string]authzResult, error) {
+	body, err := json.Marshal(map[string][]string{"topics": topics})
+	if err != nil {
+		return nil, fmt.Errorf("%w: encode request: %v", ErrTopicTransient, err)
+	}
+	endpoint := strings.TrimRight(apiBase, "/") + "/api/realtime/authorize/batch"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: build request: %v", ErrTopicTransient, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+internalJWT)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: authorize batch call failed: %v", ErrTopicTransient, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, errBatchUnsupported
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("%w: authorize batch 401 (bearer rejected)", ErrTopicForbidden)
+	default:
+		return nil, fmt.Errorf("%w: authorize batch returned %d", ErrTopicTransient, resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: read body: %v", ErrTopicTransient, err)
+	}
+	var parsed struct {
+		Results map[string]struct {
+			Permission string `json:"permission"`
+			Error      string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return nil, fmt.Errorf("%w: invalid authorize batch response: %v", ErrTopicTransient, err)
+	}
+
+	results := make(map[string]authzResult, len(topics))
+	for _, topic := range topics {
+		r, ok := parsed.Results[topic]
+		switch {
+		case !ok:
+			results[topic] = authzResult{Err: fmt.Errorf("%w: topic missing from authorize batch response", ErrTopicTransient)}
+		case r.Error == "forbidden":
+			results[topic] = authzResult{Err: fmt.Errorf("%w: authorize batch (no access)", ErrTopicForbidden)}
+		case r.Error == "not_found":
+			results[topic] = authzResult{Err: fmt.Errorf("%w: authorize batch", ErrTopicNotFound)}
+		case r.Error == "bad_request":
+			results[topic] = authzResult{Err: fmt.Errorf("%w: authorize batch", ErrTopicBadRequest)}
+		case r.Error != "":
+			results[topic] = authzResult{Err: fmt.Errorf("%w: authorize batch error %q", ErrTopicTransient, r.Error)}
+		case r.Permission == "":
+			results[topic] = authzResult{Err: fmt.Errorf("%w: empty permission in authorize batch response", ErrTopicTransient)}
+		default:
+			results[topic] = authzResult{Permission: r.Permission}
+		}
+	}
+	return results, nil
+}
+
+// authzBatcher coalesces concurrent authorize calls for the same user (a
+// batch subscribe, or several tabs opening at once) into one batched
+// request. The first call for a user opens a batch; calls arriving within
+// window join it, and all of them wait for its results. A batch holding a
+// single topic goes to the single-topic endpoint as before.
+type authzBatcher struct {
+	window  time.Duration
+	auth    *Auth
+	apiBase string
+
+	// unsupportedUntil is the unix-nano time until which batches are sent
+	// as single calls, after the batch endpoint answered 404/405.
+	unsupportedUntil atomic.Int64
+
+	mu      sync.Mutex
+	pending map[string]*authzBatch // by user ID
+}
+
+type authzBatch struct {
+	claims *Claims
+	topics []string
+	seen   map[string]bool
+
+	once    sync.Once
+	done    chan struct{}
+	results map[string]authzResult
+}
+
+func newAuthzBatcher(window time.Duration, auth *Auth, apiBase string) *authzBatcher {
+	return &authzBatcher{window: window, auth: auth, apiBase: apiBase, pending: make(map[string]*authzBatch)}
+}
+
+// authorize returns claims' permission on topic, via the user's pending
+// batch.
+func (b *authzBatcher) authorize(claims *Claims, topic string) (string, error) {
+	userID := claims.UserID
+	b.mu.Lock()
+	batch := b.pending[userID]
+	if batch == nil {
+		batch = &authzBatch{claims: claims, seen: make(map[string]bool), done: make(chan struct{})}
+		b.pending[userID] = batch
+		time.AfterFunc(b.window, func() { b.flush(userID, batch) })
+	} else {
+		authorizeBatchStats.Add("coalesced", 1)
+	}
+	if !batch.seen[topic] {
+		batch.seen[topic] = true
+		batch.topics = append(batch.topics, topic)
+	}
+	full := len(batch.topics) >= authorizeBatchMaxTopics
+	if full {
+		delete(b.pending, userID)
+	}
+	b.mu.Unlock()
+
+	if full {
+		b.flush(userID, batch)
+	}
+	<-batch.done
+	r := batch.results[topic]
+	return r.Permission, r.Err
+}
+
+// flush sends batch once, on the window timer or when it fills up.
+func (b *authzBatcher) flush(userID string, batch *authzBatch) {
+	batch.once.Do(func() {
+		b.mu.Lock()
+		if b.pending[userID] == batch {
+			delete(b.pending, userID)
+		}
+		b.mu.Unlock()
+		batch.results = b.send(batch.claims, batch.topics)
+		close(batch.done)
+	})
+}
+
+// send authorizes topics for claims: one batched request when there are
+// several topics and the endpoint exists, else one request per topic, in
+// parallel.
+func (b *authzBatcher) send(claims *Claims, topics []string) map[string]authzResult {
+	results := make(map[string]authzResult, len(topics))
+	bearer, err := b.auth.MintInternalJWT(claims)
+	if err != nil {
+		for _, topic := range topics {
+			results[topic] = authzResult{Err: ErrTopicTransient}
+		}
+		return results
+	}
+
+	if len(topics) > 1 {
+		if time.Now().UnixNano() >= b.unsupportedUntil.Load() {
+			batch, err := AuthorizeTopics(b.apiBase, topics, bearer)
+			switch {
+			case err == nil:
+				authorizeBatchStats.Add("batches", 1)
+				authorizeBatchStats.Add("topics", int64(len(topics)))
+				return batch
+			case errors.Is(err, errBatchUnsupported):
+				b.unsupportedUntil.Store(time.Now().Add(authorizeBatchRetryAfter).UnixNano())
+				logf(regionLocal, "[authz] %v; using one call per topic for %s", err, authorizeBatchRetryAfter)
+			default:
+				for _, topic := range topics {
+					results[topic] = authzResult{Err: err}
+				}
+				return results
+			}
+		}
+		authorizeBatchStats.Add("fallbacks", 1)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, topic := range topics {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			permission, err := AuthorizeTopic(b.apiBase, topic, bearer)
+			mu.Lock()
+			results[topic] = authzResult{Permission: permission, Err: err}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBatchNextJS serves the single and batch authorize endpoints, denying
+// desktop:denied and granting editor elsewhere. Topics named desktop:gone
+// are missing from batch responses. With batch false the batch endpoint is
+// a 404, as on a Next.js app that predates it.
+type fakeBatchNextJS struct {
+	*httptest.Server
+	batch       atomic.Bool
+	singleCalls atomic.Int32
+	batchCalls  atomic.Int32
+}
+
+func newFakeBatchNextJS(t *testing.T, secret []byte) *fakeBatchNextJS {
+	f := &fakeBatchNextJS{}
+	f.batch.Store(true)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := verifyInternalBearerForTest(secret, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if !ok || payload["aud"] != realtimeInternalAudience {
+			http.Error(w, "invalid bearer", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/api/realtime/authorize" && r.Method == http.MethodGet:
+			f.singleCalls.Add(1)
+			if r.URL.Query().Get("topic") == "desktop:denied" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"permission": "editor"})
+		case r.URL.Path == "/api/realtime/authorize/batch" && r.Method == http.MethodPost && f.batch.Load():
+			f.batchCalls.Add(1)
+			var req struct {
+				Topics []string `json:"topics"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			results := map[string]any{}
+			for _, topic := range req.Topics {
+				switch topic {
+				case "desktop:denied":
+					results[topic] = map[string]string{"error": "forbidden"}
+				case "desktop:missing":
+					results[topic] = map[string]string{"error": "not_found"}
+				case "desktop:gone":
+				default:
+					results[topic] = map[string]string{"permission": "editor"}
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]any{"results": results})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestAuthorizeTopics_Contract(t *testing.T) {
+	secret := []byte("batch-test-secret")
+	nextjs := newFakeBatchNextJS(t, secret)
+	bearer, _ := (&Auth{jwtSecret: secret}).MintInternalJWT(&Claims{UserID: "u1"})
+
+	results, err := AuthorizeTopics(nextjs.URL, []string{"desktop:a", "desktop:denied", "desktop:missing", "desktop:gone"}, bearer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results["desktop:a"]; r.Permission != "editor" || r.Err != nil {
+		t.Errorf("desktop:a: %+v", r)
+	}
+	for topic, want := range map[string]error{
+		"desktop:denied":  ErrTopicForbidden,
+		"desktop:missing": ErrTopicNotFound,
+		"desktop:gone":    ErrTopicTransient,
+	} {
+		if err := results[topic].Err; !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", topic, err, want)
+		}
+	}
+
+	if _, err := AuthorizeTopics(nextjs.URL, []string{"desktop:a"}, "bogus"); !errors.Is(err, ErrTopicForbidden) {
+		t.Errorf("rejected bearer: got %v, want forbidden", err)
+	}
+	nextjs.batch.Store(false)
+	if _, err := AuthorizeTopics(nextjs.URL, []string{"desktop:a"}, bearer); !errors.Is(err, errBatchUnsupported) {
+		t.Errorf("missing endpoint: got %v, want errBatchUnsupported", err)
+	}
+}
+
+// authorizeConcurrently calls b.authorize for each topic at once.
+func authorizeConcurrently(b *authzBatcher, claims *Claims, topics ...string) []authzResult {
+	out := make([]authzResult, len(topics))
+	var wg sync.WaitGroup
+	for i, topic := range topics {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out[i].Permission, out[i].Err = b.authorize(claims, topic)
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+func TestAuthzBatcher_CoalescesPerUser(t *testing.T) {
+	secret := []byte("batch-test-secret")
+	nextjs := newFakeBatchNextJS(t, secret)
+	b := newAuthzBatcher(50*time.Millisecond, &Auth{jwtSecret: secret}, nextjs.URL)
+
+	alice, bob := &Claims{UserID: "alice"}, &Claims{UserID: "bob"}
+	var wg sync.WaitGroup
+	var aliceResults, bobResults []authzResult
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aliceResults = authorizeConcurrently(b, alice, "desktop:a", "desktop:b", "desktop:denied", "desktop:a")
+	}()
+	go func() { defer wg.Done(); bobResults = authorizeConcurrently(b, bob, "desktop:a", "desktop:c") }()
+	wg.Wait()
+
+	if got := nextjs.batchCalls.Load(); got != 2 {
+		t.Fatalf("expected one batch per user, got %d", got)
+	}
+	if got := nextjs.singleCalls.Load(); got != 0 {
+		t.Fatalf("expected no single calls, got %d", got)
+	}
+	for i, r := range aliceResults {
+		if wantErr := i == 2; (r.Err != nil) != wantErr || (!wantErr && r.Permission != "editor") {
+			t.Errorf("alice result %d: %+v", i, r)
+		}
+	}
+	for i, r := range bobResults {
+		if r.Err != nil || r.Permission != "editor" {
+			t.Errorf("bob result %d: %+v", i, r)
+		}
+	}
+
+	// A lone topic goes to the single-topic endpoint.
+	if perm, err := b.authorize(alice, "desktop:z"); err != nil || perm != "editor" {
+		t.Fatalf("single: %q %v", perm, err)
+	}
+	if got := nextjs.singleCalls.Load(); got != 1 {
+		t.Fatalf("expected one single call, got %d", got)
+	}
+}
+
+func TestAuthzBatcher_FallsBackWithoutBatchEndpoint(t *testing.T) {
+	secret := []byte("batch-test-secret")
+	nextjs := newFakeBatchNextJS(t, secret)
+	nextjs.batch.Store(false)
+	b := newAuthzBatcher(20*time.Millisecond, &Auth{jwtSecret: secret}, nextjs.URL)
+	claims := &Claims{UserID: "alice"}
+
+	before := expvarInt(authorizeBatchStats, "fallbacks")
+	results := authorizeConcurrently(b, claims, "desktop:a", "desktop:denied")
+	if results[0].Permission != "editor" || !errors.Is(results[1].Err, ErrTopicForbidden) {
+		t.Fatalf("fallback results: %+v", results)
+	}
+	if got := nextjs.singleCalls.Load(); got != 2 {
+		t.Fatalf("expected two single calls, got %d", got)
+	}
+
+	// The missing endpoint is remembered: the next batch skips it.
+	nextjs.batch.Store(true)
+	authorizeConcurrently(b, claims, "desktop:b", "desktop:c")
+	if got := nextjs.batchCalls.Load(); got != 0 {
+		t.Fatalf("batch endpoint should not be retried yet, got %d calls", got)
+	}
+	if got := expvarInt(authorizeBatchStats, "fallbacks") - before; got != 2 {
+		t.Errorf("fallbacks should count both batches, got %d", got)
+	}
+}
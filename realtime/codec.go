@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/olahol/melody"
+	"github.com/ugorji/go/codec"
+)
+
+// WebSocket subprotocols offered on /ws/connection. A client that offers
+// none of them (every browser tab predating this) gets JSON, as before.
+const (
+	SubprotocolJSON    = "moodio.json"
+	SubprotocolMsgpack = "moodio.msgpack"
+	SubprotocolCBOR    = "moodio.cbor"
+)
+
+// serverSubprotocols is the server's preference order. gorilla picks the
+// first entry here that the client also offered.
+var serverSubprotocols = []string{SubprotocolMsgpack, SubprotocolCBOR, SubprotocolJSON}
+
+// wireEncoding is the frame encoding negotiated for one connection. The
+// relay works in JSON internally and transcodes at the edge, so clients
+// using different encodings can share a topic.
+type wireEncoding int
+
+const (
+	encodingJSON wireEncoding = iota
+	encodingMsgpack
+	encodingCBOR
+)
+
+var (
+	msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+	cborHandle    = &codec.CborHandle{}
+)
+
+func init() {
+	mapType := reflect.TypeOf(map[string]any(nil))
+	msgpackHandle.MapType = mapType
+	msgpackHandle.RawToString = true
+	cborHandle.MapType = mapType
+}
+
+// configureSubprotocols makes melody's upgrader negotiate our subprotocols.
+func configureSubprotocols(m *melody.Melody) {
+	m.Upgrader.Subprotocols = serverSubprotocols
+}
+
+func encodingForSubprotocol(p string) wireEncoding {
+	switch p {
+	case SubprotocolMsgpack:
+		return encodingMsgpack
+	case SubprotocolCBOR:
+		return encodingCBOR
+	default:
+		return encodingJSON
+	}
+}
+
+// sessionEncoding reads the subprotocol gorilla actually agreed on. SSE
+// sessions are always JSON.
+func sessionEncoding(s sessionConn) wireEncoding {
+	ws, ok := s.(*melody.Session)
+	if !ok {
+		return encodingJSON
+	}
+	conn := ws.WebsocketConnection()
+	if conn == nil {
+		return encodingJSON
+	}
+	return encodingForSubprotocol(conn.Subprotocol())
+}
+
+func (e wireEncoding) String() string {
+	switch e {
+	case encodingMsgpack:
+		return "msgpack"
+	case encodingCBOR:
+		return "cbor"
+	default:
+		return "json"
+	}
+}
+
+func (e wireEncoding) handle() codec.Handle {
+	if e == encodingCBOR {
+		return cborHandle
+	}
+	return msgpackHandle
+}
+
+// fromJSON converts an outgoing JSON frame to this encoding.
+func (e wireEncoding) fromJSON(frame []byte) ([]byte, error) {
+	if e == encodingJSON {
+		return frame, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(frame))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var out []byte
+	if err := codec.NewEncoderBytes(&out, e.handle()).Encode(normalizeJSONNumbers(v)); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// toJSON converts an incoming frame in this encoding to JSON.
+func (e wireEncoding) toJSON(frame []byte) ([]byte, error) {
+	if e == encodingJSON {
+		return frame, nil
+	}
+	var v any
+	if err := codec.NewDecoderBytes(frame, e.handle()).Decode(&v); err != nil {
+		return nil, err
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s frame is not representable as JSON: %w", e, err)
+	}
+	return out, nil
+}
+
+// normalizeJSONNumbers turns json.Number into int64 where exact, float64
+// otherwise, so integers stay compact integers on the binary wire.
+func normalizeJSONNumbers(v any) any {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		if math.IsInf(f, 0) {
+			return x.String()
+		}
+		return f
+	case map[string]any:
+		for k, val := range x {
+			x[k] = normalizeJSONNumbers(val)
+		}
+		return x
+	case []any:
+		for i, val := range x {
+			x[i] = normalizeJSONNumbers(val)
+		}
+		return x
+	default:
+		return v
+	}
+}
+
+// outFrame is one outgoing JSON frame plus its lazily built transcodings,
+// so a broadcast encodes at most once per encoding in use.
+type outFrame struct {
+	json    []byte
+	msgpack []byte
+	cbor    []byte
+}
+
+func newOutFrame(frame []byte) *outFrame {
+	return &outFrame{json: frame}
+}
+
+// writeTo sends the frame to s in the session's negotiated encoding.
+func (f *outFrame) writeTo(s sessionConn) error {
+	enc := encodingJSON
+	if keys := getSessionKeys(s); keys != nil {
+		enc = keys.Encoding
+	}
+	var slot *[]byte
+	switch enc {
+	case encodingMsgpack:
+		slot = &f.msgpack
+	case encodingCBOR:
+		slot = &f.cbor
+	default:
+		return s.Write(f.json)
+	}
+	if *slot == nil {
+		out, err := enc.fromJSON(f.json)
+		if err != nil {
+			logf(regionLocal, "error transcoding frame to %s: %v", enc, err)
+			return err
+		}
+		*slot = out
+	}
+	return s.WriteBinary(*slot)
+}
+
+// writeFrame sends a single JSON frame to s in the session's encoding.
+func writeFrame(s sessionConn, frame []byte) error {
+	return newOutFrame(frame).writeTo(s)
+}
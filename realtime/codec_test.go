@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+func TestWireEncoding_RoundTrip(t *testing.T) {
+	frame := []byte(`{"op":"event","topic":"desktop:a","type":"cursor_move","payload":{"x":12,"y":-3.5,"big":9007199254740993,"tags":["a","b"],"nested":{"ok":true,"none":null}}}`)
+	for _, enc := range []wireEncoding{encodingMsgpack, encodingCBOR} {
+		bin, err := enc.fromJSON(frame)
+		if err != nil {
+			t.Fatalf("%s: fromJSON: %v", enc, err)
+		}
+		back, err := enc.toJSON(bin)
+		if err != nil {
+			t.Fatalf("%s: toJSON: %v", enc, err)
+		}
+		var want, got any
+		_ = json.Unmarshal(frame, &want)
+		if err := json.Unmarshal(back, &got); err != nil {
+			t.Fatalf("%s: round trip is not JSON: %v", enc, err)
+		}
+		wantJSON, _ := json.Marshal(want)
+		gotJSON, _ := json.Marshal(got)
+		if string(wantJSON) != string(gotJSON) {
+			t.Errorf("%s: round trip mismatch\nwant %s\ngot  %s", enc, wantJSON, gotJSON)
+		}
+		if !strings.Contains(string(back), "9007199254740993") {
+			t.Errorf("%s: large integers must survive exactly, got %s", enc, back)
+		}
+	}
+}
+
+func TestWireEncoding_RejectsGarbage(t *testing.T) {
+	for _, enc := range []wireEncoding{encodingMsgpack, encodingCBOR} {
+		if _, err := enc.toJSON([]byte{0xc1}); err == nil {
+			t.Errorf("%s: invalid frame should fail to decode", enc)
+		}
+	}
+}
+
+type binaryClient struct {
+	conn *websocket.Conn
+	enc  wireEncoding
+}
+
+func dialBinary(t *testing.T, server *httptest.Server, subprotocol, userId, firstName string) *binaryClient {
+	t.Helper()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/connection"
+	header := http.Header{}
+	header.Set("X-User-Id", userId)
+	header.Set("X-First-Name", firstName)
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol, SubprotocolJSON}}
+	conn, _, err := dialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if conn.Subprotocol() != subprotocol {
+		t.Fatalf("expected subprotocol %s, got %q", subprotocol, conn.Subprotocol())
+	}
+	return &binaryClient{conn: conn, enc: encodingForSubprotocol(subprotocol)}
+}
+
+func (bc *binaryClient) send(t *testing.T, obj map[string]any) {
+	t.Helper()
+	var out []byte
+	if err := codec.NewEncoderBytes(&out, bc.enc.handle()).Encode(obj); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := bc.conn.WriteMessage(websocket.BinaryMessage, out); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// readUntilOp reads binary frames until one with the given op (and, for
+// events, type) arrives.
+func (bc *binaryClient) readUntilOp(t *testing.T, op string, eventType ...string) map[string]any {
+	t.Helper()
+	_ = bc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		mt, data, err := bc.conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", op, err)
+		}
+		if mt != websocket.BinaryMessage {
+			t.Fatalf("expected binary frames on %s, got text %s", bc.enc, data)
+		}
+		var v map[string]any
+		if err := codec.NewDecoderBytes(data, bc.enc.handle()).Decode(&v); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if v["op"] == op && (len(eventType) == 0 || v["type"] == eventType[0]) {
+			return v
+		}
+	}
+}
+
+// TestBinaryClients_ShareTopicWithJSON — MessagePack and CBOR clients and a
+// plain JSON client in the same topic all see each other's events.
+func TestBinaryClients_ShareTopicWithJSON(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:codec"
+
+	for _, proto := range []string{SubprotocolMsgpack, SubprotocolCBOR} {
+		bc := dialBinary(t, server, proto, "u-bin", "Bin")
+		bc.send(t, map[string]any{"op": "subscribe", "topic": topic, "ref": "s1"})
+		ack := bc.readUntilOp(t, "subscribed")
+		if ack["ref"] != "s1" {
+			t.Fatalf("%s: unexpected ack %v", proto, ack)
+		}
+
+		js := connectAndSubscribe(t, server, topic, "u-json", "Json", "editor")
+		js.publish(t, topic, "cursor_move", map[string]any{"x": 7})
+		evt := bc.readUntilOp(t, "event", "cursor_move")
+		payload, _ := evt["payload"].(map[string]any)
+		if payload == nil {
+			t.Fatalf("%s: unexpected event %v", proto, evt)
+		}
+		if x, ok := payload["x"].(int64); !ok || x != 7 {
+			if ux, ok := payload["x"].(uint64); !ok || ux != 7 {
+				t.Fatalf("%s: expected integer x=7, got %#v", proto, payload["x"])
+			}
+		}
+
+		bc.send(t, map[string]any{"op": "publish", "topic": topic, "type": "asset_moved", "payload": map[string]any{"id": "a1"}})
+		time.Sleep(200 * time.Millisecond)
+		events := js.findEventsOfType("asset_moved", topic)
+		if len(events) != 1 {
+			t.Fatalf("%s: JSON client should receive the binary client's event, got %d", proto, len(events))
+		}
+		js.close()
+		bc.conn.Close()
+	}
+}
+
+func TestBinaryClient_InvalidFrame(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+
+	bc := dialBinary(t, server, SubprotocolMsgpack, "u-bin", "Bin")
+	defer bc.conn.Close()
+	if err := bc.conn.WriteMessage(websocket.BinaryMessage, []byte{0xc1}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	errFrame := bc.readUntilOp(t, "error")
+	if errFrame["code"] != ErrCodeBadRequest {
+		t.Fatalf("expected bad_request, got %v", errFrame)
+	}
+}
+
+func TestNoSubprotocol_StaysJSON(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+
+	tc := connectAndSubscribe(t, server, "desktop:plain", "u-a", "Alice", "editor")
+	defer tc.close()
+	if p := tc.conn.Subprotocol(); p != "" {
+		t.Fatalf("client offering no subprotocol should get none, got %q", p)
+	}
+}
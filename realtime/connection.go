@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/olahol/melody"
@@ -27,12 +29,25 @@ const sessionKeysKey = "__keys"
 
 // SessionKeys is the per-session state cached at connect time.
 // Access is read-only after HandleConnect returns (with the exception of
-// SubsSubs mutations, which have their own mutex).
+// Subs and caps mutations, which have their own mutexes).
 type SessionKeys struct {
 	SessionID string
 	Claims    *Claims
 	Subs      *SessionSubs
 
+	// Encoding is the frame encoding negotiated via subprotocol at upgrade.
+	Encoding wireEncoding
+
+	// caps is what the client declared in its hello, if it sent one.
+	caps sessionCaps
+
+	// Heartbeat state. lastSeen is the unix-nano time of the last inbound
+	// frame; pingSent is the ts of the outstanding server ping (0 if none);
+	// rttMs is the last measured round trip.
+	lastSeen atomic.Int64
+	pingSent atomic.Int64
+	rttMs    atomic.Int64
+
 	// Op channel and its done chan. Written once (at connect), read until
 	// disconnect. HandleMessage pushes parsed ops here; a per-session goroutine
 	// drains and dispatches. HandleDisconnect closes opCh.
@@ -51,6 +66,7 @@ func (k *SessionKeys) DisplayName() string {
 // subEntry is the per-topic record stored in SessionSubs.
 type subEntry struct {
 	Permission string
+	State      json.RawMessage // presence_update state, nil until set
 }
 
 // SessionSubs holds the set of topics this session is subscribed to along
@@ -87,8 +103,9 @@ func (s *SessionSubs) Get(topic string) (subEntry, bool) {
 func (s *SessionSubs) Add(topic, permission string) (added bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	_, exists := s.topics[topic]
-	s.topics[topic] = subEntry{Permission: permission}
+	e, exists := s.topics[topic]
+	e.Permission = permission
+	s.topics[topic] = e
 	return !exists
 }
 
@@ -204,22 +221,37 @@ func (c *authzCache) InvalidateSession(sessionId string) {
 	}
 }
 
+// sessionConn is one client connection: a melody WebSocket session, or an
+// SSE stream with its POST endpoint (sse.go). Everything past the transport
+// (SessionKeys, subscriptions, the dispatcher) works on this.
+type sessionConn interface {
+	Write(msg []byte) error
+	WriteBinary(msg []byte) error
+	Get(key string) (any, bool)
+	Set(key string, value any)
+	CloseWithMsg(msg []byte) error
+}
+
+var _ sessionConn = (*melody.Session)(nil)
+
 // cacheSessionKeys stashes a fresh SessionKeys onto the melody session. Called
 // from HandleConnect. Starts the per-session dispatch goroutine.
-func (rm *RoomManager) cacheSessionKeys(s *melody.Session, sessionId string, claims *Claims) *SessionKeys {
+func (rm *RoomManager) cacheSessionKeys(s sessionConn, sessionId string, claims *Claims) *SessionKeys {
 	keys := &SessionKeys{
 		SessionID: sessionId,
 		Claims:    claims,
 		Subs:      newSessionSubs(),
+		Encoding:  sessionEncoding(s),
 		opCh:      make(chan IncomingOp, sessionOpQueueSize),
 		opDone:    make(chan struct{}),
 	}
+	keys.touch()
 	s.Set(sessionKeysKey, keys)
 	go rm.runDispatcher(s, keys)
 	return keys
 }
 
-func getSessionKeys(s *melody.Session) *SessionKeys {
+func getSessionKeys(s sessionConn) *SessionKeys {
 	v, ok := s.Get(sessionKeysKey)
 	if !ok {
 		return nil
@@ -233,16 +265,30 @@ func getSessionKeys(s *melody.Session) *SessionKeys {
 
 // runDispatcher serializes all control/publish ops for a single session.
 // Blocking calls (authorize HTTP) run here, off the melody read pump.
-func (rm *RoomManager) runDispatcher(s *melody.Session, keys *SessionKeys) {
+func (rm *RoomManager) runDispatcher(s sessionConn, keys *SessionKeys) {
 	defer close(keys.opDone)
 	for op := range keys.opCh {
 		switch op.Op {
+		case OpHello:
+			rm.handleHello(s, keys, op)
 		case OpSubscribe:
 			rm.handleSubscribe(s, keys, op)
 		case OpUnsubscribe:
 			rm.handleUnsubscribe(s, keys, op)
 		case OpPublish:
 			rm.handlePublish(s, keys, op)
+		case OpPresenceUpdate:
+			rm.handlePresenceUpdate(s, keys, op)
+		case OpLock:
+			rm.handleLock(s, keys, op)
+		case OpUnlock:
+			rm.handleUnlock(s, keys, op)
+		case OpYSync:
+			rm.handleYSync(s, keys, op)
+		case OpYUpdate:
+			rm.handleYUpdate(s, keys, op)
+		case OpHistory:
+			rm.handleHistory(s, keys, op)
 		default:
 			writeError(s, ErrorMsg{
 				Op:      OpError,
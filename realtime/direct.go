@@ -0,0 +1,87 @@
+package main
+
+// directTarget is the recipient of a direct publish: one session, or every
+// session of one user (except the sender's own).
+type directTarget struct {
+	SessionID string
+	UserID    string
+}
+
+func (t directTarget) matches(sessionID, userID string) bool {
+	if t.SessionID != "" {
+		return sessionID == t.SessionID
+	}
+	return userID == t.UserID
+}
+
+// deliverDirectLocal writes msg to local members of topic matching target,
+// skipping sender. Returns the number of sessions written to.
+func (rm *RoomManager) deliverDirectLocal(topic string, sender sessionConn, target directTarget, msg []byte) int {
+	frame := newOutFrame(msg)
+	n := 0
+	rm.mu.RLock()
+	for sess := range rm.topics[topic] {
+		if sess == sender {
+			continue
+		}
+		k := getSessionKeys(sess)
+		if k == nil || k.Claims == nil || !target.matches(k.SessionID, k.Claims.UserID) {
+			continue
+		}
+		_ = frame.writeTo(sess)
+		n++
+	}
+	rm.mu.RUnlock()
+	return n
+}
+
+// hasRemoteRecipient reports whether a remote session in topic matches target.
+func (rm *RoomManager) hasRemoteRecipient(topic string, target directTarget) bool {
+	rm.remoteMu.RLock()
+	defer rm.remoteMu.RUnlock()
+	for _, rs := range rm.remoteSessions[topic] {
+		if target.matches(rs.SessionID, rs.UserID) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRemoteSender reports whether sessionID is a session of region known to
+// be subscribed to topic. Federated direct events are delivered only from
+// such senders, so the sending relay is not the only one checking.
+func (rm *RoomManager) hasRemoteSender(topic, sessionID, region string) bool {
+	if sessionID == "" {
+		return false
+	}
+	rm.remoteMu.RLock()
+	defer rm.remoteMu.RUnlock()
+	for _, rs := range rm.remoteSessions[topic] {
+		if rs.SessionID == sessionID && rs.Region == region {
+			return true
+		}
+	}
+	return false
+}
+
+// publishDirect delivers a direct event to its recipients in topic. The
+// event only goes to federation when a remote session matches, and the
+// receiving relays deliver it to matching subscribers only. If nobody
+// subscribed to topic matches, a ref-tagged publish gets not_found.
+func (rm *RoomManager) publishDirect(s sessionConn, op IncomingOp, target directTarget, msg []byte) {
+	topic := op.Topic
+	delivered := rm.deliverDirectLocal(topic, s, target, msg)
+
+	if rm.federator != nil && rm.hasRemoteRecipient(topic, target) {
+		if err := rm.federator.Publish(topic, msg); err != nil {
+			logf(regionLocal, "[federation] publish error for topic=%s: %v", topicIDForLog(topic), err)
+		} else {
+			delivered++
+		}
+	}
+
+	if delivered == 0 && op.Ref != "" {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeNotFound,
+			Message: "recipient is not subscribed to this topic", Ref: op.Ref})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func (tc *testClient) publishTo(t *testing.T, topic, eventType, ref string, target map[string]any) {
+	t.Helper()
+	msg := map[string]any{"op": "publish", "topic": topic, "type": eventType, "ref": ref, "payload": map[string]any{"x": 1}}
+	for k, v := range target {
+		msg[k] = v
+	}
+	tc.sendRaw(t, msg)
+}
+
+func TestDirect_ToSession(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:direct"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	carol := connectAndSubscribe(t, server, topic, "u-carol", "Carol", "editor")
+	defer carol.close()
+
+	alice.publishTo(t, topic, "follow_me", "", map[string]any{"to": bob.sessionID})
+	time.Sleep(100 * time.Millisecond)
+
+	got := bob.findEventsOfType("follow_me", topic)
+	if len(got) != 1 {
+		t.Fatalf("bob should get exactly one direct event, got %d", len(got))
+	}
+	var evt TopicEvent
+	_ = json.Unmarshal(got[0], &evt)
+	if evt.To != bob.sessionID || evt.SessionID != alice.sessionID {
+		t.Errorf("direct event should name sender and recipient: %s", got[0])
+	}
+	if n := len(carol.findEventsOfType("follow_me", topic)); n != 0 {
+		t.Fatalf("carol must not receive a message addressed to bob, got %d", n)
+	}
+}
+
+func TestDirect_ToUserReachesEveryTab(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:direct-user"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	aliceTab2 := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer aliceTab2.close()
+	bob1 := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob1.close()
+	bob2 := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob2.close()
+
+	alice.publishTo(t, topic, "handoff_request", "", map[string]any{"toUser": "u-bob"})
+	alice.publishTo(t, topic, "tab_sync", "", map[string]any{"toUser": "u-alice"})
+	time.Sleep(100 * time.Millisecond)
+
+	for i, tc := range []*testClient{bob1, bob2} {
+		if n := len(tc.findEventsOfType("handoff_request", topic)); n != 1 {
+			t.Errorf("bob tab %d should get the handoff request, got %d", i+1, n)
+		}
+	}
+	if n := len(aliceTab2.findEventsOfType("handoff_request", topic)); n != 0 {
+		t.Errorf("alice's other tab must not get bob's message, got %d", n)
+	}
+	if n := len(aliceTab2.findEventsOfType("tab_sync", topic)); n != 1 {
+		t.Errorf("toUser self should reach the sender's other tabs, got %d", n)
+	}
+	if n := len(alice.findEventsOfType("tab_sync", topic)); n != 0 {
+		t.Errorf("sender must not receive its own direct event, got %d", n)
+	}
+}
+
+func TestDirect_RecipientMustBeSubscribed(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:direct-check"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	dave := connectAndSubscribe(t, server, "desktop:elsewhere", "u-dave", "Dave", "editor")
+	defer dave.close()
+
+	alice.publishTo(t, topic, "follow_me", "d1", map[string]any{"to": dave.sessionID})
+	if code := errorCode(alice.waitForOp(t, OpError, "d1")); code != ErrCodeNotFound {
+		t.Errorf("expected not_found, got %q", code)
+	}
+	alice.publishTo(t, topic, "follow_me", "d2", map[string]any{"toUser": "u-dave"})
+	if code := errorCode(alice.waitForOp(t, OpError, "d2")); code != ErrCodeNotFound {
+		t.Errorf("expected not_found, got %q", code)
+	}
+	alice.publishTo(t, topic, "follow_me", "d3", map[string]any{"to": dave.sessionID, "toUser": "u-dave"})
+	if code := errorCode(alice.waitForOp(t, OpError, "d3")); code != ErrCodeBadRequest {
+		t.Errorf("expected bad_request, got %q", code)
+	}
+	alice.publishTo(t, "desktop:elsewhere", "follow_me", "d4", map[string]any{"to": dave.sessionID})
+	if code := errorCode(alice.waitForOp(t, OpError, "d4")); code != ErrCodeNotSubscribed {
+		t.Errorf("sender must be subscribed, got %q", code)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := len(dave.findEventsOfType("follow_me", "")); n != 0 {
+		t.Fatalf("dave is not in the topic and must receive nothing, got %d", n)
+	}
+}
+
+func TestDirect_Federated(t *testing.T) {
+	roomsUS, _, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	topic := "desktop:direct-fed"
+
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	carol := connectAndSubscribe(t, serverHK, topic, "u-carol", "Carol", "editor")
+	defer carol.close()
+	waitFor(t, func() bool { return len(remoteSessionIDs(roomsUS, topic)) == 2 })
+
+	alice.publishTo(t, topic, "follow_me", "f1", map[string]any{"to": bob.sessionID})
+	alice.publishTo(t, topic, "wave", "f2", map[string]any{"toUser": "u-carol"})
+	waitFor(t, func() bool {
+		return len(bob.findEventsOfType("follow_me", topic)) > 0 && len(carol.findEventsOfType("wave", topic)) > 0
+	})
+	time.Sleep(settle)
+
+	if n := len(bob.findEventsOfType("follow_me", topic)); n != 1 {
+		t.Errorf("bob should get the direct event across regions, got %d", n)
+	}
+	if n := len(carol.findEventsOfType("follow_me", topic)); n != 0 {
+		t.Errorf("carol must not get bob's event, got %d", n)
+	}
+	if n := len(carol.findEventsOfType("wave", topic)); n != 1 {
+		t.Errorf("carol should get the toUser event across regions, got %d", n)
+	}
+	if n := len(bob.findEventsOfType("wave", topic)); n != 0 {
+		t.Errorf("bob must not get carol's event, got %d", n)
+	}
+	if n := len(alice.findEventsOfType(OpError, "")); n != 0 {
+		t.Errorf("remote recipients should not produce errors, got %d", n)
+	}
+}
+
+func TestDirect_FederatedSenderMustBeKnown(t *testing.T) {
+	roomsUS, roomsHK, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	topic := "desktop:direct-sender"
+
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	waitFor(t, func() bool {
+		return len(remoteSessionIDs(roomsUS, topic)) == 1 && len(remoteSessionIDs(roomsHK, topic)) == 1
+	})
+
+	direct := func(eventType, sessionID string) []byte {
+		msg, _ := json.Marshal(map[string]any{"op": OpEvent, "topic": topic, "type": eventType,
+			"sessionId": sessionID, "to": bob.sessionID, "payload": map[string]any{}})
+		return msg
+	}
+	roomsHK.handleFederatedMessage(topic, "us-east-2", direct("forged", "session_nobody"))
+	roomsHK.handleFederatedMessage(topic, "eu-west-1", direct("wrong_region", alice.sessionID))
+	roomsHK.handleFederatedMessage(topic, "us-east-2", direct("genuine", alice.sessionID))
+	waitFor(t, func() bool { return len(bob.findEventsOfType("genuine", topic)) > 0 })
+	time.Sleep(settle)
+
+	for _, eventType := range []string{"forged", "wrong_region"} {
+		if n := len(bob.findEventsOfType(eventType, topic)); n != 0 {
+			t.Errorf("%s: direct events from unknown remote senders must be dropped, got %d", eventType, n)
+		}
+	}
+}
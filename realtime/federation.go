@@ -1,6 +1,14 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
 
 // Federator abstracts cross-server message forwarding so the RoomManager
 // can relay events between regional relay instances. When nil, the relay
@@ -32,3 +40,149 @@ func decodeFederatedMsg(data []byte) (FederatedMessage, error) {
 	err := json.Unmarshal(data, &msg)
 	return msg, err
 }
+
+// ------------------------------------------------------------
+// Versioned frames (batching + compression)
+// ------------------------------------------------------------
+
+// Frame versions on the NATS wire. Version 0 is the original JSON
+// FederatedMessage above and is recognised by its leading '{'. Version 1 is
+// a two-byte header (version, codec) followed by a JSON FederatedBatch,
+// compressed with the named codec. Receivers accept both, so a rollout is:
+// deploy everywhere with batching/compression off, then turn them on.
+const federatedFrameV1 byte = 1
+
+// federationCodec identifies the compression applied to a v1 frame body.
+type federationCodec byte
+
+const (
+	codecNone   federationCodec = 0
+	codecZstd   federationCodec = 1
+	codecSnappy federationCodec = 2
+)
+
+// Bodies smaller than this are sent uncompressed even when a codec is
+// configured; the codec byte in the header records what was actually used.
+const federationCompressMinBytes = 256
+
+// federationMaxFrameBytes bounds a decompressed frame body so a corrupt or
+// hostile frame cannot balloon memory.
+const federationMaxFrameBytes = 8 << 20
+
+// FederatedBatch is the v1 frame body: several payloads for one topic from
+// one region, in publish order.
+type FederatedBatch struct {
+	RegionID string            `json:"r"`
+	Payloads []json.RawMessage `json:"ps"`
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(federationMaxFrameBytes))
+)
+
+// parseFederationCodec maps a FEDERATION_COMPRESSION value to a codec.
+func parseFederationCodec(name string) (federationCodec, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return codecNone, nil
+	case "zstd":
+		return codecZstd, nil
+	case "snappy":
+		return codecSnappy, nil
+	default:
+		return codecNone, fmt.Errorf("unknown federation compression %q (want none, zstd or snappy)", name)
+	}
+}
+
+func (c federationCodec) String() string {
+	switch c {
+	case codecZstd:
+		return "zstd"
+	case codecSnappy:
+		return "snappy"
+	default:
+		return "none"
+	}
+}
+
+// encodeFederatedFrame builds a v1 frame carrying payloads.
+func encodeFederatedFrame(regionId string, payloads [][]byte, codec federationCodec) ([]byte, error) {
+	batch := FederatedBatch{RegionID: regionId, Payloads: make([]json.RawMessage, len(payloads))}
+	for i, p := range payloads {
+		batch.Payloads[i] = json.RawMessage(p)
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < federationCompressMinBytes {
+		codec = codecNone
+	}
+	switch codec {
+	case codecZstd:
+		body = zstdEncoder.EncodeAll(body, nil)
+	case codecSnappy:
+		body = s2.EncodeSnappy(nil, body)
+	}
+	frame := make([]byte, 0, len(body)+2)
+	frame = append(frame, federatedFrameV1, byte(codec))
+	return append(frame, body...), nil
+}
+
+// decodeFederatedFrame accepts either frame version and returns the
+// originating region plus the payloads in publish order.
+func decodeFederatedFrame(data []byte) (string, [][]byte, error) {
+	if len(data) == 0 {
+		return "", nil, errors.New("empty federated frame")
+	}
+	if data[0] == '{' {
+		fm, err := decodeFederatedMsg(data)
+		if err != nil {
+			return "", nil, err
+		}
+		return fm.RegionID, [][]byte{fm.Payload}, nil
+	}
+	if data[0] != federatedFrameV1 {
+		return "", nil, fmt.Errorf("unsupported federated frame version %d", data[0])
+	}
+	if len(data) < 2 {
+		return "", nil, errors.New("truncated federated frame")
+	}
+
+	body := data[2:]
+	switch federationCodec(data[1]) {
+	case codecNone:
+	case codecZstd:
+		out, err := zstdDecoder.DecodeAll(body, nil)
+		if err != nil {
+			return "", nil, fmt.Errorf("zstd: %w", err)
+		}
+		body = out
+	case codecSnappy:
+		n, err := s2.DecodedLen(body)
+		if err != nil {
+			return "", nil, fmt.Errorf("snappy: %w", err)
+		}
+		if n > federationMaxFrameBytes {
+			return "", nil, fmt.Errorf("snappy: frame too large (%d bytes)", n)
+		}
+		out, err := s2.Decode(nil, body)
+		if err != nil {
+			return "", nil, fmt.Errorf("snappy: %w", err)
+		}
+		body = out
+	default:
+		return "", nil, fmt.Errorf("unknown federated frame codec %d", data[1])
+	}
+
+	var batch FederatedBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return "", nil, err
+	}
+	payloads := make([][]byte, len(batch.Payloads))
+	for i, p := range batch.Payloads {
+		payloads[i] = p
+	}
+	return batch.RegionID, payloads, nil
+}
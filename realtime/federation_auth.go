@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// NATS headers carrying the federation signature. The message ID makes
+// every signed message unique, so identical payloads sent within the same
+// second still get distinct signatures.
+const (
+	fedHeaderKeyID     = "Moodio-Fed-Kid"
+	fedHeaderTimestamp = "Moodio-Fed-Ts"
+	fedHeaderMessageID = "Moodio-Fed-Id"
+	fedHeaderSignature = "Moodio-Fed-Sig"
+)
+
+// fedSignatureMaxSkew bounds how old (or how far in the future) a signed
+// federated message may be. Within it, replays are caught by the keyring's
+// cache of seen signatures.
+const fedSignatureMaxSkew = 5 * time.Minute
+
+// Reasons a signed federated message is rejected. Also the keys of the
+// federation_rejected counter.
+var (
+	errFedUnsigned     = errors.New("unsigned")
+	errFedUnknownKey   = errors.New("unknown_key")
+	errFedBadSignature = errors.New("bad_signature")
+	errFedStale        = errors.New("stale")
+	errFedReplayed     = errors.New("replayed")
+)
+
+// fedSignature is the set of signature headers on a federated message.
+type fedSignature struct {
+	KeyID, Timestamp, MessageID, Signature string
+}
+
+// federationKeyring holds the shared HMAC keys relays use to authenticate
+// each other. The signing key is used for outgoing messages; every key in
+// the ring is accepted on receipt, which is what makes rotation possible:
+// add the new key everywhere, promote it to signing key, then retire the old.
+type federationKeyring struct {
+	signingKid string
+	keys       map[string][]byte
+
+	// seen holds the signatures verified so far, by their timestamp, until
+	// that timestamp is too old to pass the skew check anyway.
+	seenMu    sync.Mutex
+	seen      map[int64]map[string]struct{}
+	seenPrune int64 // unix second of the last prune
+}
+
+// parseFederationKeys parses FEDERATION_KEYS: a comma-separated list of
+// "<kid>:<secret>" pairs. The first pair is the signing key.
+func parseFederationKeys(spec string) (*federationKeyring, error) {
+	kr := &federationKeyring{keys: make(map[string][]byte)}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kid, secret, ok := strings.Cut(part, ":")
+		kid = strings.TrimSpace(kid)
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("federation key must be <kid>:<secret>")
+		}
+		if _, dup := kr.keys[kid]; dup {
+			return nil, fmt.Errorf("duplicate federation key id %q", kid)
+		}
+		kr.keys[kid] = []byte(secret)
+		if kr.signingKid == "" {
+			kr.signingKid = kid
+		}
+	}
+	if kr.signingKid == "" {
+		return nil, fmt.Errorf("no federation keys configured")
+	}
+	return kr, nil
+}
+
+// Sign returns the signature headers for a message on subject.
+func (kr *federationKeyring) Sign(subject string, data []byte, now time.Time) fedSignature {
+	sig := fedSignature{
+		KeyID:     kr.signingKid,
+		Timestamp: strconv.FormatInt(now.Unix(), 10),
+		MessageID: uuid.NewString(),
+	}
+	sig.Signature = kr.mac(kr.keys[sig.KeyID], subject, sig.Timestamp, sig.MessageID, data)
+	return sig
+}
+
+// Verify checks a message's signature headers. The subject is part of the
+// MAC so a message signed for one topic cannot be replayed onto another,
+// and a signature already seen within the skew window is a replay.
+func (kr *federationKeyring) Verify(subject string, data []byte, sig fedSignature, now time.Time) error {
+	if sig.KeyID == "" || sig.Timestamp == "" || sig.MessageID == "" || sig.Signature == "" {
+		return errFedUnsigned
+	}
+	key, ok := kr.keys[sig.KeyID]
+	if !ok {
+		return errFedUnknownKey
+	}
+	if !hmac.Equal([]byte(sig.Signature), []byte(kr.mac(key, subject, sig.Timestamp, sig.MessageID, data))) {
+		return errFedBadSignature
+	}
+	sec, err := strconv.ParseInt(sig.Timestamp, 10, 64)
+	if err != nil {
+		return errFedBadSignature
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > fedSignatureMaxSkew || d < -fedSignatureMaxSkew {
+		return errFedStale
+	}
+	if !kr.markSeen(sec, sig.Signature, now) {
+		return errFedReplayed
+	}
+	return nil
+}
+
+// markSeen records sig, signed at unix second sec, reporting false if it
+// was already recorded. Seconds older than the skew window are pruned at
+// most once a second.
+func (kr *federationKeyring) markSeen(sec int64, sig string, now time.Time) bool {
+	kr.seenMu.Lock()
+	defer kr.seenMu.Unlock()
+	if kr.seen == nil {
+		kr.seen = make(map[int64]map[string]struct{})
+	}
+	if unix := now.Unix(); unix != kr.seenPrune {
+		kr.seenPrune = unix
+		oldest := now.Add(-fedSignatureMaxSkew).Unix()
+		for s := range kr.seen {
+			if s < oldest {
+				delete(kr.seen, s)
+			}
+		}
+	}
+	bucket := kr.seen[sec]
+	if bucket == nil {
+		bucket = make(map[string]struct{})
+		kr.seen[sec] = bucket
+	}
+	if _, ok := bucket[sig]; ok {
+		return false
+	}
+	bucket[sig] = struct{}{}
+	return true
+}
+
+func (kr *federationKeyring) mac(key []byte, subject, ts, id string, data []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(subject))
+	m.Write([]byte{'\n'})
+	m.Write([]byte(ts))
+	m.Write([]byte{'\n'})
+	m.Write([]byte(id))
+	m.Write([]byte{'\n'})
+	m.Write(data)
+	return base64URLEncode(m.Sum(nil))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestParseFederationKeys(t *testing.T) {
+	kr, err := parseFederationKeys("k2:new-secret, k1:old-secret")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if kr.signingKid != "k2" {
+		t.Errorf("first key should sign, got %q", kr.signingKid)
+	}
+	if len(kr.keys) != 2 {
+		t.Errorf("expected 2 keys, got %d", len(kr.keys))
+	}
+
+	for _, bad := range []string{"", " , ", "nokid", ":secret", "k1:", "k1:a,k1:b"} {
+		if _, err := parseFederationKeys(bad); err == nil {
+			t.Errorf("parseFederationKeys(%q) should fail", bad)
+		}
+	}
+}
+
+func TestFederationKeyring_SignVerify(t *testing.T) {
+	kr, _ := parseFederationKeys("k1:secret")
+	now := time.Now()
+	data := []byte(`{"r":"us-east-2","p":{}}`)
+
+	sig := kr.Sign("room.desktop:a", data, now)
+	if err := kr.Verify("room.desktop:a", data, sig, now); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if again := kr.Sign("room.desktop:a", data, now); again.Signature == sig.Signature {
+		t.Fatal("identical messages in the same second must get distinct signatures")
+	}
+
+	with := func(mutate func(*fedSignature)) fedSignature {
+		c := sig
+		mutate(&c)
+		return c
+	}
+	cases := []struct {
+		name    string
+		subject string
+		data    []byte
+		sig     fedSignature
+		at      time.Time
+		want    error
+	}{
+		{"unsigned", "room.desktop:a", data, fedSignature{}, now, errFedUnsigned},
+		{"no message id", "room.desktop:a", data, with(func(s *fedSignature) { s.MessageID = "" }), now, errFedUnsigned},
+		{"unknown key", "room.desktop:a", data, with(func(s *fedSignature) { s.KeyID = "k9" }), now, errFedUnknownKey},
+		{"tampered body", "room.desktop:a", []byte(`{"r":"evil"}`), sig, now, errFedBadSignature},
+		{"other topic", "room.desktop:b", data, sig, now, errFedBadSignature},
+		{"tampered timestamp", "room.desktop:a", data, with(func(s *fedSignature) { s.Timestamp = "1" }), now, errFedBadSignature},
+		{"tampered message id", "room.desktop:a", data, with(func(s *fedSignature) { s.MessageID = "other" }), now, errFedBadSignature},
+		{"replayed", "room.desktop:a", data, sig, now.Add(time.Minute), errFedReplayed},
+		{"replayed later", "room.desktop:a", data, sig, now.Add(10 * time.Minute), errFedStale},
+	}
+	for _, c := range cases {
+		err := kr.Verify(c.subject, c.data, c.sig, c.at)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestFederationKeyring_SeenSignaturesArePruned(t *testing.T) {
+	kr, _ := parseFederationKeys("k1:secret")
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		at := start.Add(time.Duration(i) * time.Second)
+		if err := kr.Verify("room.x", []byte("d"), kr.Sign("room.x", []byte("d"), at), at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	later := start.Add(fedSignatureMaxSkew + 10*time.Second)
+	if err := kr.Verify("room.x", []byte("d"), kr.Sign("room.x", []byte("d"), later), later); err != nil {
+		t.Fatal(err)
+	}
+	kr.seenMu.Lock()
+	defer kr.seenMu.Unlock()
+	if len(kr.seen) != 1 {
+		t.Fatalf("signatures past the skew window should be forgotten, %d seconds kept", len(kr.seen))
+	}
+}
+
+func TestFederationKeyring_Rotation(t *testing.T) {
+	old, _ := parseFederationKeys("k1:old-secret")
+	both, _ := parseFederationKeys("k2:new-secret,k1:old-secret")
+	now := time.Now()
+	data := []byte("payload")
+
+	// A relay still signing with k1 is accepted by a relay that already
+	// promoted k2.
+	if err := both.Verify("room.x", data, old.Sign("room.x", data, now), now); err != nil {
+		t.Fatalf("old key must still verify during rotation: %v", err)
+	}
+	// The promoted relay's k2 signatures are unknown to a relay without k2.
+	sig := both.Sign("room.x", data, now)
+	if sig.KeyID != "k2" {
+		t.Fatalf("expected k2 to sign, got %q", sig.KeyID)
+	}
+	if err := old.Verify("room.x", data, sig, now); !errors.Is(err, errFedUnknownKey) {
+		t.Fatalf("expected unknown_key, got %v", err)
+	}
+}
+
+func rejectedCount(reason string) int64 {
+	v, ok := federationRejected.Get(reason).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestNATSFederator_VerifyMsg(t *testing.T) {
+	kr, _ := parseFederationKeys("k1:secret")
+	signer := &NATSFederator{opts: FederationOptions{Keys: kr}}
+
+	signed := signer.signedMsg("room.desktop:a", []byte("data"))
+	if err := signer.verifyMsg(signed); err != nil {
+		t.Fatalf("signed message rejected: %v", err)
+	}
+
+	before := rejectedCount("replayed")
+	if err := signer.verifyMsg(signed); !errors.Is(err, errFedReplayed) {
+		t.Fatalf("expected replayed, got %v", err)
+	}
+	if rejectedCount("replayed") != before+1 {
+		t.Error("replayed message should be counted")
+	}
+
+	before = rejectedCount("bad_signature")
+	signed = signer.signedMsg("room.desktop:a", []byte("data"))
+	signed.Data = []byte("tampered")
+	if err := signer.verifyMsg(signed); !errors.Is(err, errFedBadSignature) {
+		t.Fatalf("expected bad_signature, got %v", err)
+	}
+	if rejectedCount("bad_signature") != before+1 {
+		t.Error("tampered message should be counted")
+	}
+
+	unsigned := &nats.Msg{Subject: "room.desktop:a", Data: []byte("data")}
+	before = rejectedCount("unsigned")
+	if err := signer.verifyMsg(unsigned); !errors.Is(err, errFedUnsigned) {
+		t.Fatalf("expected unsigned, got %v", err)
+	}
+	tolerant := &NATSFederator{opts: FederationOptions{Keys: kr, AllowUnsigned: true}}
+	if err := tolerant.verifyMsg(unsigned); err != nil {
+		t.Fatalf("AllowUnsigned should accept unsigned messages: %v", err)
+	}
+	if rejectedCount("unsigned") != before+2 {
+		t.Error("unsigned messages should be counted even when tolerated")
+	}
+
+	open := &NATSFederator{}
+	if err := open.verifyMsg(unsigned); err != nil {
+		t.Fatalf("without keys nothing is verified: %v", err)
+	}
+	if m := open.signedMsg("room.x", []byte("d")); m.Header != nil {
+		t.Error("without keys messages should not carry signature headers")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Batch caps. A batch is flushed when its window elapses or when either cap
+// is reached, whichever comes first. The byte cap keeps frames well under the
+// default 1 MB NATS max payload.
+const (
+	federationMaxBatchMessages = 256
+	federationMaxBatchBytes    = 512 << 10
+)
+
+// federationBatcher coalesces outgoing federated payloads per topic. The
+// first payload for a topic starts a timer; everything published to that
+// topic before it fires is handed to flush as one batch, in order. Batches
+// of one topic are flushed one at a time, in the order they were cut, so a
+// full batch still being sent can't be overtaken by the next one's timer.
+type federationBatcher struct {
+	window time.Duration
+	flush  func(topic string, payloads [][]byte)
+
+	mu      sync.Mutex
+	pending map[string]*pendingBatch
+	sends   map[string]*topicSends
+	closed  bool
+}
+
+type pendingBatch struct {
+	payloads [][]byte
+	size     int
+	timer    *time.Timer
+}
+
+// topicSends orders a topic's flushes: each cut batch takes the next
+// ticket and waits on turn (whose lock is the batcher's mu) until done
+// reaches it. It is dropped once no flush is outstanding.
+type topicSends struct {
+	next, done uint64
+	turn       *sync.Cond
+}
+
+func newFederationBatcher(window time.Duration, flush func(topic string, payloads [][]byte)) *federationBatcher {
+	return &federationBatcher{
+		window:  window,
+		flush:   flush,
+		pending: make(map[string]*pendingBatch),
+		sends:   make(map[string]*topicSends),
+	}
+}
+
+// Add queues msg for topic. msg must not be modified by the caller afterwards.
+func (b *federationBatcher) Add(topic string, msg []byte) {
+	b.mu.Lock()
+	if b.closed {
+		ts, ticket := b.claimSendLocked(topic)
+		b.mu.Unlock()
+		b.send(topic, ts, ticket, [][]byte{msg})
+		return
+	}
+	pb := b.pending[topic]
+	if pb == nil {
+		pb = &pendingBatch{}
+		pb.timer = time.AfterFunc(b.window, func() { b.flushTopic(topic, pb) })
+		b.pending[topic] = pb
+	}
+	pb.payloads = append(pb.payloads, msg)
+	pb.size += len(msg)
+	if len(pb.payloads) < federationMaxBatchMessages && pb.size < federationMaxBatchBytes {
+		b.mu.Unlock()
+		return
+	}
+	pb.timer.Stop()
+	delete(b.pending, topic)
+	ts, ticket := b.claimSendLocked(topic)
+	b.mu.Unlock()
+
+	b.send(topic, ts, ticket, pb.payloads)
+}
+
+// flushTopic sends pb if it is still the pending batch for topic (it may
+// already have been flushed early by Add).
+func (b *federationBatcher) flushTopic(topic string, pb *pendingBatch) {
+	b.mu.Lock()
+	if b.pending[topic] != pb {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, topic)
+	ts, ticket := b.claimSendLocked(topic)
+	b.mu.Unlock()
+
+	b.send(topic, ts, ticket, pb.payloads)
+}
+
+// claimSendLocked reserves the next flush slot for topic. b.mu must be held.
+func (b *federationBatcher) claimSendLocked(topic string) (*topicSends, uint64) {
+	ts := b.sends[topic]
+	if ts == nil {
+		ts = &topicSends{turn: sync.NewCond(&b.mu)}
+		b.sends[topic] = ts
+	}
+	ticket := ts.next
+	ts.next++
+	return ts, ticket
+}
+
+// send waits for every earlier flush of topic to finish, then flushes
+// payloads.
+func (b *federationBatcher) send(topic string, ts *topicSends, ticket uint64, payloads [][]byte) {
+	b.mu.Lock()
+	for ts.done != ticket {
+		ts.turn.Wait()
+	}
+	b.mu.Unlock()
+
+	b.flush(topic, payloads)
+
+	b.mu.Lock()
+	ts.done++
+	if ts.done == ts.next {
+		delete(b.sends, topic)
+	} else {
+		ts.turn.Broadcast()
+	}
+	b.mu.Unlock()
+}
+
+// Close flushes everything pending. Later Adds are sent immediately.
+func (b *federationBatcher) Close() {
+	type cut struct {
+		pb     *pendingBatch
+		ts     *topicSends
+		ticket uint64
+	}
+	b.mu.Lock()
+	b.closed = true
+	cuts := make(map[string]cut, len(b.pending))
+	for topic, pb := range b.pending {
+		pb.timer.Stop()
+		ts, ticket := b.claimSendLocked(topic)
+		cuts[topic] = cut{pb, ts, ticket}
+	}
+	b.pending = make(map[string]*pendingBatch)
+	b.mu.Unlock()
+
+	for topic, c := range cuts {
+		b.send(topic, c.ts, c.ticket, c.pb.payloads)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFederatedFrame_RoundTripAllCodecs(t *testing.T) {
+	payloads := [][]byte{
+		[]byte(`{"op":"event","topic":"desktop:a","type":"cursor_move","payload":{"x":1}}`),
+		[]byte(`{"op":"event","topic":"desktop:a","type":"asset_moved","payload":{"id":"` + longString(400) + `"}}`),
+	}
+	for _, codec := range []federationCodec{codecNone, codecZstd, codecSnappy} {
+		frame, err := encodeFederatedFrame("us-east-2", payloads, codec)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", codec, err)
+		}
+		if frame[0] != federatedFrameV1 {
+			t.Fatalf("%s: expected version byte %d, got %d", codec, federatedFrameV1, frame[0])
+		}
+		if federationCodec(frame[1]) != codec {
+			t.Errorf("%s: header records codec %d", codec, frame[1])
+		}
+		region, got, err := decodeFederatedFrame(frame)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", codec, err)
+		}
+		if region != "us-east-2" {
+			t.Errorf("%s: region mismatch: %q", codec, region)
+		}
+		if len(got) != len(payloads) {
+			t.Fatalf("%s: expected %d payloads, got %d", codec, len(payloads), len(got))
+		}
+		for i := range payloads {
+			if !bytes.Equal(got[i], payloads[i]) {
+				t.Errorf("%s: payload %d mismatch: %s", codec, i, got[i])
+			}
+		}
+	}
+}
+
+func TestFederatedFrame_SmallBodiesSkipCompression(t *testing.T) {
+	frame, err := encodeFederatedFrame("us-east-2", [][]byte{[]byte(`{"a":1}`)}, codecZstd)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if federationCodec(frame[1]) != codecNone {
+		t.Fatalf("tiny frame should be sent uncompressed, codec=%d", frame[1])
+	}
+}
+
+func TestFederatedFrame_AcceptsLegacyV0(t *testing.T) {
+	legacy, err := encodeFederatedMsg("ap-northeast-1", []byte(`{"op":"event"}`))
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	region, payloads, err := decodeFederatedFrame(legacy)
+	if err != nil {
+		t.Fatalf("decode legacy: %v", err)
+	}
+	if region != "ap-northeast-1" || len(payloads) != 1 || string(payloads[0]) != `{"op":"event"}` {
+		t.Fatalf("legacy decode mismatch: region=%q payloads=%q", region, payloads)
+	}
+}
+
+func TestFederatedFrame_RejectsUnknownVersionAndCodec(t *testing.T) {
+	cases := [][]byte{
+		nil,
+		{federatedFrameV1},
+		{2, 0, '{', '}'},
+		{federatedFrameV1, 9, '{', '}'},
+		{federatedFrameV1, byte(codecZstd), 'n', 'o', 'p', 'e'},
+	}
+	for _, c := range cases {
+		if _, _, err := decodeFederatedFrame(c); err == nil {
+			t.Errorf("decodeFederatedFrame(%v) should fail", c)
+		}
+	}
+}
+
+func TestParseFederationCodec(t *testing.T) {
+	for in, want := range map[string]federationCodec{
+		"": codecNone, "none": codecNone, "ZSTD": codecZstd, " snappy ": codecSnappy,
+	} {
+		got, err := parseFederationCodec(in)
+		if err != nil || got != want {
+			t.Errorf("parseFederationCodec(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseFederationCodec("gzip"); err == nil {
+		t.Error("unknown codec should error")
+	}
+}
+
+type flushRecorder struct {
+	mu      sync.Mutex
+	batches map[string][][][]byte
+}
+
+func (r *flushRecorder) flush(topic string, payloads [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.batches == nil {
+		r.batches = make(map[string][][][]byte)
+	}
+	r.batches[topic] = append(r.batches[topic], payloads)
+}
+
+func (r *flushRecorder) get(topic string) [][][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.batches[topic]
+}
+
+func TestFederationBatcher_FlushesAfterWindowInOrder(t *testing.T) {
+	rec := &flushRecorder{}
+	b := newFederationBatcher(50*time.Millisecond, rec.flush)
+
+	for i := 0; i < 5; i++ {
+		b.Add("desktop:a", []byte(fmt.Sprintf("%d", i)))
+	}
+	b.Add("desktop:b", []byte("other"))
+
+	if len(rec.get("desktop:a")) != 0 {
+		t.Fatal("nothing should flush before the window elapses")
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	batches := rec.get("desktop:a")
+	if len(batches) != 1 || len(batches[0]) != 5 {
+		t.Fatalf("expected one batch of 5 for desktop:a, got %v", batches)
+	}
+	for i, p := range batches[0] {
+		if string(p) != fmt.Sprintf("%d", i) {
+			t.Fatalf("batch out of order: %q", batches[0])
+		}
+	}
+	if len(rec.get("desktop:b")) != 1 {
+		t.Fatal("topics must be batched independently")
+	}
+}
+
+func TestFederationBatcher_FlushesEarlyWhenFull(t *testing.T) {
+	rec := &flushRecorder{}
+	b := newFederationBatcher(time.Hour, rec.flush)
+
+	for i := 0; i < federationMaxBatchMessages+1; i++ {
+		b.Add("desktop:a", []byte("x"))
+	}
+	batches := rec.get("desktop:a")
+	if len(batches) != 1 || len(batches[0]) != federationMaxBatchMessages {
+		t.Fatalf("expected one full batch, got %d batches", len(batches))
+	}
+
+	b.Close()
+	batches = rec.get("desktop:a")
+	if len(batches) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("Close should flush the remainder, got %d batches", len(batches))
+	}
+
+	b.Add("desktop:a", []byte("late"))
+	if n := len(rec.get("desktop:a")); n != 3 {
+		t.Fatalf("Add after Close should send immediately, got %d batches", n)
+	}
+}
+
+// TestFederationBatcher_FullBatchIsNotOvertaken — while a full batch is
+// still being flushed, the next batch of the same topic waits for it even
+// if its window has already elapsed.
+func TestFederationBatcher_FullBatchIsNotOvertaken(t *testing.T) {
+	rec := &flushRecorder{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	b := newFederationBatcher(10*time.Millisecond, func(topic string, payloads [][]byte) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		rec.flush(topic, payloads)
+	})
+
+	go func() {
+		for i := 0; i < federationMaxBatchMessages; i++ {
+			b.Add("desktop:a", []byte("full"))
+		}
+	}()
+	<-started
+	b.Add("desktop:a", []byte("next"))
+	time.Sleep(5 * 10 * time.Millisecond) // the second batch's window elapses
+	close(release)
+
+	waitFor(t, func() bool { return len(rec.get("desktop:a")) == 2 })
+	batches := rec.get("desktop:a")
+	if len(batches[0]) != federationMaxBatchMessages || string(batches[1][0]) != "next" {
+		t.Fatalf("batches flushed out of order: %d payloads, then %q", len(batches[0]), batches[1][0])
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.sends) != 0 {
+		t.Errorf("send order state should be dropped once idle, got %d topics", len(b.sends))
+	}
+}
@@ -1,12 +1,30 @@
 package main
 
 import (
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/nats-io/nats.go"
 )
 
+// FederationOptions tunes the NATS wire format. The zero value sends one
+// legacy (v0) JSON frame per event, which every relay version understands.
+type FederationOptions struct {
+	// BatchWindow, when > 0, coalesces events per topic for up to this long
+	// and sends them as one v1 frame.
+	BatchWindow time.Duration
+	// Compression is applied to v1 frame bodies. Setting it without a batch
+	// window sends single-event v1 frames.
+	Compression federationCodec
+	// Keys, when set, signs every outgoing message and verifies every
+	// incoming one. Messages that fail verification are dropped.
+	Keys *federationKeyring
+	// AllowUnsigned accepts (but still counts) messages without a signature.
+	// Only meant for the rollout window while relays are gaining keys.
+	AllowUnsigned bool
+}
+
 // NATSFederator implements Federator using NATS pub/sub.
 // Each relay server connects to its local NATS node; cross-region
 // forwarding is handled transparently by NATS gateways.
@@ -15,50 +33,146 @@ type NATSFederator struct {
 	regionId string
 	subs     map[string]*nats.Subscription
 	mu       sync.Mutex
+
+	opts    FederationOptions
+	batcher *federationBatcher
+
+	// onReconnect is invoked (on its own goroutine) after NATS reconnects.
+	onReconnect func()
 }
 
-func NewNATSFederator(url, regionId string) (*NATSFederator, error) {
+func NewNATSFederator(url, regionId string, opts FederationOptions) (*NATSFederator, error) {
+	f := &NATSFederator{
+		regionId: regionId,
+		subs:     make(map[string]*nats.Subscription),
+		opts:     opts,
+	}
 	nc, err := nats.Connect(url,
 		nats.Name("moodio-relay-"+regionId),
 		nats.ReconnectWait(2*time.Second),
 		nats.MaxReconnects(-1),
 		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
-		logf(regionLocal, "[nats] disconnected: %v", err)
+			logf(regionLocal, "[nats] disconnected: %v", err)
 		}),
 		nats.ReconnectHandler(func(nc *nats.Conn) {
-		logf(regionLocal, "[nats] reconnected to %s", nc.ConnectedUrl())
+			logf(regionLocal, "[nats] reconnected to %s", nc.ConnectedUrl())
+			f.mu.Lock()
+			fn := f.onReconnect
+			f.mu.Unlock()
+			if fn != nil {
+				go fn()
+			}
 		}),
 	)
 	if err != nil {
 		return nil, err
 	}
 	logf(regionLocal, "[nats] connected to %s (region=%s)", nc.ConnectedUrl(), regionId)
-	return &NATSFederator{
-		conn:     nc,
-		regionId: regionId,
-		subs:     make(map[string]*nats.Subscription),
-	}, nil
+	f.conn = nc
+	if opts.BatchWindow > 0 {
+		f.batcher = newFederationBatcher(opts.BatchWindow, f.publishFrame)
+	}
+	return f, nil
+}
+
+// OnReconnect registers a callback fired after every NATS reconnect. NATS
+// restores subscriptions itself; the callback is for application state that
+// may have drifted while partitioned (remote presence).
+func (f *NATSFederator) OnReconnect(fn func()) {
+	f.mu.Lock()
+	f.onReconnect = fn
+	f.mu.Unlock()
 }
 
 func (f *NATSFederator) Publish(roomId string, msg []byte) error {
+	if f.batcher != nil {
+		f.batcher.Add(roomId, msg)
+		return nil
+	}
+	if f.opts.Compression != codecNone {
+		data, err := encodeFederatedFrame(f.regionId, [][]byte{msg}, f.opts.Compression)
+		if err != nil {
+			return err
+		}
+		return f.send("room."+roomId, data)
+	}
 	data, err := encodeFederatedMsg(f.regionId, msg)
 	if err != nil {
 		return err
 	}
-	return f.conn.Publish("room."+roomId, data)
+	return f.send("room."+roomId, data)
+}
+
+// send publishes data on subject, signing it when a keyring is configured.
+func (f *NATSFederator) send(subject string, data []byte) error {
+	return f.conn.PublishMsg(f.signedMsg(subject, data))
+}
+
+func (f *NATSFederator) signedMsg(subject string, data []byte) *nats.Msg {
+	m := &nats.Msg{Subject: subject, Data: data}
+	if f.opts.Keys != nil {
+		sig := f.opts.Keys.Sign(subject, data, time.Now())
+		m.Header = nats.Header{}
+		m.Header.Set(fedHeaderKeyID, sig.KeyID)
+		m.Header.Set(fedHeaderTimestamp, sig.Timestamp)
+		m.Header.Set(fedHeaderMessageID, sig.MessageID)
+		m.Header.Set(fedHeaderSignature, sig.Signature)
+	}
+	return m
+}
+
+// verifyMsg authenticates an inbound message. Rejections are counted under
+// federation_rejected; unsigned messages are also counted when tolerated.
+func (f *NATSFederator) verifyMsg(m *nats.Msg) error {
+	if f.opts.Keys == nil {
+		return nil
+	}
+	err := f.opts.Keys.Verify(m.Subject, m.Data, fedSignature{
+		KeyID:     m.Header.Get(fedHeaderKeyID),
+		Timestamp: m.Header.Get(fedHeaderTimestamp),
+		MessageID: m.Header.Get(fedHeaderMessageID),
+		Signature: m.Header.Get(fedHeaderSignature),
+	}, time.Now())
+	if err == nil {
+		return nil
+	}
+	federationRejected.Add(err.Error(), 1)
+	if errors.Is(err, errFedUnsigned) && f.opts.AllowUnsigned {
+		return nil
+	}
+	return err
+}
+
+// publishFrame is the batcher's flush callback. Errors are logged here since
+// the original Publish callers have long returned.
+func (f *NATSFederator) publishFrame(roomId string, payloads [][]byte) {
+	data, err := encodeFederatedFrame(f.regionId, payloads, f.opts.Compression)
+	if err == nil {
+		err = f.send("room."+roomId, data)
+	}
+	if err != nil {
+		logf(regionLocal, "[nats] batch publish error for topic=%s (%d events): %v",
+			topicIDForLog(roomId), len(payloads), err)
+	}
 }
 
 func (f *NATSFederator) Subscribe(roomId string, handler func(string, []byte)) error {
 	sub, err := f.conn.Subscribe("room."+roomId, func(m *nats.Msg) {
-		fm, err := decodeFederatedMsg(m.Data)
+		if err := f.verifyMsg(m); err != nil {
+			logf(regionLocal, "[nats] dropped federated message on topic=%s: %v", topicIDForLog(roomId), err)
+			return
+		}
+		region, payloads, err := decodeFederatedFrame(m.Data)
 		if err != nil {
 			logf(regionLocal, "[nats] bad federated message: %v", err)
 			return
 		}
-		if fm.RegionID == f.regionId {
+		if region == f.regionId {
 			return
 		}
-		handler(fm.RegionID, fm.Payload)
+		for _, p := range payloads {
+			handler(region, p)
+		}
 	})
 	if err != nil {
 		return err
@@ -81,5 +195,8 @@ func (f *NATSFederator) Unsubscribe(roomId string) error {
 }
 
 func (f *NATSFederator) Close() {
+	if f.batcher != nil {
+		f.batcher.Close()
+	}
 	f.conn.Close()
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -14,6 +15,10 @@ type mockFederator struct {
 	mu       sync.Mutex
 	subs     map[string]func(string, []byte)
 	peer     *mockFederator
+
+	// partitioned, when set, silently drops everything this side publishes
+	// (simulates a NATS link outage).
+	partitioned atomic.Bool
 }
 
 func newMockFederatorPair(a, b string) (*mockFederator, *mockFederator) {
@@ -29,6 +34,9 @@ func (f *mockFederator) Publish(topic string, msg []byte) error {
 	if err != nil {
 		return err
 	}
+	if f.partitioned.Load() {
+		return nil
+	}
 	if f.peer != nil {
 		f.peer.mu.Lock()
 		handler, ok := f.peer.subs[topic]
@@ -10,10 +10,12 @@ require (
 require github.com/gorilla/websocket v1.5.0
 
 require (
-	github.com/klauspost/compress v1.18.2 // indirect
+	github.com/klauspost/compress v1.18.2
+	github.com/mattn/go-sqlite3 v1.14.33
 	github.com/nats-io/nats.go v1.49.0
 	github.com/nats-io/nkeys v0.4.12 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/ugorji/go/codec v1.3.1
 	golang.org/x/crypto v0.46.0 // indirect
 	golang.org/x/sys v0.39.0 // indirect
 )
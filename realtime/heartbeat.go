@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/olahol/melody"
+)
+
+const (
+	// defaultHeartbeatInterval is how often heartbeat-capable sessions are
+	// pinged when HEARTBEAT_INTERVAL is unset.
+	defaultHeartbeatInterval = 25 * time.Second
+
+	// closeCodeIdle is the WebSocket close code sent to sessions dropped by
+	// the idle timeout (4000-4999 is reserved for applications).
+	closeCodeIdle = 4000
+
+	// A new RTT sample is only broadcast as session_latency when it moves by
+	// at least latencyReportMinDeltaMs and by a quarter of the previous value,
+	// so jitter does not flood topics.
+	latencyReportMinDeltaMs = 20
+
+	// CapabilityHeartbeat opts a session into server pings and RTT tracking.
+	CapabilityHeartbeat = "heartbeat"
+)
+
+// HeartbeatMsg is the server's ping (heartbeat sessions only) and its pong
+// reply to a client ping.
+type HeartbeatMsg struct {
+	Op         string `json:"op"`
+	TS         int64  `json:"ts"`
+	ServerTime int64  `json:"serverTime,omitempty"`
+	RTTMs      int64  `json:"rttMs,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+}
+
+func init() {
+	knownCapabilities[CapabilityHeartbeat] = true
+}
+
+// touch records inbound application traffic for the idle timeout.
+func (k *SessionKeys) touch() {
+	k.lastSeen.Store(time.Now().UnixNano())
+}
+
+// LatencyMs is the last measured round trip in milliseconds, 0 if unknown.
+func (k *SessionKeys) LatencyMs() int64 {
+	return k.rttMs.Load()
+}
+
+// handlePing answers a client ping immediately (not via the dispatcher, so
+// queued subscribes don't inflate the client's RTT measurement).
+func (rm *RoomManager) handlePing(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	data, err := json.Marshal(HeartbeatMsg{
+		Op:         OpPong,
+		TS:         op.TS,
+		ServerTime: time.Now().UnixMilli(),
+		RTTMs:      keys.LatencyMs(),
+		Ref:        op.Ref,
+	})
+	if err != nil {
+		return
+	}
+	_ = writeFrame(s, data)
+}
+
+// handlePong completes a server ping. Pongs that don't echo the outstanding
+// ping's ts are ignored.
+func (rm *RoomManager) handlePong(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	if op.TS == 0 || !keys.pingSent.CompareAndSwap(op.TS, 0) {
+		return
+	}
+	rtt := time.Now().UnixMilli() - op.TS
+	if rtt < 1 {
+		rtt = 1
+	}
+	rm.renewSessionLocks(keys)
+	prev := keys.rttMs.Swap(rtt)
+	if !latencyChanged(prev, rtt) {
+		return
+	}
+	for _, topic := range keys.Subs.Snapshot() {
+		if evt := buildSessionInfoEvent(EventSessionLatency, topic, localSessionInfo(keys, topic)); evt != nil {
+			rm.broadcastToTopic(topic, s, evt)
+		}
+	}
+}
+
+func latencyChanged(prev, next int64) bool {
+	if prev == 0 {
+		return true
+	}
+	delta := next - prev
+	if delta < 0 {
+		delta = -delta
+	}
+	return delta >= latencyReportMinDeltaMs && delta*4 >= prev
+}
+
+// RunHeartbeat pings heartbeat-capable sessions and closes those that have
+// sent nothing for idleTimeout. It ticks every heartbeatInterval, or every
+// idleTimeout/2 if that is shorter, so a session answering pings never
+// idles out. Returns immediately if both are disabled.
+//
+// Sessions without the capability are never closed as idle: a passive
+// viewer may legitimately send nothing. Their dead WebSocket connections
+// are caught by melody's protocol-level ping/pong instead.
+func (rm *RoomManager) RunHeartbeat(stop <-chan struct{}) {
+	interval := rm.heartbeatInterval
+	if rm.idleTimeout > 0 {
+		if half := rm.idleTimeout / 2; interval <= 0 || half < interval {
+			interval = half
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			rm.heartbeatTick(now)
+		}
+	}
+}
+
+func (rm *RoomManager) heartbeatTick(now time.Time) {
+	for _, s := range rm.connections() {
+		keys := getSessionKeys(s)
+		if keys == nil {
+			continue
+		}
+		heartbeat := keys.HasCapability(CapabilityHeartbeat)
+		if rm.idleTimeout > 0 && heartbeat && now.Sub(time.Unix(0, keys.lastSeen.Load())) > rm.idleTimeout {
+			logf(regionLocal, "[idle] closing session=%s user=%s after %s without traffic",
+				truncateID(keys.SessionID), keys.DisplayName(), rm.idleTimeout)
+			_ = s.CloseWithMsg(melody.FormatCloseMessage(closeCodeIdle, "idle timeout"))
+			continue
+		}
+		if rm.heartbeatInterval > 0 && heartbeat {
+			ts := now.UnixMilli()
+			keys.pingSent.Store(ts)
+			if data, err := json.Marshal(HeartbeatMsg{Op: OpPing, TS: ts}); err == nil {
+				_ = writeFrame(s, data)
+			}
+		}
+	}
+}
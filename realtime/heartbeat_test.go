@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/olahol/melody"
+)
+
+// answerPing waits for a server ping, sleeps delay, and echoes it back.
+func (tc *testClient) answerPing(t *testing.T, delay time.Duration) {
+	t.Helper()
+	var ping HeartbeatMsg
+	_ = json.Unmarshal(tc.waitForOp(t, OpPing, ""), &ping)
+	time.Sleep(delay)
+	tc.sendRaw(t, map[string]any{"op": OpPong, "ts": ping.TS})
+}
+
+func latencyOf(infos []SessionInfo, sessionID string) int64 {
+	for _, info := range infos {
+		if info.SessionID == sessionID {
+			return info.LatencyMs
+		}
+	}
+	return -1
+}
+
+func TestPing_EchoesClientTimestamp(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+
+	tc := dialRaw(t, server, "u-a", "Alice", "editor")
+	defer tc.close()
+	tc.sendRaw(t, map[string]any{"op": OpPing, "ts": 12345, "ref": "p1"})
+
+	var pong HeartbeatMsg
+	_ = json.Unmarshal(tc.waitForOp(t, OpPong, "p1"), &pong)
+	if pong.TS != 12345 || pong.ServerTime == 0 {
+		t.Fatalf("unexpected pong: %+v", pong)
+	}
+	if pong.RTTMs != 0 {
+		t.Fatalf("no RTT should be reported before a server ping is answered, got %d", pong.RTTMs)
+	}
+}
+
+// TestHeartbeat_LatencyInPresence — a heartbeat client's RTT is measured,
+// announced as session_latency, and included in later subscribe acks.
+func TestHeartbeat_LatencyInPresence(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	// Ticks are driven by hand, so exactly one ping is outstanding.
+	rooms.heartbeatInterval = time.Hour
+
+	topic := "desktop:latency"
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+
+	alice := dialRaw(t, server, "u-alice", "Alice", "editor")
+	defer alice.close()
+	alice.sendRaw(t, helloRequest("h1", 1, CapabilityHeartbeat))
+	alice.waitForOp(t, OpHelloAck, "h1")
+	alice.subscribe(t, topic)
+	rooms.heartbeatTick(time.Now())
+	alice.answerPing(t, 40*time.Millisecond)
+
+	waitFor(t, func() bool { return len(bob.findEventsOfType(EventSessionLatency, topic)) > 0 })
+	events := bob.findEventsOfType(EventSessionLatency, topic)
+	var evt struct {
+		Payload SessionInfo `json:"payload"`
+	}
+	_ = json.Unmarshal(events[0], &evt)
+	if evt.Payload.SessionID != alice.sessionID || evt.Payload.LatencyMs < 40 {
+		t.Fatalf("unexpected latency event: %s", events[0])
+	}
+
+	carol := dialRaw(t, server, "u-carol", "Carol", "editor")
+	defer carol.close()
+	carol.subscribe(t, topic)
+	var ack SubscribedAck
+	_ = json.Unmarshal(carol.waitForOp(t, OpSubscribed, ""), &ack)
+	if got := latencyOf(ack.Sessions, alice.sessionID); got < 40 {
+		t.Fatalf("ack should carry alice's latency, got %d", got)
+	}
+	if got := latencyOf(ack.Sessions, bob.sessionID); got != 0 {
+		t.Fatalf("bob never answered a ping, latency should be unknown, got %d", got)
+	}
+}
+
+func TestHeartbeat_NoPingsWithoutCapability(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.heartbeatInterval = time.Hour
+
+	tc := connectAndSubscribe(t, server, "desktop:quiet", "u-a", "Alice", "editor")
+	defer tc.close()
+	rooms.heartbeatTick(time.Now())
+	rooms.heartbeatTick(time.Now())
+	// Frames to one session are written in order, so once the pong is back
+	// any ping would have arrived.
+	tc.sendRaw(t, map[string]any{"op": OpPing, "ts": 1, "ref": "barrier"})
+	tc.waitForOp(t, OpPong, "barrier")
+	for _, raw := range tc.waitForMessages(1, 0) {
+		var env struct {
+			Op string `json:"op"`
+		}
+		_ = json.Unmarshal(raw, &env)
+		if env.Op == OpPing {
+			t.Fatal("clients without the heartbeat capability must not be pinged")
+		}
+	}
+}
+
+// TestIdleTimeout_DropsSilentSessions — a heartbeat session with no inbound
+// traffic is closed and leaves presence; one that keeps pinging stays, and
+// so does a quiet session without the capability.
+func TestIdleTimeout_DropsSilentSessions(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.heartbeatInterval = 0
+	rooms.idleTimeout = 100 * time.Millisecond
+
+	topic := "desktop:idle"
+	silent := dialHello(t, server, "u-silent", "Silent", CapabilityHeartbeat)
+	silent.subscribe(t, topic)
+	chatty := dialHello(t, server, "u-chatty", "Chatty", CapabilityHeartbeat)
+	defer chatty.close()
+	chatty.subscribe(t, topic)
+	passive := connectAndSubscribe(t, server, topic, "u-passive", "Passive", "viewer")
+	defer passive.close()
+
+	time.Sleep(rooms.idleTimeout + 20*time.Millisecond)
+	chatty.sendRaw(t, map[string]any{"op": OpPing, "ts": 1, "ref": "p1"})
+	chatty.waitForOp(t, OpPong, "p1")
+	rooms.heartbeatTick(time.Now())
+
+	select {
+	case <-silent.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent session should have been closed")
+	}
+	waitFor(t, func() bool { return chatty.sawSessionEvent(EventSessionLeft, topic, silent.sessionID) })
+	for name, tc := range map[string]*testClient{"active": chatty, "passive": passive} {
+		select {
+		case <-tc.done:
+			t.Fatalf("%s session must not be closed", name)
+		default:
+		}
+	}
+}
+
+func TestFederatedLatencyUpdatesRemoteSession(t *testing.T) {
+	rm := NewRoomManager(melody.New())
+	topic := "desktop:remote-latency"
+	rm.remoteSessions[topic] = []SessionInfo{{SessionID: "hk-1", Region: "ap-northeast-1"}}
+
+	evt := buildSessionInfoEvent(EventSessionLatency, topic, SessionInfo{SessionID: "hk-1", LatencyMs: 180})
+	rm.handleFederatedMessage(topic, "ap-northeast-1", evt)
+
+	if got := rm.remoteSessions[topic][0].LatencyMs; got != 180 {
+		t.Fatalf("remote latency should be 180, got %d", got)
+	}
+}
+
+func TestLatencyChanged(t *testing.T) {
+	cases := []struct {
+		prev, next int64
+		want       bool
+	}{
+		{0, 5, true},
+		{100, 110, false},
+		{100, 130, true},
+		{400, 430, false},
+		{400, 300, true},
+	}
+	for _, c := range cases {
+		if got := latencyChanged(c.prev, c.next); got != c.want {
+			t.Errorf("latencyChanged(%d, %d) = %v, want %v", c.prev, c.next, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+)
+
+// ProtocolVersion is the envelope version this relay speaks. Bump it when
+// an existing envelope changes shape; additive fields and new ops are gated
+// by capabilities instead.
+const ProtocolVersion = 1
+
+// serverVersion is stamped at build time:
+//
+//	go build -ldflags "-X main.serverVersion=1.4.2"
+var serverVersion = "dev"
+
+// knownCapabilities lists the client capabilities this relay understands.
+// Clients may declare anything; unknown capabilities are ignored and left
+// out of the hello_ack so the client knows what took effect.
+var knownCapabilities = map[string]bool{}
+
+// HelloLimits advertises the per-session limits enforced by this relay.
+type HelloLimits struct {
+	MaxTopicsPerSession int     `json:"maxTopicsPerSession"`
+	MaxMessageBytes     int64   `json:"maxMessageBytes"`
+	SubscribesPerSecond float64 `json:"subscribesPerSecond"`
+	SubscribeBurst      int     `json:"subscribeBurst"`
+	HeartbeatIntervalMs int64   `json:"heartbeatIntervalMs,omitempty"`
+	IdleTimeoutMs       int64   `json:"idleTimeoutMs,omitempty"`
+	LockTTLMs           int64   `json:"lockTtlMs"`
+}
+
+// HelloMsg is the server hello, the first frame of every session.
+type HelloMsg struct {
+	Op              string      `json:"op"`
+	ServerVersion   string      `json:"serverVersion"`
+	ProtocolVersion int         `json:"protocolVersion"`
+	SessionID       string      `json:"sessionId"`
+	Encoding        string      `json:"encoding"`
+	Limits          HelloLimits `json:"limits"`
+	Features        []string    `json:"features"`
+}
+
+// HelloAck answers a client hello with what took effect.
+type HelloAck struct {
+	Op              string   `json:"op"`
+	ProtocolVersion int      `json:"protocolVersion"`
+	Capabilities    []string `json:"capabilities"`
+	Ref             string   `json:"ref,omitempty"`
+}
+
+// sessionCaps holds what a session declared in its hello. The dispatcher
+// writes it once; broadcast paths on other goroutines read it.
+type sessionCaps struct {
+	mu              sync.RWMutex
+	helloed         bool
+	protocolVersion int
+	caps            map[string]struct{}
+}
+
+// HasCapability reports whether the session declared (and the server
+// accepted) capability c. Sessions that never sent hello have none.
+func (k *SessionKeys) HasCapability(c string) bool {
+	k.caps.mu.RLock()
+	defer k.caps.mu.RUnlock()
+	_, ok := k.caps.caps[c]
+	return ok
+}
+
+// ProtocolVersion is the negotiated envelope version for this session.
+func (k *SessionKeys) ProtocolVersion() int {
+	k.caps.mu.RLock()
+	defer k.caps.mu.RUnlock()
+	if k.caps.protocolVersion == 0 {
+		return ProtocolVersion
+	}
+	return k.caps.protocolVersion
+}
+
+// serverFeatures lists what is enabled on this relay and usable from s, for
+// the server hello. Binary encodings are listed when the upgrader offers
+// them, and only to WebSocket sessions; SSE frames are always JSON. Batch
+// subscribe has no switch and is always listed.
+func (rm *RoomManager) serverFeatures(s sessionConn) []string {
+	var features []string
+	if _, sse := s.(*sseConn); !sse {
+		for _, enc := range []struct{ subprotocol, feature string }{
+			{SubprotocolMsgpack, "encoding:msgpack"},
+			{SubprotocolCBOR, "encoding:cbor"},
+		} {
+			if slices.Contains(rm.melody.Upgrader.Subprotocols, enc.subprotocol) {
+				features = append(features, enc.feature)
+			}
+		}
+	}
+	if allowedTopicNamespaces[ydocNamespace] {
+		features = append(features, "ydoc")
+	}
+	features = append(features, "subscribe_batch")
+	if rm.federator != nil {
+		features = append(features, "federation")
+	}
+	if rm.historyEnabled() {
+		features = append(features, "history")
+	}
+	return features
+}
+
+// sendServerHello writes the server hello; HandleConnect sends it before
+// any other frame.
+func (rm *RoomManager) sendServerHello(s sessionConn, keys *SessionKeys) {
+	data, err := json.Marshal(HelloMsg{
+		Op:              OpHello,
+		ServerVersion:   serverVersion,
+		ProtocolVersion: ProtocolVersion,
+		SessionID:       keys.SessionID,
+		Encoding:        keys.Encoding.String(),
+		Limits: HelloLimits{
+			MaxTopicsPerSession: MaxTopicsPerSession,
+			MaxMessageBytes:     rm.melody.Config.MaxMessageSize,
+			SubscribesPerSecond: SubscribeTokensPerSec,
+			SubscribeBurst:      MaxSubscribeTokens,
+			HeartbeatIntervalMs: rm.heartbeatInterval.Milliseconds(),
+			IdleTimeoutMs:       rm.idleTimeout.Milliseconds(),
+			LockTTLMs:           rm.lockTTL.Milliseconds(),
+		},
+		Features: rm.serverFeatures(s),
+	})
+	if err != nil {
+		logf(regionLocal, "error marshalling hello: %v", err)
+		return
+	}
+	_ = writeFrame(s, data)
+}
+
+// handleHello takes a client hello, which declares the client's protocol
+// version and capabilities, and answers with hello_ack.
+func (rm *RoomManager) handleHello(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	version := op.ProtocolVersion
+	if version == 0 || version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < 0 {
+		writeError(s, ErrorMsg{Op: OpError, Code: ErrCodeBadRequest, Message: "invalid protocolVersion", Ref: op.Ref})
+		return
+	}
+
+	accepted := make([]string, 0, len(op.Capabilities))
+	caps := make(map[string]struct{}, len(op.Capabilities))
+	for _, c := range op.Capabilities {
+		if _, dup := caps[c]; dup || !knownCapabilities[c] {
+			continue
+		}
+		caps[c] = struct{}{}
+		accepted = append(accepted, c)
+	}
+
+	keys.caps.mu.Lock()
+	if keys.caps.helloed {
+		keys.caps.mu.Unlock()
+		writeError(s, ErrorMsg{Op: OpError, Code: ErrCodeBadRequest, Message: "hello already sent", Ref: op.Ref})
+		return
+	}
+	keys.caps.helloed = true
+	keys.caps.protocolVersion = version
+	keys.caps.caps = caps
+	keys.caps.mu.Unlock()
+
+	reply, err := json.Marshal(HelloAck{
+		Op:              OpHelloAck,
+		ProtocolVersion: version,
+		Capabilities:    accepted,
+		Ref:             op.Ref,
+	})
+	if err != nil {
+		return
+	}
+	_ = writeFrame(s, reply)
+
+	logf(regionLocal, "[hello] session=%s protocol=%d capabilities=%v",
+		truncateID(keys.SessionID), version, accepted)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func helloRequest(ref string, version int, caps ...string) map[string]any {
+	return map[string]any{"op": "hello", "ref": ref, "protocolVersion": version, "capabilities": caps}
+}
+
+// dialHello connects and completes a hello declaring caps.
+func dialHello(t *testing.T, server *httptest.Server, userId, firstName string, caps ...string) *testClient {
+	t.Helper()
+	tc := dialRaw(t, server, userId, firstName, "editor")
+	tc.sendRaw(t, helloRequest("hello", ProtocolVersion, caps...))
+	tc.waitForOp(t, OpHelloAck, "hello")
+	return tc
+}
+
+// TestHello_AdvertisesVersionLimitsAndFeatures — the server hello is the
+// first frame of a session, sent before the client says anything.
+func TestHello_AdvertisesVersionLimitsAndFeatures(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+
+	tc := dialRaw(t, server, "u-a", "Alice", "editor")
+	defer tc.close()
+
+	var hello HelloMsg
+	if err := json.Unmarshal(tc.hello, &hello); err != nil {
+		t.Fatalf("unmarshal hello: %v", err)
+	}
+	if hello.ProtocolVersion != ProtocolVersion || hello.ServerVersion != serverVersion {
+		t.Errorf("unexpected versions: %+v", hello)
+	}
+	if hello.Limits.MaxTopicsPerSession != MaxTopicsPerSession || hello.Limits.MaxMessageBytes != 4096 {
+		t.Errorf("unexpected limits: %+v", hello.Limits)
+	}
+	if hello.Encoding != "json" || hello.SessionID == "" {
+		t.Errorf("unexpected session fields: %+v", hello)
+	}
+	want := []string{"encoding:msgpack", "encoding:cbor", "ydoc", "subscribe_batch"}
+	if !slices.Equal(hello.Features, want) {
+		t.Errorf("features: got %v, want %v", hello.Features, want)
+	}
+
+	tc.sendRaw(t, helloRequest("h1", 1, "no_such_capability"))
+	var ack HelloAck
+	_ = json.Unmarshal(tc.waitForOp(t, OpHelloAck, "h1"), &ack)
+	if ack.ProtocolVersion != ProtocolVersion || len(ack.Capabilities) != 0 {
+		t.Errorf("unknown capabilities must not be accepted, got %+v", ack)
+	}
+	for _, raw := range tc.waitForMessages(1, 0) {
+		var env struct {
+			Op string `json:"op"`
+		}
+		if json.Unmarshal(raw, &env) == nil && env.Op == OpHello {
+			t.Error("a client hello must not repeat the server hello")
+		}
+	}
+}
+
+// TestHello_FeaturesFollowConfig — features are derived from what is
+// enabled, not a fixed list.
+func TestHello_FeaturesFollowConfig(t *testing.T) {
+	m, rooms, server := setupTestServer()
+	defer server.Close()
+	m.Upgrader.Subprotocols = []string{SubprotocolCBOR, SubprotocolJSON}
+	rooms.federator = &mockFederator{}
+
+	tc := dialRaw(t, server, "u-a", "Alice", "editor")
+	defer tc.close()
+	var hello HelloMsg
+	_ = json.Unmarshal(tc.hello, &hello)
+	want := []string{"encoding:cbor", "ydoc", "subscribe_batch", "federation"}
+	if !slices.Equal(hello.Features, want) {
+		t.Fatalf("features: got %v, want %v", hello.Features, want)
+	}
+}
+
+func TestHello_NewerClientIsDowngraded(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+
+	tc := dialRaw(t, server, "u-a", "Alice", "editor")
+	defer tc.close()
+	tc.sendRaw(t, helloRequest("h1", ProtocolVersion+3))
+
+	var ack HelloAck
+	_ = json.Unmarshal(tc.waitForOp(t, OpHelloAck, "h1"), &ack)
+	if ack.ProtocolVersion != ProtocolVersion {
+		t.Fatalf("server should answer with its own version, got %d", ack.ProtocolVersion)
+	}
+}
+
+func TestHello_CapabilitiesAreStoredOnce(t *testing.T) {
+	knownCapabilities["test_cap"] = true
+	defer delete(knownCapabilities, "test_cap")
+
+	m, _, server := setupTestServer()
+	defer server.Close()
+
+	tc := dialRaw(t, server, "u-a", "Alice", "editor")
+	defer tc.close()
+	tc.sendRaw(t, helloRequest("h1", 1, "test_cap", "test_cap", "other"))
+
+	var ack HelloAck
+	_ = json.Unmarshal(tc.waitForOp(t, OpHelloAck, "h1"), &ack)
+	if len(ack.Capabilities) != 1 || ack.Capabilities[0] != "test_cap" {
+		t.Fatalf("expected [test_cap], got %v", ack.Capabilities)
+	}
+
+	var keys *SessionKeys
+	sessions, _ := m.Sessions()
+	for _, s := range sessions {
+		keys = getSessionKeys(s)
+	}
+	if keys == nil || !keys.HasCapability("test_cap") || keys.HasCapability("other") {
+		t.Fatal("session should carry exactly the accepted capability")
+	}
+
+	tc.sendRaw(t, helloRequest("h2", 1))
+	if code := errorCode(tc.waitForOp(t, OpError, "h2")); code != ErrCodeBadRequest {
+		t.Fatalf("second hello should be rejected, got %q", code)
+	}
+	if !keys.HasCapability("test_cap") {
+		t.Fatal("rejected hello must not reset capabilities")
+	}
+}
+
+// TestHello_OptionalForOldClients — a client that never says hello gets
+// the subscribed ack right after the server hello.
+func TestHello_OptionalForOldClients(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+
+	tc := connectAndSubscribe(t, server, "desktop:old", "u-a", "Alice", "editor")
+	defer tc.close()
+	msgs := tc.waitForMessages(1, time.Second)
+	var env struct {
+		Op string `json:"op"`
+	}
+	_ = json.Unmarshal(msgs[0], &env)
+	if env.Op != OpSubscribed {
+		t.Fatalf("first frame should be the ack, got %s", msgs[0])
+	}
+}
+
+func errorCode(raw json.RawMessage) string {
+	var e ErrorMsg
+	_ = json.Unmarshal(raw, &e)
+	return e.Code
+}
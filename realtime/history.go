@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultHistoryLimit = 100
+	MaxHistoryLimit     = 500
+)
+
+var errHistoryDisabled = errors.New("history is not enabled on this relay")
+
+// HistoryMsg answers a history op, and is the body of /internal/history.
+// Events are in seq order. More is set when further records lie beyond
+// this page: continue with afterSeq = the last seq when reading forward,
+// or beforeSeq = the first seq when reading back.
+type HistoryMsg struct {
+	Op     string             `json:"op,omitempty"`
+	Topic  string             `json:"topic"`
+	Events []StateEventRecord `json:"events"`
+	More   bool               `json:"more"`
+	Ref    string             `json:"ref,omitempty"`
+}
+
+// historyEnabled reports whether the event sink can serve history.
+func (rm *RoomManager) historyEnabled() bool {
+	if rm.events == nil {
+		return false
+	}
+	_, ok := rm.events.sink.(EventReader)
+	return ok
+}
+
+// newHistoryQuery validates a query from the wire or the HTTP endpoint.
+func newHistoryQuery(topic string, afterSeq, beforeSeq uint64, since int64, limit int) (HistoryQuery, error) {
+	if _, _, err := parseTopic(topic); err != nil {
+		return HistoryQuery{}, err
+	}
+	q := HistoryQuery{Topic: topic, AfterSeq: afterSeq, BeforeSeq: beforeSeq, Since: since, Limit: limit}
+	switch {
+	case since < 0 || limit < 0:
+		return HistoryQuery{}, errors.New("since and limit must not be negative")
+	case beforeSeq > 0 && q.forward():
+		return HistoryQuery{}, errors.New("beforeSeq cannot be combined with afterSeq or since")
+	case limit == 0:
+		q.Limit = defaultHistoryLimit
+	case limit > MaxHistoryLimit:
+		q.Limit = MaxHistoryLimit
+	}
+	return q, nil
+}
+
+// queryHistory reads one page of q, reporting whether there is more.
+func (rm *RoomManager) queryHistory(q HistoryQuery) ([]StateEventRecord, bool, error) {
+	if !rm.historyEnabled() {
+		return nil, false, errHistoryDisabled
+	}
+	want := q.Limit
+	q.Limit++
+	recs, err := rm.events.sink.(EventReader).ReadTopic(q)
+	if err != nil {
+		return nil, false, err
+	}
+	more := len(recs) > want
+	if more {
+		if q.forward() {
+			recs = recs[:want]
+		} else {
+			recs = recs[len(recs)-want:]
+		}
+	}
+	if recs == nil {
+		recs = []StateEventRecord{}
+	}
+	return recs, more, nil
+}
+
+func (rm *RoomManager) handleHistory(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	topic := op.Topic
+	if _, ok := keys.Subs.Get(topic); !ok {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeNotSubscribed, Ref: op.Ref})
+		return
+	}
+	q, err := newHistoryQuery(topic, op.AfterSeq, op.BeforeSeq, op.Since, op.Limit)
+	if err != nil {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeBadRequest, Message: err.Error(), Ref: op.Ref})
+		return
+	}
+	if !rm.historyEnabled() {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeNotFound, Message: errHistoryDisabled.Error(), Ref: op.Ref})
+		return
+	}
+	// Queries may scan the log on disk; they share the subscribe budget.
+	if !keys.Subs.TryConsume() {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeRateLimited,
+			Message: "too many history requests", Ref: op.Ref})
+		return
+	}
+
+	recs, more, err := rm.queryHistory(q)
+	if err != nil {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeInternal, Message: "history read failed", Ref: op.Ref})
+		logf(regionLocal, "[history] session=%s topic=%s read failed: %v",
+			truncateID(keys.SessionID), topicIDForLog(topic), err)
+		return
+	}
+	data, err := json.Marshal(HistoryMsg{Op: OpHistory, Topic: topic, Events: recs, More: more, Ref: op.Ref})
+	if err != nil {
+		return
+	}
+	_ = writeFrame(s, data)
+}
+
+// historyHandler serves GET /internal/history for support tooling. The
+// caller is identified by a user access token (Authorization: Bearer, or
+// the access token cookie) and must be authorized on the topic, exactly as
+// for a subscribe. Query parameters mirror the history op.
+func historyHandler(auth *Auth, rm *RoomManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		claims, err := auth.ValidateRequest(r)
+		if err != nil {
+			logf(regionLocal, "[auth] rejected history request: %v", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		params := r.URL.Query()
+		topic := params.Get("topic")
+		var afterSeq, beforeSeq uint64
+		var since, limit int64
+		for name, dst := range map[string]any{"afterSeq": &afterSeq, "beforeSeq": &beforeSeq, "since": &since, "limit": &limit} {
+			v := params.Get(name)
+			if v == "" {
+				continue
+			}
+			switch d := dst.(type) {
+			case *uint64:
+				*d, err = strconv.ParseUint(v, 10, 64)
+			case *int64:
+				*d, err = strconv.ParseInt(v, 10, 64)
+			}
+			if err != nil {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+		}
+		if limit > MaxHistoryLimit {
+			limit = MaxHistoryLimit
+		}
+		q, err := newHistoryQuery(topic, afterSeq, beforeSeq, since, int(limit))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := rm.authorizeTopic(&SessionKeys{Claims: claims}, topic); err != nil {
+			status := http.StatusInternalServerError
+			switch errorCodeFor(err) {
+			case ErrCodeForbidden:
+				status = http.StatusForbidden
+			case ErrCodeNotFound:
+				status = http.StatusNotFound
+			case ErrCodeBadRequest:
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		recs, more, err := rm.queryHistory(q)
+		if errors.Is(err, errHistoryDisabled) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logf(regionLocal, "[history] topic=%s read failed: %v", topicIDForLog(topic), err)
+			http.Error(w, "history read failed", http.StatusInternalServerError)
+			return
+		}
+		logf(regionLocal, "[history] user=%s topic=%s events=%d", truncateID(claims.UserID), topicIDForLog(topic), len(recs))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(HistoryMsg{Topic: topic, Events: recs, More: more})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withJSONLSink gives rooms an event log on a JSONL sink in a temp dir.
+func withJSONLSink(t *testing.T, rooms *RoomManager, rotateBytes int64) {
+	t.Helper()
+	sink, err := openJSONLSink(SinkOptions{Path: t.TempDir(), RotateBytes: rotateBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := newEventLog(sink, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms.events = events
+	t.Cleanup(func() { events.Close() })
+}
+
+// history sends a history op and returns the reply.
+func (tc *testClient) history(t *testing.T, topic, ref string, params map[string]any) HistoryMsg {
+	t.Helper()
+	op := map[string]any{"op": "history", "topic": topic, "ref": ref}
+	for k, v := range params {
+		op[k] = v
+	}
+	tc.sendRaw(t, op)
+	var msg HistoryMsg
+	if err := json.Unmarshal(tc.waitForOp(t, OpHistory, ref), &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func seqsOf(recs []StateEventRecord) []uint64 {
+	out := make([]uint64, len(recs))
+	for i, r := range recs {
+		out[i] = r.Seq
+	}
+	return out
+}
+
+func equalSeqs(got []StateEventRecord, want ...uint64) bool {
+	seqs := seqsOf(got)
+	if len(seqs) != len(want) {
+		return false
+	}
+	for i := range want {
+		if seqs[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestJSONLSink_ReadTopic(t *testing.T) {
+	s, err := openJSONLSink(SinkOptions{Path: t.TempDir(), RotateBytes: 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for seq := uint64(1); seq <= 30; seq++ {
+		topic := "desktop:a"
+		if seq%3 == 0 {
+			topic = "desktop:b"
+		}
+		s.Write([]StateEventRecord{{Seq: seq, Topic: topic, Type: "asset_moved", Timestamp: int64(seq * 10)}})
+	}
+	if files, _ := s.(*jsonlSink).files(); len(files) < 3 {
+		t.Fatalf("test needs several files, got %v", files)
+	}
+	r := s.(EventReader)
+
+	for _, tc := range []struct {
+		name string
+		q    HistoryQuery
+		want []uint64
+	}{
+		{"newest", HistoryQuery{Topic: "desktop:b", Limit: 3}, []uint64{24, 27, 30}},
+		{"before", HistoryQuery{Topic: "desktop:b", BeforeSeq: 24, Limit: 3}, []uint64{15, 18, 21}},
+		{"before start", HistoryQuery{Topic: "desktop:b", BeforeSeq: 7, Limit: 3}, []uint64{3, 6}},
+		{"after", HistoryQuery{Topic: "desktop:b", AfterSeq: 10, Limit: 3}, []uint64{12, 15, 18}},
+		{"since", HistoryQuery{Topic: "desktop:a", Since: 250, Limit: 10}, []uint64{25, 26, 28, 29}},
+		{"since and after", HistoryQuery{Topic: "desktop:a", Since: 250, AfterSeq: 26, Limit: 10}, []uint64{28, 29}},
+		{"other topic", HistoryQuery{Topic: "desktop:c", Limit: 10}, nil},
+	} {
+		got, err := r.ReadTopic(tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalSeqs(got, tc.want...) {
+			t.Errorf("%s: got %v, want %v", tc.name, seqsOf(got), tc.want)
+		}
+	}
+}
+
+func TestHistory_PagesBackAndForward(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	withJSONLSink(t, rooms, 0)
+	topic := "desktop:history"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	for i := 0; i < 5; i++ {
+		alice.publish(t, topic, "asset_moved", map[string]any{"i": i})
+	}
+	alice.publish(t, topic, "cursor_move", map[string]any{"x": 1}) // not recorded
+	time.Sleep(100 * time.Millisecond)
+
+	last := alice.history(t, topic, "h1", map[string]any{"limit": 2})
+	if !equalSeqs(last.Events, 4, 5) || !last.More || last.Topic != topic {
+		t.Fatalf("expected the last two events with more, got %+v", last)
+	}
+	if e := last.Events[1]; e.Type != "asset_moved" || e.SessionID != alice.sessionID || string(e.Payload) != `{"i":4}` {
+		t.Fatalf("unexpected record: %+v", e)
+	}
+	older := alice.history(t, topic, "h2", map[string]any{"limit": 2, "beforeSeq": 4})
+	if !equalSeqs(older.Events, 2, 3) || !older.More {
+		t.Fatalf("expected 2,3 with more, got %+v", older)
+	}
+	oldest := alice.history(t, topic, "h3", map[string]any{"limit": 2, "beforeSeq": 2})
+	if !equalSeqs(oldest.Events, 1) || oldest.More {
+		t.Fatalf("expected 1 without more, got %+v", oldest)
+	}
+	after := alice.history(t, topic, "h4", map[string]any{"afterSeq": 3})
+	if !equalSeqs(after.Events, 4, 5) || after.More {
+		t.Fatalf("expected 4,5 without more, got %+v", after)
+	}
+	since := alice.history(t, topic, "h5", map[string]any{"since": last.Events[0].Timestamp, "limit": 1})
+	if len(since.Events) != 1 || since.Events[0].Timestamp < last.Events[0].Timestamp || !since.More {
+		t.Fatalf("unexpected since page: %+v", since)
+	}
+}
+
+func TestHistory_Errors(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:history-err"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "viewer")
+	defer alice.close()
+
+	alice.sendRaw(t, map[string]any{"op": "history", "topic": topic, "ref": "off"})
+	if code := errorCode(alice.waitForOp(t, OpError, "off")); code != ErrCodeNotFound {
+		t.Fatalf("history without a sink should be not_found, got %s", code)
+	}
+
+	withJSONLSink(t, rooms, 0)
+	alice.sendRaw(t, map[string]any{"op": "history", "topic": "desktop:other", "ref": "nosub"})
+	if code := errorCode(alice.waitForOp(t, OpError, "nosub")); code != ErrCodeNotSubscribed {
+		t.Fatalf("expected not_subscribed, got %s", code)
+	}
+	alice.sendRaw(t, map[string]any{"op": "history", "topic": topic, "afterSeq": 1, "beforeSeq": 5, "ref": "both"})
+	if code := errorCode(alice.waitForOp(t, OpError, "both")); code != ErrCodeBadRequest {
+		t.Fatalf("expected bad_request, got %s", code)
+	}
+	// Viewers may read history.
+	if msg := alice.history(t, topic, "ok", nil); len(msg.Events) != 0 || msg.More {
+		t.Fatalf("expected an empty page, got %+v", msg)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	withJSONLSink(t, rooms, 0)
+	topic := "desktop:history-http"
+	rooms.authorizeOverride = func(claims *Claims, topic string) (string, error) {
+		if claims.UserID == "u-support" {
+			return "editor", nil
+		}
+		return "", ErrTopicForbidden
+	}
+
+	alice := dialRaw(t, server, "u-support", "Support", "")
+	defer alice.close()
+	alice.subscribe(t, topic)
+	alice.publish(t, topic, "asset_added", map[string]any{"id": "a1"})
+	alice.publish(t, topic, "asset_removed", map[string]any{"id": "a1"})
+	time.Sleep(100 * time.Millisecond)
+
+	secret := []byte("history-secret")
+	api := httptest.NewServer(historyHandler(&Auth{jwtSecret: secret}, rooms))
+	defer api.Close()
+	get := func(userID, query string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, api.URL+"?"+query, nil)
+		if userID != "" {
+			req.Header.Set("Authorization", "Bearer "+signTestJWT(t, secret, &Claims{UserID: userID}))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("u-support", "topic="+topic+"&limit=1")
+	var msg HistoryMsg
+	json.NewDecoder(resp.Body).Decode(&msg)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !equalSeqs(msg.Events, 2) || !msg.More || msg.Events[0].Type != "asset_removed" {
+		t.Fatalf("unexpected response %d %+v", resp.StatusCode, msg)
+	}
+
+	for _, tc := range []struct {
+		user, query string
+		status      int
+	}{
+		{"", "topic=" + topic, http.StatusUnauthorized},
+		{"u-other", "topic=" + topic, http.StatusForbidden},
+		{"u-support", "topic=bogus", http.StatusBadRequest},
+		{"u-support", "topic=" + topic + "&afterSeq=x", http.StatusBadRequest},
+	} {
+		resp := get(tc.user, tc.query)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("user=%q %s: got %d, want %d", tc.user, tc.query, resp.StatusCode, tc.status)
+		}
+	}
+}
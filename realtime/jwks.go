@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultJWKSRefreshInterval is how often the JWKS is re-fetched when
+	// JWKS_REFRESH_INTERVAL is unset.
+	defaultJWKSRefreshInterval = 10 * time.Minute
+
+	// jwksMinRefreshGap throttles refreshes triggered by unknown kids, so a
+	// stream of forged kids can't turn into a stream of fetches.
+	jwksMinRefreshGap = 30 * time.Second
+
+	// jwksMaxBytes bounds the JWKS document.
+	jwksMaxBytes = 1 << 20
+
+	// minRSAKeyBits is the smallest RSA modulus accepted from a JWKS.
+	minRSAKeyBits = 2048
+)
+
+// jwksStats counts refreshes (refreshed, refresh_failed), JWKS entries
+// skipped as unusable (skipped_keys) and tokens naming a kid the JWKS
+// doesn't hold, even after a refresh (unknown_kid).
+var jwksStats = expvar.NewMap("jwks")
+
+// jwk is one usable verification key from a JWKS.
+type jwk struct {
+	kid string
+	alg string // RS256 or ES256
+	key crypto.PublicKey
+}
+
+// jwksCache holds the public keys of a JWKS document fetched from a URL or
+// read from a file. It is refreshed on a timer and, throttled, whenever a
+// token names a kid it doesn't hold, which is how key rotation on the
+// issuer side is picked up between timer refreshes.
+type jwksCache struct {
+	source string
+	load   func() ([]byte, error)
+
+	keys atomic.Pointer[[]jwk]
+
+	mu          sync.Mutex // serializes refreshes
+	lastRefresh time.Time
+}
+
+// newJWKSCache returns a cache for source, a http(s) URL or a file path.
+// It holds no keys until the first refresh.
+func newJWKSCache(source string) *jwksCache {
+	c := &jwksCache{source: source}
+	if isHTTPURL(source) {
+		c.load = func() ([]byte, error) { return fetchJWKS(source) }
+	} else {
+		c.load = func() ([]byte, error) { return os.ReadFile(source) }
+	}
+	c.keys.Store(&[]jwk{})
+	return c
+}
+
+func isHTTPURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	resp, err := authHTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, jwksMaxBytes))
+}
+
+// refresh reloads the JWKS. On failure the current keys stay in use.
+func (c *jwksCache) refresh() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshLocked()
+}
+
+func (c *jwksCache) refreshLocked() error {
+	c.lastRefresh = time.Now()
+	data, err := c.load()
+	if err == nil {
+		var keys []jwk
+		if keys, err = parseJWKS(data); err == nil {
+			c.keys.Store(&keys)
+			jwksStats.Add("refreshed", 1)
+			return nil
+		}
+	}
+	jwksStats.Add("refresh_failed", 1)
+	return err
+}
+
+// refreshForKid refreshes unless kid has appeared since the caller looked,
+// or the last refresh was less than jwksMinRefreshGap ago.
+func (c *jwksCache) refreshForKid(kid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.find(kid, "")) > 0 || time.Since(c.lastRefresh) < jwksMinRefreshGap {
+		return
+	}
+	if err := c.refreshLocked(); err != nil {
+		logf(regionLocal, "[auth] jwks refresh for unknown kid failed: %v", err)
+	}
+}
+
+// Run refreshes the cache every interval. It never returns.
+func (c *jwksCache) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.refresh(); err != nil {
+			logf(regionLocal, "[auth] jwks refresh from %s failed, keeping current keys: %v", c.source, err)
+		}
+	}
+}
+
+// find returns the keys with kid (any kid if empty) usable for alg (any
+// alg if empty).
+func (c *jwksCache) find(kid, alg string) []jwk {
+	var out []jwk
+	for _, k := range *c.keys.Load() {
+		if (kid == "" || k.kid == kid) && (alg == "" || k.alg == alg) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// verify checks a RS256 or ES256 signature over input. A token naming a
+// kid is checked against that key, refreshing the JWKS once if it is
+// unknown; one without a kid against every key for alg.
+func (c *jwksCache) verify(alg, kid string, input, sig []byte) error {
+	if kid != "" && len(c.find(kid, "")) == 0 {
+		c.refreshForKid(kid)
+		if len(c.find(kid, "")) == 0 {
+			jwksStats.Add("unknown_kid", 1)
+			return fmt.Errorf("unknown kid %q", kid)
+		}
+	}
+	candidates := c.find(kid, alg)
+	if len(candidates) == 0 {
+		return fmt.Errorf("no %s key for kid %q", alg, kid)
+	}
+	digest := sha256.Sum256(input)
+	for _, k := range candidates {
+		if verifyJWK(k, digest[:], sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature")
+}
+
+func verifyJWK(k jwk, digest, sig []byte) bool {
+	switch pub := k.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS ES256 signatures are r||s, 32 bytes each, not ASN.1.
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// rawJWK is a JWKS entry as published.
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS extracts the usable verification keys of a JWKS document:
+// RSA keys of at least minRSAKeyBits for RS256 and P-256 keys for ES256.
+// Other entries (encryption keys, other key types and curves) are skipped
+// and counted, so an issuer can publish them without breaking the relay.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var doc struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS JSON: %w", err)
+	}
+	if doc.Keys == nil {
+		return nil, fmt.Errorf("JWKS has no keys array")
+	}
+	keys := make([]jwk, 0, len(doc.Keys))
+	for _, raw := range doc.Keys {
+		var r rawJWK
+		var k jwk
+		err := json.Unmarshal(raw, &r)
+		if err == nil {
+			k, err = r.toJWK()
+		}
+		if err != nil {
+			jwksStats.Add("skipped_keys", 1)
+			logf(regionLocal, "[auth] skipping jwks key kid=%q: %v", r.Kid, err)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (r rawJWK) toJWK() (jwk, error) {
+	if r.Use != "" && r.Use != "sig" {
+		return jwk{}, fmt.Errorf("use %q", r.Use)
+	}
+	switch r.Kty {
+	case "RSA":
+		if r.Alg != "" && r.Alg != algRS256 {
+			return jwk{}, fmt.Errorf("alg %q", r.Alg)
+		}
+		n, err1 := decodeJWTSegment(r.N)
+		e, err2 := decodeJWTSegment(r.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return jwk{}, fmt.Errorf("invalid RSA key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < minRSAKeyBits {
+			return jwk{}, fmt.Errorf("RSA key shorter than %d bits", minRSAKeyBits)
+		}
+		return jwk{kid: r.Kid, alg: algRS256, key: pub}, nil
+	case "EC":
+		if r.Alg != "" && r.Alg != algES256 {
+			return jwk{}, fmt.Errorf("alg %q", r.Alg)
+		}
+		if r.Crv != "P-256" {
+			return jwk{}, fmt.Errorf("curve %q", r.Crv)
+		}
+		x, err1 := decodeJWTSegment(r.X)
+		y, err2 := decodeJWTSegment(r.Y)
+		if err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return jwk{}, fmt.Errorf("invalid EC key")
+		}
+		// SEC 1 uncompressed point; parsing checks it is on the curve.
+		point := append(append([]byte{4}, x...), y...)
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return jwk{}, fmt.Errorf("invalid EC key: %w", err)
+		}
+		return jwk{kid: r.Kid, alg: algES256, key: pub}, nil
+	}
+	return jwk{}, fmt.Errorf("kty %q", r.Kty)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jwksServer serves a JWKS document that tests can swap, counting fetches.
+type jwksServer struct {
+	mu      sync.Mutex
+	doc     []byte
+	fetches int
+}
+
+func (js *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.fetches++
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js.doc)
+}
+
+func (js *jwksServer) set(keys ...map[string]any) {
+	doc, _ := json.Marshal(map[string]any{"keys": keys})
+	js.mu.Lock()
+	js.doc = doc
+	js.mu.Unlock()
+}
+
+func (js *jwksServer) fetchCount() int {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.fetches
+}
+
+func rsaJWK(kid string, pub *rsa.PublicKey) map[string]any {
+	return map[string]any{
+		"kty": "RSA", "kid": kid, "alg": "RS256", "use": "sig",
+		"n": base64URLEncode(pub.N.Bytes()),
+		"e": base64URLEncode(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, pub *ecdsa.PublicKey) map[string]any {
+	point, _ := pub.Bytes()
+	return map[string]any{
+		"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": base64URLEncode(point[1:33]),
+		"y": base64URLEncode(point[33:]),
+	}
+}
+
+// signAsymmetricTestJWT signs claims with an RSA (RS256) or P-256 (ES256)
+// private key.
+func signAsymmetricTestJWT(t *testing.T, key crypto.Signer, kid string, claims any) string {
+	t.Helper()
+	alg := algRS256
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = algES256
+	}
+	header := map[string]any{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	hBytes, _ := json.Marshal(header)
+	pBytes, _ := json.Marshal(claims)
+	input := base64URLEncode(hBytes) + "." + base64URLEncode(pBytes)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return input + "." + base64URLEncode(sig)
+}
+
+type jwksFixture struct {
+	auth   *Auth
+	server *jwksServer
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+}
+
+func newJWKSFixture(t *testing.T) *jwksFixture {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := &jwksServer{}
+	js.set(rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey))
+	srv := httptest.NewServer(js)
+	t.Cleanup(srv.Close)
+
+	a := &Auth{jwtSecret: []byte("hs-secret"), jwks: newJWKSCache(srv.URL)}
+	a.policy.algorithms = knownJWTAlgorithms
+	if err := a.jwks.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	return &jwksFixture{auth: a, server: js, rsa: rsaKey, ec: ecKey}
+}
+
+func TestJWKS_VerifiesRS256AndES256(t *testing.T) {
+	f := newJWKSFixture(t)
+	claims := &Claims{UserID: "user-1", Exp: time.Now().Add(time.Minute).Unix()}
+
+	for name, token := range map[string]string{
+		"RS256":        signAsymmetricTestJWT(t, f.rsa, "rsa-1", claims),
+		"ES256":        signAsymmetricTestJWT(t, f.ec, "ec-1", claims),
+		"ES256 no kid": signAsymmetricTestJWT(t, f.ec, "", claims),
+		"HS256":        signTestJWT(t, f.auth.jwtSecret, claims),
+	} {
+		got, err := f.auth.validateJWT(token)
+		if err != nil || got.UserID != "user-1" {
+			t.Errorf("%s: unexpected %+v %v", name, got, err)
+		}
+	}
+}
+
+func TestJWKS_Rejects(t *testing.T) {
+	f := newJWKSFixture(t)
+	claims := &Claims{UserID: "user-1", Exp: time.Now().Add(time.Minute).Unix()}
+	otherRSA, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	rs := signAsymmetricTestJWT(t, f.rsa, "rsa-1", claims)
+	parts := strings.Split(rs, ".")
+	// Algorithm confusion: HS256 keyed with the RSA public key, naming its kid.
+	pubAsSecret := signRawTestJWT(t, f.rsa.PublicKey.N.Bytes(),
+		map[string]any{"alg": "HS256", "kid": "rsa-1"}, claims)
+	// The ES256 key named in an RS256 header.
+	esAsRS := signAsymmetricTestJWT(t, f.rsa, "ec-1", claims)
+	// A DER signature instead of r||s.
+	digest := sha256.Sum256([]byte("x"))
+	der, _ := ecdsa.SignASN1(rand.Reader, f.ec, digest[:])
+	es := strings.Split(signAsymmetricTestJWT(t, f.ec, "ec-1", claims), ".")
+
+	for name, token := range map[string]string{
+		"wrong key":         signAsymmetricTestJWT(t, otherRSA, "rsa-1", claims),
+		"tampered payload":  parts[0] + "." + base64URLEncode([]byte(`{"userId":"admin"}`)) + "." + parts[2],
+		"hs256 with pubkey": pubAsSecret,
+		"key of other type": esAsRS,
+		"es256 DER sig":     es[0] + "." + es[1] + "." + base64URLEncode(der),
+	} {
+		if _, err := f.auth.validateJWT(token); err == nil {
+			t.Errorf("%s: expected rejection", name)
+		}
+	}
+
+	// Without JWKS, asymmetric tokens are refused whatever the policy says.
+	noJWKS := &Auth{jwtSecret: []byte("hs-secret")}
+	noJWKS.policy.algorithms = knownJWTAlgorithms
+	if _, err := noJWKS.validateJWT(rs); err == nil {
+		t.Error("RS256 without a JWKS should be rejected")
+	}
+	// And the default policy is HS256 only.
+	f.auth.policy.algorithms = nil
+	if _, err := f.auth.validateJWT(rs); err == nil {
+		t.Error("RS256 should need JWT_ALGORITHMS to allow it")
+	}
+}
+
+func TestJWKS_DefaultPolicyKeepsHS256ForTicketsAndServices(t *testing.T) {
+	f := newJWKSFixture(t)
+	f.auth.policy.algorithms = jwksJWTAlgorithms
+	exp := time.Now().Add(time.Minute).Unix()
+
+	user := signTestJWT(t, f.auth.jwtSecret, &Claims{UserID: "user-1", Exp: exp})
+	if _, err := f.auth.validateJWT(user); err == nil {
+		t.Error("HS256 user token should be refused once a JWKS is configured")
+	}
+	if _, err := f.auth.validateJWT(signAsymmetricTestJWT(t, f.rsa, "rsa-1", &Claims{UserID: "user-1", Exp: exp})); err != nil {
+		t.Errorf("RS256 user token: %v", err)
+	}
+
+	service := signTestJWT(t, f.auth.jwtSecret, &Claims{
+		UserID: "svc-render", Kind: claimKindService, Namespaces: []string{"board"}, Exp: exp,
+	})
+	if _, err := f.auth.validateJWT(service); err != nil {
+		t.Errorf("HS256 service token: %v", err)
+	}
+	ticket := signTestJWT(t, f.auth.jwtSecret, testTicketClaims("t-jwks", 30*time.Second))
+	if _, err := f.auth.RedeemTicket(ticket, time.Now()); err != nil {
+		t.Errorf("HS256 connect ticket: %v", err)
+	}
+
+	// Listing HS256 explicitly keeps user tokens working during migration.
+	if err := f.auth.policy.parseAlgorithms("HS256,RS256,ES256"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.auth.validateJWT(user); err != nil {
+		t.Errorf("HS256 user token with JWT_ALGORITHMS listing it: %v", err)
+	}
+}
+
+func TestJWKS_RefreshesOnUnknownKid(t *testing.T) {
+	f := newJWKSFixture(t)
+	claims := &Claims{UserID: "user-1", Exp: time.Now().Add(time.Minute).Unix()}
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f.server.set(rsaJWK("rsa-1", &f.rsa.PublicKey), rsaJWK("rsa-2", &rotated.PublicKey))
+
+	// The issuer rotated; the relay hasn't seen rsa-2 yet. Refreshes are
+	// throttled from the last one, so pretend that was a while ago.
+	f.auth.jwks.lastRefresh = time.Now().Add(-time.Minute)
+	before := f.server.fetchCount()
+	if _, err := f.auth.validateJWT(signAsymmetricTestJWT(t, rotated, "rsa-2", claims)); err != nil {
+		t.Fatalf("unknown kid should trigger a refresh: %v", err)
+	}
+	if got := f.server.fetchCount() - before; got != 1 {
+		t.Fatalf("expected one fetch, got %d", got)
+	}
+
+	// Forged kids right after can't force more fetches.
+	unknownBefore := expvarInt(jwksStats, "unknown_kid")
+	for i := 0; i < 5; i++ {
+		if _, err := f.auth.validateJWT(signAsymmetricTestJWT(t, rotated, "forged", claims)); err == nil {
+			t.Fatal("forged kid should be rejected")
+		}
+	}
+	if got := f.server.fetchCount() - before; got != 1 {
+		t.Fatalf("refreshes should be throttled, got %d fetches", got)
+	}
+	if got := expvarInt(jwksStats, "unknown_kid") - unknownBefore; got != 5 {
+		t.Fatalf("expected 5 unknown_kid, got %d", got)
+	}
+}
+
+func TestJWKS_FailedRefreshKeepsKeys(t *testing.T) {
+	f := newJWKSFixture(t)
+	f.server.mu.Lock()
+	f.server.doc = []byte("<html>maintenance</html>")
+	f.server.mu.Unlock()
+	if err := f.auth.jwks.refresh(); err == nil {
+		t.Fatal("a broken document should fail the refresh")
+	}
+	token := signAsymmetricTestJWT(t, f.ec, "ec-1", &Claims{UserID: "user-1"})
+	if _, err := f.auth.validateJWT(token); err != nil {
+		t.Fatalf("keys from the last good refresh should stay: %v", err)
+	}
+}
+
+func TestParseJWKS_SkipsUnusableKeys(t *testing.T) {
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	good, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encKey := ecJWK("enc", &good.PublicKey)
+	encKey["use"] = "enc"
+	offCurve := ecJWK("off-curve", &good.PublicKey)
+	offCurve["y"] = base64URLEncode(make([]byte, 32))
+	doc, _ := json.Marshal(map[string]any{"keys": []any{
+		ecJWK("good", &good.PublicKey),
+		rsaJWK("small", &small.PublicKey),
+		map[string]any{"kty": "EC", "kid": "p384", "crv": "P-384", "x": "AA", "y": "AA"},
+		encKey,
+		offCurve,
+		map[string]any{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}})
+
+	before := expvarInt(jwksStats, "skipped_keys")
+	keys, err := parseJWKS(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].kid != "good" || keys[0].alg != algES256 {
+		t.Fatalf("expected only the P-256 key, got %+v", keys)
+	}
+	if got := expvarInt(jwksStats, "skipped_keys") - before; got != 5 {
+		t.Fatalf("expected 5 skipped keys, got %d", got)
+	}
+	for _, bad := range []string{"", "[]", `{"keys": null}`, `{"other": []}`} {
+		if _, err := parseJWKS([]byte(bad)); err == nil {
+			t.Errorf("parseJWKS(%q) should fail", bad)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Signing algorithms the relay knows. HS256 tokens are verified with the
+// shared keyset, RS256 and ES256 tokens with JWKS keys only. The header is
+// checked before the signature so "none", RS256-with-the-secret-as-key and
+// friends are refused outright.
+const (
+	algHS256 = "HS256"
+	algRS256 = "RS256"
+	algES256 = "ES256"
+)
+
+var knownJWTAlgorithms = map[string]bool{algHS256: true, algRS256: true, algES256: true}
+
+// jwksJWTAlgorithms is the default once a JWKS is configured: user access
+// tokens must then be asymmetric, and JWT_ALGORITHMS has to list HS256
+// explicitly to keep accepting shared-secret user tokens while migrating.
+var jwksJWTAlgorithms = map[string]bool{algRS256: true, algES256: true}
+
+// defaultJWTClockSkew is the leeway applied to exp, nbf and iat when
+// JWT_CLOCK_SKEW is unset.
+const defaultJWTClockSkew = 30 * time.Second
+
+// jwtHeader is the JOSE header of an incoming token.
+type jwtHeader struct {
+	Alg  string   `json:"alg"`
+	Typ  string   `json:"typ,omitempty"`
+	Kid  string   `json:"kid,omitempty"`
+	Crit []string `json:"crit,omitempty"`
+}
+
+// jwtPolicy is the header and registered-claim policy applied to incoming
+// tokens. The zero value accepts HS256 only, checks exp only when present,
+// with no leeway, and no audience or issuer; main builds the production
+// policy from the environment.
+type jwtPolicy struct {
+	// algorithms accepted on user access tokens; nil means HS256 only.
+	// Connect tickets and service tokens may always use HS256 (see
+	// allowsClaims).
+	algorithms map[string]bool
+
+	requireExp bool
+	requireIat bool
+	requireNbf bool
+	skew       time.Duration
+
+	// audience, if set, must be in the aud of access tokens (user and
+	// service). Connect tickets carry their own audience instead.
+	audience string
+	// issuer, if set, must equal the iss of every token.
+	issuer string
+}
+
+// parseRequiredClaims parses JWT_REQUIRED_CLAIMS, a comma-separated subset
+// of exp, iat and nbf.
+func (p *jwtPolicy) parseRequiredClaims(list string) error {
+	p.requireExp, p.requireIat, p.requireNbf = false, false, false
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "exp":
+			p.requireExp = true
+		case "iat":
+			p.requireIat = true
+		case "nbf":
+			p.requireNbf = true
+		default:
+			return fmt.Errorf("unknown claim %q (want exp, iat or nbf)", name)
+		}
+	}
+	return nil
+}
+
+// parseAlgorithms parses JWT_ALGORITHMS, a comma-separated subset of the
+// known algorithms.
+func (p *jwtPolicy) parseAlgorithms(list string) error {
+	algs := make(map[string]bool)
+	for _, alg := range strings.Split(list, ",") {
+		alg = strings.TrimSpace(alg)
+		if alg == "" {
+			continue
+		}
+		if !knownJWTAlgorithms[alg] {
+			return fmt.Errorf("unknown algorithm %q (want HS256, RS256 or ES256)", alg)
+		}
+		algs[alg] = true
+	}
+	if len(algs) == 0 {
+		return fmt.Errorf("no algorithms")
+	}
+	p.algorithms = algs
+	return nil
+}
+
+// allowsAlg reports whether incoming tokens may use alg.
+func (p *jwtPolicy) allowsAlg(alg string) bool {
+	if p.algorithms == nil {
+		return alg == algHS256
+	}
+	return p.algorithms[alg]
+}
+
+// allowsClaims reports whether a token signed with alg may carry claims.
+// Connect tickets and service tokens are minted server-side with the shared
+// secret, not by the login flow, so they keep HS256 whatever the policy
+// says about user tokens.
+func (p *jwtPolicy) allowsClaims(alg string, claims *Claims) bool {
+	if p.allowsAlg(alg) {
+		return true
+	}
+	return alg == algHS256 && (claims.IsService() || claims.Aud.contains(connectTicketAudience))
+}
+
+// decodeJWTSegment decodes one unpadded base64url segment, rejecting
+// padding and non-canonical encodings.
+func decodeJWTSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.Strict().DecodeString(s)
+}
+
+// parseJWTHeader decodes and checks a token's header segment.
+func parseJWTHeader(segment string) (*jwtHeader, error) {
+	raw, err := decodeJWTSegment(segment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header encoding: %w", err)
+	}
+	var h jwtHeader
+	if err := json.Unmarshal(raw, &h); err != nil {
+		return nil, fmt.Errorf("invalid header JSON: %w", err)
+	}
+	switch {
+	case !knownJWTAlgorithms[h.Alg]:
+		return nil, fmt.Errorf("unsupported alg %q", h.Alg)
+	case h.Typ != "" && !strings.EqualFold(h.Typ, "JWT"):
+		return nil, fmt.Errorf("unsupported typ %q", h.Typ)
+	case len(h.Crit) > 0:
+		return nil, fmt.Errorf("unsupported critical header %q", h.Crit)
+	}
+	return &h, nil
+}
+
+// checkTimes applies the exp, nbf and iat rules of p to claims at now.
+func (p *jwtPolicy) checkTimes(claims *Claims, now time.Time) error {
+	skew := int64(p.skew / time.Second)
+	unix := now.Unix()
+	switch {
+	case claims.Exp == 0 && p.requireExp:
+		return fmt.Errorf("missing exp")
+	case claims.Iat == 0 && p.requireIat:
+		return fmt.Errorf("missing iat")
+	case claims.Nbf == 0 && p.requireNbf:
+		return fmt.Errorf("missing nbf")
+	case claims.Exp < 0 || claims.Iat < 0 || claims.Nbf < 0:
+		return fmt.Errorf("negative time claim")
+	case claims.Exp > 0 && unix > claims.Exp+skew:
+		return fmt.Errorf("token expired")
+	case claims.Nbf > 0 && unix+skew < claims.Nbf:
+		return fmt.Errorf("token not valid yet")
+	case claims.Iat > 0 && unix+skew < claims.Iat:
+		return fmt.Errorf("token issued in the future")
+	case claims.Exp > 0 && claims.Iat > 0 && claims.Exp < claims.Iat:
+		return fmt.Errorf("exp before iat")
+	}
+	return nil
+}
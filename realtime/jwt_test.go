@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPolicySecret = []byte("policy-secret")
+
+// signRawTestJWT signs header and payload as given, for tokens signTestJWT
+// can't express.
+func signRawTestJWT(t *testing.T, secret []byte, header, payload any) string {
+	t.Helper()
+	hBytes, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pBytes, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64URLEncode(hBytes) + "." + base64URLEncode(pBytes)
+	return signingInput + "." + hmacSign(t, secret, signingInput)
+}
+
+func strictTestAuth() *Auth {
+	a := &Auth{jwtSecret: testPolicySecret}
+	a.policy.requireExp = true
+	a.policy.requireIat = true
+	a.policy.skew = 30 * time.Second
+	a.policy.audience = "moodio"
+	a.policy.issuer = "https://app.moodio.test"
+	return a
+}
+
+// validPolicyPayload passes strictTestAuth.
+func validPolicyPayload() map[string]any {
+	now := time.Now().Unix()
+	return map[string]any{
+		"userId": "user-1",
+		"aud":    "moodio",
+		"iss":    "https://app.moodio.test",
+		"iat":    now,
+		"exp":    now + 300,
+	}
+}
+
+func TestValidateJWT_StrictPolicyAccepts(t *testing.T) {
+	a := strictTestAuth()
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	now := time.Now().Unix()
+
+	accepted := map[string]struct {
+		header  any
+		payload func(p map[string]any)
+	}{
+		"plain":              {hs256, func(map[string]any) {}},
+		"no typ":             {map[string]any{"alg": "HS256"}, func(map[string]any) {}},
+		"lowercase typ":      {map[string]any{"alg": "HS256", "typ": "jwt"}, func(map[string]any) {}},
+		"kid and extra hdrs": {map[string]any{"alg": "HS256", "kid": "k1", "x5t": "ignored"}, func(map[string]any) {}},
+		"aud list":           {hs256, func(p map[string]any) { p["aud"] = []string{"other", "moodio"} }},
+		"expired within skew": {hs256, func(p map[string]any) {
+			p["iat"], p["exp"] = now-300, now-10
+		}},
+		"nbf within skew": {hs256, func(p map[string]any) { p["nbf"] = now + 10 }},
+		"iat within skew": {hs256, func(p map[string]any) { p["iat"] = now + 10 }},
+	}
+	for name, c := range accepted {
+		p := validPolicyPayload()
+		c.payload(p)
+		if _, err := a.validateJWT(signRawTestJWT(t, a.jwtSecret, c.header, p)); err != nil {
+			t.Errorf("%s: unexpected rejection: %v", name, err)
+		}
+	}
+}
+
+func TestValidateJWT_StrictPolicyRejects(t *testing.T) {
+	a := strictTestAuth()
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	now := time.Now().Unix()
+
+	rejected := map[string]struct {
+		header  any
+		payload func(p map[string]any)
+	}{
+		"alg none":           {map[string]any{"alg": "none"}, func(map[string]any) {}},
+		"alg lowercase":      {map[string]any{"alg": "hs256"}, func(map[string]any) {}},
+		"alg RS256":          {map[string]any{"alg": "RS256"}, func(map[string]any) {}},
+		"alg HS512":          {map[string]any{"alg": "HS512"}, func(map[string]any) {}},
+		"alg missing":        {map[string]any{"typ": "JWT"}, func(map[string]any) {}},
+		"alg not a string":   {map[string]any{"alg": 256}, func(map[string]any) {}},
+		"typ JWE":            {map[string]any{"alg": "HS256", "typ": "JWE"}, func(map[string]any) {}},
+		"crit":               {map[string]any{"alg": "HS256", "crit": []string{"exp"}}, func(map[string]any) {}},
+		"kid not a string":   {map[string]any{"alg": "HS256", "kid": 7}, func(map[string]any) {}},
+		"header is an array": {[]string{"HS256"}, func(map[string]any) {}},
+		"header is null":     {nil, func(map[string]any) {}},
+		"missing exp":        {hs256, func(p map[string]any) { delete(p, "exp") }},
+		"missing iat":        {hs256, func(p map[string]any) { delete(p, "iat") }},
+		"expired":            {hs256, func(p map[string]any) { p["iat"], p["exp"] = now-600, now-60 }},
+		"not valid yet":      {hs256, func(p map[string]any) { p["nbf"] = now + 60 }},
+		"issued in future":   {hs256, func(p map[string]any) { p["iat"], p["exp"] = now+60, now+600 }},
+		"exp before iat":     {hs256, func(p map[string]any) { p["iat"], p["exp"] = now, now-1 }},
+		"negative exp":       {hs256, func(p map[string]any) { p["exp"] = -1 }},
+		"exp as a string":    {hs256, func(p map[string]any) { p["exp"] = "soon" }},
+		"wrong audience":     {hs256, func(p map[string]any) { p["aud"] = "someone-else" }},
+		"missing audience":   {hs256, func(p map[string]any) { delete(p, "aud") }},
+		"aud not a string":   {hs256, func(p map[string]any) { p["aud"] = 1 }},
+		"internal audience":  {hs256, func(p map[string]any) { p["aud"] = []string{"moodio", realtimeInternalAudience} }},
+		"wrong issuer":       {hs256, func(p map[string]any) { p["iss"] = "https://evil.test" }},
+		"missing issuer":     {hs256, func(p map[string]any) { delete(p, "iss") }},
+		"missing userId":     {hs256, func(p map[string]any) { delete(p, "userId") }},
+	}
+	for name, c := range rejected {
+		p := validPolicyPayload()
+		c.payload(p)
+		if _, err := a.validateJWT(signRawTestJWT(t, a.jwtSecret, c.header, p)); err == nil {
+			t.Errorf("%s: expected rejection", name)
+		}
+	}
+}
+
+func TestValidateJWT_MalformedSegments(t *testing.T) {
+	a := strictTestAuth()
+	valid := signRawTestJWT(t, a.jwtSecret, map[string]any{"alg": "HS256"}, validPolicyPayload())
+	parts := strings.Split(valid, ".")
+	if _, err := a.validateJWT(valid); err != nil {
+		t.Fatalf("baseline token rejected: %v", err)
+	}
+
+	signed := func(header, payload string) string {
+		input := header + "." + payload
+		return input + "." + hmacSign(t, a.jwtSecret, input)
+	}
+	cases := map[string]string{
+		"empty":               "",
+		"dots only":           "..",
+		"empty signature":     parts[0] + "." + parts[1] + ".",
+		"padded signature":    valid + "=",
+		"std base64 sig":      parts[0] + "." + parts[1] + "." + strings.NewReplacer("-", "+", "_", "/").Replace(parts[2]) + "+",
+		"padded header":       signed(parts[0]+"==", parts[1]),
+		"header not JSON":     signed(base64URLEncode([]byte("alg=HS256")), parts[1]),
+		"payload not JSON":    signed(parts[0], base64URLEncode([]byte("userId=user-1"))),
+		"payload is an array": signed(parts[0], base64URLEncode([]byte(`["user-1"]`))),
+		"payload with space":  signed(parts[0], parts[1]+" "),
+		"truncated signature": valid[:len(valid)-4],
+		"four segments":       valid + ".x",
+	}
+	for name, token := range cases {
+		if _, err := a.validateJWT(token); err == nil {
+			t.Errorf("%s: expected rejection", name)
+		}
+	}
+}
+
+func TestJWTPolicy_ZeroValueIsLenient(t *testing.T) {
+	a := &Auth{jwtSecret: testPolicySecret}
+	token := signRawTestJWT(t, a.jwtSecret, map[string]any{"alg": "HS256"}, map[string]any{"userId": "user-1"})
+	if _, err := a.validateJWT(token); err != nil {
+		t.Fatalf("zero policy should not require exp: %v", err)
+	}
+	a.policy.requireExp = true
+	if _, err := a.validateJWT(token); err == nil {
+		t.Fatal("requireExp should reject a token without exp")
+	}
+}
+
+func TestJWTPolicy_ParseRequiredClaims(t *testing.T) {
+	var p jwtPolicy
+	if err := p.parseRequiredClaims(" exp, nbf ,"); err != nil || !p.requireExp || p.requireIat || !p.requireNbf {
+		t.Fatalf("unexpected %+v %v", p, err)
+	}
+	if err := p.parseRequiredClaims(""); err != nil || p.requireExp || p.requireNbf {
+		t.Fatalf("empty list should require nothing, got %+v %v", p, err)
+	}
+	if err := p.parseRequiredClaims("exp,aud"); err == nil {
+		t.Fatal("unknown claims should be rejected")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultJWTKeysReloadInterval is how often JWT_KEYS_FILE is re-read when
+// JWT_KEYS_RELOAD_INTERVAL is unset.
+const defaultJWTKeysReloadInterval = 10 * time.Second
+
+// jwtKeyStats counts keyset reloads (reloaded, reload_failed) and tokens
+// naming a kid the keyset doesn't hold (unknown_kid).
+var jwtKeyStats = expvar.NewMap("jwt_keys")
+
+// jwtKeyset holds the HS256 secrets shared with Next.js. Every key verifies
+// incoming tokens; the signing key also signs MintInternalJWT bearers.
+// Rotation works like FEDERATION_KEYS: add the new key on every relay, move
+// Next.js to it, promote it to signing key, then retire the old one once
+// the last tokens signed with it have expired.
+type jwtKeyset struct {
+	signingKid string
+	keys       map[string][]byte
+}
+
+// singleJWTKeyset wraps JWT_ACCESS_SECRET. Its one key has no kid and
+// verifies tokens whatever kid they name.
+func singleJWTKeyset(secret []byte) *jwtKeyset {
+	return &jwtKeyset{keys: map[string][]byte{"": secret}}
+}
+
+// parseJWTKeys parses a keyset: "<kid>:<secret>" pairs separated by commas
+// or newlines, where blank lines and lines starting with # are ignored.
+// The first pair is the signing key.
+func parseJWTKeys(spec string) (*jwtKeyset, error) {
+	ks := &jwtKeyset{keys: make(map[string][]byte)}
+	for _, line := range strings.Split(spec, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			kid, secret, ok := strings.Cut(part, ":")
+			kid = strings.TrimSpace(kid)
+			if !ok || kid == "" || secret == "" {
+				return nil, fmt.Errorf("jwt key must be <kid>:<secret>")
+			}
+			if _, dup := ks.keys[kid]; dup {
+				return nil, fmt.Errorf("duplicate jwt key id %q", kid)
+			}
+			ks.keys[kid] = []byte(secret)
+			if ks.signingKid == "" {
+				ks.signingKid = kid
+			}
+		}
+	}
+	if ks.signingKid == "" {
+		return nil, fmt.Errorf("no jwt keys configured")
+	}
+	return ks, nil
+}
+
+// signingKey returns the kid and secret that sign outgoing tokens.
+func (ks *jwtKeyset) signingKey() (string, []byte) {
+	return ks.signingKid, ks.keys[ks.signingKid]
+}
+
+// verify checks an HS256 signature over input. A token naming a kid is
+// checked against that key only; one without a kid against every key.
+func (ks *jwtKeyset) verify(kid string, input, sig []byte) error {
+	if kid != "" && ks.signingKid != "" {
+		key, ok := ks.keys[kid]
+		if !ok {
+			jwtKeyStats.Add("unknown_kid", 1)
+			return fmt.Errorf("unknown kid %q", kid)
+		}
+		if !hmac.Equal(sig, hmacSHA256(key, input)) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	for _, key := range ks.keys {
+		if hmac.Equal(sig, hmacSHA256(key, input)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature")
+}
+
+func hmacSHA256(key, input []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(input)
+	return m.Sum(nil)
+}
+
+// LoadKeysFile replaces the keyset with the contents of path, returning
+// them for WatchKeysFile.
+func (a *Auth) LoadKeysFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := parseJWTKeys(string(data))
+	if err != nil {
+		return nil, err
+	}
+	a.keys.Store(ks)
+	return data, nil
+}
+
+// WatchKeysFile re-reads path every interval and swaps the keyset in when
+// the contents differ from loaded. A file that can't be read or parsed is
+// logged once and the current keyset stays in use.
+func (a *Auth) WatchKeysFile(path string, loaded []byte, interval time.Duration) {
+	var rejected []byte // contents of the last file that failed to parse
+	unreadable := false
+	for range time.Tick(interval) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !unreadable {
+				logf(regionLocal, "[auth] keys file unreadable, keeping current keys: %v", err)
+				jwtKeyStats.Add("reload_failed", 1)
+				unreadable = true
+			}
+			continue
+		}
+		unreadable = false
+		if bytes.Equal(data, loaded) || (rejected != nil && bytes.Equal(data, rejected)) {
+			continue
+		}
+		ks, err := parseJWTKeys(string(data))
+		if err != nil {
+			logf(regionLocal, "[auth] keys file invalid, keeping current keys: %v", err)
+			jwtKeyStats.Add("reload_failed", 1)
+			rejected = data
+			continue
+		}
+		a.keys.Store(ks)
+		loaded, rejected = data, nil
+		jwtKeyStats.Add("reloaded", 1)
+		logf(regionLocal, "[auth] reloaded %d jwt keys (signing kid=%s)", len(ks.keys), ks.signingKid)
+	}
+}
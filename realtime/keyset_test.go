@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKeyToken(t *testing.T, secret, kid string) string {
+	t.Helper()
+	header := map[string]any{"alg": "HS256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	return signRawTestJWT(t, []byte(secret), header, map[string]any{"userId": "user-1"})
+}
+
+func TestParseJWTKeys(t *testing.T) {
+	ks, err := parseJWTKeys("# rotated 2026-10\nk2:new-secret\n\nk1:old-secret, k0:older\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.signingKid != "k2" || len(ks.keys) != 3 || string(ks.keys["k0"]) != "older" {
+		t.Fatalf("unexpected keyset %+v", ks)
+	}
+	for _, bad := range []string{"", "# only a comment\n", "k1", ":secret", "k1:", "k1:a,k1:b"} {
+		if _, err := parseJWTKeys(bad); err == nil {
+			t.Errorf("parseJWTKeys(%q) should fail", bad)
+		}
+	}
+}
+
+func TestKeyset_KidSelection(t *testing.T) {
+	a := &Auth{}
+	ks, _ := parseJWTKeys("k2:new-secret,k1:old-secret")
+	a.keys.Store(ks)
+
+	for name, token := range map[string]string{
+		"current kid": testKeyToken(t, "new-secret", "k2"),
+		"old kid":     testKeyToken(t, "old-secret", "k1"),
+		"no kid, old": testKeyToken(t, "old-secret", ""),
+	} {
+		if _, err := a.validateJWT(token); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	before := expvarInt(jwtKeyStats, "unknown_kid")
+	if _, err := a.validateJWT(testKeyToken(t, "new-secret", "k9")); err == nil {
+		t.Error("an unknown kid should be rejected")
+	}
+	if got := expvarInt(jwtKeyStats, "unknown_kid") - before; got != 1 {
+		t.Errorf("unknown_kid should count the rejection, got %d", got)
+	}
+	if _, err := a.validateJWT(testKeyToken(t, "new-secret", "k1")); err == nil {
+		t.Error("a kid must select its own key, not any key")
+	}
+	if _, err := a.validateJWT(testKeyToken(t, "retired-secret", "")); err == nil {
+		t.Error("a token signed with no configured key should be rejected")
+	}
+}
+
+func TestKeyset_SingleSecretIgnoresKid(t *testing.T) {
+	a := &Auth{jwtSecret: []byte("only-secret")}
+	if _, err := a.validateJWT(testKeyToken(t, "only-secret", "whatever")); err != nil {
+		t.Fatalf("JWT_ACCESS_SECRET alone should not care about kid: %v", err)
+	}
+}
+
+func TestMintInternalJWT_UsesSigningKey(t *testing.T) {
+	a := &Auth{}
+	ks, _ := parseJWTKeys("k2:new-secret,k1:old-secret")
+	a.keys.Store(ks)
+
+	token, err := a.MintInternalJWT(&Claims{UserID: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := parseJWTHeader(strings.Split(token, ".")[0])
+	if err != nil || header.Kid != "k2" {
+		t.Fatalf("expected kid k2, got %+v %v", header, err)
+	}
+	if !verifyTestJWTSignature(t, []byte("new-secret"), token) {
+		t.Fatal("internal JWT should be signed with the signing key")
+	}
+}
+
+func TestWatchKeysFile_HotReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt-keys")
+	if err := os.WriteFile(path, []byte("k1:old-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := &Auth{}
+	loaded, err := a.LoadKeysFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.WatchKeysFile(path, loaded, 10*time.Millisecond)
+
+	newToken := testKeyToken(t, "new-secret", "k2")
+	if _, err := a.validateJWT(newToken); err == nil {
+		t.Fatal("k2 is not configured yet")
+	}
+
+	// Rotate in k2 as signing key, keeping k1 for tokens already issued.
+	os.WriteFile(path, []byte("k2:new-secret\nk1:old-secret\n"), 0o600)
+	waitFor(t, func() bool { return a.keyset().signingKid == "k2" })
+	if _, err := a.validateJWT(newToken); err != nil {
+		t.Fatalf("k2 should verify after reload: %v", err)
+	}
+	if _, err := a.validateJWT(testKeyToken(t, "old-secret", "k1")); err != nil {
+		t.Fatalf("k1 should still verify: %v", err)
+	}
+
+	// A broken file leaves the keyset alone.
+	before := expvarInt(jwtKeyStats, "reload_failed")
+	os.WriteFile(path, []byte("k2 new-secret\n"), 0o600)
+	waitFor(t, func() bool { return expvarInt(jwtKeyStats, "reload_failed") > before })
+	if _, err := a.validateJWT(newToken); err != nil {
+		t.Fatalf("an invalid file should not drop the current keys: %v", err)
+	}
+}
+
+// waitFor polls cond for up to two seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// connLimitRejected counts handshakes refused with 429, keyed by the limit
+// that was hit: user, ip or global.
+var connLimitRejected = expvar.NewMap("conn_limit_rejected")
+
+// connLimiter caps concurrent WebSocket and SSE connections per user ID,
+// per client IP and in total (MAX_CONNECTIONS_PER_USER,
+// MAX_CONNECTIONS_PER_IP, MAX_CONNECTIONS). A limit of 0 is off. A nil
+// limiter admits everything.
+//
+// Slots are taken in the handshake, before the upgrade, and given back when
+// the handler returns. Both melody and the SSE handler serve the connection
+// on the handler goroutine, so that is when the session has disconnected.
+// The global and per-IP slots are taken before the request is authenticated
+// (admitPeer), so a refusal doesn't spend a connect ticket; the per-user slot
+// needs the claims and is taken after (admitUser).
+type connLimiter struct {
+	perUser int
+	perIP   int
+	global  int
+
+	// trustedProxies are the peers whose X-Forwarded-For / X-Real-IP headers
+	// are believed (TRUSTED_PROXIES). Empty: the TCP peer is the client.
+	trustedProxies []netip.Prefix
+
+	mu    sync.Mutex
+	users map[string]int
+	ips   map[string]int
+	total int
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{users: make(map[string]int), ips: make(map[string]int)}
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES, a comma-separated list of IPs
+// and CIDR prefixes.
+func parseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out, nil
+}
+
+func (l *connLimiter) trusted(addr netip.Addr) bool {
+	for _, p := range l.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the connection is counted under. Forwarding
+// headers are only read when the TCP peer is a trusted proxy; X-Forwarded-For
+// is walked right to left past trusted hops, since entries further left are
+// whatever the client chose to send. X-Real-IP is the fallback when there is
+// no X-Forwarded-For.
+func (l *connLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	addr = addr.Unmap()
+	if !l.trusted(addr) {
+		return addr.String()
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	if len(hops) == 0 {
+		if real, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return real.Unmap().String()
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break // garbage: count the last hop we could read
+		}
+		addr = hop.Unmap()
+		if !l.trusted(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// acquirePeer takes the global and per-IP slots for a connection from ip.
+// It returns the function giving them back, or the name of the limit that
+// is full.
+func (l *connLimiter) acquirePeer(ip string) (release func(), limit string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.global > 0 && l.total >= l.global:
+		return nil, "global"
+	case l.perIP > 0 && l.ips[ip] >= l.perIP:
+		return nil, "ip"
+	}
+	l.total++
+	l.ips[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.ips[ip]--; l.ips[ip] <= 0 {
+				delete(l.ips, ip)
+			}
+		})
+	}, ""
+}
+
+// acquireUser takes the per-user slot for a connection from userID.
+func (l *connLimiter) acquireUser(userID string) (release func(), limit string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perUser > 0 && l.users[userID] >= l.perUser {
+		return nil, "user"
+	}
+	l.users[userID]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.users[userID]--; l.users[userID] <= 0 {
+				delete(l.users, userID)
+			}
+		})
+	}, ""
+}
+
+// admitPeer takes the global and per-IP slots for a handshake on endpoint,
+// before it is authenticated. It returns the IP the connection is counted
+// under, for admitUser. When a limit is full it answers 429, logs and
+// counts the refusal, and returns false.
+func (l *connLimiter) admitPeer(w http.ResponseWriter, r *http.Request, endpoint string) (ip string, release func(), ok bool) {
+	if l == nil {
+		return "", func() {}, true
+	}
+	ip = l.clientIP(r)
+	release, limit := l.acquirePeer(ip)
+	if limit != "" {
+		l.reject(w, endpoint, limit, "", ip)
+		return "", nil, false
+	}
+	return ip, release, true
+}
+
+// admitUser takes the per-user slot for an authenticated handshake, like
+// admitPeer.
+func (l *connLimiter) admitUser(w http.ResponseWriter, claims *Claims, ip, endpoint string) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	release, limit := l.acquireUser(claims.UserID)
+	if limit != "" {
+		l.reject(w, endpoint, limit, claims.UserID, ip)
+		return nil, false
+	}
+	return release, true
+}
+
+func (l *connLimiter) reject(w http.ResponseWriter, endpoint, limit, userID, ip string) {
+	connLimitRejected.Add(limit, 1)
+	logf(regionLocal, "[limit] rejected %s connection: %s limit reached (user=%s ip=%s)",
+		endpoint, limit, userID, ip)
+	http.Error(w, fmt.Sprintf("too many connections (%s limit)", limit), http.StatusTooManyRequests)
+}
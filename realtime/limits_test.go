@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/olahol/melody"
+)
+
+func TestConnLimiter_Acquire(t *testing.T) {
+	l := newConnLimiter()
+	l.perUser, l.perIP, l.global = 2, 2, 4
+
+	r1, _ := l.acquirePeer("10.0.0.1")
+	l.acquirePeer("10.0.0.1")
+	if _, limit := l.acquirePeer("10.0.0.1"); limit != "ip" {
+		t.Fatalf("third connection from 10.0.0.1: got %q, want ip", limit)
+	}
+	l.acquirePeer("10.0.0.2")
+	l.acquirePeer("10.0.0.3")
+	if _, limit := l.acquirePeer("10.0.0.4"); limit != "global" {
+		t.Fatalf("fifth connection: got %q, want global", limit)
+	}
+
+	r1()
+	r1() // releasing twice gives back one slot only
+	if _, limit := l.acquirePeer("10.0.0.4"); limit != "" {
+		t.Fatalf("freed slot should be reusable, got %q", limit)
+	}
+	if _, limit := l.acquirePeer("10.0.0.5"); limit != "global" {
+		t.Fatalf("double release must not free a second slot, got %q", limit)
+	}
+
+	u1, _ := l.acquireUser("alice")
+	l.acquireUser("alice")
+	if _, limit := l.acquireUser("alice"); limit != "user" {
+		t.Fatalf("third alice connection: got %q, want user", limit)
+	}
+	if _, limit := l.acquireUser("bob"); limit != "" {
+		t.Fatalf("bob has his own slots, got %q", limit)
+	}
+	u1()
+	if _, limit := l.acquireUser("alice"); limit != "" {
+		t.Fatalf("freed user slot should be reusable, got %q", limit)
+	}
+
+	var off *connLimiter
+	rec := httptest.NewRecorder()
+	if _, release, ok := off.admitPeer(rec, httptest.NewRequest(http.MethodGet, "/ws/connection", nil), "ws_connection"); !ok || release == nil {
+		t.Fatal("a nil limiter admits everything")
+	}
+	if release, ok := off.admitUser(rec, &Claims{UserID: "alice"}, "", "ws_connection"); !ok || release == nil {
+		t.Fatal("a nil limiter admits everything")
+	}
+}
+
+func TestConnLimiter_ClientIP(t *testing.T) {
+	l := newConnLimiter()
+	var err error
+	if l.trustedProxies, err = parseTrustedProxies("127.0.0.1, 10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		remote string
+		header map[string]string
+		want   string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer's headers ignored", "203.0.113.7:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"nginx", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed left entry", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"trusted hops skipped", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"x-real-ip fallback", "127.0.0.1:5000", map[string]string{"X-Real-IP": "198.51.100.2"}, "198.51.100.2"},
+		{"garbage hop", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, junk, 10.1.2.3"}, "10.1.2.3"},
+		{"no headers", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"mapped v4", "[::ffff:203.0.113.7]:5000", nil, "203.0.113.7"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/ws/connection", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		if got := l.clientIP(r); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("invalid prefix should fail")
+	}
+}
+
+func TestConnLimits_WSHandshake(t *testing.T) {
+	secret := []byte("limits-test-secret")
+	auth := &Auth{jwtSecret: secret}
+	m := melody.New()
+	rooms := NewRoomManager(m)
+	rooms.Configure(auth, "http://unused")
+	m.HandleConnect(func(s *melody.Session) { rooms.HandleConnect(s) })
+	m.HandleDisconnect(func(s *melody.Session) { rooms.HandleDisconnect(s) })
+	limits := newConnLimiter()
+	limits.perUser = 1
+	srv := httptest.NewServer(wsHandshakeHandler(auth, m, limits))
+	defer srv.Close()
+
+	header := http.Header{}
+	header.Set("Cookie", "moodio_access_token="+signTestJWT(t, secret, &Claims{UserID: "user-1", Exp: time.Now().Add(5 * time.Minute).Unix()}))
+	first, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := expvarInt(connLimitRejected, "user")
+	if code := dialHandshake(t, srv, "", header); code != http.StatusTooManyRequests {
+		t.Fatalf("second connection: got %d, want 429", code)
+	}
+	if got := expvarInt(connLimitRejected, "user") - before; got != 1 {
+		t.Errorf("rejection should be counted, got %d", got)
+	}
+
+	first.Close()
+	waitFor(t, func() bool {
+		limits.mu.Lock()
+		defer limits.mu.Unlock()
+		return limits.total == 0
+	})
+	if code := dialHandshake(t, srv, "", header); code != http.StatusSwitchingProtocols {
+		t.Fatalf("slot should be free after disconnect, got %d", code)
+	}
+}
+
+func TestConnLimits_SSE(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.connLimits = newConnLimiter()
+	rooms.connLimits.perIP = 1
+	sseServer := setupSSEServer(rooms)
+	defer sseServer.Close()
+
+	alice := dialSSE(t, sseServer, "u-alice", "Alice", "editor")
+	defer alice.close()
+
+	req, _ := http.NewRequest(http.MethodGet, sseServer.URL+"/ws/sse", nil)
+	req.AddCookie(&http.Cookie{Name: "moodio_access_token", Value: sseCookie(t, "u-bob", "Bob", "editor")})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second stream from the same IP: got %d, want 429", resp.StatusCode)
+	}
+}
+
+// TestConnLimits_RefusalKeepsTicket — a handshake refused by a connection
+// limit doesn't spend its connect ticket: peer limits are checked before
+// the ticket is redeemed, and a per-user refusal gives it back.
+func TestConnLimits_RefusalKeepsTicket(t *testing.T) {
+	auth := &Auth{jwtSecret: testTicketSecret}
+	m := melody.New()
+	rooms := NewRoomManager(m)
+	rooms.Configure(auth, "http://unused")
+	m.HandleConnect(func(s *melody.Session) { rooms.HandleConnect(s) })
+	m.HandleDisconnect(func(s *melody.Session) { rooms.HandleDisconnect(s) })
+	limits := newConnLimiter()
+	srv := httptest.NewServer(wsHandshakeHandler(auth, m, limits))
+	defer srv.Close()
+
+	hold := func(userID string) *websocket.Conn {
+		header := http.Header{}
+		header.Set("Cookie", "moodio_access_token="+signTestJWT(t, testTicketSecret, &Claims{UserID: userID, Exp: time.Now().Add(5 * time.Minute).Unix()}))
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	drained := func() bool {
+		limits.mu.Lock()
+		defer limits.mu.Unlock()
+		return limits.total == 0 && len(limits.users) == 0
+	}
+
+	for _, tc := range []struct {
+		limit  string
+		set    *int
+		holder string
+	}{
+		{"user", &limits.perUser, "user-1"},
+		{"global", &limits.global, "user-2"},
+	} {
+		limits.mu.Lock()
+		*tc.set = 1
+		limits.mu.Unlock()
+		held := hold(tc.holder)
+		query := "?ticket=" + signTestJWT(t, testTicketSecret, testTicketClaims("t-"+tc.limit, 30*time.Second))
+		if code := dialHandshake(t, srv, query, nil); code != http.StatusTooManyRequests {
+			t.Fatalf("%s limit: got %d, want 429", tc.limit, code)
+		}
+		held.Close()
+		waitFor(t, drained)
+		if code := dialHandshake(t, srv, query, nil); code != http.StatusSwitchingProtocols {
+			t.Fatalf("%s limit: the refused ticket should still work, got %d", tc.limit, code)
+		}
+		waitFor(t, drained)
+		limits.mu.Lock()
+		*tc.set = 0
+		limits.mu.Unlock()
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	// EventLockAcquired / EventLockReleased announce lock changes to the
+	// topic; the payload is a LockInfo.
+	EventLockAcquired = "lock_acquired"
+	EventLockReleased = "lock_released"
+
+	// EventLockRenewed extends a lease on other relays. Never forwarded to
+	// clients.
+	EventLockRenewed = "lock_renewed"
+
+	// Reasons carried by lock_released.
+	LockReleaseUnlock      = "unlock"
+	LockReleaseExpired     = "expired"
+	LockReleaseUnsubscribe = "unsubscribe"
+	LockReleaseDisconnect  = "disconnect"
+	LockReleasePreempted   = "preempted"
+
+	defaultLockTTL = 30 * time.Second
+
+	// MaxLocksPerSession caps the locks one session may hold in one topic.
+	MaxLocksPerSession = 32
+)
+
+// Lock keys name a resource inside the topic, e.g. "asset:abc123" or
+// "cell:row-1:col-2".
+var lockKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+
+// LockInfo describes an advisory lock held on a resource key in a topic.
+type LockInfo struct {
+	Key        string `json:"key"`
+	SessionID  string `json:"sessionId"`
+	UserID     string `json:"userId"`
+	FirstName  string `json:"firstName"`
+	Email      string `json:"email"`
+	AcquiredAt int64  `json:"acquiredAt"`
+	ExpiresAt  int64  `json:"expiresAt"`
+	TTLMs      int64  `json:"ttlMs"`
+
+	// Reason is set on lock_released only.
+	Reason string `json:"reason,omitempty"`
+}
+
+// LockAck answers a successful lock (op "locked") or unlock (op "unlocked").
+type LockAck struct {
+	Op    string   `json:"op"`
+	Topic string   `json:"topic"`
+	Lock  LockInfo `json:"lock"`
+	Ref   string   `json:"ref,omitempty"`
+}
+
+// lockLease is a held lock. session is nil for locks held on other relays;
+// those expire here on their own TTL unless a lock_renewed arrives.
+type lockLease struct {
+	info    LockInfo
+	session sessionConn
+	timer   *time.Timer
+}
+
+// lockWins reports whether a beats b when two relays granted the same key
+// concurrently: earliest acquiredAt, then lowest session ID. Every relay
+// applies the same rule, so they converge on one holder.
+func lockWins(a, b LockInfo) bool {
+	if a.AcquiredAt != b.AcquiredAt {
+		return a.AcquiredAt < b.AcquiredAt
+	}
+	return a.SessionID < b.SessionID
+}
+
+// setLeaseLocked stores lease under topic/key and (re)arms its expiry.
+// Called with lockMu held.
+func (rm *RoomManager) setLeaseLocked(topic string, lease *lockLease) {
+	if rm.locks[topic] == nil {
+		rm.locks[topic] = make(map[string]*lockLease)
+	}
+	rm.locks[topic][lease.info.Key] = lease
+	rm.armLeaseLocked(topic, lease)
+}
+
+func (rm *RoomManager) armLeaseLocked(topic string, lease *lockLease) {
+	if lease.timer != nil {
+		lease.timer.Stop()
+	}
+	ttl := time.Duration(lease.info.TTLMs) * time.Millisecond
+	lease.timer = time.AfterFunc(ttl, func() { rm.expireLock(topic, lease) })
+}
+
+// deleteLeaseLocked drops lease if it is still the holder of its key.
+// Called with lockMu held.
+func (rm *RoomManager) deleteLeaseLocked(topic string, lease *lockLease) bool {
+	if rm.locks[topic][lease.info.Key] != lease {
+		return false
+	}
+	lease.timer.Stop()
+	delete(rm.locks[topic], lease.info.Key)
+	if len(rm.locks[topic]) == 0 {
+		delete(rm.locks, topic)
+	}
+	return true
+}
+
+func (rm *RoomManager) handleLock(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	topic := op.Topic
+	entry, ok := keys.Subs.Get(topic)
+	if !ok {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeNotSubscribed, Ref: op.Ref})
+		return
+	}
+	if entry.Permission == "viewer" {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeForbidden, Message: "viewers cannot lock", Ref: op.Ref})
+		return
+	}
+	if !keys.Claims.mayPublish(OpLock) {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeForbidden, Message: "lock not allowed for this service account", Ref: op.Ref})
+		return
+	}
+	if !lockKeyRegex.MatchString(op.Key) {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeBadRequest, Message: "invalid lock key", Ref: op.Ref})
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	ttl := rm.lockTTL.Milliseconds()
+
+	rm.lockMu.Lock()
+	cur := rm.locks[topic][op.Key]
+	if cur != nil && cur.info.SessionID != keys.SessionID {
+		held := cur.info
+		rm.lockMu.Unlock()
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeLocked,
+			Message: "locked by " + displayName(held.FirstName, held.Email), Lock: &held, Ref: op.Ref})
+		return
+	}
+	if cur != nil {
+		// Re-locking a key this session holds renews the lease.
+		cur.info.ExpiresAt = now + ttl
+		rm.armLeaseLocked(topic, cur)
+		info := cur.info
+		rm.lockMu.Unlock()
+		rm.writeLockAck(s, OpLocked, topic, info, op.Ref)
+		rm.federateLockEvent(topic, EventLockRenewed, info)
+		return
+	}
+	held := 0
+	for _, l := range rm.locks[topic] {
+		if l.info.SessionID == keys.SessionID {
+			held++
+		}
+	}
+	if held >= MaxLocksPerSession {
+		rm.lockMu.Unlock()
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeRateLimited, Message: "too many locks", Ref: op.Ref})
+		return
+	}
+	lease := &lockLease{
+		session: s,
+		info: LockInfo{
+			Key:        op.Key,
+			SessionID:  keys.SessionID,
+			UserID:     keys.Claims.UserID,
+			FirstName:  keys.Claims.FirstName,
+			Email:      keys.Claims.Email,
+			AcquiredAt: now,
+			ExpiresAt:  now + ttl,
+			TTLMs:      ttl,
+		},
+	}
+	rm.setLeaseLocked(topic, lease)
+	rm.lockMu.Unlock()
+
+	rm.writeLockAck(s, OpLocked, topic, lease.info, op.Ref)
+	if evt := buildLockEvent(EventLockAcquired, topic, lease.info); evt != nil {
+		rm.broadcastToTopic(topic, s, evt)
+	}
+
+	logf(regionLocal, "[lock] session=%s topic=%s key=%s acquired",
+		truncateID(keys.SessionID), topicIDForLog(topic), op.Key)
+}
+
+func (rm *RoomManager) handleUnlock(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	topic := op.Topic
+	rm.lockMu.Lock()
+	cur := rm.locks[topic][op.Key]
+	if cur == nil || cur.info.SessionID != keys.SessionID {
+		rm.lockMu.Unlock()
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeNotFound, Message: "lock not held", Ref: op.Ref})
+		return
+	}
+	rm.deleteLeaseLocked(topic, cur)
+	rm.lockMu.Unlock()
+
+	info := cur.info
+	info.Reason = LockReleaseUnlock
+	rm.writeLockAck(s, OpUnlocked, topic, info, op.Ref)
+	if evt := buildLockEvent(EventLockReleased, topic, info); evt != nil {
+		rm.broadcastToTopic(topic, s, evt)
+	}
+
+	logf(regionLocal, "[lock] session=%s topic=%s key=%s released",
+		truncateID(keys.SessionID), topicIDForLog(topic), op.Key)
+}
+
+// expireLock releases a lease whose TTL ran out. Only the holder's relay
+// announces it to federation; others drop their copy silently on their own.
+func (rm *RoomManager) expireLock(topic string, lease *lockLease) {
+	rm.lockMu.Lock()
+	ok := rm.deleteLeaseLocked(topic, lease)
+	rm.lockMu.Unlock()
+	if !ok {
+		return
+	}
+
+	info := lease.info
+	info.Reason = LockReleaseExpired
+	evt := buildLockEvent(EventLockReleased, topic, info)
+	if evt == nil {
+		return
+	}
+	if lease.session != nil {
+		rm.broadcastToTopic(topic, nil, evt)
+		logf(regionLocal, "[lock] session=%s topic=%s key=%s expired",
+			truncateID(info.SessionID), topicIDForLog(topic), info.Key)
+	} else {
+		rm.broadcastToTopicLocal(topic, evt)
+	}
+}
+
+// releaseSessionLocks releases every lock keys holds in topic. Used on
+// unsubscribe and disconnect.
+func (rm *RoomManager) releaseSessionLocks(s sessionConn, keys *SessionKeys, topic, reason string) {
+	var released []LockInfo
+	rm.lockMu.Lock()
+	for _, lease := range rm.locks[topic] {
+		if lease.info.SessionID == keys.SessionID && rm.deleteLeaseLocked(topic, lease) {
+			released = append(released, lease.info)
+		}
+	}
+	rm.lockMu.Unlock()
+
+	for _, info := range released {
+		info.Reason = reason
+		if evt := buildLockEvent(EventLockReleased, topic, info); evt != nil {
+			rm.broadcastToTopic(topic, s, evt)
+		}
+	}
+}
+
+// renewSessionLocks extends every lease keys holds. Called on each pong, so
+// heartbeat clients keep their locks for as long as the connection is alive.
+func (rm *RoomManager) renewSessionLocks(keys *SessionKeys) {
+	now := time.Now().UnixMilli()
+	type renewal struct {
+		topic string
+		info  LockInfo
+	}
+	var renewed []renewal
+	rm.lockMu.Lock()
+	for _, topic := range keys.Subs.Snapshot() {
+		for _, lease := range rm.locks[topic] {
+			if lease.info.SessionID != keys.SessionID {
+				continue
+			}
+			lease.info.ExpiresAt = now + lease.info.TTLMs
+			rm.armLeaseLocked(topic, lease)
+			renewed = append(renewed, renewal{topic, lease.info})
+		}
+	}
+	rm.lockMu.Unlock()
+
+	for _, r := range renewed {
+		rm.federateLockEvent(r.topic, EventLockRenewed, r.info)
+	}
+}
+
+// topicLocks lists the locks held in topic, by key, for subscribed acks.
+func (rm *RoomManager) topicLocks(topic string) []LockInfo {
+	rm.lockMu.Lock()
+	out := make([]LockInfo, 0, len(rm.locks[topic]))
+	for _, lease := range rm.locks[topic] {
+		out = append(out, lease.info)
+	}
+	rm.lockMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// dropTopicLocks forgets every lock in topic without announcing anything.
+// Called when the last local member leaves: no one is left to tell, and
+// federation updates for the topic stop arriving.
+func (rm *RoomManager) dropTopicLocks(topic string) {
+	rm.lockMu.Lock()
+	for _, lease := range rm.locks[topic] {
+		lease.timer.Stop()
+	}
+	delete(rm.locks, topic)
+	rm.lockMu.Unlock()
+}
+
+// publishLocalLocks re-announces locks held by local sessions in topic, in
+// reply to a presence sync request from a relay that just joined it.
+func (rm *RoomManager) publishLocalLocks(topic string) {
+	var held []LockInfo
+	rm.lockMu.Lock()
+	for _, lease := range rm.locks[topic] {
+		if lease.session != nil {
+			held = append(held, lease.info)
+		}
+	}
+	rm.lockMu.Unlock()
+	for _, info := range held {
+		rm.federateLockEvent(topic, EventLockAcquired, info)
+	}
+}
+
+// handleRemoteLockEvent applies a lock event from another region and
+// forwards acquisitions and releases to local members.
+func (rm *RoomManager) handleRemoteLockEvent(topic, sourceRegion, eventType string, payload json.RawMessage, msg []byte) {
+	var info LockInfo
+	if err := json.Unmarshal(payload, &info); err != nil || info.Key == "" || info.TTLMs <= 0 {
+		logf(sourceRegion, "[federation] bad %s for topic=%s", eventType, topicIDForLog(topic))
+		return
+	}
+
+	rm.lockMu.Lock()
+	cur := rm.locks[topic][info.Key]
+	switch eventType {
+	case EventLockRenewed:
+		if cur != nil && cur.info.SessionID == info.SessionID {
+			cur.info.ExpiresAt = info.ExpiresAt
+			cur.info.TTLMs = info.TTLMs
+			rm.armLeaseLocked(topic, cur)
+		}
+		rm.lockMu.Unlock()
+		return
+
+	case EventLockReleased:
+		if cur == nil || cur.info.SessionID != info.SessionID || !rm.deleteLeaseLocked(topic, cur) {
+			rm.lockMu.Unlock()
+			return
+		}
+		rm.lockMu.Unlock()
+		rm.broadcastToTopicLocal(topic, msg)
+		return
+	}
+
+	// lock_acquired.
+	if cur != nil && cur.info.SessionID == info.SessionID {
+		rm.armLeaseLocked(topic, cur)
+		rm.lockMu.Unlock()
+		return
+	}
+	if cur != nil && lockWins(cur.info, info) {
+		rm.lockMu.Unlock()
+		return
+	}
+	if cur != nil {
+		rm.deleteLeaseLocked(topic, cur)
+	}
+	rm.setLeaseLocked(topic, &lockLease{info: info})
+	rm.lockMu.Unlock()
+
+	if cur != nil {
+		lost := cur.info
+		lost.Reason = LockReleasePreempted
+		if evt := buildLockEvent(EventLockReleased, topic, lost); evt != nil {
+			rm.broadcastToTopicLocal(topic, evt)
+		}
+		logf(sourceRegion, "[lock] session=%s topic=%s key=%s preempted by session=%s",
+			truncateID(lost.SessionID), topicIDForLog(topic), lost.Key, truncateID(info.SessionID))
+	}
+	rm.broadcastToTopicLocal(topic, msg)
+}
+
+// federateLockEvent publishes a lock event to other regions only.
+func (rm *RoomManager) federateLockEvent(topic, eventType string, info LockInfo) {
+	if rm.federator == nil {
+		return
+	}
+	evt := buildLockEvent(eventType, topic, info)
+	if evt == nil {
+		return
+	}
+	if err := rm.federator.Publish(topic, evt); err != nil {
+		logf(regionLocal, "[federation] publish error for topic=%s: %v", topicIDForLog(topic), err)
+	}
+}
+
+func (rm *RoomManager) writeLockAck(s sessionConn, ackOp, topic string, info LockInfo, ref string) {
+	data, err := json.Marshal(LockAck{Op: ackOp, Topic: topic, Lock: info, Ref: ref})
+	if err != nil {
+		return
+	}
+	_ = writeFrame(s, data)
+}
+
+func buildLockEvent(eventType, topic string, info LockInfo) []byte {
+	evt := TopicEvent{
+		Op:        OpEvent,
+		Topic:     topic,
+		Type:      eventType,
+		SessionID: info.SessionID,
+		UserID:    info.UserID,
+		FirstName: info.FirstName,
+		Email:     info.Email,
+		Timestamp: time.Now().UnixMilli(),
+		Payload:   info,
+	}
+	data, err := json.Marshal(evt)
+	if err != nil {
+		logf(regionLocal, "error marshalling %s event: %v", eventType, err)
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func (tc *testClient) lock(t *testing.T, op, topic, key, ref string) {
+	t.Helper()
+	tc.sendRaw(t, map[string]any{"op": op, "topic": topic, "key": key, "ref": ref})
+}
+
+func lockEvents(tc *testClient, eventType, topic string) []LockInfo {
+	var out []LockInfo
+	for _, raw := range tc.findEventsOfType(eventType, topic) {
+		var evt struct {
+			Payload LockInfo `json:"payload"`
+		}
+		_ = json.Unmarshal(raw, &evt)
+		out = append(out, evt.Payload)
+	}
+	return out
+}
+
+func TestLock_ConflictAndRelease(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "production-table:locks"
+	key := "cell:row-1:col-2"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+
+	alice.lock(t, OpLock, topic, key, "l1")
+	var ack LockAck
+	_ = json.Unmarshal(alice.waitForOp(t, OpLocked, "l1"), &ack)
+	if ack.Lock.Key != key || ack.Lock.SessionID != alice.sessionID || ack.Lock.ExpiresAt <= ack.Lock.AcquiredAt {
+		t.Fatalf("unexpected lock ack: %+v", ack)
+	}
+
+	bob.lock(t, OpLock, topic, key, "l2")
+	var conflict ErrorMsg
+	_ = json.Unmarshal(bob.waitForOp(t, OpError, "l2"), &conflict)
+	if conflict.Code != ErrCodeLocked || conflict.Lock == nil || conflict.Lock.SessionID != alice.sessionID {
+		t.Fatalf("expected locked error naming alice, got %+v", conflict)
+	}
+	if got := lockEvents(bob, EventLockAcquired, topic); len(got) != 1 || got[0].Key != key {
+		t.Fatalf("bob should see lock_acquired, got %+v", got)
+	}
+
+	bob.lock(t, OpUnlock, topic, key, "u1")
+	if code := errorCode(bob.waitForOp(t, OpError, "u1")); code != ErrCodeNotFound {
+		t.Fatalf("unlocking someone else's lock should be not_found, got %q", code)
+	}
+
+	alice.lock(t, OpUnlock, topic, key, "u2")
+	alice.waitForOp(t, OpUnlocked, "u2")
+	waitFor(t, func() bool { return len(lockEvents(bob, EventLockReleased, topic)) > 0 })
+	if got := lockEvents(bob, EventLockReleased, topic); len(got) != 1 || got[0].Reason != LockReleaseUnlock {
+		t.Fatalf("bob should see lock_released reason=unlock, got %+v", got)
+	}
+
+	bob.lock(t, OpLock, topic, key, "l3")
+	bob.waitForOp(t, OpLocked, "l3")
+}
+
+func TestLock_Validation(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:lock-checks"
+
+	viewer := connectAndSubscribe(t, server, topic, "u-view", "View", "viewer")
+	defer viewer.close()
+	viewer.lock(t, OpLock, topic, "asset:a1", "v1")
+	if code := errorCode(viewer.waitForOp(t, OpError, "v1")); code != ErrCodeForbidden {
+		t.Errorf("viewer lock should be forbidden, got %q", code)
+	}
+
+	editor := connectAndSubscribe(t, server, topic, "u-ed", "Ed", "editor")
+	defer editor.close()
+	editor.lock(t, OpLock, topic, "", "e1")
+	if code := errorCode(editor.waitForOp(t, OpError, "e1")); code != ErrCodeBadRequest {
+		t.Errorf("empty key should be bad_request, got %q", code)
+	}
+	editor.lock(t, OpLock, topic, "asset a1", "e2")
+	if code := errorCode(editor.waitForOp(t, OpError, "e2")); code != ErrCodeBadRequest {
+		t.Errorf("key with spaces should be bad_request, got %q", code)
+	}
+	editor.lock(t, OpLock, "desktop:other", "asset:a1", "e3")
+	if code := errorCode(editor.waitForOp(t, OpError, "e3")); code != ErrCodeNotSubscribed {
+		t.Errorf("lock outside subscribed topics should be not_subscribed, got %q", code)
+	}
+}
+
+func TestLock_InSubscribedAck(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:lock-ack"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	alice.lock(t, OpLock, topic, "asset:b", "l1")
+	alice.lock(t, OpLock, topic, "asset:a", "l2")
+	alice.waitForOp(t, OpLocked, "l2")
+
+	bob := dialRaw(t, server, "u-bob", "Bob", "editor")
+	defer bob.close()
+	bob.subscribe(t, topic)
+	var ack SubscribedAck
+	_ = json.Unmarshal(bob.waitForOp(t, OpSubscribed, ""), &ack)
+	if len(ack.Locks) != 2 || ack.Locks[0].Key != "asset:a" || ack.Locks[1].Key != "asset:b" {
+		t.Fatalf("ack should list both locks by key, got %+v", ack.Locks)
+	}
+}
+
+func TestLock_ReleasedOnUnsubscribeAndDisconnect(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:lock-leave"
+
+	observer := connectAndSubscribe(t, server, topic, "u-obs", "Obs", "editor")
+	defer observer.close()
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+
+	alice.lock(t, OpLock, topic, "asset:1", "a1")
+	alice.waitForOp(t, OpLocked, "a1")
+	bob.lock(t, OpLock, topic, "asset:2", "b1")
+	bob.waitForOp(t, OpLocked, "b1")
+
+	alice.close()
+	bob.unsubscribe(t, topic)
+	waitFor(t, func() bool { return len(lockEvents(observer, EventLockReleased, topic)) >= 2 })
+
+	reasons := map[string]string{}
+	for _, info := range lockEvents(observer, EventLockReleased, topic) {
+		reasons[info.Key] = info.Reason
+	}
+	if reasons["asset:1"] != LockReleaseDisconnect || reasons["asset:2"] != LockReleaseUnsubscribe {
+		t.Fatalf("unexpected release reasons: %v", reasons)
+	}
+}
+
+func TestLock_ExpiresUnlessRenewed(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.lockTTL = 200 * time.Millisecond
+	topic := "desktop:lock-ttl"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+
+	alice.lock(t, OpLock, topic, "asset:1", "l1")
+	alice.waitForOp(t, OpLocked, "l1")
+	time.Sleep(120 * time.Millisecond)
+	alice.lock(t, OpLock, topic, "asset:1", "l2") // renew
+	alice.waitForOp(t, OpLocked, "l2")
+	time.Sleep(120 * time.Millisecond)
+
+	bob.lock(t, OpLock, topic, "asset:1", "b1")
+	if code := errorCode(bob.waitForOp(t, OpError, "b1")); code != ErrCodeLocked {
+		t.Fatalf("renewed lock should still be held, got %q", code)
+	}
+
+	waitFor(t, func() bool { return len(lockEvents(bob, EventLockReleased, topic)) > 0 })
+	if got := lockEvents(bob, EventLockReleased, topic); len(got) != 1 || got[0].Reason != LockReleaseExpired {
+		t.Fatalf("bob should see the lease expire, got %+v", got)
+	}
+	bob.lock(t, OpLock, topic, "asset:1", "b2")
+	bob.waitForOp(t, OpLocked, "b2")
+}
+
+func TestLock_RenewedByHeartbeat(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.heartbeatInterval = 50 * time.Millisecond
+	rooms.lockTTL = 200 * time.Millisecond
+	stop := make(chan struct{})
+	defer close(stop)
+	go rooms.RunHeartbeat(stop)
+	topic := "desktop:lock-heartbeat"
+
+	alice := dialHello(t, server, "u-alice", "Alice", CapabilityHeartbeat)
+	defer alice.close()
+	alice.subscribe(t, topic)
+	alice.lock(t, OpLock, topic, "asset:1", "l1")
+	alice.waitForOp(t, OpLocked, "l1")
+
+	for i := 0; i < 8; i++ {
+		alice.clearMessages()
+		alice.answerPing(t, 0)
+	}
+
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	bob.lock(t, OpLock, topic, "asset:1", "b1")
+	if code := errorCode(bob.waitForOp(t, OpError, "b1")); code != ErrCodeLocked {
+		t.Fatalf("heartbeats should keep the lease alive, got %q", code)
+	}
+}
+
+func TestLock_Federated(t *testing.T) {
+	roomsUS, roomsHK, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	topic := "production-table:lock-fed"
+	key := "cell:r1:c1"
+
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	waitFor(t, func() bool {
+		_, us := remoteSessionIDs(roomsUS, topic)[bob.sessionID]
+		_, hk := remoteSessionIDs(roomsHK, topic)[alice.sessionID]
+		return us && hk
+	})
+
+	alice.lock(t, OpLock, topic, key, "a1")
+	alice.waitForOp(t, OpLocked, "a1")
+	waitFor(t, func() bool { return len(lockEvents(bob, EventLockAcquired, topic)) > 0 })
+
+	if got := lockEvents(bob, EventLockAcquired, topic); len(got) != 1 || got[0].SessionID != alice.sessionID {
+		t.Fatalf("bob should see alice's lock across regions, got %+v", got)
+	}
+	bob.lock(t, OpLock, topic, key, "b1")
+	if code := errorCode(bob.waitForOp(t, OpError, "b1")); code != ErrCodeLocked {
+		t.Fatalf("remote lock should conflict, got %q", code)
+	}
+
+	alice.lock(t, OpUnlock, topic, key, "a2")
+	alice.waitForOp(t, OpUnlocked, "a2")
+	waitFor(t, func() bool { return len(roomsHK.topicLocks(topic)) == 0 })
+	bob.lock(t, OpLock, topic, key, "b2")
+	bob.waitForOp(t, OpLocked, "b2")
+}
+
+func TestLock_FederatedLateJoinerLearnsLocks(t *testing.T) {
+	_, roomsHK, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	topic := "desktop:lock-late"
+
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	alice.lock(t, OpLock, topic, "asset:1", "a1")
+	alice.waitForOp(t, OpLocked, "a1")
+
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	waitFor(t, func() bool { return len(roomsHK.topicLocks(topic)) == 1 })
+
+	bob.lock(t, OpLock, topic, "asset:1", "b1")
+	if code := errorCode(bob.waitForOp(t, OpError, "b1")); code != ErrCodeLocked {
+		t.Fatalf("a relay joining late should learn existing locks, got %q", code)
+	}
+}
+
+// TestLock_ConcurrentGrantTieBreak — when two regions grant the same key at
+// once, the earlier acquisition wins everywhere and the loser is told.
+func TestLock_ConcurrentGrantTieBreak(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:lock-race"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	alice.lock(t, OpLock, topic, "asset:1", "a1")
+	var ack LockAck
+	_ = json.Unmarshal(alice.waitForOp(t, OpLocked, "a1"), &ack)
+
+	remote := func(at int64, sessionID string) []byte {
+		info := LockInfo{Key: "asset:1", SessionID: sessionID, UserID: "u-remote", AcquiredAt: at, ExpiresAt: at + 30000, TTLMs: 30000}
+		return buildLockEvent(EventLockAcquired, topic, info)
+	}
+
+	// Later grant elsewhere: ours stands.
+	rooms.handleFederatedMessage(topic, "ap-northeast-1", remote(ack.Lock.AcquiredAt+5, "session_late"))
+	if locks := rooms.topicLocks(topic); len(locks) != 1 || locks[0].SessionID != alice.sessionID {
+		t.Fatalf("earlier local lock should win, got %+v", locks)
+	}
+
+	// Earlier grant elsewhere: ours is preempted.
+	rooms.handleFederatedMessage(topic, "ap-northeast-1", remote(ack.Lock.AcquiredAt-5, "session_early"))
+	if locks := rooms.topicLocks(topic); len(locks) != 1 || locks[0].SessionID != "session_early" {
+		t.Fatalf("earlier remote lock should win, got %+v", locks)
+	}
+	waitFor(t, func() bool { return len(lockEvents(alice, EventLockReleased, topic)) > 0 })
+	if got := lockEvents(alice, EventLockReleased, topic); len(got) != 1 || got[0].Reason != LockReleasePreempted {
+		t.Fatalf("alice should be told her lock was preempted, got %+v", got)
+	}
+}
+
+func TestLockWins(t *testing.T) {
+	a := LockInfo{SessionID: "session_a", AcquiredAt: 100}
+	b := LockInfo{SessionID: "session_b", AcquiredAt: 100}
+	c := LockInfo{SessionID: "session_0", AcquiredAt: 101}
+	if !lockWins(a, b) || lockWins(b, a) {
+		t.Error("equal timestamps should tie-break on session ID")
+	}
+	if !lockWins(a, c) || lockWins(c, a) {
+		t.Error("earlier acquisition should win")
+	}
+}
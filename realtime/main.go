@@ -5,7 +5,11 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/olahol/melody"
 )
@@ -17,8 +21,9 @@ func main() {
 	}
 
 	jwtSecret := os.Getenv("JWT_ACCESS_SECRET")
-	if jwtSecret == "" {
-		fatalf(regionLocal, "JWT_ACCESS_SECRET environment variable is required")
+	keysFile := os.Getenv("JWT_KEYS_FILE")
+	if jwtSecret == "" && keysFile == "" {
+		fatalf(regionLocal, "JWT_ACCESS_SECRET or JWT_KEYS_FILE environment variable is required")
 	}
 
 	apiBase := os.Getenv("PERMISSION_API_BASE")
@@ -30,9 +35,218 @@ func main() {
 	m.Config.MaxMessageSize = 65536
 
 	auth := &Auth{jwtSecret: []byte(jwtSecret)}
+	if keysFile != "" {
+		loaded, err := auth.LoadKeysFile(keysFile)
+		if err != nil {
+			fatalf(regionLocal, "invalid JWT_KEYS_FILE: %v", err)
+		}
+		interval := defaultJWTKeysReloadInterval
+		if v := os.Getenv("JWT_KEYS_RELOAD_INTERVAL"); v != "" {
+			interval, err = time.ParseDuration(v)
+			if err != nil || interval <= 0 {
+				fatalf(regionLocal, "invalid JWT_KEYS_RELOAD_INTERVAL %q", v)
+			}
+		}
+		go auth.WatchKeysFile(keysFile, loaded, interval)
+		logf(regionLocal, "[auth] loaded %d jwt keys from %s (signing kid=%s, reload every %s)",
+			len(auth.keyset().keys), keysFile, auth.keyset().signingKid, interval)
+	}
+	auth.policy.requireExp = true
+	auth.policy.skew = defaultJWTClockSkew
+	if v, ok := os.LookupEnv("JWT_REQUIRED_CLAIMS"); ok {
+		if err := auth.policy.parseRequiredClaims(v); err != nil {
+			fatalf(regionLocal, "invalid JWT_REQUIRED_CLAIMS: %v", err)
+		}
+	}
+	if v := os.Getenv("JWT_CLOCK_SKEW"); v != "" {
+		skew, err := time.ParseDuration(v)
+		if err != nil || skew < 0 {
+			fatalf(regionLocal, "invalid JWT_CLOCK_SKEW %q", v)
+		}
+		auth.policy.skew = skew
+	}
+	jwksSource := os.Getenv("JWKS_URL")
+	if v := os.Getenv("JWKS_FILE"); v != "" {
+		if jwksSource != "" {
+			fatalf(regionLocal, "set at most one of JWKS_URL and JWKS_FILE")
+		}
+		jwksSource = v
+	}
+	if jwksSource != "" {
+		auth.jwks = newJWKSCache(jwksSource)
+		if err := auth.jwks.refresh(); err != nil {
+			if os.Getenv("JWKS_FILE") != "" {
+				fatalf(regionLocal, "invalid JWKS_FILE: %v", err)
+			}
+			// Next.js may be deploying; unknown kids and the timer retry.
+			logf(regionLocal, "[auth] jwks fetch from %s failed, starting without keys: %v", jwksSource, err)
+		}
+		interval := defaultJWKSRefreshInterval
+		if v := os.Getenv("JWKS_REFRESH_INTERVAL"); v != "" {
+			var err error
+			interval, err = time.ParseDuration(v)
+			if err != nil || interval <= 0 {
+				fatalf(regionLocal, "invalid JWKS_REFRESH_INTERVAL %q", v)
+			}
+		}
+		go auth.jwks.Run(interval)
+		auth.policy.algorithms = jwksJWTAlgorithms
+		logf(regionLocal, "[auth] verifying RS256/ES256 tokens with %d jwks keys from %s (refresh every %s)",
+			len(auth.jwks.find("", "")), jwksSource, interval)
+	}
+	if v := os.Getenv("JWT_ALGORITHMS"); v != "" {
+		if err := auth.policy.parseAlgorithms(v); err != nil {
+			fatalf(regionLocal, "invalid JWT_ALGORITHMS: %v", err)
+		}
+		if auth.jwks == nil && (auth.policy.allowsAlg(algRS256) || auth.policy.allowsAlg(algES256)) {
+			fatalf(regionLocal, "JWT_ALGORITHMS lists RS256/ES256 but neither JWKS_URL nor JWKS_FILE is set")
+		}
+	}
+	if v := os.Getenv("ALLOWED_ORIGINS"); v != "" {
+		origins, err := parseOriginAllowList(v)
+		if err != nil {
+			fatalf(regionLocal, "invalid ALLOWED_ORIGINS: %v", err)
+		}
+		auth.origins = origins
+	} else {
+		logf(regionLocal, "[origin] ALLOWED_ORIGINS not set; cookie handshakes are accepted from any origin")
+	}
+	auth.policy.audience = os.Getenv("JWT_AUDIENCE")
+	auth.policy.issuer = os.Getenv("JWT_ISSUER")
 	rooms := NewRoomManager(m)
 	rooms.Configure(auth, apiBase)
 
+	if v := os.Getenv("HEARTBEAT_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval < 0 {
+			fatalf(regionLocal, "invalid HEARTBEAT_INTERVAL %q", v)
+		}
+		rooms.heartbeatInterval = interval
+	}
+	if v := os.Getenv("PRESENCE_GRACE_PERIOD"); v != "" {
+		grace, err := time.ParseDuration(v)
+		if err != nil || grace < 0 {
+			fatalf(regionLocal, "invalid PRESENCE_GRACE_PERIOD %q", v)
+		}
+		rooms.leaveGrace = grace
+	}
+	if v := os.Getenv("IDLE_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			fatalf(regionLocal, "invalid IDLE_TIMEOUT %q", v)
+		}
+		rooms.idleTimeout = timeout
+	}
+	if v, ok := os.LookupEnv("SNAPSHOT_EVENT_TYPES"); ok {
+		rooms.snapshotTypes = parseSnapshotEventTypes(v)
+	}
+	if v := os.Getenv("LOCK_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			fatalf(regionLocal, "invalid LOCK_TTL %q", v)
+		}
+		rooms.lockTTL = ttl
+	}
+	for name, limit := range map[string]*int{
+		"YDOC_MAX_UPDATES": &rooms.ydocMaxUpdates,
+		"YDOC_MAX_BYTES":   &rooms.ydocMaxBytes,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				fatalf(regionLocal, "invalid %s %q", name, v)
+			}
+			*limit = n
+		}
+	}
+	if v := os.Getenv("AUTHORIZE_BATCH_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window < 0 {
+			fatalf(regionLocal, "invalid AUTHORIZE_BATCH_WINDOW %q", v)
+		}
+		if window > 0 {
+			rooms.authzBatcher = newAuthzBatcher(window, auth, apiBase)
+			logf(regionLocal, "[authz] coalescing authorize calls per user over %s", window)
+		}
+	}
+	limits := newConnLimiter()
+	for name, limit := range map[string]*int{
+		"MAX_CONNECTIONS_PER_USER": &limits.perUser,
+		"MAX_CONNECTIONS_PER_IP":   &limits.perIP,
+		"MAX_CONNECTIONS":          &limits.global,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				fatalf(regionLocal, "invalid %s %q", name, v)
+			}
+			*limit = n
+		}
+	}
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		proxies, err := parseTrustedProxies(v)
+		if err != nil {
+			fatalf(regionLocal, "invalid TRUSTED_PROXIES: %v", err)
+		}
+		limits.trustedProxies = proxies
+	}
+	if limits.perUser > 0 || limits.perIP > 0 || limits.global > 0 {
+		rooms.connLimits = limits
+		logf(regionLocal, "[limit] connection limits: per user=%d, per ip=%d, global=%d (0 = off), %d trusted proxies",
+			limits.perUser, limits.perIP, limits.global, len(limits.trustedProxies))
+	}
+	if rooms.heartbeatInterval > 0 && rooms.lockTTL <= rooms.heartbeatInterval {
+		logf(regionLocal, "[lock] LOCK_TTL %s is not longer than HEARTBEAT_INTERVAL %s; heartbeat clients will lose locks between pings",
+			rooms.lockTTL, rooms.heartbeatInterval)
+	}
+
+	// Durable state-event log: off unless EVENT_SINK is set.
+	if kind := os.Getenv("EVENT_SINK"); kind != "" {
+		opts := SinkOptions{Path: os.Getenv("EVENT_SINK_PATH")}
+		if v := os.Getenv("EVENT_SINK_ROTATE_BYTES"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				fatalf(regionLocal, "invalid EVENT_SINK_ROTATE_BYTES %q", v)
+			}
+			opts.RotateBytes = n
+		}
+		if v := os.Getenv("EVENT_SINK_KEEP_FILES"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				fatalf(regionLocal, "invalid EVENT_SINK_KEEP_FILES %q", v)
+			}
+			opts.KeepFiles = n
+		}
+		sink, err := openEventSink(kind, opts)
+		if err != nil {
+			fatalf(regionLocal, "invalid EVENT_SINK: %v", err)
+		}
+		events, err := newEventLog(sink, defaultEventQueueSize)
+		if err != nil {
+			fatalf(regionLocal, "[sink] %s: %v", kind, err)
+		}
+		rooms.events = events
+		logf(regionLocal, "[sink] writing state events to %s (path=%q, from seq=%d)", kind, opts.Path, events.seq+1)
+	}
+
+	// Outbound webhooks: off unless WEBHOOK_URL is set.
+	if url := os.Getenv("WEBHOOK_URL"); url != "" {
+		secret := os.Getenv("WEBHOOK_SECRET")
+		if secret == "" {
+			fatalf(regionLocal, "WEBHOOK_SECRET is required when WEBHOOK_URL is set")
+		}
+		list, ok := os.LookupEnv("WEBHOOK_EVENTS")
+		if !ok {
+			list = defaultWebhookEvents
+		}
+		events, err := parseWebhookEvents(list)
+		if err != nil {
+			fatalf(regionLocal, "invalid WEBHOOK_EVENTS: %v", err)
+		}
+		rooms.webhooks = newWebhookNotifier(url, []byte(secret), events, defaultWebhookQueueSize)
+		logf(regionLocal, "[webhook] posting %s to %s", list, url)
+	}
+
 	// Federation: auto-enable if NATS_URL is configured.
 	if natsURL := os.Getenv("NATS_URL"); natsURL != "" {
 		regionId := os.Getenv("REGION_ID")
@@ -44,17 +258,60 @@ func main() {
 			logf(regionLocal, "[federation] auto-detected region: %s", regionId)
 		}
 
-		fed, err := NewNATSFederator(natsURL, regionId)
+		var fedOpts FederationOptions
+		if v := os.Getenv("FEDERATION_BATCH_WINDOW"); v != "" {
+			window, err := time.ParseDuration(v)
+			if err != nil || window < 0 {
+				fatalf(regionLocal, "invalid FEDERATION_BATCH_WINDOW %q", v)
+			}
+			fedOpts.BatchWindow = window
+		}
+		codec, err := parseFederationCodec(os.Getenv("FEDERATION_COMPRESSION"))
+		if err != nil {
+			fatalf(regionLocal, "%v", err)
+		}
+		fedOpts.Compression = codec
+		if spec := os.Getenv("FEDERATION_KEYS"); spec != "" {
+			keys, err := parseFederationKeys(spec)
+			if err != nil {
+				fatalf(regionLocal, "invalid FEDERATION_KEYS: %v", err)
+			}
+			fedOpts.Keys = keys
+			fedOpts.AllowUnsigned = os.Getenv("FEDERATION_ALLOW_UNSIGNED") == "true"
+		} else {
+			logf(regionLocal, "[federation] FEDERATION_KEYS not set; federated messages are not authenticated")
+		}
+
+		fed, err := NewNATSFederator(natsURL, regionId, fedOpts)
 		if err != nil {
 			logf(regionLocal, "[federation] NATS unavailable at %s, running without federation: %v", natsURL, err)
 		} else {
 			rooms.federator = fed
 			rooms.regionId = regionId
-			defer fed.Close()
-			logf(regionLocal, "[federation] enabled (region=%s, nats=%s)", regionId, natsURL)
+			fed.OnReconnect(rooms.ResyncPresence)
+			logf(regionLocal, "[federation] enabled (region=%s, nats=%s, batch=%s, compression=%s, signed=%t)",
+				regionId, natsURL, fedOpts.BatchWindow, fedOpts.Compression, fedOpts.Keys != nil)
 		}
 	}
 
+	// The server has no graceful shutdown; before the process is stopped,
+	// send pending federation batches, then flush queued state events.
+	// This is the only place either is closed: os.Exit skips deferred calls.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		if rooms.federator != nil {
+			rooms.federator.Close()
+		}
+		if rooms.events != nil {
+			if err := rooms.events.Close(); err != nil {
+				logf(regionLocal, "[sink] close failed: %v", err)
+			}
+		}
+		os.Exit(0)
+	}()
+
 	// Single multiplexed WebSocket endpoint. Identity is verified via the
 	// moodio_access_token cookie on handshake; the verified Claims are cached
 	// on the session for the lifetime of the connection. Topic authorization
@@ -62,7 +319,12 @@ func main() {
 	//
 	// Path lives under /ws/ so existing Nginx location blocks route it
 	// correctly without any config change.
-	http.HandleFunc("/ws/connection", wsHandshakeHandler(auth, m))
+	http.HandleFunc("/ws/connection", wsHandshakeHandler(auth, m, rooms.connLimits))
+
+	// SSE fallback for networks that block WebSocket upgrades: events
+	// stream down /ws/sse, ops go up as POSTs. Same auth and handlers.
+	http.HandleFunc("/ws/sse", sseHandler(auth, rooms))
+	http.HandleFunc("/ws/sse/op", sseOpHandler(auth, rooms))
 
 	m.HandleConnect(func(s *melody.Session) {
 		rooms.HandleConnect(s)
@@ -70,9 +332,13 @@ func main() {
 	m.HandleMessage(func(s *melody.Session, msg []byte) {
 		rooms.HandleMessage(s, msg)
 	})
+	m.HandleMessageBinary(func(s *melody.Session, msg []byte) {
+		rooms.HandleMessageBinary(s, msg)
+	})
 	m.HandleDisconnect(func(s *melody.Session) {
 		rooms.HandleDisconnect(s)
 	})
+	go rooms.RunHeartbeat(nil)
 
 	// Unauthenticated latency echo endpoint used by the admin page.
 	pingMelody := melody.New()
@@ -86,34 +352,18 @@ func main() {
 		}
 	})
 
+	// Topic history for support tooling. Like /debug/vars, reachable from the
+	// host network only (Nginx routes /ws/ alone).
+	http.HandleFunc("/internal/history", historyHandler(auth, rooms))
+
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
 	})
 
-	http.HandleFunc("/check", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-
-		logf(regionLocal, "[check] received check request from %s", r.RemoteAddr)
-
-		region := fetchEC2Region()
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "ok",
-			"region": region,
-		})
-	})
+	http.HandleFunc("/check", checkHandler(auth))
 
-	logf(regionLocal, "realtime server starting on :%s", port)
+	logf(regionLocal, "realtime server %s (protocol v%d) starting on :%s", serverVersion, ProtocolVersion, port)
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
 		fatalf(regionLocal, "listen error: %v", err)
 	}
@@ -121,14 +371,34 @@ func main() {
 
 // wsHandshakeHandler returns the /ws HTTP handler. Factored out of main so
 // tests can mount it against an httptest.Server without invoking main().
-func wsHandshakeHandler(auth *Auth, m *melody.Melody) http.HandlerFunc {
+func wsHandshakeHandler(auth *Auth, m *melody.Melody, limits *connLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		claims, err := auth.ValidateFromCookie(r)
+		// Before authentication, so a refused request can't spend a ticket.
+		if !auth.CheckHandshakeOrigin(r, "ws_connection") {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		// HandleRequestWithKeys serves the connection until it closes, so
+		// the slots are held for the session's lifetime. The peer limits
+		// go before authentication, so a refused request can't spend a
+		// ticket either.
+		ip, releasePeer, ok := limits.admitPeer(w, r, "ws_connection")
+		if !ok {
+			return
+		}
+		defer releasePeer()
+		claims, err := auth.ValidateHandshake(r)
 		if err != nil {
 			logf(regionLocal, "[auth] rejected connection: %v", err)
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
+		releaseUser, ok := limits.admitUser(w, claims, ip, "ws_connection")
+		if !ok {
+			auth.ReleaseTicket(claims)
+			return
+		}
+		defer releaseUser()
 
 		sessionId := generateSessionId()
 
@@ -142,6 +412,35 @@ func wsHandshakeHandler(auth *Auth, m *melody.Melody) http.HandlerFunc {
 	}
 }
 
+// checkHandler returns the /check handler. CORS is granted to origins on
+// the ALLOWED_ORIGINS list (any origin when unset).
+func checkHandler(auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := auth.corsOrigin(r.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		logf(regionLocal, "[check] received check request from %s", r.RemoteAddr)
+
+		region := fetchEC2Region()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "ok",
+			"region": region,
+		})
+	}
+}
+
 func fetchEC2Region() string {
 	client := &http.Client{}
 
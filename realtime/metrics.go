@@ -0,0 +1,12 @@
+package main
+
+import "expvar"
+
+// Operational counters, published as JSON on /debug/vars by the expvar
+// package (registered on the default mux). Nginx only routes /ws/ to the
+// relay, so the endpoint is reachable from inside the host network only.
+var (
+	// federationRejected counts inbound federated messages dropped by
+	// signature verification, keyed by reason.
+	federationRejected = expvar.NewMap("federation_rejected")
+)
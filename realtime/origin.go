@@ -0,0 +1,150 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originRejected counts browser requests refused by the Origin allow-list,
+// keyed by endpoint.
+var originRejected = expvar.NewMap("origin_rejected")
+
+// originAllowList is the set of browser origins allowed to use the
+// access token cookie against the relay (ALLOWED_ORIGINS). Entries are
+// exact origins ("https://app.moodio.com") or wildcard subdomains
+// ("https://*.moodio.com", which matches any depth of subdomain but not
+// moodio.com itself). Scheme and port must match.
+type originAllowList struct {
+	exact     map[string]bool
+	wildcards []originWildcard
+}
+
+type originWildcard struct {
+	scheme string
+	suffix string // ".moodio.com"
+	port   string
+}
+
+// parseOriginAllowList parses a comma-separated ALLOWED_ORIGINS.
+func parseOriginAllowList(spec string) (*originAllowList, error) {
+	l := &originAllowList{exact: make(map[string]bool)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		origin := entry
+		scheme, rest, _ := strings.Cut(entry, "://")
+		wildcard := strings.HasPrefix(rest, "*.")
+		if wildcard {
+			origin = scheme + "://" + rest[len("*."):]
+		}
+		if strings.Contains(origin, "*") {
+			return nil, fmt.Errorf("origin %q: only a leading *. subdomain wildcard is supported", entry)
+		}
+		scheme, host, port, err := splitOrigin(origin)
+		if err != nil {
+			return nil, fmt.Errorf("origin %q: %w", entry, err)
+		}
+		if wildcard {
+			l.wildcards = append(l.wildcards, originWildcard{scheme, "." + host, port})
+		} else {
+			l.exact[joinOrigin(scheme, host, port)] = true
+		}
+	}
+	if len(l.exact) == 0 && len(l.wildcards) == 0 {
+		return nil, fmt.Errorf("no origins")
+	}
+	return l, nil
+}
+
+// splitOrigin parses a serialized origin into lowercase scheme and host and
+// its port, dropping the scheme's default port.
+func splitOrigin(origin string) (scheme, host, port string, err error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", "", "", err
+	}
+	scheme = strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", "", "", fmt.Errorf("scheme must be http or https")
+	}
+	if u.Hostname() == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", "", fmt.Errorf("not an origin")
+	}
+	host, port = strings.ToLower(u.Hostname()), u.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	return scheme, host, port, nil
+}
+
+func joinOrigin(scheme, host, port string) string {
+	if port != "" {
+		host += ":" + port
+	}
+	return scheme + "://" + host
+}
+
+// allows reports whether the Origin header value origin is on the list.
+func (l *originAllowList) allows(origin string) bool {
+	scheme, host, port, err := splitOrigin(origin)
+	if err != nil {
+		return false // includes "null"
+	}
+	if l.exact[joinOrigin(scheme, host, port)] {
+		return true
+	}
+	for _, w := range l.wildcards {
+		if w.scheme == scheme && w.port == port && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin guards cookie-authenticated browser requests against
+// cross-site use: a request with an Origin header not on the allow-list is
+// refused, logged and counted under endpoint. Requests without an Origin
+// (native clients) and requests carrying a Bearer header, which a cross-site
+// page can't obtain, are not checked; other Authorization schemes are. Everything passes when no allow-list
+// is configured.
+func (a *Auth) CheckOrigin(r *http.Request, endpoint string) bool {
+	origin := r.Header.Get("Origin")
+	if a.origins == nil || origin == "" {
+		return true
+	}
+	if _, ok := bearerToken(r); ok {
+		return true
+	}
+	if a.origins.allows(origin) {
+		return true
+	}
+	originRejected.Add(endpoint, 1)
+	logf(regionLocal, "[origin] rejected %s request from origin %q (%s)", endpoint, origin, r.RemoteAddr)
+	return false
+}
+
+// CheckHandshakeOrigin is CheckOrigin for endpoints authenticated with
+// ValidateHandshake. A request carrying a connect ticket is not checked:
+// ValidateHandshake authenticates it with the ticket (or a Bearer header)
+// and ignores the cookie. Endpoints that only read the cookie must use
+// CheckOrigin, or a bogus ticket parameter would skip the check.
+func (a *Auth) CheckHandshakeOrigin(r *http.Request, endpoint string) bool {
+	if r.URL.Query().Has(connectTicketParam) {
+		return true
+	}
+	return a.CheckOrigin(r, endpoint)
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin: origin itself if allowed, else empty.
+func (a *Auth) corsOrigin(origin string) string {
+	if a.origins == nil || a.origins.allows(origin) {
+		return origin
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/olahol/melody"
+)
+
+func TestParseOriginAllowList(t *testing.T) {
+	l, err := parseOriginAllowList("https://app.moodio.com, https://*.moodio.dev,http://localhost:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for origin, want := range map[string]bool{
+		"https://app.moodio.com":     true,
+		"https://APP.moodio.com:443": true,
+		"http://app.moodio.com":      false,
+		"https://app.moodio.com:444": false,
+		"https://evil-moodio.com":    false,
+		"https://a.moodio.dev":       true,
+		"https://a.b.moodio.dev":     true,
+		"https://moodio.dev":         false,
+		"https://evilmoodio.dev":     false,
+		"https://a.moodio.dev:8443":  false,
+		"http://localhost:3000":      true,
+		"http://localhost:3001":      false,
+		"null":                       false,
+		"":                           false,
+	} {
+		if got := l.allows(origin); got != want {
+			t.Errorf("allows(%q) = %v, want %v", origin, got, want)
+		}
+	}
+	for _, bad := range []string{"", " , ", "app.moodio.com", "ftp://moodio.com", "https://*moodio.com", "https://a.*.moodio.com", "https://moodio.com/path"} {
+		if _, err := parseOriginAllowList(bad); err == nil {
+			t.Errorf("parseOriginAllowList(%q) should fail", bad)
+		}
+	}
+}
+
+func TestCheckOrigin_WSHandshake(t *testing.T) {
+	secret := []byte("origin-test-secret")
+	origins, _ := parseOriginAllowList("https://app.moodio.com")
+	auth := &Auth{jwtSecret: secret, origins: origins}
+	m := melody.New()
+	srv := httptest.NewServer(wsHandshakeHandler(auth, m, nil))
+	defer srv.Close()
+
+	token := signTestJWT(t, secret, &Claims{UserID: "user-1", Exp: time.Now().Add(5 * time.Minute).Unix()})
+	dial := func(origin, credential string) int {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		switch credential {
+		case "bearer":
+			header.Set("Authorization", "Bearer "+token)
+		case "basic+cookie":
+			header.Set("Authorization", "Basic dXNlcjpwYXNz")
+			header.Set("Cookie", "moodio_access_token="+token)
+		default:
+			header.Set("Cookie", "moodio_access_token="+token)
+		}
+		return dialHandshake(t, srv, "", header)
+	}
+
+	before := expvarInt(originRejected, "ws_connection")
+	if code := dial("https://evil.example", "cookie"); code != http.StatusForbidden {
+		t.Fatalf("cross-site cookie handshake: got %d, want 403", code)
+	}
+	if got := expvarInt(originRejected, "ws_connection") - before; got != 1 {
+		t.Errorf("rejection should be counted, got %d", got)
+	}
+	// Only a Bearer header exempts the request; the cookie is still used.
+	if code := dial("https://evil.example", "basic+cookie"); code != http.StatusForbidden {
+		t.Fatalf("cross-site cookie handshake with a Basic header: got %d, want 403", code)
+	}
+	for name, code := range map[string]int{
+		"allowed origin":       dial("https://app.moodio.com", "cookie"),
+		"no origin":            dial("", "cookie"),
+		"bearer, other origin": dial("https://evil.example", "bearer"),
+	} {
+		if code != http.StatusSwitchingProtocols {
+			t.Errorf("%s: got %d, want 101", name, code)
+		}
+	}
+}
+
+func TestCheckOrigin_SSEOp(t *testing.T) {
+	origins, _ := parseOriginAllowList("https://app.moodio.com")
+	auth := &Auth{jwtSecret: testSSESecret, origins: origins}
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/ws/sse/op?sessionId=session_x", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	req.AddCookie(&http.Cookie{Name: "moodio_access_token", Value: sseCookie(t, "u-alice", "Alice", "")})
+	rec := httptest.NewRecorder()
+	sseOpHandler(auth, rooms)(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("cross-site op post: got %d, want 403", rec.Code)
+	}
+
+	// The op endpoint authenticates with the cookie, so a ticket parameter
+	// must not exempt the request from the check.
+	req = httptest.NewRequest(http.MethodPost, "/ws/sse/op?sessionId=session_x&"+connectTicketParam+"=bogus", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	req.AddCookie(&http.Cookie{Name: "moodio_access_token", Value: sseCookie(t, "u-alice", "Alice", "")})
+	rec = httptest.NewRecorder()
+	sseOpHandler(auth, rooms)(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("cross-site op post with a bogus ticket: got %d, want 403", rec.Code)
+	}
+}
+
+func TestCheckHandler_CORS(t *testing.T) {
+	origins, _ := parseOriginAllowList("https://*.moodio.com")
+	for _, tc := range []struct {
+		auth   *Auth
+		origin string
+		want   string
+	}{
+		{&Auth{origins: origins}, "https://app.moodio.com", "https://app.moodio.com"},
+		{&Auth{origins: origins}, "https://evil.example", ""},
+		{&Auth{}, "https://evil.example", "https://evil.example"},
+	} {
+		req := httptest.NewRequest(http.MethodOptions, "/check", nil)
+		req.Header.Set("Origin", tc.origin)
+		rec := httptest.NewRecorder()
+		checkHandler(tc.auth)(rec, req)
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tc.want {
+			t.Errorf("origin %q: ACAO %q, want %q", tc.origin, got, tc.want)
+		}
+		if rec.Header().Get("Vary") != "Origin" {
+			t.Errorf("origin %q: missing Vary: Origin", tc.origin)
+		}
+	}
+}
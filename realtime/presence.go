@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// presenceSyncPayload is the optional payload of a presence_sync_request.
+// Resync asks peers to answer with a full presence_snapshot instead of
+// individual session_joined events.
+type presenceSyncPayload struct {
+	Resync bool `json:"resync,omitempty"`
+}
+
+// presenceSnapshotPayload is the payload of a presence_snapshot event.
+type presenceSnapshotPayload struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// ResyncPresence reconciles remote presence for every topic that has local
+// subscribers. Called by the federator after a NATS reconnect: while the
+// link was down we may have missed session_joined/session_left in both
+// directions, and requestPresenceSync only fires on the first local
+// subscriber, so nothing else would repair it.
+//
+// For each topic we (1) publish our own presence_snapshot so peers replace
+// their view of this region, (2) ask peers for theirs, and (3) mark every
+// remote session we currently know as pending. Snapshots that arrive within
+// resyncWindow replace the sender region's sessions; whatever is still
+// pending when the window closes is dropped with a session_left.
+func (rm *RoomManager) ResyncPresence() {
+	if rm.federator == nil {
+		return
+	}
+
+	rm.mu.RLock()
+	topics := make([]string, 0, len(rm.topics))
+	for topic := range rm.topics {
+		topics = append(topics, topic)
+	}
+	rm.mu.RUnlock()
+	if len(topics) == 0 {
+		return
+	}
+
+	rm.remoteMu.Lock()
+	rm.resyncGen++
+	gen := rm.resyncGen
+	for _, topic := range topics {
+		pending := make(map[string]struct{}, len(rm.remoteSessions[topic]))
+		for _, rs := range rm.remoteSessions[topic] {
+			pending[rs.SessionID] = struct{}{}
+		}
+		rm.resyncPending[topic] = pending
+	}
+	rm.remoteMu.Unlock()
+
+	for _, topic := range topics {
+		rm.publishPresenceSnapshot(topic)
+		rm.requestPresenceResync(topic)
+	}
+
+	logf(regionLocal, "[federation] presence resync started for %d topics", len(topics))
+
+	time.AfterFunc(rm.resyncWindow, func() {
+		rm.finishPresenceResync(gen)
+	})
+}
+
+// requestPresenceResync is requestPresenceSync with the resync flag set, so
+// peers reply with a presence_snapshot.
+func (rm *RoomManager) requestPresenceResync(topic string) {
+	msg, _ := json.Marshal(map[string]any{
+		"op":      OpEvent,
+		"type":    EventPresenceSync,
+		"topic":   topic,
+		"payload": presenceSyncPayload{Resync: true},
+	})
+	if err := rm.federator.Publish(topic, msg); err != nil {
+		logf(regionLocal, "[federation] presence resync request failed for topic=%s: %v",
+			topicIDForLog(topic), err)
+	}
+}
+
+// publishPresenceSnapshot publishes the full list of local sessions in a
+// topic. An empty list is meaningful: it tells peers this region has nobody.
+func (rm *RoomManager) publishPresenceSnapshot(topic string) {
+	rm.mu.RLock()
+	members := rm.topics[topic]
+	sessions := make([]SessionInfo, 0, len(members))
+	for sess := range members {
+		k := getSessionKeys(sess)
+		if k == nil || k.Claims == nil {
+			continue
+		}
+		sessions = append(sessions, localSessionInfo(k, topic))
+	}
+	rm.mu.RUnlock()
+	sessions = append(sessions, rm.heldSessions(topic)...)
+
+	msg, err := json.Marshal(map[string]any{
+		"op":      OpEvent,
+		"type":    EventPresenceSnapshot,
+		"topic":   topic,
+		"payload": presenceSnapshotPayload{Sessions: sessions},
+	})
+	if err != nil {
+		logf(regionLocal, "error marshalling presence snapshot: %v", err)
+		return
+	}
+	if err := rm.federator.Publish(topic, msg); err != nil {
+		logf(regionLocal, "[federation] presence snapshot failed for topic=%s: %v",
+			topicIDForLog(topic), err)
+	}
+}
+
+// applyPresenceSnapshot replaces every remote session from sourceRegion in
+// topic with the snapshot contents and tells local subscribers about the
+// difference.
+func (rm *RoomManager) applyPresenceSnapshot(topic, sourceRegion string, snapshot []SessionInfo) {
+	incoming := make(map[string]struct{}, len(snapshot))
+	ordered := make([]SessionInfo, 0, len(snapshot))
+	for _, info := range snapshot {
+		if info.SessionID == "" {
+			continue
+		}
+		if _, dup := incoming[info.SessionID]; dup {
+			continue
+		}
+		info.Region = sourceRegion
+		incoming[info.SessionID] = struct{}{}
+		ordered = append(ordered, info)
+	}
+
+	var joined, left []SessionInfo
+
+	rm.remoteMu.Lock()
+	current := rm.remoteSessions[topic]
+	kept := make([]SessionInfo, 0, len(current)+len(incoming))
+	known := make(map[string]struct{}, len(current))
+	for _, rs := range current {
+		if rs.Region != sourceRegion {
+			kept = append(kept, rs)
+			continue
+		}
+		known[rs.SessionID] = struct{}{}
+		if _, ok := incoming[rs.SessionID]; !ok {
+			left = append(left, rs)
+		}
+	}
+	for _, info := range ordered {
+		if _, seen := known[info.SessionID]; !seen {
+			joined = append(joined, info)
+		}
+		kept = appendRemoteSession(kept, info)
+	}
+	if len(kept) == 0 {
+		delete(rm.remoteSessions, topic)
+	} else {
+		rm.remoteSessions[topic] = kept
+	}
+	if pending := rm.resyncPending[topic]; pending != nil {
+		for id := range known {
+			delete(pending, id)
+		}
+		for id := range incoming {
+			delete(pending, id)
+		}
+	}
+	rm.remoteMu.Unlock()
+
+	rm.emitPresenceCorrections(topic, sourceRegion, joined, left)
+}
+
+// finishPresenceResync drops remote sessions that no snapshot confirmed
+// during the resync window. A later ResyncPresence supersedes this one.
+func (rm *RoomManager) finishPresenceResync(gen uint64) {
+	stale := make(map[string][]SessionInfo)
+
+	rm.remoteMu.Lock()
+	if gen != rm.resyncGen {
+		rm.remoteMu.Unlock()
+		return
+	}
+	for topic, pending := range rm.resyncPending {
+		if len(pending) > 0 {
+			kept := rm.remoteSessions[topic][:0]
+			for _, rs := range rm.remoteSessions[topic] {
+				if _, ok := pending[rs.SessionID]; ok {
+					stale[topic] = append(stale[topic], rs)
+				} else {
+					kept = append(kept, rs)
+				}
+			}
+			if len(kept) == 0 {
+				delete(rm.remoteSessions, topic)
+			} else {
+				rm.remoteSessions[topic] = kept
+			}
+		}
+		delete(rm.resyncPending, topic)
+	}
+	rm.remoteMu.Unlock()
+
+	for topic, sessions := range stale {
+		rm.emitPresenceCorrections(topic, regionLocal, nil, sessions)
+	}
+}
+
+// emitPresenceCorrections delivers session_joined / session_left for remote
+// sessions whose presence changed during a resync. Local-only: every region
+// reconciles its own view.
+//
+// A user with several sessions in the batch gets a single user event: the
+// first of their sessions carries it.
+func (rm *RoomManager) emitPresenceCorrections(topic, region string, joined, left []SessionInfo) {
+	topicLog := topicIDForLog(topic)
+	userDone := make(map[string]bool)
+	for _, info := range left {
+		if evt := buildSessionInfoEvent(EventSessionLeft, topic, info); evt != nil {
+			var userEvt []byte
+			if !userDone[info.UserID] {
+				userDone[info.UserID] = true
+				userEvt = rm.userEventFor(topic, EventSessionLeft, info, nil)
+			}
+			rm.broadcastPresence(topic, nil, evt, userEvt, false)
+		}
+		logf(region, "[room] %s left topic=%s (resync)", displayName(info.FirstName, info.Email), topicLog)
+	}
+
+	joining := make(map[string]bool, len(joined))
+	for _, info := range joined {
+		joining[info.SessionID] = true
+	}
+	userDone = make(map[string]bool)
+	for _, info := range joined {
+		if evt := buildSessionInfoEvent(EventSessionJoined, topic, info); evt != nil {
+			var userEvt []byte
+			if !userDone[info.UserID] {
+				userDone[info.UserID] = true
+				userEvt = rm.userEventFor(topic, EventSessionJoined, info, joining)
+			}
+			rm.broadcastPresence(topic, nil, evt, userEvt, false)
+		}
+		logf(region, "[room] %s joined topic=%s (resync)", displayName(info.FirstName, info.Email), topicLog)
+	}
+}
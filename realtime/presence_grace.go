@@ -0,0 +1,138 @@
+package main
+
+import (
+	"time"
+)
+
+// heldSession is a disconnected session whose session_left is being held
+// back for the grace period, in case the user is only reloading the page.
+type heldSession struct {
+	info  SessionInfo
+	timer *time.Timer
+}
+
+// holdLeave keeps info listed in topic for rm.leaveGrace after its session
+// disconnected. If nobody claims it in time, session_left goes out then.
+func (rm *RoomManager) holdLeave(topic string, info SessionInfo) {
+	held := &heldSession{info: info}
+
+	rm.leaveMu.Lock()
+	if rm.heldLeaves[topic] == nil {
+		rm.heldLeaves[topic] = make(map[string]*heldSession)
+	}
+	rm.heldLeaves[topic][info.SessionID] = held
+	held.timer = time.AfterFunc(rm.leaveGrace, func() { rm.expireHeldLeave(topic, held) })
+	rm.leaveMu.Unlock()
+
+	logf(regionLocal, "[room] holding leave of session=%s topic=%s for %s",
+		truncateID(info.SessionID), topicIDForLog(topic), rm.leaveGrace)
+}
+
+func (rm *RoomManager) expireHeldLeave(topic string, held *heldSession) {
+	rm.leaveMu.Lock()
+	if rm.heldLeaves[topic][held.info.SessionID] != held {
+		rm.leaveMu.Unlock()
+		return
+	}
+	rm.deleteHeldLocked(topic, held.info.SessionID)
+	rm.leaveMu.Unlock()
+
+	rm.announceLeave(topic, nil, held.info)
+	rm.notifyTopicEmpty(topic)
+}
+
+func (rm *RoomManager) deleteHeldLocked(topic, sessionID string) {
+	delete(rm.heldLeaves[topic], sessionID)
+	if len(rm.heldLeaves[topic]) == 0 {
+		delete(rm.heldLeaves, topic)
+	}
+}
+
+// claimHeldLeaves cancels every held leave of userID in topic and returns
+// the held sessions. Called when the user shows up again in the topic,
+// locally or via federation.
+func (rm *RoomManager) claimHeldLeaves(topic, userID string) []SessionInfo {
+	if userID == "" {
+		return nil
+	}
+	var claimed []SessionInfo
+	rm.leaveMu.Lock()
+	for id, held := range rm.heldLeaves[topic] {
+		if held.info.UserID != userID {
+			continue
+		}
+		held.timer.Stop()
+		rm.deleteHeldLocked(topic, id)
+		claimed = append(claimed, held.info)
+	}
+	rm.leaveMu.Unlock()
+	return claimed
+}
+
+// announceJoin delivers sessionEvt for info joining topic (a local subscribe
+// or federated ingress). If the same user had held sessions there, this is
+// a reload: the held sessions are retired right after with an immediate
+// session_left each, and since the user never left, user-level clients see
+// neither user_joined nor user_left.
+func (rm *RoomManager) announceJoin(topic string, sender sessionConn, info SessionInfo, sessionEvt []byte, federate bool) {
+	held := rm.claimHeldLeaves(topic, info.UserID)
+	var userEvt []byte
+	if len(held) == 0 {
+		userEvt = rm.userEventFor(topic, EventSessionJoined, info, nil)
+	}
+	rm.broadcastPresence(topic, sender, sessionEvt, userEvt, federate)
+	if federate { // local session; remote ones are reported by their relay
+		rm.notifyUserWebhook(topic, userEvt)
+	}
+	for _, h := range held {
+		rm.announceLeave(topic, nil, h)
+	}
+}
+
+// announceLeave broadcasts session_left for a local session that is no
+// longer in the topic (and user_left if it was the user's last).
+func (rm *RoomManager) announceLeave(topic string, sender sessionConn, info SessionInfo) {
+	evt := buildSessionInfoEvent(EventSessionLeft, topic, info)
+	if evt == nil {
+		return
+	}
+	userEvt := rm.userEventFor(topic, EventSessionLeft, info, nil)
+	rm.broadcastPresence(topic, sender, evt, userEvt, true)
+	rm.notifyUserWebhook(topic, userEvt)
+}
+
+// hasHeldLeaves reports whether any session is held in topic.
+func (rm *RoomManager) hasHeldLeaves(topic string) bool {
+	rm.leaveMu.Lock()
+	defer rm.leaveMu.Unlock()
+	return len(rm.heldLeaves[topic]) > 0
+}
+
+// heldSessions lists the sessions currently held in topic.
+func (rm *RoomManager) heldSessions(topic string) []SessionInfo {
+	rm.leaveMu.Lock()
+	defer rm.leaveMu.Unlock()
+	out := make([]SessionInfo, 0, len(rm.heldLeaves[topic]))
+	for _, held := range rm.heldLeaves[topic] {
+		out = append(out, held.info)
+	}
+	return out
+}
+
+// leaveTopicsOnDisconnect drops a disconnecting session from all its topics,
+// holding back session_left when a grace period is configured.
+func (rm *RoomManager) leaveTopicsOnDisconnect(s sessionConn, keys *SessionKeys, topics []string) {
+	for _, topic := range topics {
+		info := localSessionInfo(keys, topic)
+		keys.Subs.Remove(topic)
+		rm.releaseSessionLocks(s, keys, topic, LockReleaseDisconnect)
+		rm.dropSessionSnapshot(topic, keys.SessionID)
+		rm.removeFromTopic(topic, s)
+		if rm.leaveGrace > 0 {
+			rm.holdLeave(topic, info)
+			continue
+		}
+		rm.notifyTopicEmpty(topic)
+		rm.broadcastLocalSessionEvent(s, keys, EventSessionLeft, topic, info.Permission)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func ackSessionIDs(t *testing.T, tc *testClient, topic string) map[string]bool {
+	t.Helper()
+	tc.clearMessages()
+	tc.subscribe(t, topic) // idempotent resubscribe re-sends the ack
+	var ack SubscribedAck
+	_ = json.Unmarshal(tc.waitForOp(t, OpSubscribed, ""), &ack)
+	out := make(map[string]bool)
+	for _, info := range ack.Sessions {
+		out[info.SessionID] = true
+	}
+	return out
+}
+
+func setupFederatedPair(t *testing.T) (us, hk *RoomManager, serverUS, serverHK *httptest.Server) {
+	t.Helper()
+	fedUS, fedHK := newMockFederatorPair("us-east-2", "ap-northeast-1")
+	_, us, serverUS = setupTestServer()
+	us.federator = fedUS
+	us.regionId = "us-east-2"
+	_, hk, serverHK = setupTestServer()
+	hk.federator = fedHK
+	hk.regionId = "ap-northeast-1"
+	return us, hk, serverUS, serverHK
+}
+
+// TestLeaveGrace_ReloadDoesNotFlap — a reload within the grace period swaps
+// the old session for the new one without a visible gap.
+func TestLeaveGrace_ReloadDoesNotFlap(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.leaveGrace = 500 * time.Millisecond
+	topic := "desktop:reload"
+
+	observer := connectAndSubscribe(t, server, topic, "u-obs", "Obs", "editor")
+	defer observer.close()
+	users := dialHello(t, server, "u-users", "Users", CapabilityUserPresence)
+	defer users.close()
+	users.subscribe(t, topic)
+
+	before := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	waitFor(t, func() bool { return len(users.findEventsOfType(EventUserJoined, topic)) > 0 })
+	users.clearMessages()
+	before.close()
+	waitFor(t, func() bool { return len(rooms.heldSessions(topic)) == 1 })
+
+	if n := len(observer.findEventsOfType(EventSessionLeft, topic)); n != 0 {
+		t.Fatalf("session_left must be held during the grace period, got %d", n)
+	}
+	if !ackSessionIDs(t, observer, topic)[before.sessionID] {
+		t.Fatal("held session should still be listed in acks")
+	}
+
+	after := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer after.close()
+	waitFor(t, func() bool {
+		return observer.sawSessionEvent(EventSessionJoined, topic, after.sessionID) &&
+			observer.sawSessionEvent(EventSessionLeft, topic, before.sessionID)
+	})
+	time.Sleep(settle)
+	if n := len(users.findEventsOfType(EventUserLeft, topic)) + len(users.findEventsOfType(EventUserJoined, topic)); n != 0 {
+		t.Errorf("user-level clients should see no churn on reload, got %d events", n)
+	}
+
+	// The claim removed the held leave, so its timer has nothing to fire.
+	if held := rooms.heldSessions(topic); len(held) != 0 {
+		t.Fatalf("a claimed leave must not stay held, got %+v", held)
+	}
+}
+
+func TestLeaveGrace_ExpiresWithoutReconnect(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.leaveGrace = 200 * time.Millisecond
+	topic := "desktop:gone"
+
+	observer := connectAndSubscribe(t, server, topic, "u-obs", "Obs", "editor")
+	defer observer.close()
+	users := dialHello(t, server, "u-users", "Users", CapabilityUserPresence)
+	defer users.close()
+	users.subscribe(t, topic)
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	alice.close()
+	waitFor(t, func() bool { return len(rooms.heldSessions(topic)) == 1 })
+	if n := len(observer.findEventsOfType(EventSessionLeft, topic)); n != 0 {
+		t.Fatalf("leave should be held, got %d session_left", n)
+	}
+
+	waitFor(t, func() bool {
+		return observer.sawSessionEvent(EventSessionLeft, topic, alice.sessionID) &&
+			len(users.findEventsOfType(EventUserLeft, topic)) > 0
+	})
+	time.Sleep(settle)
+	if n := len(users.findEventsOfType(EventUserLeft, topic)); n != 1 {
+		t.Fatalf("user_left should fire once the grace period ends, got %d", n)
+	}
+	if ackSessionIDs(t, observer, topic)[alice.sessionID] {
+		t.Fatal("expired session must no longer be listed")
+	}
+}
+
+func TestLeaveGrace_UnsubscribeIsImmediate(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.leaveGrace = time.Second
+	topic := "desktop:unsub-now"
+
+	observer := connectAndSubscribe(t, server, topic, "u-obs", "Obs", "editor")
+	defer observer.close()
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+
+	alice.unsubscribe(t, topic)
+	waitFor(t, func() bool { return observer.sawSessionEvent(EventSessionLeft, topic, alice.sessionID) })
+	if held := rooms.heldSessions(topic); len(held) != 0 {
+		t.Fatalf("an explicit unsubscribe should not be held, got %+v", held)
+	}
+}
+
+// TestLeaveGrace_ReconnectToOtherRegion — alice drops off the US relay and
+// comes back on HK within the grace period: US retires the held session as
+// soon as it hears about the HK one, and nobody sees alice leave.
+func TestLeaveGrace_ReconnectToOtherRegion(t *testing.T) {
+	us, hk, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	us.leaveGrace = 500 * time.Millisecond
+	topic := "desktop:reload-fed"
+
+	keepUS := connectAndSubscribe(t, serverUS, topic, "u-keep", "Keep", "editor")
+	defer keepUS.close()
+	users := dialHello(t, serverHK, "u-users", "Users", CapabilityUserPresence)
+	defer users.close()
+	users.subscribe(t, topic)
+
+	before := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	waitFor(t, func() bool { return len(users.findEventsOfType(EventUserJoined, topic)) > 0 })
+	users.clearMessages()
+
+	before.close()
+	waitFor(t, func() bool { return len(us.heldSessions(topic)) == 1 })
+	if _, ok := remoteSessionIDs(hk, topic)[before.sessionID]; !ok {
+		t.Fatal("HK should still list the held US session")
+	}
+
+	after := connectAndSubscribe(t, serverHK, topic, "u-alice", "Alice", "editor")
+	defer after.close()
+	waitFor(t, func() bool {
+		_, listed := remoteSessionIDs(hk, topic)[before.sessionID]
+		return !listed && keepUS.sawSessionEvent(EventSessionLeft, topic, before.sessionID)
+	})
+	time.Sleep(settle)
+	if n := len(users.findEventsOfType(EventUserLeft, topic)); n != 0 {
+		t.Errorf("alice never left, got %d user_left", n)
+	}
+	if held := us.heldSessions(topic); len(held) != 0 {
+		t.Fatalf("the claimed leave must not stay held, got %+v", held)
+	}
+}
+
+func TestLeaveGrace_ExpiryReachesOtherRegion(t *testing.T) {
+	us, hk, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	us.leaveGrace = 200 * time.Millisecond
+	topic := "desktop:gone-fed"
+
+	keepUS := connectAndSubscribe(t, serverUS, topic, "u-keep", "Keep", "editor")
+	defer keepUS.close()
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	waitFor(t, func() bool { return bob.sawSessionEvent(EventSessionJoined, topic, alice.sessionID) })
+
+	alice.close()
+	waitFor(t, func() bool { return len(us.heldSessions(topic)) == 1 })
+	if bob.sawSessionEvent(EventSessionLeft, topic, alice.sessionID) {
+		t.Fatal("HK must not hear session_left during the grace period")
+	}
+	waitFor(t, func() bool { return bob.sawSessionEvent(EventSessionLeft, topic, alice.sessionID) })
+	if _, ok := remoteSessionIDs(hk, topic)[alice.sessionID]; ok {
+		t.Fatal("HK should drop alice after the grace period")
+	}
+}
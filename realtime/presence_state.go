@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// MaxPresenceStateBytes caps the merged per-(session, topic) presence state.
+// It rides along in every ack and presence snapshot, so it must stay small.
+const MaxPresenceStateBytes = 1024
+
+var (
+	errPresenceStateNotObject = errors.New("state must be a JSON object")
+	errPresenceStateTooLarge  = errors.New("state too large")
+)
+
+// SetState replaces the presence state stored for topic. Returns false if
+// the session is not subscribed to it.
+func (s *SessionSubs) SetState(topic string, state json.RawMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.topics[topic]
+	if !ok {
+		return false
+	}
+	e.State = state
+	s.topics[topic] = e
+	return true
+}
+
+// mergePresenceState applies patch to cur as a shallow JSON merge: top-level
+// keys in patch overwrite, keys set to null are removed. A null patch clears
+// the state. The result is nil when no keys remain.
+func mergePresenceState(cur, patch json.RawMessage) (json.RawMessage, error) {
+	if len(patch) == 0 || bytes.Equal(bytes.TrimSpace(patch), []byte("null")) {
+		return nil, nil
+	}
+	var delta map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &delta); err != nil || delta == nil {
+		return nil, errPresenceStateNotObject
+	}
+	merged := make(map[string]json.RawMessage)
+	if len(cur) > 0 {
+		if err := json.Unmarshal(cur, &merged); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range delta {
+		if bytes.Equal(bytes.TrimSpace(v), []byte("null")) {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+	out, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxPresenceStateBytes {
+		return nil, errPresenceStateTooLarge
+	}
+	return out, nil
+}
+
+// handlePresenceUpdate merges op.State into the session's presence state on
+// op.Topic and broadcasts the delta as presence_updated. Viewers may update
+// presence; it is not a mutation.
+func (rm *RoomManager) handlePresenceUpdate(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	topic := op.Topic
+	entry, ok := keys.Subs.Get(topic)
+	if !ok {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeNotSubscribed, Ref: op.Ref})
+		return
+	}
+	merged, err := mergePresenceState(entry.State, op.State)
+	if err != nil {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeBadRequest, Message: err.Error(), Ref: op.Ref})
+		return
+	}
+	if !keys.Subs.SetState(topic, merged) {
+		return
+	}
+
+	delta := op.State
+	if len(delta) == 0 {
+		delta = json.RawMessage("null")
+	}
+	evt := TopicEvent{
+		Op:        OpEvent,
+		Topic:     topic,
+		Type:      EventPresenceUpdated,
+		SessionID: keys.SessionID,
+		UserID:    keys.Claims.UserID,
+		FirstName: keys.Claims.FirstName,
+		Email:     keys.Claims.Email,
+		Service:   keys.Claims.IsService(),
+		Timestamp: time.Now().UnixMilli(),
+		Payload:   delta,
+	}
+	data, err := json.Marshal(evt)
+	if err != nil {
+		logf(regionLocal, "error marshalling presence_updated: %v", err)
+		return
+	}
+	rm.broadcastToTopic(topic, s, data)
+}
+
+// applyRemotePresenceDelta merges a federated presence_updated delta into
+// the matching remote session. Called with remoteMu held.
+func (rm *RoomManager) applyRemotePresenceDelta(topic, sessionID string, delta json.RawMessage) {
+	for i := range rm.remoteSessions[topic] {
+		rs := &rm.remoteSessions[topic][i]
+		if rs.SessionID != sessionID {
+			continue
+		}
+		if merged, err := mergePresenceState(rs.State, delta); err == nil {
+			rs.State = merged
+		}
+		return
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (tc *testClient) presenceUpdate(t *testing.T, topic, ref string, state any) {
+	t.Helper()
+	tc.sendRaw(t, map[string]any{"op": OpPresenceUpdate, "topic": topic, "state": state, "ref": ref})
+}
+
+func stateOf(infos []SessionInfo, sessionID string) map[string]any {
+	for _, info := range infos {
+		if info.SessionID == sessionID && len(info.State) > 0 {
+			var out map[string]any
+			_ = json.Unmarshal(info.State, &out)
+			return out
+		}
+	}
+	return nil
+}
+
+func TestMergePresenceState(t *testing.T) {
+	cur := json.RawMessage(`{"color":"red","status":"idle"}`)
+	got, err := mergePresenceState(cur, json.RawMessage(`{"status":"editing","selected":"a1","color":null}`))
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if string(got) != `{"selected":"a1","status":"editing"}` {
+		t.Fatalf("unexpected merge: %s", got)
+	}
+	if got, _ := mergePresenceState(cur, json.RawMessage(`null`)); got != nil {
+		t.Fatalf("null patch should clear, got %s", got)
+	}
+	if got, _ := mergePresenceState(cur, json.RawMessage(`{"color":null,"status":null}`)); got != nil {
+		t.Fatalf("removing every key should clear, got %s", got)
+	}
+	for _, bad := range []string{`[1]`, `"idle"`, `42`} {
+		if _, err := mergePresenceState(nil, json.RawMessage(bad)); err != errPresenceStateNotObject {
+			t.Errorf("%s should be rejected, got %v", bad, err)
+		}
+	}
+	big := json.RawMessage(`{"blob":"` + strings.Repeat("x", MaxPresenceStateBytes) + `"}`)
+	if _, err := mergePresenceState(nil, big); err != errPresenceStateTooLarge {
+		t.Errorf("oversized state should be rejected, got %v", err)
+	}
+}
+
+// TestPresenceUpdate_DeltasAndLateJoiners — deltas are broadcast as-is and
+// the merged state shows up in a late joiner's ack.
+func TestPresenceUpdate_DeltasAndLateJoiners(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:awareness"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "viewer")
+	defer alice.close()
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+
+	alice.presenceUpdate(t, topic, "p1", map[string]any{"color": "#f00", "status": "idle"})
+	alice.presenceUpdate(t, topic, "p2", map[string]any{"status": "editing"})
+	time.Sleep(100 * time.Millisecond)
+
+	events := bob.findEventsOfType(EventPresenceUpdated, topic)
+	if len(events) != 2 {
+		t.Fatalf("bob should see 2 presence_updated deltas, got %d", len(events))
+	}
+	var last struct {
+		SessionID string         `json:"sessionId"`
+		Payload   map[string]any `json:"payload"`
+	}
+	_ = json.Unmarshal(events[1], &last)
+	if last.SessionID != alice.sessionID || len(last.Payload) != 1 || last.Payload["status"] != "editing" {
+		t.Fatalf("second event should carry only the delta, got %s", events[1])
+	}
+	if len(alice.findEventsOfType(EventPresenceUpdated, topic)) != 0 {
+		t.Error("sender should not receive its own presence_updated")
+	}
+
+	carol := dialRaw(t, server, "u-carol", "Carol", "editor")
+	defer carol.close()
+	carol.subscribe(t, topic)
+	var ack SubscribedAck
+	_ = json.Unmarshal(carol.waitForOp(t, OpSubscribed, ""), &ack)
+	state := stateOf(ack.Sessions, alice.sessionID)
+	if state["color"] != "#f00" || state["status"] != "editing" {
+		t.Fatalf("late joiner should see merged state, got %v", state)
+	}
+}
+
+func TestPresenceUpdate_ClearedOnUnsubscribe(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:awareness-clear"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+
+	alice.presenceUpdate(t, topic, "p1", map[string]any{"status": "editing"})
+	time.Sleep(50 * time.Millisecond)
+	alice.unsubscribe(t, topic)
+	time.Sleep(50 * time.Millisecond)
+	alice.subscribe(t, topic)
+
+	bob.clearMessages()
+	bob.subscribe(t, topic) // idempotent resubscribe re-sends the ack
+	var ack SubscribedAck
+	_ = json.Unmarshal(bob.waitForOp(t, OpSubscribed, ""), &ack)
+	if state := stateOf(ack.Sessions, alice.sessionID); state != nil {
+		t.Fatalf("state should be cleared by unsubscribe, got %v", state)
+	}
+}
+
+func TestPresenceUpdate_Errors(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+
+	tc := connectAndSubscribe(t, server, "desktop:awareness-err", "u-a", "Alice", "editor")
+	defer tc.close()
+
+	tc.presenceUpdate(t, "desktop:other", "e1", map[string]any{"x": 1})
+	if code := errorCode(tc.waitForOp(t, OpError, "e1")); code != ErrCodeNotSubscribed {
+		t.Errorf("expected not_subscribed, got %q", code)
+	}
+	tc.presenceUpdate(t, "desktop:awareness-err", "e2", []int{1, 2})
+	if code := errorCode(tc.waitForOp(t, OpError, "e2")); code != ErrCodeBadRequest {
+		t.Errorf("expected bad_request, got %q", code)
+	}
+}
+
+// TestPresenceUpdate_Federated — deltas reach the other region's clients and
+// are merged into its remoteSessions.
+func TestPresenceUpdate_Federated(t *testing.T) {
+	fedUS, fedHK := newMockFederatorPair("us-east-2", "ap-northeast-1")
+
+	_, roomsUS, serverUS := setupTestServer()
+	defer serverUS.Close()
+	roomsUS.federator = fedUS
+	roomsUS.regionId = "us-east-2"
+
+	_, roomsHK, serverHK := setupTestServer()
+	defer serverHK.Close()
+	roomsHK.federator = fedHK
+	roomsHK.regionId = "ap-northeast-1"
+
+	topic := "desktop:awareness-fed"
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	waitFor(t, func() bool { _, ok := remoteSessionIDs(roomsHK, topic)[alice.sessionID]; return ok })
+
+	// The mock federator delivers each message on its own goroutine, so
+	// wait for each delta to land; NATS itself preserves per-subject order.
+	alice.presenceUpdate(t, topic, "p1", map[string]any{"color": "#0f0", "status": "idle"})
+	waitFor(t, func() bool { return len(bob.findEventsOfType(EventPresenceUpdated, topic)) == 1 })
+	alice.presenceUpdate(t, topic, "p2", map[string]any{"status": nil})
+	waitFor(t, func() bool { return len(bob.findEventsOfType(EventPresenceUpdated, topic)) == 2 })
+
+	if n := len(bob.findEventsOfType(EventPresenceUpdated, topic)); n != 2 {
+		t.Fatalf("bob should see 2 federated deltas, got %d", n)
+	}
+	state := stateOf(roomsHK.getSessionsInTopic(topic, ""), alice.sessionID)
+	if state["color"] != "#0f0" || len(state) != 1 {
+		t.Fatalf("HK remote state should be {color}, got %v", state)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/olahol/melody"
+)
+
+func remoteSessionIDs(rm *RoomManager, topic string) map[string]string {
+	rm.remoteMu.RLock()
+	defer rm.remoteMu.RUnlock()
+	out := make(map[string]string)
+	for _, rs := range rm.remoteSessions[topic] {
+		out[rs.SessionID] = rs.FirstName
+	}
+	return out
+}
+
+// settle gives frames already on the wire time to land before a test
+// asserts that something did not happen. Positive checks poll with waitFor.
+const settle = 30 * time.Millisecond
+
+// sawSessionEvent reports whether tc received eventType for sessionID.
+func (tc *testClient) sawSessionEvent(eventType, topic, sessionID string) bool {
+	return sessionEventIDs(tc.findEventsOfType(eventType, topic))[sessionID]
+}
+
+func sessionEventIDs(raws []json.RawMessage) map[string]bool {
+	out := make(map[string]bool)
+	for _, raw := range raws {
+		var evt struct {
+			SessionID string `json:"sessionId"`
+		}
+		if json.Unmarshal(raw, &evt) == nil {
+			out[evt.SessionID] = true
+		}
+	}
+	return out
+}
+
+// TestPresenceResync_ReplacesStaleRemoteSessions — presence changes made on
+// either side of a partition are reconciled when one relay reconnects, and
+// local clients get the corrected session_joined / session_left.
+func TestPresenceResync_ReplacesStaleRemoteSessions(t *testing.T) {
+	fedUS, fedHK := newMockFederatorPair("us-east-2", "ap-northeast-1")
+
+	_, roomsUS, serverUS := setupTestServer()
+	defer serverUS.Close()
+	roomsUS.federator = fedUS
+	roomsUS.regionId = "us-east-2"
+
+	_, roomsHK, serverHK := setupTestServer()
+	defer serverHK.Close()
+	roomsHK.federator = fedHK
+	roomsHK.regionId = "ap-northeast-1"
+
+	topic := "desktop:resync"
+
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	waitFor(t, func() bool {
+		_, us := remoteSessionIDs(roomsUS, topic)[bob.sessionID]
+		_, hk := remoteSessionIDs(roomsHK, topic)[alice.sessionID]
+		return us && hk
+	})
+
+	// Partition. Bob leaves and Dave arrives in HK; Erin arrives in US.
+	fedUS.partitioned.Store(true)
+	fedHK.partitioned.Store(true)
+	bob.close()
+	dave := connectAndSubscribe(t, serverHK, topic, "u-dave", "Dave", "editor")
+	defer dave.close()
+	erin := connectAndSubscribe(t, serverUS, topic, "u-erin", "Erin", "editor")
+	defer erin.close()
+	time.Sleep(settle)
+
+	fedUS.partitioned.Store(false)
+	fedHK.partitioned.Store(false)
+	alice.clearMessages()
+	dave.clearMessages()
+
+	roomsUS.ResyncPresence()
+	waitFor(t, func() bool {
+		us := remoteSessionIDs(roomsUS, topic)
+		_, hasDave := us[dave.sessionID]
+		_, hasErin := remoteSessionIDs(roomsHK, topic)[erin.sessionID]
+		return hasDave && hasErin && len(us) == 1 &&
+			alice.sawSessionEvent(EventSessionLeft, topic, bob.sessionID) &&
+			alice.sawSessionEvent(EventSessionJoined, topic, dave.sessionID)
+	})
+
+	us := remoteSessionIDs(roomsUS, topic)
+	if _, ok := us[bob.sessionID]; ok {
+		t.Error("US should have dropped bob after resync")
+	}
+	if _, ok := us[dave.sessionID]; !ok || len(us) != 1 {
+		t.Errorf("US remote sessions should be exactly dave, got %v", us)
+	}
+	hk := remoteSessionIDs(roomsHK, topic)
+	if _, ok := hk[alice.sessionID]; !ok {
+		t.Errorf("HK should know alice after resync, got %v", hk)
+	}
+	if _, ok := hk[erin.sessionID]; !ok {
+		t.Errorf("HK should know erin after resync, got %v", hk)
+	}
+
+	if !sessionEventIDs(alice.findEventsOfType("session_left", topic))[bob.sessionID] {
+		t.Error("alice should get a corrected session_left for bob")
+	}
+	if !sessionEventIDs(alice.findEventsOfType("session_joined", topic))[dave.sessionID] {
+		t.Error("alice should get a corrected session_joined for dave")
+	}
+	if !sessionEventIDs(dave.findEventsOfType("session_joined", topic))[erin.sessionID] {
+		t.Error("dave should get a corrected session_joined for erin")
+	}
+	if len(alice.findEventsOfType(EventPresenceSnapshot, "")) != 0 {
+		t.Error("presence snapshots must not be forwarded to clients")
+	}
+}
+
+// TestPresenceResync_DropsUnconfirmedAfterWindow — if the region a remote
+// session lived on has nobody left in the topic, no snapshot arrives; the
+// session must still be dropped once the resync window closes.
+func TestPresenceResync_DropsUnconfirmedAfterWindow(t *testing.T) {
+	fedUS, fedHK := newMockFederatorPair("us-east-2", "ap-northeast-1")
+
+	_, roomsUS, serverUS := setupTestServer()
+	defer serverUS.Close()
+	roomsUS.federator = fedUS
+	roomsUS.regionId = "us-east-2"
+	roomsUS.resyncWindow = 200 * time.Millisecond
+
+	_, roomsHK, serverHK := setupTestServer()
+	defer serverHK.Close()
+	roomsHK.federator = fedHK
+	roomsHK.regionId = "ap-northeast-1"
+
+	topic := "desktop:resync-window"
+
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	waitFor(t, func() bool { _, ok := remoteSessionIDs(roomsUS, topic)[bob.sessionID]; return ok })
+
+	fedHK.partitioned.Store(true)
+	bob.close()
+	time.Sleep(settle)
+	fedHK.partitioned.Store(false)
+	alice.clearMessages()
+
+	roomsUS.ResyncPresence()
+	time.Sleep(settle)
+	if _, ok := remoteSessionIDs(roomsUS, topic)[bob.sessionID]; !ok {
+		t.Fatal("bob should still be listed while the resync window is open")
+	}
+
+	waitFor(t, func() bool { _, ok := remoteSessionIDs(roomsUS, topic)[bob.sessionID]; return !ok })
+	time.Sleep(settle)
+	if !sessionEventIDs(alice.findEventsOfType("session_left", topic))[bob.sessionID] {
+		t.Fatal("alice should get session_left for bob")
+	}
+}
+
+// TestApplyPresenceSnapshot_OnlyTouchesSourceRegion — a snapshot from one
+// region must not evict sessions that belong to a third region.
+func TestApplyPresenceSnapshot_OnlyTouchesSourceRegion(t *testing.T) {
+	rm := NewRoomManager(melody.New())
+	topic := "desktop:three-regions"
+	rm.remoteSessions[topic] = []SessionInfo{
+		{SessionID: "hk-1", Region: "ap-northeast-1"},
+		{SessionID: "hk-2", Region: "ap-northeast-1"},
+		{SessionID: "eu-1", Region: "eu-west-1"},
+	}
+
+	rm.applyPresenceSnapshot(topic, "ap-northeast-1", []SessionInfo{
+		{SessionID: "hk-2"},
+		{SessionID: "hk-3"},
+		{SessionID: "hk-3"},
+	})
+
+	got := remoteSessionIDs(rm, topic)
+	for _, id := range []string{"hk-2", "hk-3", "eu-1"} {
+		if _, ok := got[id]; !ok {
+			t.Errorf("expected %s after snapshot, got %v", id, got)
+		}
+	}
+	if _, ok := got["hk-1"]; ok {
+		t.Error("hk-1 should be replaced away by the snapshot")
+	}
+	if len(got) != 3 {
+		t.Errorf("expected 3 remote sessions, got %d", len(got))
+	}
+}
@@ -9,13 +9,26 @@ import (
 
 // Op codes on the wire.
 const (
-	OpSubscribe    = "subscribe"
-	OpUnsubscribe  = "unsubscribe"
-	OpPublish      = "publish"
-	OpSubscribed   = "subscribed"
-	OpUnsubscribed = "unsubscribed"
-	OpEvent        = "event"
-	OpError        = "error"
+	OpHello           = "hello"
+	OpPing            = "ping"
+	OpPong            = "pong"
+	OpSubscribe       = "subscribe"
+	OpUnsubscribe     = "unsubscribe"
+	OpPublish         = "publish"
+	OpPresenceUpdate  = "presence_update"
+	OpLock            = "lock"
+	OpUnlock          = "unlock"
+	OpYSync           = "ysync"
+	OpYUpdate         = "yupdate"
+	OpHistory         = "history"
+	OpHelloAck        = "hello_ack"
+	OpSubscribed      = "subscribed"
+	OpSubscribedBatch = "subscribed_batch"
+	OpUnsubscribed    = "unsubscribed"
+	OpLocked          = "locked"
+	OpUnlocked        = "unlocked"
+	OpEvent           = "event"
+	OpError           = "error"
 )
 
 // Error codes returned on the wire inside ErrorMsg.
@@ -25,6 +38,7 @@ const (
 	ErrCodeBadRequest    = "bad_request"
 	ErrCodeRateLimited   = "rate_limited"
 	ErrCodeNotSubscribed = "not_subscribed"
+	ErrCodeLocked        = "locked"
 	ErrCodeInternal      = "internal"
 )
 
@@ -44,6 +58,22 @@ type SessionInfo struct {
 	FirstName  string `json:"firstName"`
 	Email      string `json:"email"`
 	Permission string `json:"permission"`
+
+	// Service marks a service account (see service_account.go); its
+	// FirstName is a display name such as "System".
+	Service bool `json:"service,omitempty"`
+
+	// LatencyMs is the session's last measured round trip to its relay.
+	// Omitted until a heartbeat-capable client has answered a ping.
+	LatencyMs int64 `json:"latencyMs,omitempty"`
+
+	// State is the session's custom presence state on this topic (cursor
+	// color, selection, status...). See presence_update.
+	State json.RawMessage `json:"state,omitempty"`
+
+	// Region is the relay a remote session is connected to. Set from the
+	// federated envelope on ingress; never sent on the wire.
+	Region string `json:"-"`
 }
 
 // IncomingOp is the single envelope for all client -> server messages.
@@ -53,17 +83,63 @@ type IncomingOp struct {
 	Type    string          `json:"type,omitempty"`
 	Payload json.RawMessage `json:"payload,omitempty"`
 	Ref     string          `json:"ref,omitempty"`
+
+	// publish only: deliver to one session (To) or one user's sessions
+	// (ToUser) in the topic instead of broadcasting.
+	To     string `json:"to,omitempty"`
+	ToUser string `json:"toUser,omitempty"`
+
+	// lock / unlock: the resource key within the topic. publish: the
+	// resource a snapshot-tracked event describes (see snapshot.go).
+	Key string `json:"key,omitempty"`
+
+	// ysync / yupdate only (ydoc topics). Binary Yjs data is base64.
+	Step        int    `json:"step,omitempty"`
+	StateVector string `json:"stateVector,omitempty"`
+	Update      string `json:"update,omitempty"`
+
+	// history only. See HistoryQuery.
+	AfterSeq  uint64 `json:"afterSeq,omitempty"`
+	BeforeSeq uint64 `json:"beforeSeq,omitempty"`
+	Since     int64  `json:"since,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+
+	// presence_update only: a JSON object merged into the session's state.
+	State json.RawMessage `json:"state,omitempty"`
+
+	// subscribe only: subscribe to several topics at once instead of
+	// Topic. See subscribe_batch.go.
+	Topics []string `json:"topics,omitempty"`
+
+	// ping / pong only.
+	TS int64 `json:"ts,omitempty"`
+
+	// hello only.
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
 }
 
 // SubscribedAck is sent after a successful subscribe; it subsumes the old
 // room_joined frame by carrying the existing sessions list.
 type SubscribedAck struct {
-	Op         string        `json:"op"`
-	Topic      string        `json:"topic"`
-	Permission string        `json:"permission"`
-	SessionID  string        `json:"sessionId"`
-	Sessions   []SessionInfo `json:"sessions"`
-	Ref        string        `json:"ref,omitempty"`
+	Op         string            `json:"op"`
+	Topic      string            `json:"topic"`
+	Permission string            `json:"permission"`
+	SessionID  string            `json:"sessionId"`
+	Sessions   []SessionInfo     `json:"sessions"`
+	Users      []UserInfo        `json:"users,omitempty"` // user_presence capability only
+	Locks      []LockInfo        `json:"locks,omitempty"`
+	Snapshot   []json.RawMessage `json:"snapshot,omitempty"` // last tracked event per resource, oldest first
+	Ref        string            `json:"ref,omitempty"`
+}
+
+// SubscribeBatchAck answers a subscribe with topics. Results holds, in
+// request order, the SubscribedAck or ErrorMsg a single subscribe to each
+// topic would have produced, without ref.
+type SubscribeBatchAck struct {
+	Op      string `json:"op"`
+	Results []any  `json:"results"`
+	Ref     string `json:"ref,omitempty"`
 }
 
 type UnsubscribedAck struct {
@@ -78,6 +154,9 @@ type ErrorMsg struct {
 	Code    string `json:"code"`
 	Message string `json:"message,omitempty"`
 	Ref     string `json:"ref,omitempty"`
+
+	// Lock is the current holder, on locked errors only.
+	Lock *LockInfo `json:"lock,omitempty"`
 }
 
 // TopicEvent is the envelope for every topic-scoped event broadcast to
@@ -90,8 +169,14 @@ type TopicEvent struct {
 	UserID    string `json:"userId"`
 	FirstName string `json:"firstName"`
 	Email     string `json:"email"`
+	Service   bool   `json:"service,omitempty"`
 	Timestamp int64  `json:"timestamp"`
 	Payload   any    `json:"payload,omitempty"`
+	Key       string `json:"key,omitempty"`
+
+	// Set on direct events only; relays use them to route across regions.
+	To     string `json:"to,omitempty"`
+	ToUser string `json:"toUser,omitempty"`
 }
 
 // parseTopic validates a topic string of the form "<namespace>:<id>".
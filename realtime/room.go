@@ -14,8 +14,25 @@ const (
 	EventSessionJoined = "session_joined"
 	EventSessionLeft   = "session_left"
 	EventPresenceSync  = "presence_sync_request"
+
+	// EventSessionLatency re-announces a session's SessionInfo when its
+	// measured round trip changes noticeably.
+	EventSessionLatency = "session_latency"
+
+	// EventPresenceUpdated carries a presence_update delta; the payload is
+	// the patch the sender applied, not the full state.
+	EventPresenceUpdated = "presence_updated"
+
+	// EventPresenceSnapshot carries a relay's full local session list for a
+	// topic. Receivers replace (rather than append to) the sender region's
+	// remote sessions. Never forwarded to clients.
+	EventPresenceSnapshot = "presence_snapshot"
 )
 
+// presenceResyncWindow is how long a reconnecting relay waits for presence
+// snapshots before dropping remote sessions nobody vouched for.
+const presenceResyncWindow = 3 * time.Second
+
 // RoomManager tracks topic -> local session membership, per-relay authorize
 // caching, and federation wiring. Sessions can be subscribed to many topics;
 // each topic has its own membership set.
@@ -23,7 +40,7 @@ type RoomManager struct {
 	melody *melody.Melody
 
 	mu     sync.RWMutex
-	topics map[string]map[*melody.Session]struct{}
+	topics map[string]map[sessionConn]struct{}
 
 	authCache *authzCache
 
@@ -35,6 +52,10 @@ type RoomManager struct {
 	// Used by tests to avoid standing up a second httptest.Server.
 	authorizeOverride func(claims *Claims, topic string) (string, error)
 
+	// authzBatcher coalesces authorize calls per user when
+	// AUTHORIZE_BATCH_WINDOW is set. See authorize_batch.go.
+	authzBatcher *authzBatcher
+
 	federator Federator
 	regionId  string
 
@@ -42,14 +63,83 @@ type RoomManager struct {
 	// Keyed by topic -> list of SessionInfo.
 	remoteMu       sync.RWMutex
 	remoteSessions map[string][]SessionInfo
+
+	// resyncPending holds, per topic, the remote session IDs that were known
+	// before a federation reconnect and have not yet been re-confirmed by a
+	// presence snapshot. Guarded by remoteMu. See ResyncPresence.
+	resyncPending map[string]map[string]struct{}
+	resyncGen     uint64
+	resyncWindow  time.Duration
+
+	// Heartbeat / idle timeout, set by main.go before RunHeartbeat starts.
+	heartbeatInterval time.Duration
+	idleTimeout       time.Duration
+
+	// heldLeaves holds, per topic, disconnected sessions whose session_left
+	// is delayed by leaveGrace (0 = announce immediately). See holdLeave.
+	leaveMu    sync.Mutex
+	heldLeaves map[string]map[string]*heldSession
+	leaveGrace time.Duration
+
+	// locks holds advisory locks per topic -> resource key, local and
+	// remote. See locks.go.
+	lockMu  sync.Mutex
+	locks   map[string]map[string]*lockLease
+	lockTTL time.Duration
+
+	// snapshots holds the last-known state per topic -> resource for the
+	// event types in snapshotTypes. See snapshot.go.
+	snapMu        sync.Mutex
+	snapshots     map[string]map[string]*snapshotEntry
+	snapshotTypes map[string]bool
+
+	// ydocs holds the Yjs update log per ydoc topic. See ydoc.go.
+	ydocMu           sync.Mutex
+	ydocs            map[string]*ydoc
+	ydocCompactAfter int
+	ydocMaxUpdates   int
+	ydocMaxBytes     int
+
+	// events receives accepted state events when EVENT_SINK is set.
+	events *eventLog
+
+	// webhooks posts topic and user lifecycle events when WEBHOOK_URL is set.
+	// webhookTopics, guarded by mu, holds the topics reported active and
+	// not yet empty. See notifyTopicEmpty.
+	webhooks      *webhookNotifier
+	webhookTopics map[string]bool
+
+	// sseSessions holds open SSE sessions by session ID, for the op
+	// endpoint and the heartbeat. See sse.go.
+	sseMu       sync.Mutex
+	sseSessions map[string]*sseConn
+
+	// connLimits caps WebSocket and SSE connections when any
+	// MAX_CONNECTIONS* limit is set. See limits.go.
+	connLimits *connLimiter
 }
 
 func NewRoomManager(m *melody.Melody) *RoomManager {
+	configureSubprotocols(m)
 	return &RoomManager{
-		melody:         m,
-		topics:         make(map[string]map[*melody.Session]struct{}),
-		authCache:      newAuthzCache(),
-		remoteSessions: make(map[string][]SessionInfo),
+		melody:            m,
+		topics:            make(map[string]map[sessionConn]struct{}),
+		authCache:         newAuthzCache(),
+		remoteSessions:    make(map[string][]SessionInfo),
+		resyncPending:     make(map[string]map[string]struct{}),
+		resyncWindow:      presenceResyncWindow,
+		heldLeaves:        make(map[string]map[string]*heldSession),
+		webhookTopics:     make(map[string]bool),
+		heartbeatInterval: defaultHeartbeatInterval,
+		locks:             make(map[string]map[string]*lockLease),
+		lockTTL:           defaultLockTTL,
+		snapshots:         make(map[string]map[string]*snapshotEntry),
+		snapshotTypes:     parseSnapshotEventTypes(strings.Join(defaultSnapshotEventTypes, ",")),
+		ydocs:             make(map[string]*ydoc),
+		ydocCompactAfter:  defaultYDocCompactAfter,
+		ydocMaxUpdates:    defaultYDocMaxUpdates,
+		ydocMaxBytes:      defaultYDocMaxBytes,
+		sseSessions:       make(map[string]*sseConn),
 	}
 }
 
@@ -64,7 +154,7 @@ func (rm *RoomManager) Configure(auth *Auth, apiBase string) {
 // Melody callbacks
 // ------------------------------------------------------------
 
-func (rm *RoomManager) HandleConnect(s *melody.Session) {
+func (rm *RoomManager) HandleConnect(s sessionConn) {
 	// Identity keys are stashed under temporary keys by the /ws handler
 	// before the upgrade. Pull them out and cache into SessionKeys.
 	sessionId := mustGetString(s, "sessionId")
@@ -75,14 +165,33 @@ func (rm *RoomManager) HandleConnect(s *melody.Session) {
 	}
 	keys := rm.cacheSessionKeys(s, sessionId, claims)
 
-	logf(regionLocal, "[connect] session=%s user=%s", truncateID(keys.SessionID), keys.DisplayName())
+	logf(regionLocal, "[connect] session=%s user=%s encoding=%s",
+		truncateID(keys.SessionID), keys.DisplayName(), keys.Encoding)
+	rm.sendServerHello(s, keys)
 }
 
-func (rm *RoomManager) HandleMessage(s *melody.Session, msg []byte) {
+// HandleMessageBinary accepts binary frames from sessions that negotiated
+// MessagePack or CBOR. They are transcoded to JSON and handled as usual.
+func (rm *RoomManager) HandleMessageBinary(s sessionConn, msg []byte) {
 	keys := getSessionKeys(s)
 	if keys == nil {
 		return
 	}
+	frame, err := keys.Encoding.toJSON(msg)
+	if err != nil {
+		writeError(s, ErrorMsg{Op: OpError, Code: ErrCodeBadRequest, Message: "invalid " + keys.Encoding.String() + " frame"})
+		return
+	}
+	rm.HandleMessage(s, frame)
+}
+
+func (rm *RoomManager) HandleMessage(s sessionConn, msg []byte) {
+	keys := getSessionKeys(s)
+	if keys == nil {
+		return
+	}
+
+	keys.touch()
 
 	var op IncomingOp
 	if err := json.Unmarshal(msg, &op); err != nil {
@@ -90,9 +199,16 @@ func (rm *RoomManager) HandleMessage(s *melody.Session, msg []byte) {
 		return
 	}
 
-	// Fast-path validation: reject unknown ops before queueing.
+	// Fast-path validation: reject unknown ops before queueing. Heartbeat
+	// ops are answered inline.
 	switch op.Op {
-	case OpSubscribe, OpUnsubscribe, OpPublish:
+	case OpPing:
+		rm.handlePing(s, keys, op)
+		return
+	case OpPong:
+		rm.handlePong(s, keys, op)
+		return
+	case OpHello, OpSubscribe, OpUnsubscribe, OpPublish, OpPresenceUpdate, OpLock, OpUnlock, OpYSync, OpYUpdate, OpHistory:
 	default:
 		writeError(s, ErrorMsg{Op: OpError, Code: ErrCodeBadRequest, Message: "unknown op", Ref: op.Ref})
 		return
@@ -107,7 +223,7 @@ func (rm *RoomManager) HandleMessage(s *melody.Session, msg []byte) {
 	}
 }
 
-func (rm *RoomManager) HandleDisconnect(s *melody.Session) {
+func (rm *RoomManager) HandleDisconnect(s sessionConn) {
 	keys := getSessionKeys(s)
 	if keys == nil {
 		return
@@ -118,14 +234,7 @@ func (rm *RoomManager) HandleDisconnect(s *melody.Session) {
 	<-keys.opDone
 
 	topics := keys.Subs.Snapshot()
-	for _, topic := range topics {
-		entry, _ := keys.Subs.Remove(topic)
-		rm.removeFromTopic(topic, s)
-		left := buildSessionEvent(EventSessionLeft, keys, topic, entry.Permission)
-		if left != nil {
-			rm.broadcastToTopic(topic, s, left)
-		}
-	}
+	rm.leaveTopicsOnDisconnect(s, keys, topics)
 
 	rm.authCache.InvalidateSession(keys.SessionID)
 
@@ -137,7 +246,11 @@ func (rm *RoomManager) HandleDisconnect(s *melody.Session) {
 // Op handlers (invoked by dispatcher goroutine)
 // ------------------------------------------------------------
 
-func (rm *RoomManager) handleSubscribe(s *melody.Session, keys *SessionKeys, op IncomingOp) {
+func (rm *RoomManager) handleSubscribe(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	if op.Topics != nil {
+		rm.handleSubscribeBatch(s, keys, op)
+		return
+	}
 	topic := op.Topic
 	if _, _, err := parseTopic(topic); err != nil {
 		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeBadRequest, Message: err.Error(), Ref: op.Ref})
@@ -186,16 +299,23 @@ func (rm *RoomManager) handleSubscribe(s *melody.Session, keys *SessionKeys, op
 
 	rm.writeSubscribedAck(s, keys, topic, permission, op.Ref)
 
-	joined := buildSessionEvent(EventSessionJoined, keys, topic, permission)
-	if joined != nil {
-		rm.broadcastToTopic(topic, s, joined)
+	rm.announceSubscribe(s, keys, topic, permission)
+}
+
+// announceSubscribe runs the steps that follow a new subscription's ack:
+// the ydoc sync request and the session_joined broadcast.
+func (rm *RoomManager) announceSubscribe(s sessionConn, keys *SessionKeys, topic, permission string) {
+	if isYDocTopic(topic) {
+		rm.requestYDocState(s, topic, false)
 	}
 
+	rm.broadcastLocalSessionEvent(s, keys, EventSessionJoined, topic, permission)
+
 	logf(regionLocal, "[sub] session=%s topic=%s permission=%s",
 		truncateID(keys.SessionID), topicIDForLog(topic), permission)
 }
 
-func (rm *RoomManager) handleUnsubscribe(s *melody.Session, keys *SessionKeys, op IncomingOp) {
+func (rm *RoomManager) handleUnsubscribe(s sessionConn, keys *SessionKeys, op IncomingOp) {
 	topic := op.Topic
 	entry, ok := keys.Subs.Remove(topic)
 	if !ok {
@@ -203,23 +323,23 @@ func (rm *RoomManager) handleUnsubscribe(s *melody.Session, keys *SessionKeys, o
 		return
 	}
 
+	rm.releaseSessionLocks(s, keys, topic, LockReleaseUnsubscribe)
+	rm.dropSessionSnapshot(topic, keys.SessionID)
 	rm.removeFromTopic(topic, s)
+	rm.notifyTopicEmpty(topic)
 	rm.authCache.Invalidate(authzCacheKey{SessionID: keys.SessionID, Topic: topic})
 
-	left := buildSessionEvent(EventSessionLeft, keys, topic, entry.Permission)
-	if left != nil {
-		rm.broadcastToTopic(topic, s, left)
-	}
+	rm.broadcastLocalSessionEvent(s, keys, EventSessionLeft, topic, entry.Permission)
 
 	ack, err := json.Marshal(UnsubscribedAck{Op: OpUnsubscribed, Topic: topic, Ref: op.Ref})
 	if err == nil {
-		_ = s.Write(ack)
+		_ = writeFrame(s, ack)
 	}
 
 	logf(regionLocal, "[unsub] session=%s topic=%s", truncateID(keys.SessionID), topicIDForLog(topic))
 }
 
-func (rm *RoomManager) handlePublish(s *melody.Session, keys *SessionKeys, op IncomingOp) {
+func (rm *RoomManager) handlePublish(s sessionConn, keys *SessionKeys, op IncomingOp) {
 	topic := op.Topic
 	entry, ok := keys.Subs.Get(topic)
 	if !ok {
@@ -231,15 +351,25 @@ func (rm *RoomManager) handlePublish(s *melody.Session, keys *SessionKeys, op In
 		return
 	}
 
+	if op.To != "" && op.ToUser != "" {
+		writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeBadRequest,
+			Message: "set at most one of to and toUser", Ref: op.Ref})
+		return
+	}
+
 	if entry.Permission == "viewer" && isMutationEvent(op.Type) {
 		logf(regionLocal, "[room] blocked mutation %s from viewer session=%s topic=%s",
 			op.Type, truncateID(keys.SessionID), topicIDForLog(topic))
 		return
 	}
-
-	if isStateEvent(op.Type) {
-		logf(regionLocal, "[event] %s %s topic=%s by %s",
-			op.Type, truncatePayloadForLog(op.Payload), topicIDForLog(topic), keys.DisplayName())
+	if !keys.Claims.mayPublish(op.Type) {
+		logf(regionLocal, "[room] blocked %s from service account %s topic=%s",
+			op.Type, truncateID(keys.Claims.UserID), topicIDForLog(topic))
+		if op.Ref != "" {
+			writeError(s, ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeForbidden,
+				Message: "event type not allowed for this service account", Ref: op.Ref})
+		}
+		return
 	}
 
 	evt := TopicEvent{
@@ -250,22 +380,45 @@ func (rm *RoomManager) handlePublish(s *melody.Session, keys *SessionKeys, op In
 		UserID:    keys.Claims.UserID,
 		FirstName: keys.Claims.FirstName,
 		Email:     keys.Claims.Email,
+		Service:   keys.Claims.IsService(),
 		Timestamp: time.Now().UnixMilli(),
 		Payload:   op.Payload,
+		Key:       op.Key,
+		To:        op.To,
+		ToUser:    op.ToUser,
 	}
 	data, err := json.Marshal(evt)
 	if err != nil {
 		logf(regionLocal, "error marshalling event: %v", err)
 		return
 	}
+	if op.To != "" || op.ToUser != "" {
+		// Direct events reach one user, so they stay out of the state event
+		// log and /internal/history, as they stay out of the snapshot.
+		rm.publishDirect(s, op, directTarget{SessionID: op.To, UserID: op.ToUser}, data)
+		return
+	}
+	if isStateEvent(op.Type) {
+		logf(regionLocal, "[event] %s %s topic=%s by %s",
+			op.Type, truncatePayloadForLog(op.Payload), topicIDForLog(topic), keys.DisplayName())
+		rm.recordStateEvent(evt, op.Payload, rm.localRegion())
+	}
+	rm.recordSnapshot(topic, op.Type, op.Key, keys.SessionID, evt.Timestamp, true, data)
 	rm.broadcastToTopic(topic, s, data)
 }
 
 // authorizeTopic mints a fresh internal JWT and calls the Next.js dispatcher.
+// Service accounts are decided locally from their token.
 func (rm *RoomManager) authorizeTopic(keys *SessionKeys, topic string) (string, error) {
+	if keys.Claims.IsService() {
+		return authorizeService(keys.Claims, topic)
+	}
 	if rm.authorizeOverride != nil {
 		return rm.authorizeOverride(keys.Claims, topic)
 	}
+	if rm.authzBatcher != nil {
+		return rm.authzBatcher.authorize(keys.Claims, topic)
+	}
 	if rm.auth == nil || rm.apiBase == "" {
 		return "", ErrTopicTransient
 	}
@@ -289,7 +442,16 @@ func errorCodeFor(err error) string {
 	}
 }
 
-func (rm *RoomManager) writeSubscribedAck(s *melody.Session, keys *SessionKeys, topic, permission, ref string) {
+func (rm *RoomManager) writeSubscribedAck(s sessionConn, keys *SessionKeys, topic, permission, ref string) {
+	data, err := json.Marshal(rm.subscribedAck(keys, topic, permission, ref))
+	if err != nil {
+		logf(regionLocal, "error marshalling subscribed ack: %v", err)
+		return
+	}
+	_ = writeFrame(s, data)
+}
+
+func (rm *RoomManager) subscribedAck(keys *SessionKeys, topic, permission, ref string) SubscribedAck {
 	sessions := rm.getSessionsInTopic(topic, keys.SessionID)
 	ack := SubscribedAck{
 		Op:         OpSubscribed,
@@ -297,29 +459,37 @@ func (rm *RoomManager) writeSubscribedAck(s *melody.Session, keys *SessionKeys,
 		Permission: permission,
 		SessionID:  keys.SessionID,
 		Sessions:   sessions,
+		Locks:      rm.topicLocks(topic),
+		Snapshot:   rm.topicSnapshot(topic),
 		Ref:        ref,
 	}
-	data, err := json.Marshal(ack)
-	if err != nil {
-		logf(regionLocal, "error marshalling subscribed ack: %v", err)
-		return
+	if keys.HasCapability(CapabilityUserPresence) {
+		ack.Users = aggregateUsers(sessions)
 	}
-	_ = s.Write(data)
+	return ack
 }
 
 // ------------------------------------------------------------
 // Topic membership + fan-out
 // ------------------------------------------------------------
 
-func (rm *RoomManager) addToTopic(topic string, s *melody.Session) {
+func (rm *RoomManager) addToTopic(topic string, s sessionConn) {
 	rm.mu.Lock()
 	isFirst := rm.topics[topic] == nil
 	if isFirst {
-		rm.topics[topic] = make(map[*melody.Session]struct{})
+		rm.topics[topic] = make(map[sessionConn]struct{})
 	}
 	rm.topics[topic][s] = struct{}{}
+	// A reload within the leave grace period finds the topic still active.
+	activated := rm.webhooks != nil && !rm.webhookTopics[topic]
+	if activated {
+		rm.webhookTopics[topic] = true
+	}
 	rm.mu.Unlock()
 
+	if activated {
+		rm.notifyWebhook(WebhookTopicActive, topic, nil)
+	}
 	if isFirst && rm.federator != nil {
 		rm.federator.Subscribe(topic, func(sourceRegion string, msg []byte) {
 			rm.handleFederatedMessage(topic, sourceRegion, msg)
@@ -328,7 +498,7 @@ func (rm *RoomManager) addToTopic(topic string, s *melody.Session) {
 	}
 }
 
-func (rm *RoomManager) removeFromTopic(topic string, s *melody.Session) {
+func (rm *RoomManager) removeFromTopic(topic string, s sessionConn) {
 	rm.mu.Lock()
 	members := rm.topics[topic]
 	if members == nil {
@@ -342,21 +512,28 @@ func (rm *RoomManager) removeFromTopic(topic string, s *melody.Session) {
 	}
 	rm.mu.Unlock()
 
+	if empty {
+		rm.dropTopicLocks(topic)
+		rm.dropTopicSnapshot(topic)
+		rm.dropYDoc(topic)
+	}
 	if empty && rm.federator != nil {
 		rm.federator.Unsubscribe(topic)
 		rm.remoteMu.Lock()
 		delete(rm.remoteSessions, topic)
+		delete(rm.resyncPending, topic)
 		rm.remoteMu.Unlock()
 	}
 }
 
 // broadcastToTopic delivers locally and publishes to federation.
-func (rm *RoomManager) broadcastToTopic(topic string, sender *melody.Session, msg []byte) {
+func (rm *RoomManager) broadcastToTopic(topic string, sender sessionConn, msg []byte) {
+	frame := newOutFrame(msg)
 	rm.mu.RLock()
 	members := rm.topics[topic]
 	for sess := range members {
 		if sess != sender {
-			_ = sess.Write(msg)
+			_ = frame.writeTo(sess)
 		}
 	}
 	rm.mu.RUnlock()
@@ -371,10 +548,11 @@ func (rm *RoomManager) broadcastToTopic(topic string, sender *melody.Session, ms
 // broadcastToTopicLocal writes a message to all local sessions in a topic
 // without re-publishing to federation. Used for cross-region message delivery.
 func (rm *RoomManager) broadcastToTopicLocal(topic string, msg []byte) {
+	frame := newOutFrame(msg)
 	rm.mu.RLock()
 	members := rm.topics[topic]
 	for sess := range members {
-		_ = sess.Write(msg)
+		_ = frame.writeTo(sess)
 	}
 	rm.mu.RUnlock()
 }
@@ -391,21 +569,16 @@ func (rm *RoomManager) getSessionsInTopic(topic string, excludeSessionId string)
 		if k.SessionID == excludeSessionId {
 			continue
 		}
-		entry, ok := k.Subs.Get(topic)
-		perm := ""
-		if ok {
-			perm = entry.Permission
-		}
-		result = append(result, SessionInfo{
-			SessionID:  k.SessionID,
-			UserID:     k.Claims.UserID,
-			FirstName:  k.Claims.FirstName,
-			Email:      k.Claims.Email,
-			Permission: perm,
-		})
+		result = append(result, localSessionInfo(k, topic))
 	}
 	rm.mu.RUnlock()
 
+	for _, info := range rm.heldSessions(topic) {
+		if info.SessionID != excludeSessionId {
+			result = append(result, info)
+		}
+	}
+
 	if rm.federator != nil {
 		rm.remoteMu.RLock()
 		for _, rs := range rm.remoteSessions[topic] {
@@ -423,24 +596,46 @@ func (rm *RoomManager) getSessionsInTopic(topic string, excludeSessionId string)
 // Event builders
 // ------------------------------------------------------------
 
+// localSessionInfo describes a local session as seen by a specific topic.
+func localSessionInfo(k *SessionKeys, topic string) SessionInfo {
+	entry, _ := k.Subs.Get(topic)
+	return SessionInfo{
+		SessionID:  k.SessionID,
+		UserID:     k.Claims.UserID,
+		FirstName:  k.Claims.FirstName,
+		Email:      k.Claims.Email,
+		Permission: entry.Permission,
+		Service:    k.Claims.IsService(),
+		LatencyMs:  k.LatencyMs(),
+		State:      entry.State,
+	}
+}
+
 // buildSessionEvent constructs a session_joined / session_left TopicEvent
 // scoped to a specific topic (because permission is per-topic now).
 func buildSessionEvent(eventType string, keys *SessionKeys, topic, permission string) []byte {
-	info := SessionInfo{
+	return buildSessionInfoEvent(eventType, topic, SessionInfo{
 		SessionID:  keys.SessionID,
 		UserID:     keys.Claims.UserID,
 		FirstName:  keys.Claims.FirstName,
 		Email:      keys.Claims.Email,
 		Permission: permission,
-	}
+		Service:    keys.Claims.IsService(),
+	})
+}
+
+// buildSessionInfoEvent is buildSessionEvent for sessions we only know by
+// their SessionInfo (e.g. remote sessions corrected after a resync).
+func buildSessionInfoEvent(eventType, topic string, info SessionInfo) []byte {
 	evt := TopicEvent{
 		Op:        OpEvent,
 		Topic:     topic,
 		Type:      eventType,
-		SessionID: keys.SessionID,
-		UserID:    keys.Claims.UserID,
-		FirstName: keys.Claims.FirstName,
-		Email:     keys.Claims.Email,
+		SessionID: info.SessionID,
+		UserID:    info.UserID,
+		FirstName: info.FirstName,
+		Email:     info.Email,
+		Service:   info.Service,
 		Timestamp: time.Now().UnixMilli(),
 		Payload:   info,
 	}
@@ -506,16 +701,16 @@ func (rm *RoomManager) publishLocalPresence(topic string) {
 		if k == nil || k.Claims == nil {
 			continue
 		}
-		entry, ok := k.Subs.Get(topic)
-		perm := ""
-		if ok {
-			perm = entry.Permission
-		}
-		if evt := buildSessionEvent(EventSessionJoined, k, topic, perm); evt != nil {
+		if evt := buildSessionInfoEvent(EventSessionJoined, topic, localSessionInfo(k, topic)); evt != nil {
 			events = append(events, evt)
 		}
 	}
 	rm.mu.RUnlock()
+	for _, info := range rm.heldSessions(topic) {
+		if evt := buildSessionInfoEvent(EventSessionJoined, topic, info); evt != nil {
+			events = append(events, evt)
+		}
+	}
 
 	for _, evt := range events {
 		_ = rm.federator.Publish(topic, evt)
@@ -533,10 +728,16 @@ func (rm *RoomManager) handleFederatedMessage(topic string, sourceRegion string,
 		Op        string          `json:"op"`
 		Topic     string          `json:"topic"`
 		Type      string          `json:"type"`
+		UserID    string          `json:"userId"`
 		FirstName string          `json:"firstName"`
 		Email     string          `json:"email"`
+		Service   bool            `json:"service"`
 		SessionID string          `json:"sessionId"`
 		Payload   json.RawMessage `json:"payload"`
+		To        string          `json:"to"`
+		ToUser    string          `json:"toUser"`
+		Update    string          `json:"update"`
+		Timestamp int64           `json:"timestamp"`
 	}
 	if err := json.Unmarshal(msg, &peek); err == nil {
 		// Defense in depth: reject cross-wired payloads.
@@ -545,8 +746,49 @@ func (rm *RoomManager) handleFederatedMessage(topic string, sourceRegion string,
 				topicLog, topicIDForLog(peek.Topic))
 			return
 		}
-		if peek.Type == EventPresenceSync {
-			rm.publishLocalPresence(topic)
+		if peek.Op == OpYUpdate {
+			rm.applyRemoteYUpdate(topic, sourceRegion, peek.Update, msg)
+			return
+		}
+		if peek.To != "" || peek.ToUser != "" {
+			if !rm.hasRemoteSender(topic, peek.SessionID, sourceRegion) {
+				logf(sourceRegion, "[federation] direct event from unknown session=%s topic=%s; dropping",
+					truncateID(peek.SessionID), topicLog)
+				return
+			}
+			rm.deliverDirectLocal(topic, nil, directTarget{SessionID: peek.To, UserID: peek.ToUser}, msg)
+			return
+		}
+
+		switch peek.Type {
+		case EventPresenceSync:
+			var req presenceSyncPayload
+			_ = json.Unmarshal(peek.Payload, &req)
+			if req.Resync {
+				rm.publishPresenceSnapshot(topic)
+			} else {
+				rm.publishLocalPresence(topic)
+			}
+			rm.publishLocalLocks(topic)
+			rm.publishLocalSnapshot(topic)
+			rm.publishYDocState(topic)
+			return
+		case EventPresenceSnapshot:
+			var snap presenceSnapshotPayload
+			if err := json.Unmarshal(peek.Payload, &snap); err != nil {
+				logf(sourceRegion, "[federation] bad presence snapshot for topic=%s: %v", topicLog, err)
+				return
+			}
+			rm.applyPresenceSnapshot(topic, sourceRegion, snap.Sessions)
+			return
+		case EventYDocState:
+			rm.applyYDocState(topic, sourceRegion, peek.Payload)
+			return
+		case EventStateSnapshot:
+			rm.applyStateSnapshot(topic, peek.Payload)
+			return
+		case EventLockAcquired, EventLockRenewed, EventLockReleased:
+			rm.handleRemoteLockEvent(topic, sourceRegion, peek.Type, peek.Payload, msg)
 			return
 		}
 
@@ -554,22 +796,60 @@ func (rm *RoomManager) handleFederatedMessage(topic string, sourceRegion string,
 		case EventSessionJoined:
 			var info SessionInfo
 			if json.Unmarshal(peek.Payload, &info) == nil && info.SessionID != "" {
+				info.Region = sourceRegion
 				rm.remoteMu.Lock()
 				rm.remoteSessions[topic] = appendRemoteSession(rm.remoteSessions[topic], info)
+				delete(rm.resyncPending[topic], info.SessionID)
 				rm.remoteMu.Unlock()
 			}
 			logf(sourceRegion, "[room] %s joined topic=%s", displayName(peek.FirstName, peek.Email), topicLog)
+		case EventSessionLatency:
+			var info SessionInfo
+			if json.Unmarshal(peek.Payload, &info) == nil {
+				rm.remoteMu.Lock()
+				for i := range rm.remoteSessions[topic] {
+					if rm.remoteSessions[topic][i].SessionID == info.SessionID {
+						rm.remoteSessions[topic][i].LatencyMs = info.LatencyMs
+					}
+				}
+				rm.remoteMu.Unlock()
+			}
+		case EventPresenceUpdated:
+			rm.remoteMu.Lock()
+			rm.applyRemotePresenceDelta(topic, peek.SessionID, peek.Payload)
+			rm.remoteMu.Unlock()
 		case EventSessionLeft:
 			rm.remoteMu.Lock()
 			rm.remoteSessions[topic] = removeRemoteSession(rm.remoteSessions[topic], peek.SessionID)
 			rm.remoteMu.Unlock()
+			rm.dropSessionSnapshot(topic, peek.SessionID)
 			logf(sourceRegion, "[room] %s left topic=%s", displayName(peek.FirstName, peek.Email), topicLog)
 		}
 
+		if peek.Type == EventSessionJoined || peek.Type == EventSessionLeft {
+			info := SessionInfo{SessionID: peek.SessionID, UserID: peek.UserID, FirstName: peek.FirstName, Email: peek.Email, Service: peek.Service}
+			if peek.Type == EventSessionJoined {
+				rm.announceJoin(topic, nil, info, msg, false)
+			} else {
+				rm.broadcastPresence(topic, nil, msg, rm.userEventFor(topic, peek.Type, info, nil), false)
+			}
+			return
+		}
+
 		if isStateEvent(peek.Type) {
 			logf(sourceRegion, "[event] %s %s topic=%s by %s",
 				peek.Type, truncatePayloadForLog(peek.Payload), topicLog, displayName(peek.FirstName, peek.Email))
+			rm.recordStateEvent(TopicEvent{
+				Topic:     topic,
+				Type:      peek.Type,
+				SessionID: peek.SessionID,
+				UserID:    peek.UserID,
+				FirstName: peek.FirstName,
+				Email:     peek.Email,
+				Timestamp: peek.Timestamp,
+			}, peek.Payload, sourceRegion)
 		}
+		rm.recordRemoteSnapshot(topic, msg)
 	}
 
 	rm.broadcastToTopicLocal(topic, msg)
@@ -597,15 +877,15 @@ func removeRemoteSession(sessions []SessionInfo, sessionId string) []SessionInfo
 // Small helpers
 // ------------------------------------------------------------
 
-func writeError(s *melody.Session, err ErrorMsg) {
+func writeError(s sessionConn, err ErrorMsg) {
 	data, mErr := json.Marshal(err)
 	if mErr != nil {
 		return
 	}
-	_ = s.Write(data)
+	_ = writeFrame(s, data)
 }
 
-func mustGetString(s *melody.Session, key string) string {
+func mustGetString(s sessionConn, key string) string {
 	v, ok := s.Get(key)
 	if !ok {
 		return ""
@@ -42,6 +42,7 @@ func setupTestServer() (*melody.Melody, *RoomManager, *httptest.Server) {
 
 	m.HandleConnect(func(s *melody.Session) { rooms.HandleConnect(s) })
 	m.HandleMessage(func(s *melody.Session, msg []byte) { rooms.HandleMessage(s, msg) })
+	m.HandleMessageBinary(func(s *melody.Session, msg []byte) { rooms.HandleMessageBinary(s, msg) })
 	m.HandleDisconnect(func(s *melody.Session) { rooms.HandleDisconnect(s) })
 
 	mux := http.NewServeMux()
@@ -78,6 +79,8 @@ type testClient struct {
 	done     chan struct{}
 	// sessionID populated from the first "subscribed" ack.
 	sessionID string
+	// hello is the server hello, taken off messages by dialRaw.
+	hello json.RawMessage
 }
 
 // dialRaw opens a connection to /ws with the given identity headers but does
@@ -99,6 +102,8 @@ func dialRaw(t *testing.T, server *httptest.Server, userId, firstName, permissio
 	}
 	tc := &testClient{conn: conn, done: make(chan struct{})}
 	go tc.readLoop()
+	tc.hello = tc.waitForOp(t, OpHello, "")
+	tc.clearMessages()
 	return tc
 }
 
@@ -202,6 +207,35 @@ func (tc *testClient) subscribeExpectError(t *testing.T, topic string) string {
 	}
 }
 
+// waitForOp waits for a frame with the given op (and ref, if non-empty) and
+// returns it. Unrelated frames are left in place.
+func (tc *testClient) waitForOp(t *testing.T, op, ref string) json.RawMessage {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		tc.mu.Lock()
+		for _, raw := range tc.messages {
+			var env struct {
+				Op  string `json:"op"`
+				Ref string `json:"ref"`
+			}
+			if json.Unmarshal(raw, &env) != nil {
+				continue
+			}
+			if env.Op == op && (ref == "" || env.Ref == ref) {
+				tc.mu.Unlock()
+				return raw
+			}
+		}
+		tc.mu.Unlock()
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for %s (ref=%q)", op, ref)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 func (tc *testClient) unsubscribe(t *testing.T, topic string) {
 	t.Helper()
 	ref := "unsub-" + topic + "-" + randSuffix()
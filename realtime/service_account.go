@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Service accounts are non-human identities for backend publishers (render
+// and thumbnail workers). Next.js signs their tokens with JWT_ACCESS_SECRET
+// like access tokens, plus kind "service" and two allow-lists: the topic
+// namespaces the account may subscribe to, and the event types it may
+// publish. The relay authorizes them itself; the Next.js authorize endpoint
+// only knows users.
+const (
+	claimKindService = "service"
+
+	// serviceDisplayName stands in for a service account's firstName when
+	// the token sets none, so clients never render a blank author.
+	serviceDisplayName = "System"
+
+	// servicePermission is the permission a service account gets on every
+	// topic in its namespaces. What it may write is bounded by EventTypes.
+	servicePermission = "editor"
+)
+
+// IsService reports whether the claims belong to a service account.
+func (c *Claims) IsService() bool {
+	return c != nil && c.Kind == claimKindService
+}
+
+// checkKind validates the kind claim and, for service accounts, their
+// allow-lists. It fills in the display name.
+func (c *Claims) checkKind() error {
+	switch c.Kind {
+	case "":
+		return nil
+	case claimKindService:
+	default:
+		return fmt.Errorf("unknown token kind %q", c.Kind)
+	}
+	if len(c.Namespaces) == 0 {
+		return fmt.Errorf("service token without namespaces")
+	}
+	if strings.TrimSpace(c.FirstName) == "" {
+		c.FirstName = serviceDisplayName
+	}
+	return nil
+}
+
+// mayPublish reports whether the claims allow writing eventType. Users are
+// bounded by their topic permission instead, so they always may. Ops that
+// write without a publish (yupdate, lock) count as their op name.
+func (c *Claims) mayPublish(eventType string) bool {
+	if !c.IsService() {
+		return true
+	}
+	for _, t := range c.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeService decides a service account's access to topic from its
+// namespace allow-list.
+func authorizeService(claims *Claims, topic string) (string, error) {
+	ns, _, err := parseTopic(topic)
+	if err != nil {
+		return "", ErrTopicBadRequest
+	}
+	for _, allowed := range claims.Namespaces {
+		if allowed == ns {
+			return servicePermission, nil
+		}
+	}
+	return "", ErrTopicForbidden
+}
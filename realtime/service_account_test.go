@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var testServiceSecret = []byte("handshake-test-secret")
+
+func testServiceClaims(namespaces, eventTypes []string) *Claims {
+	return &Claims{
+		UserID:     "svc-render",
+		Kind:       claimKindService,
+		Namespaces: namespaces,
+		EventTypes: eventTypes,
+		Exp:        time.Now().Add(5 * time.Minute).Unix(),
+	}
+}
+
+// dialWithToken opens a WebSocket on the handshake fixture with a Bearer
+// token.
+func dialWithToken(t *testing.T, srv *httptest.Server, token string) *testClient {
+	t.Helper()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/connection"
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("failed to dial /ws: %v", err)
+	}
+	tc := &testClient{conn: conn, done: make(chan struct{})}
+	go tc.readLoop()
+	return tc
+}
+
+func TestValidateJWT_ServiceTokens(t *testing.T) {
+	a := &Auth{jwtSecret: testServiceSecret}
+
+	got, err := a.validateJWT(signTestJWT(t, a.jwtSecret, testServiceClaims([]string{"desktop"}, nil)))
+	if err != nil {
+		t.Fatalf("validateJWT: %v", err)
+	}
+	if !got.IsService() || got.FirstName != serviceDisplayName {
+		t.Fatalf("expected a service account displayed as %q, got %+v", serviceDisplayName, got)
+	}
+
+	named := testServiceClaims([]string{"desktop"}, nil)
+	named.FirstName = "Render worker"
+	if got, _ := a.validateJWT(signTestJWT(t, a.jwtSecret, named)); got == nil || got.FirstName != "Render worker" {
+		t.Fatalf("a firstName in the token should be kept, got %+v", got)
+	}
+
+	if _, err := a.validateJWT(signTestJWT(t, a.jwtSecret, testServiceClaims(nil, nil))); err == nil {
+		t.Error("a service token without namespaces should be rejected")
+	}
+	robot := testServiceClaims([]string{"desktop"}, nil)
+	robot.Kind = "robot"
+	if _, err := a.validateJWT(signTestJWT(t, a.jwtSecret, robot)); err == nil {
+		t.Error("an unknown kind should be rejected")
+	}
+}
+
+func TestServiceAccount_ScopedAccess(t *testing.T) {
+	srv := buildHandshakeFixture(t, testServiceSecret)
+	defer srv.Close()
+	topic := "desktop:svc"
+
+	user := dialWithToken(t, srv, signTestJWT(t, testServiceSecret, &Claims{UserID: "u-alice", FirstName: "Alice"}))
+	defer user.close()
+	user.subscribe(t, topic)
+
+	svc := dialWithToken(t, srv, signTestJWT(t, testServiceSecret,
+		testServiceClaims([]string{"desktop"}, []string{"render_progress"})))
+	defer svc.close()
+	svc.subscribe(t, topic)
+	if code := svc.subscribeExpectError(t, "production-table:svc"); code != ErrCodeForbidden {
+		t.Fatalf("namespace outside the allow-list: got %s, want forbidden", code)
+	}
+
+	svc.publish(t, topic, "render_progress", map[string]any{"pct": 50})
+	svc.sendRaw(t, map[string]any{"op": "publish", "topic": topic, "type": "asset_removed", "ref": "p2"})
+	if code := errorCode(svc.waitForOp(t, OpError, "p2")); code != ErrCodeForbidden {
+		t.Fatalf("event type outside the allow-list: got %s, want forbidden", code)
+	}
+	svc.lock(t, OpLock, topic, "asset:a1", "l1")
+	if code := errorCode(svc.waitForOp(t, OpError, "l1")); code != ErrCodeForbidden {
+		t.Fatalf("lock outside the allow-list: got %s, want forbidden", code)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if len(user.findEventsOfType("asset_removed", topic)) != 0 {
+		t.Fatal("disallowed event type should not be delivered")
+	}
+	events := user.findEventsOfType("render_progress", topic)
+	if len(events) != 1 {
+		t.Fatalf("expected the allowed event, got %d", len(events))
+	}
+	var evt TopicEvent
+	json.Unmarshal(events[0], &evt)
+	if !evt.Service || evt.FirstName != serviceDisplayName || evt.UserID != "svc-render" {
+		t.Fatalf("event should carry the service display identity, got %+v", evt)
+	}
+
+	joined := user.findEventsOfType(EventSessionJoined, topic)
+	if len(joined) != 1 {
+		t.Fatalf("expected the service session to join, got %d", len(joined))
+	}
+	var join struct {
+		Payload SessionInfo `json:"payload"`
+	}
+	json.Unmarshal(joined[0], &join)
+	if !join.Payload.Service || join.Payload.Permission != servicePermission {
+		t.Fatalf("unexpected service session info %+v", join.Payload)
+	}
+}
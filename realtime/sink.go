@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StateEventRecord is one accepted state event (see isStateEvent) as
+// written to an EventSink. Seq increases by one per record on this relay
+// and survives restarts.
+type StateEventRecord struct {
+	Seq       uint64          `json:"seq"`
+	Topic     string          `json:"topic"`
+	Type      string          `json:"type"`
+	SessionID string          `json:"sessionId"`
+	UserID    string          `json:"userId"`
+	FirstName string          `json:"firstName"`
+	Email     string          `json:"email"`
+	Region    string          `json:"region"`
+	Timestamp int64           `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// EventSink is an append-only store of state events.
+type EventSink interface {
+	// Write appends records, which arrive in seq order.
+	Write(recs []StateEventRecord) error
+	// LastSeq is the highest seq stored, 0 when empty.
+	LastSeq() (uint64, error)
+	Close() error
+}
+
+// EventReader is implemented by sinks that can serve history queries.
+type EventReader interface {
+	// ReadTopic returns up to q.Limit records of q.Topic in seq order:
+	// the oldest matches for forward queries, the newest otherwise.
+	ReadTopic(q HistoryQuery) ([]StateEventRecord, error)
+}
+
+// HistoryQuery selects a topic's records. With AfterSeq or Since set it
+// reads forward from there; otherwise it reads back from BeforeSeq (0 =
+// the newest record).
+type HistoryQuery struct {
+	Topic     string
+	AfterSeq  uint64
+	Since     int64 // Unix ms, inclusive
+	BeforeSeq uint64
+	Limit     int
+}
+
+func (q HistoryQuery) forward() bool { return q.AfterSeq > 0 || q.Since > 0 }
+
+// matches reports whether rec falls in q's range, ignoring Limit.
+func (q HistoryQuery) matches(rec *StateEventRecord) bool {
+	if rec.Topic != q.Topic {
+		return false
+	}
+	if q.forward() {
+		return rec.Seq > q.AfterSeq && rec.Timestamp >= q.Since
+	}
+	return q.BeforeSeq == 0 || rec.Seq < q.BeforeSeq
+}
+
+// SinkOptions configures the built-in sinks.
+type SinkOptions struct {
+	Path string
+
+	// JSONL only: rotate to a new file after RotateBytes, and keep at most
+	// KeepFiles files (0 = keep all).
+	RotateBytes int64
+	KeepFiles   int
+}
+
+// eventSinks maps EVENT_SINK values to constructors. Optional backends
+// register themselves from their own (build-tagged) files.
+var eventSinks = map[string]func(SinkOptions) (EventSink, error){
+	"jsonl": openJSONLSink,
+}
+
+// openEventSink opens the sink named kind.
+func openEventSink(kind string, opts SinkOptions) (EventSink, error) {
+	open, ok := eventSinks[kind]
+	if !ok {
+		known := make([]string, 0, len(eventSinks))
+		for k := range eventSinks {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		hint := ""
+		if kind == "sqlite" {
+			hint = " (sqlite requires building with -tags sqlite)"
+		}
+		return nil, fmt.Errorf("unknown event sink %q, want one of %s%s", kind, strings.Join(known, ", "), hint)
+	}
+	return open(opts)
+}
+
+// eventSinkStats counts records by outcome: written, dropped (queue full)
+// and failed (sink error).
+var eventSinkStats = expvar.NewMap("event_sink")
+
+const (
+	defaultEventQueueSize = 4096
+	eventSinkMaxBatch     = 256
+)
+
+// eventLog feeds an EventSink from a bounded queue on its own goroutine, so
+// a slow disk never stalls publishes. Records are dropped (and counted)
+// when the queue is full.
+type eventLog struct {
+	sink EventSink
+
+	mu      sync.Mutex
+	seq     uint64
+	queue   chan StateEventRecord
+	closed  bool
+	stopped chan struct{}
+}
+
+func newEventLog(sink EventSink, queueSize int) (*eventLog, error) {
+	last, err := sink.LastSeq()
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLog{
+		sink:    sink,
+		seq:     last,
+		queue:   make(chan StateEventRecord, queueSize),
+		stopped: make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// Record stamps rec with the next seq and queues it. Never blocks.
+func (l *eventLog) Record(rec StateEventRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	rec.Seq = l.seq + 1
+	select {
+	case l.queue <- rec:
+		l.seq = rec.Seq
+	default:
+		eventSinkStats.Add("dropped", 1)
+	}
+}
+
+func (l *eventLog) run() {
+	defer close(l.stopped)
+	batch := make([]StateEventRecord, 0, eventSinkMaxBatch)
+	for rec := range l.queue {
+		batch = append(batch[:0], rec)
+	drain:
+		for len(batch) < eventSinkMaxBatch {
+			select {
+			case more, ok := <-l.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, more)
+			default:
+				break drain
+			}
+		}
+		if err := l.sink.Write(batch); err != nil {
+			eventSinkStats.Add("failed", int64(len(batch)))
+			logf(regionLocal, "[sink] write of %d events failed: %v", len(batch), err)
+			continue
+		}
+		eventSinkStats.Add("written", int64(len(batch)))
+	}
+}
+
+// Close flushes queued records and closes the sink.
+func (l *eventLog) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.queue)
+	l.mu.Unlock()
+	<-l.stopped
+	return l.sink.Close()
+}
+
+// localRegion names this relay in records: its federation region, or
+// "local" in single-server mode.
+func (rm *RoomManager) localRegion() string {
+	if rm.regionId != "" {
+		return rm.regionId
+	}
+	return regionLocal
+}
+
+// recordStateEvent sends an accepted state event to the event sink, if one
+// is configured.
+func (rm *RoomManager) recordStateEvent(evt TopicEvent, payload json.RawMessage, region string) {
+	if rm.events == nil {
+		return
+	}
+	ts := evt.Timestamp
+	if ts == 0 {
+		ts = time.Now().UnixMilli()
+	}
+	rm.events.Record(StateEventRecord{
+		Topic:     evt.Topic,
+		Type:      evt.Type,
+		SessionID: evt.SessionID,
+		UserID:    evt.UserID,
+		FirstName: evt.FirstName,
+		Email:     evt.Email,
+		Region:    region,
+		Timestamp: ts,
+		Payload:   payload,
+	})
+}
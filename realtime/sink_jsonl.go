@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultJSONLRotateBytes = 64 << 20
+	jsonlPrefix             = "events-"
+	jsonlSuffix             = ".jsonl"
+)
+
+// jsonlSink writes one JSON record per line into files named after the
+// first seq they hold (events-00000000000000000042.jsonl), so names sort
+// in write order. A new file is started on open and whenever the current
+// one passes RotateBytes.
+type jsonlSink struct {
+	dir         string
+	rotateBytes int64
+	keepFiles   int
+
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	lastSeq uint64
+}
+
+func openJSONLSink(opts SinkOptions) (EventSink, error) {
+	dir := opts.Path
+	if dir == "" {
+		dir = "events"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &jsonlSink{dir: dir, rotateBytes: opts.RotateBytes, keepFiles: opts.KeepFiles}
+	if s.rotateBytes <= 0 {
+		s.rotateBytes = defaultJSONLRotateBytes
+	}
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	// The newest file may be empty if the relay stopped right after a rotate.
+	for i := len(files) - 1; i >= 0 && s.lastSeq == 0; i-- {
+		if s.lastSeq, err = lastSeqInFile(filepath.Join(dir, files[i])); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// files lists the sink's files, oldest first.
+func (s *jsonlSink) files() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), jsonlPrefix) && strings.HasSuffix(e.Name(), jsonlSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *jsonlSink) LastSeq() (uint64, error) { return s.lastSeq, nil }
+
+func (s *jsonlSink) Write(recs []StateEventRecord) error {
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if s.f == nil || s.size >= s.rotateBytes {
+			if err := s.rotate(rec.Seq); err != nil {
+				return err
+			}
+		}
+		line = append(line, '\n')
+		if _, err := s.w.Write(line); err != nil {
+			return err
+		}
+		s.size += int64(len(line))
+		s.lastSeq = rec.Seq
+	}
+	if s.w == nil {
+		return nil
+	}
+	return s.w.Flush()
+}
+
+// rotate closes the current file and starts one whose first record is seq,
+// then prunes old files beyond keepFiles.
+func (s *jsonlSink) rotate(seq uint64) error {
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", jsonlPrefix, seq, jsonlSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.f, s.w, s.size = f, bufio.NewWriter(f), 0
+
+	if s.keepFiles <= 0 {
+		return nil
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for len(files) > s.keepFiles {
+		if err := os.Remove(filepath.Join(s.dir, files[0])); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (s *jsonlSink) closeFile() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f, s.w = nil, nil
+	return err
+}
+
+func (s *jsonlSink) Close() error { return s.closeFile() }
+
+// firstSeqOf parses the first seq from a file name.
+func firstSeqOf(name string) uint64 {
+	n, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, jsonlPrefix), jsonlSuffix), 10, 64)
+	return n
+}
+
+// ReadTopic scans the files that can hold q's range: forward from the file
+// holding AfterSeq, or backward from the newest file until Limit records
+// are found. It may run alongside Write; a partly written last line is
+// skipped and files pruned meanwhile are ignored.
+func (s *jsonlSink) ReadTopic(q HistoryQuery) ([]StateEventRecord, error) {
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	if q.forward() {
+		var out []StateEventRecord
+		for i, name := range files {
+			if i+1 < len(files) && firstSeqOf(files[i+1]) <= q.AfterSeq+1 {
+				continue // holds only seqs <= AfterSeq
+			}
+			if out, err = s.scanFile(name, q, out, q.Limit-len(out)); err != nil {
+				return nil, err
+			}
+			if len(out) >= q.Limit {
+				break
+			}
+		}
+		return out, nil
+	}
+
+	var out []StateEventRecord
+	for i := len(files) - 1; i >= 0 && len(out) < q.Limit; i-- {
+		if q.BeforeSeq > 0 && firstSeqOf(files[i]) >= q.BeforeSeq {
+			continue
+		}
+		page, err := s.scanFile(files[i], q, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if need := q.Limit - len(out); len(page) > need {
+			page = page[len(page)-need:]
+		}
+		out = append(page, out...)
+	}
+	return out, nil
+}
+
+// scanFile appends the records of name matching q to out, stopping after
+// max of them (0 = no limit).
+func (s *jsonlSink) scanFile(name string, q HistoryQuery, out []StateEventRecord, max int) ([]StateEventRecord, error) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Cheap pre-filter before decoding: the topic as json.Marshal writes it.
+	topic, _ := json.Marshal(q.Topic)
+	needle := append([]byte(`"topic":`), topic...)
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 4<<20)
+	found := 0
+	for sc.Scan() {
+		line := sc.Bytes()
+		if !bytes.Contains(line, needle) {
+			continue
+		}
+		var rec StateEventRecord
+		if json.Unmarshal(line, &rec) != nil || !q.matches(&rec) {
+			continue
+		}
+		out = append(out, rec)
+		if found++; max > 0 && found >= max {
+			break
+		}
+	}
+	return out, sc.Err()
+}
+
+// lastSeqInFile returns the seq of the last complete record in a JSONL
+// file, reading only its tail.
+func lastSeqInFile(name string) (uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	const tail = 1 << 20
+	offset := info.Size() - tail
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return 0, err
+	}
+	lines := bytes.Split(bytes.TrimRight(buf, "\n"), []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		if i == 0 && offset > 0 {
+			break // may be cut off
+		}
+		var rec struct {
+			Seq uint64 `json:"seq"`
+		}
+		if json.Unmarshal(lines[i], &rec) == nil && rec.Seq > 0 {
+			return rec.Seq, nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,146 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/url"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	eventSinks["sqlite"] = openSQLiteSink
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS state_events (
+	seq        INTEGER PRIMARY KEY,
+	topic      TEXT    NOT NULL,
+	type       TEXT    NOT NULL,
+	session_id TEXT    NOT NULL,
+	user_id    TEXT    NOT NULL,
+	first_name TEXT    NOT NULL,
+	email      TEXT    NOT NULL,
+	region     TEXT    NOT NULL,
+	ts         INTEGER NOT NULL,
+	payload    TEXT
+);
+CREATE INDEX IF NOT EXISTS state_events_topic_seq ON state_events (topic, seq);
+`
+
+// sqliteSink stores state events in a SQLite database (cgo, build tag
+// "sqlite"). One row per event, keyed by seq.
+type sqliteSink struct {
+	db *sql.DB
+}
+
+func openSQLiteSink(opts SinkOptions) (EventSink, error) {
+	path := opts.Path
+	if path == "" {
+		path = "events.db"
+	}
+	// A URI, so that '?', '#' or '%' in the path can't spill into the
+	// options.
+	dsn := url.URL{
+		Scheme:   "file",
+		Path:     path,
+		OmitHost: true,
+		RawQuery: url.Values{"_journal_mode": {"WAL"}, "_busy_timeout": {"5000"}}.Encode(),
+	}
+	db, err := sql.Open("sqlite3", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteSink{db: db}, nil
+}
+
+func (s *sqliteSink) LastSeq() (uint64, error) {
+	var seq sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(seq) FROM state_events`).Scan(&seq); err != nil {
+		return 0, err
+	}
+	return uint64(seq.Int64), nil
+}
+
+func (s *sqliteSink) Write(recs []StateEventRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO state_events
+		(seq, topic, type, session_id, user_id, first_name, email, region, ts, payload)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range recs {
+		var payload any
+		if len(r.Payload) > 0 {
+			payload = string(r.Payload)
+		}
+		if _, err := stmt.Exec(int64(r.Seq), r.Topic, r.Type, r.SessionID, r.UserID, r.FirstName, r.Email, r.Region, r.Timestamp, payload); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteSink) ReadTopic(q HistoryQuery) ([]StateEventRecord, error) {
+	const cols = `seq, topic, type, session_id, user_id, first_name, email, region, ts, payload`
+	var rows *sql.Rows
+	var err error
+	if q.forward() {
+		rows, err = s.db.Query(`SELECT `+cols+` FROM state_events
+			WHERE topic = ? AND seq > ? AND ts >= ? ORDER BY seq LIMIT ?`,
+			q.Topic, int64(q.AfterSeq), q.Since, q.Limit)
+	} else {
+		before := int64(math.MaxInt64)
+		if q.BeforeSeq > 0 {
+			before = int64(q.BeforeSeq)
+		}
+		rows, err = s.db.Query(`SELECT `+cols+` FROM state_events
+			WHERE topic = ? AND seq < ? ORDER BY seq DESC LIMIT ?`,
+			q.Topic, before, q.Limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []StateEventRecord
+	for rows.Next() {
+		var r StateEventRecord
+		var seq int64
+		var payload sql.NullString
+		if err := rows.Scan(&seq, &r.Topic, &r.Type, &r.SessionID, &r.UserID, &r.FirstName, &r.Email, &r.Region, &r.Timestamp, &payload); err != nil {
+			return nil, err
+		}
+		r.Seq = uint64(seq)
+		if payload.Valid {
+			r.Payload = json.RawMessage(payload.String)
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !q.forward() {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	return out, nil
+}
+
+func (s *sqliteSink) Close() error { return s.db.Close() }
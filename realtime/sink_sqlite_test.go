@@ -0,0 +1,82 @@
+//go:build sqlite
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteSink_WritesAndResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	s, err := openEventSink("sqlite", SinkOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last, _ := s.LastSeq(); last != 0 {
+		t.Fatalf("empty sink should report seq 0, got %d", last)
+	}
+	recs := []StateEventRecord{
+		{Seq: 1, Topic: "desktop:x", Type: "asset_moved", SessionID: "s1", UserID: "u1", Region: "local", Timestamp: 1, Payload: json.RawMessage(`{"id":"a"}`)},
+		{Seq: 2, Topic: "desktop:x", Type: "asset_removed", SessionID: "s1", UserID: "u1", Region: "local", Timestamp: 2},
+	}
+	if err := s.Write(recs); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = openEventSink("sqlite", SinkOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if last, _ := s.LastSeq(); last != 2 {
+		t.Fatalf("reopened sink should resume after seq 2, got %d", last)
+	}
+	var payload string
+	if err := s.(*sqliteSink).db.QueryRow(`SELECT payload FROM state_events WHERE seq = 1`).Scan(&payload); err != nil || payload != `{"id":"a"}` {
+		t.Fatalf("payload not stored: %q %v", payload, err)
+	}
+}
+
+func TestSQLiteSink_ReadTopic(t *testing.T) {
+	s, err := openEventSink("sqlite", SinkOptions{Path: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for seq := uint64(1); seq <= 12; seq++ {
+		topic := "desktop:a"
+		if seq%3 == 0 {
+			topic = "desktop:b"
+		}
+		s.Write([]StateEventRecord{{Seq: seq, Topic: topic, Type: "asset_moved", Timestamp: int64(seq * 10)}})
+	}
+	r := s.(EventReader)
+	if got, _ := r.ReadTopic(HistoryQuery{Topic: "desktop:b", Limit: 2}); !equalSeqs(got, 9, 12) {
+		t.Errorf("newest: got %v", seqsOf(got))
+	}
+	if got, _ := r.ReadTopic(HistoryQuery{Topic: "desktop:b", BeforeSeq: 9, Limit: 5}); !equalSeqs(got, 3, 6) {
+		t.Errorf("before: got %v", seqsOf(got))
+	}
+	if got, _ := r.ReadTopic(HistoryQuery{Topic: "desktop:a", AfterSeq: 7, Since: 20, Limit: 5}); !equalSeqs(got, 8, 10, 11) {
+		t.Errorf("after: got %v", seqsOf(got))
+	}
+}
+
+func TestSQLiteSink_PathIsEscaped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events?mode=ro#1%.db")
+	s, err := openEventSink("sqlite", SinkOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Write([]StateEventRecord{{Seq: 1, Topic: "desktop:x", Type: "asset_moved", Region: "local"}}); err != nil {
+		t.Fatalf("path characters leaked into the DSN options: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("database should be created at the literal path: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSink is an in-memory EventSink for tests.
+type memSink struct {
+	mu   sync.Mutex
+	recs []StateEventRecord
+	last uint64
+}
+
+func (m *memSink) Write(recs []StateEventRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recs = append(m.recs, recs...)
+	return nil
+}
+
+func (m *memSink) LastSeq() (uint64, error) { return m.last, nil }
+func (m *memSink) Close() error             { return nil }
+
+func (m *memSink) records() []StateEventRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]StateEventRecord(nil), m.recs...)
+}
+
+func withMemSink(t *testing.T, rooms *RoomManager) *memSink {
+	t.Helper()
+	sink := &memSink{}
+	events, err := newEventLog(sink, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms.events = events
+	t.Cleanup(func() { events.Close() })
+	return sink
+}
+
+func TestEventSink_RecordsAcceptedStateEvents(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	sink := withMemSink(t, rooms)
+	topic := "desktop:audit"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	viewer := connectAndSubscribe(t, server, topic, "u-view", "View", "viewer")
+	defer viewer.close()
+
+	alice.publish(t, topic, "asset_moved", map[string]any{"id": "a1", "x": 1})
+	alice.publish(t, topic, "asset_selected", map[string]any{"id": "a1"})                  // not a state event
+	viewer.publish(t, topic, "asset_removed", map[string]any{"id": "a1"})                  // blocked
+	alice.publishTo(t, topic, "asset_removed", "", map[string]any{"to": viewer.sessionID}) // direct
+	alice.publish(t, topic, "asset_added", map[string]any{"id": "a2"})
+	time.Sleep(100 * time.Millisecond)
+
+	recs := sink.records()
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records, got %+v", recs)
+	}
+	r := recs[0]
+	if r.Seq != 1 || r.Type != "asset_moved" || r.Topic != topic || r.SessionID != alice.sessionID ||
+		r.UserID != "u-alice" || r.Region != regionLocal || r.Timestamp == 0 || string(r.Payload) != `{"id":"a1","x":1}` {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	if recs[1].Seq != 2 || recs[1].Type != "asset_added" {
+		t.Fatalf("unexpected second record: %+v", recs[1])
+	}
+}
+
+func TestEventSink_RecordsFederatedEventsWithSourceRegion(t *testing.T) {
+	us, hk, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	usSink := withMemSink(t, us)
+	hkSink := withMemSink(t, hk)
+	topic := "desktop:audit-fed"
+
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	time.Sleep(200 * time.Millisecond)
+
+	alice.publish(t, topic, "asset_resized", map[string]any{"id": "a1"})
+	time.Sleep(200 * time.Millisecond)
+
+	for name, tc := range map[string]struct {
+		sink   *memSink
+		region string
+	}{"us": {usSink, "us-east-2"}, "hk": {hkSink, "us-east-2"}} {
+		recs := tc.sink.records()
+		if len(recs) != 1 || recs[0].Region != tc.region || recs[0].SessionID != alice.sessionID {
+			t.Errorf("%s: expected alice's event from %s, got %+v", name, tc.region, recs)
+		}
+	}
+}
+
+func TestEventLog_DropsWhenQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	sink := &blockingSink{release: block}
+	events, err := newEventLog(sink, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := expvarInt(eventSinkStats, "dropped")
+	for i := 0; i < 10; i++ {
+		events.Record(StateEventRecord{Type: "asset_moved"})
+	}
+	if got := expvarInt(eventSinkStats, "dropped") - before; got == 0 {
+		t.Fatal("records beyond the queue should be dropped, not block")
+	}
+	close(block)
+	if err := events.Close(); err != nil {
+		t.Fatal(err)
+	}
+	seqs := sink.seqs()
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("accepted records should have gapless seqs, got %v", seqs)
+		}
+	}
+}
+
+func expvarInt(m *expvar.Map, key string) int64 {
+	v, ok := m.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+type blockingSink struct {
+	memSink
+	release chan struct{}
+}
+
+func (b *blockingSink) Write(recs []StateEventRecord) error {
+	<-b.release
+	return b.memSink.Write(recs)
+}
+
+func (b *blockingSink) seqs() []uint64 {
+	var out []uint64
+	for _, r := range b.records() {
+		out = append(out, r.Seq)
+	}
+	return out
+}
+
+func TestJSONLSink_RotatesAndResumes(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *jsonlSink {
+		s, err := openJSONLSink(SinkOptions{Path: dir, RotateBytes: 300, KeepFiles: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.(*jsonlSink)
+	}
+	rec := func(seq uint64) StateEventRecord {
+		return StateEventRecord{Seq: seq, Topic: "desktop:x", Type: "asset_moved", Region: "local", Payload: json.RawMessage(`{"id":"a"}`)}
+	}
+
+	s := open()
+	for seq := uint64(1); seq <= 20; seq++ {
+		if err := s.Write([]StateEventRecord{rec(seq)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	files, _ := s.files()
+	if len(files) != 3 {
+		t.Fatalf("expected rotation to keep 3 files, got %v", files)
+	}
+	if !strings.HasPrefix(files[0], jsonlPrefix) || files[0] >= files[1] {
+		t.Fatalf("files should sort in write order: %v", files)
+	}
+	lines := readJSONL(t, filepath.Join(dir, files[2]))
+	if lines[len(lines)-1].Seq != 20 {
+		t.Fatalf("last file should end at seq 20, got %+v", lines[len(lines)-1])
+	}
+
+	s = open()
+	if last, _ := s.LastSeq(); last != 20 {
+		t.Fatalf("reopened sink should resume after seq 20, got %d", last)
+	}
+	s.Write([]StateEventRecord{rec(21)})
+	s.Close()
+	files, _ = s.files()
+	if got := readJSONL(t, filepath.Join(dir, files[len(files)-1])); len(got) != 1 || got[0].Seq != 21 {
+		t.Fatalf("a reopened sink should start a new file, got %+v", got)
+	}
+}
+
+func readJSONL(t *testing.T, name string) []StateEventRecord {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []StateEventRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r StateEventRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("bad line %q: %v", sc.Text(), err)
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func TestOpenEventSink_Unknown(t *testing.T) {
+	if _, err := openEventSink("kafka", SinkOptions{}); err == nil {
+		t.Fatal("unknown sink should fail")
+	}
+}
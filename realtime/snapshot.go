@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// EventStateSnapshot carries a relay's locally published snapshot entries
+// for a topic, in reply to a presence sync request. Receivers merge them;
+// never forwarded to clients.
+const EventStateSnapshot = "state_snapshot"
+
+// MaxSnapshotEntries caps the entries kept per topic. The oldest entry is
+// evicted first.
+const MaxSnapshotEntries = 200
+
+// defaultSnapshotEventTypes are the transient-state events a late joiner
+// would otherwise miss. Overridden by SNAPSHOT_EVENT_TYPES.
+var defaultSnapshotEventTypes = []string{
+	"asset_selected", "asset_deselected", "asset_dragging",
+	"cell_selected", "cell_deselected", "table_generating",
+	"pt_cell_selected", "pt_cell_deselected",
+}
+
+// parseSnapshotEventTypes parses a comma-separated event type list.
+func parseSnapshotEventTypes(list string) map[string]bool {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	return types
+}
+
+// stateSnapshotPayload is the payload of a state_snapshot event.
+type stateSnapshotPayload struct {
+	Events []json.RawMessage `json:"events"`
+}
+
+// snapshotEntry is the last event published for one resource in a topic.
+type snapshotEntry struct {
+	sessionID string
+	timestamp int64
+	local     bool
+	event     json.RawMessage
+}
+
+// snapshotKey identifies the resource an event describes. Publishers name
+// it with key, so e.g. asset_deselected replaces asset_selected; without a
+// key each session keeps one entry per event type.
+func snapshotKey(eventType, key, sessionID string) string {
+	if key != "" {
+		return "k:" + key
+	}
+	return "s:" + sessionID + ":" + eventType
+}
+
+// recordSnapshot stores event as the last known state of its resource if
+// eventType is tracked. Entries converge across regions by last writer
+// wins on (timestamp, session ID), whatever order they arrive in.
+func (rm *RoomManager) recordSnapshot(topic, eventType, key, sessionID string, timestamp int64, local bool, event []byte) {
+	if !rm.snapshotTypes[eventType] {
+		return
+	}
+	k := snapshotKey(eventType, key, sessionID)
+
+	rm.snapMu.Lock()
+	defer rm.snapMu.Unlock()
+	entries := rm.snapshots[topic]
+	if entries == nil {
+		entries = make(map[string]*snapshotEntry)
+		rm.snapshots[topic] = entries
+	}
+	if cur := entries[k]; cur != nil {
+		if timestamp < cur.timestamp || (timestamp == cur.timestamp && sessionID < cur.sessionID) {
+			return
+		}
+	} else if len(entries) >= MaxSnapshotEntries {
+		var oldest string
+		for ek, e := range entries {
+			if oldest == "" || e.timestamp < entries[oldest].timestamp {
+				oldest = ek
+			}
+		}
+		delete(entries, oldest)
+	}
+	entries[k] = &snapshotEntry{sessionID: sessionID, timestamp: timestamp, local: local, event: event}
+}
+
+// recordRemoteSnapshot records a federated event.
+func (rm *RoomManager) recordRemoteSnapshot(topic string, event []byte) {
+	var peek struct {
+		Topic     string `json:"topic"`
+		Type      string `json:"type"`
+		Key       string `json:"key"`
+		SessionID string `json:"sessionId"`
+		Timestamp int64  `json:"timestamp"`
+		To        string `json:"to"`
+		ToUser    string `json:"toUser"`
+	}
+	if json.Unmarshal(event, &peek) != nil || peek.Topic != topic || peek.SessionID == "" || peek.To != "" || peek.ToUser != "" {
+		return
+	}
+	rm.recordSnapshot(topic, peek.Type, peek.Key, peek.SessionID, peek.Timestamp, false, event)
+}
+
+// topicSnapshot returns the topic's entries, oldest first, for subscribed acks.
+func (rm *RoomManager) topicSnapshot(topic string) []json.RawMessage {
+	rm.snapMu.Lock()
+	entries := make([]*snapshotEntry, 0, len(rm.snapshots[topic]))
+	for _, e := range rm.snapshots[topic] {
+		entries = append(entries, e)
+	}
+	rm.snapMu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].timestamp != entries[j].timestamp {
+			return entries[i].timestamp < entries[j].timestamp
+		}
+		return entries[i].sessionID < entries[j].sessionID
+	})
+	out := make([]json.RawMessage, len(entries))
+	for i, e := range entries {
+		out[i] = e.event
+	}
+	return out
+}
+
+// dropSessionSnapshot forgets what sessionID published in topic. The state
+// is transient: a departed session's selection or drag is no longer true.
+func (rm *RoomManager) dropSessionSnapshot(topic, sessionID string) {
+	rm.snapMu.Lock()
+	for k, e := range rm.snapshots[topic] {
+		if e.sessionID == sessionID {
+			delete(rm.snapshots[topic], k)
+		}
+	}
+	if len(rm.snapshots[topic]) == 0 {
+		delete(rm.snapshots, topic)
+	}
+	rm.snapMu.Unlock()
+}
+
+// dropTopicSnapshot forgets a topic's snapshot once no local member is left.
+func (rm *RoomManager) dropTopicSnapshot(topic string) {
+	rm.snapMu.Lock()
+	delete(rm.snapshots, topic)
+	rm.snapMu.Unlock()
+}
+
+// publishLocalSnapshot sends the entries published by local sessions in
+// topic to other regions, in reply to a presence sync request.
+func (rm *RoomManager) publishLocalSnapshot(topic string) {
+	var events []json.RawMessage
+	rm.snapMu.Lock()
+	for _, e := range rm.snapshots[topic] {
+		if e.local {
+			events = append(events, e.event)
+		}
+	}
+	rm.snapMu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	msg, err := json.Marshal(map[string]any{
+		"op":      OpEvent,
+		"type":    EventStateSnapshot,
+		"topic":   topic,
+		"payload": stateSnapshotPayload{Events: events},
+	})
+	if err != nil {
+		return
+	}
+	if err := rm.federator.Publish(topic, msg); err != nil {
+		logf(regionLocal, "[federation] state snapshot publish failed for topic=%s: %v", topicIDForLog(topic), err)
+	}
+}
+
+// applyStateSnapshot merges a state_snapshot from another region.
+func (rm *RoomManager) applyStateSnapshot(topic string, payload json.RawMessage) {
+	var snap stateSnapshotPayload
+	if json.Unmarshal(payload, &snap) != nil {
+		return
+	}
+	for _, evt := range snap.Events {
+		rm.recordRemoteSnapshot(topic, evt)
+	}
+}
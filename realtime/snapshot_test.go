@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func (tc *testClient) publishKeyed(t *testing.T, topic, eventType, key string, payload map[string]any) {
+	t.Helper()
+	tc.sendRaw(t, map[string]any{"op": "publish", "topic": topic, "type": eventType, "key": key, "payload": payload})
+}
+
+// snapshotOf subscribes tc to topic and returns the events replayed in the
+// ack's snapshot.
+func snapshotOf(t *testing.T, tc *testClient, topic string) []TopicEvent {
+	t.Helper()
+	tc.subscribe(t, topic)
+	var ack SubscribedAck
+	_ = json.Unmarshal(tc.waitForOp(t, OpSubscribed, ""), &ack)
+	out := make([]TopicEvent, len(ack.Snapshot))
+	for i, raw := range ack.Snapshot {
+		_ = json.Unmarshal(raw, &out[i])
+	}
+	return out
+}
+
+func TestSnapshot_LateJoinerGetsLastState(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:snapshot"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	alice.publishKeyed(t, topic, "asset_selected", "selection:alice", map[string]any{"id": "a1"})
+	time.Sleep(5 * time.Millisecond)
+	alice.publishKeyed(t, topic, "asset_deselected", "selection:alice", map[string]any{"id": "a1"})
+	time.Sleep(5 * time.Millisecond)
+	alice.publish(t, topic, "table_generating", map[string]any{"table": "t1"})
+	alice.publish(t, topic, "asset_moved", map[string]any{"id": "a1"})
+	time.Sleep(50 * time.Millisecond)
+
+	bob := dialRaw(t, server, "u-bob", "Bob", "editor")
+	defer bob.close()
+	snap := snapshotOf(t, bob, topic)
+	if len(snap) != 2 {
+		t.Fatalf("expected 2 snapshot entries, got %+v", snap)
+	}
+	if snap[0].Type != "asset_deselected" || snap[0].Key != "selection:alice" || snap[0].SessionID != alice.sessionID {
+		t.Errorf("keyed entry should hold the latest event, got %+v", snap[0])
+	}
+	if snap[1].Type != "table_generating" {
+		t.Errorf("second entry should be table_generating, got %+v", snap[1])
+	}
+}
+
+func TestSnapshot_DroppedWhenPublisherLeaves(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:snapshot-leave"
+
+	observer := connectAndSubscribe(t, server, topic, "u-obs", "Obs", "editor")
+	defer observer.close()
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	alice.publish(t, topic, "asset_dragging", map[string]any{"id": "a1", "x": 10})
+	time.Sleep(50 * time.Millisecond)
+	alice.close()
+	time.Sleep(50 * time.Millisecond)
+
+	bob := dialRaw(t, server, "u-bob", "Bob", "editor")
+	defer bob.close()
+	if snap := snapshotOf(t, bob, topic); len(snap) != 0 {
+		t.Fatalf("a departed session's drag should not be replayed, got %+v", snap)
+	}
+}
+
+func TestSnapshot_ConfigurableTypesAndViewers(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.snapshotTypes = parseSnapshotEventTypes(" asset_moved ,")
+	topic := "desktop:snapshot-config"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	viewer := connectAndSubscribe(t, server, topic, "u-view", "View", "viewer")
+	defer viewer.close()
+	alice.publish(t, topic, "asset_selected", map[string]any{"id": "a1"})
+	alice.publishKeyed(t, topic, "asset_moved", "asset:a1", map[string]any{"id": "a1", "x": 5})
+	viewer.publishKeyed(t, topic, "asset_moved", "asset:a2", map[string]any{"id": "a2", "x": 5})
+	time.Sleep(50 * time.Millisecond)
+
+	bob := dialRaw(t, server, "u-bob", "Bob", "editor")
+	defer bob.close()
+	snap := snapshotOf(t, bob, topic)
+	if len(snap) != 1 || snap[0].Type != "asset_moved" || snap[0].Key != "asset:a1" {
+		t.Fatalf("only the editor's asset_moved should be tracked, got %+v", snap)
+	}
+}
+
+func TestSnapshot_Federated(t *testing.T) {
+	roomsUS, roomsHK, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	topic := "desktop:snapshot-fed"
+
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	alice.publishKeyed(t, topic, "asset_selected", "selection:alice", map[string]any{"id": "a1"})
+	waitFor(t, func() bool { return len(roomsUS.topicSnapshot(topic)) == 1 })
+
+	// HK joins late and learns alice's state from the sync reply.
+	carol := connectAndSubscribe(t, serverHK, topic, "u-carol", "Carol", "editor")
+	defer carol.close()
+	waitFor(t, func() bool { return len(roomsHK.topicSnapshot(topic)) == 1 })
+
+	bob := dialRaw(t, serverHK, "u-bob", "Bob", "editor")
+	defer bob.close()
+	snap := snapshotOf(t, bob, topic)
+	if len(snap) != 1 || snap[0].SessionID != alice.sessionID {
+		t.Fatalf("HK should have alice's selection after sync, got %+v", snap)
+	}
+
+	// Live updates and departures converge too.
+	alice.publishKeyed(t, topic, "asset_deselected", "selection:alice", map[string]any{"id": "a1"})
+	waitFor(t, func() bool { return len(carol.findEventsOfType("asset_deselected", topic)) > 0 })
+	dave := dialRaw(t, serverHK, "u-dave", "Dave", "editor")
+	defer dave.close()
+	if snap := snapshotOf(t, dave, topic); len(snap) != 1 || snap[0].Type != "asset_deselected" {
+		t.Fatalf("HK should track alice's latest event, got %+v", snap)
+	}
+
+	alice.close()
+	waitFor(t, func() bool { return len(roomsHK.topicSnapshot(topic)) == 0 })
+	erin := dialRaw(t, serverHK, "u-erin", "Erin", "editor")
+	defer erin.close()
+	if snap := snapshotOf(t, erin, topic); len(snap) != 0 {
+		t.Fatalf("alice left; HK should drop her entries, got %+v", snap)
+	}
+}
+
+func TestRecordSnapshot_LastWriterWins(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:lww"
+
+	rooms.recordSnapshot(topic, "asset_selected", "k", "session_b", 200, false, []byte(`"new"`))
+	rooms.recordSnapshot(topic, "asset_deselected", "k", "session_a", 100, false, []byte(`"old"`))
+	rooms.recordSnapshot(topic, "asset_deselected", "k", "session_a", 200, false, []byte(`"tie-loses"`))
+	if snap := rooms.topicSnapshot(topic); len(snap) != 1 || string(snap[0]) != `"new"` {
+		t.Fatalf("late-arriving older event must not win, got %s", snap)
+	}
+
+	for i := 0; i < MaxSnapshotEntries+5; i++ {
+		rooms.recordSnapshot(topic, "asset_dragging", "", "session_"+randSuffix(), int64(300+i), false, []byte(`{}`))
+	}
+	if n := len(rooms.topicSnapshot(topic)); n != MaxSnapshotEntries {
+		t.Fatalf("snapshot should be capped at %d, got %d", MaxSnapshotEntries, n)
+	}
+}
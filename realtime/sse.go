@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server-Sent Events fallback for networks that block WebSocket upgrades.
+// GET /ws/sse opens a stream that carries every server frame; ops are sent
+// with POST /ws/sse/op?sessionId=... and handled exactly like WebSocket
+// frames (same SessionKeys, dispatcher and authorization). Replies arrive
+// on the stream.
+
+const (
+	// sseKeepAliveInterval spaces comment lines that keep idle streams open
+	// through proxies. Not a heartbeat: it proves nothing about the client.
+	sseKeepAliveInterval = 15 * time.Second
+
+	// sseOutputBuffer matches melody's default per-session output buffer.
+	sseOutputBuffer = 256
+)
+
+var (
+	errSSEClosed     = errors.New("sse session closed")
+	errSSEBufferFull = errors.New("sse output buffer full")
+	errSSEBinary     = errors.New("sse sessions are JSON only")
+)
+
+// sseConn is the sessionConn of an SSE session. Frames written to it are
+// queued for the stream handler; like melody, a frame is dropped when the
+// buffer is full.
+type sseConn struct {
+	userID string
+	output chan []byte
+	done   chan struct{}
+	once   sync.Once
+
+	mu   sync.RWMutex
+	keys map[string]any
+}
+
+func newSSEConn(sessionID string, claims *Claims) *sseConn {
+	return &sseConn{
+		userID: claims.UserID,
+		output: make(chan []byte, sseOutputBuffer),
+		done:   make(chan struct{}),
+		// Same temporary keys the /ws handler passes to melody; HandleConnect
+		// moves them into SessionKeys.
+		keys: map[string]any{"sessionId": sessionID, "claims": claims},
+	}
+}
+
+func (c *sseConn) Write(msg []byte) error {
+	select {
+	case <-c.done:
+		return errSSEClosed
+	default:
+	}
+	select {
+	case c.output <- msg:
+		return nil
+	default:
+		return errSSEBufferFull
+	}
+}
+
+func (c *sseConn) WriteBinary([]byte) error { return errSSEBinary }
+
+func (c *sseConn) Get(key string) (any, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.keys[key]
+	return v, ok
+}
+
+func (c *sseConn) Set(key string, value any) {
+	c.mu.Lock()
+	c.keys[key] = value
+	c.mu.Unlock()
+}
+
+// CloseWithMsg ends the stream. The close message has no SSE equivalent.
+func (c *sseConn) CloseWithMsg([]byte) error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+// sseSession returns the open SSE session with sessionID, or nil.
+func (rm *RoomManager) sseSession(sessionID string) *sseConn {
+	rm.sseMu.Lock()
+	defer rm.sseMu.Unlock()
+	return rm.sseSessions[sessionID]
+}
+
+// connections lists every open session, WebSocket and SSE.
+func (rm *RoomManager) connections() []sessionConn {
+	var out []sessionConn
+	if sessions, err := rm.melody.Sessions(); err == nil {
+		for _, s := range sessions {
+			out = append(out, s)
+		}
+	}
+	rm.sseMu.Lock()
+	for _, c := range rm.sseSessions {
+		out = append(out, c)
+	}
+	rm.sseMu.Unlock()
+	return out
+}
+
+// writeSSEFrame writes frame as one SSE event. JSON frames are compact, but
+// a raw payload relayed as-is could still hold newlines; each line gets its
+// own data field, which the client joins back.
+func writeSSEFrame(w io.Writer, event string, frame []byte) error {
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	for _, line := range bytes.Split(frame, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// sseHandler serves GET /ws/sse, authenticated like /ws/connection. The
+// first event, named "session", carries the session ID to post ops with;
+// every later event is an unnamed JSON frame identical to a WebSocket text
+// frame.
+func sseHandler(auth *Auth, rm *RoomManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.CheckHandshakeOrigin(r, "sse") {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		ip, releasePeer, ok := rm.connLimits.admitPeer(w, r, "sse")
+		if !ok {
+			return
+		}
+		defer releasePeer()
+		claims, err := auth.ValidateHandshake(r)
+		if err != nil {
+			logf(regionLocal, "[auth] rejected sse connection: %v", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		releaseUser, ok := rm.connLimits.admitUser(w, claims, ip, "sse")
+		if !ok {
+			auth.ReleaseTicket(claims)
+			return
+		}
+		defer releaseUser()
+
+		sessionID := generateSessionId()
+		conn := newSSEConn(sessionID, claims)
+		rm.sseMu.Lock()
+		rm.sseSessions[sessionID] = conn
+		rm.sseMu.Unlock()
+		rm.HandleConnect(conn)
+		defer func() {
+			conn.CloseWithMsg(nil)
+			rm.sseMu.Lock()
+			delete(rm.sseSessions, sessionID)
+			rm.sseMu.Unlock()
+			rm.HandleDisconnect(conn)
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // Nginx: don't buffer the stream
+		w.WriteHeader(http.StatusOK)
+		hello, _ := json.Marshal(map[string]string{"sessionId": sessionID})
+		if writeSSEFrame(w, "session", hello) != nil {
+			return
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(sseKeepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case <-conn.done:
+				return
+			case frame := <-conn.output:
+				err = writeSSEFrame(w, "", frame)
+			case <-keepAlive.C:
+				_, err = io.WriteString(w, ": keepalive\n\n")
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// sseOpHandler serves POST /ws/sse/op?sessionId=...: the body is one op
+// envelope, exactly as sent over a WebSocket. The caller must be the user
+// who opened the stream. Accepted ops get 202 and answer on the stream,
+// including errors about the op itself.
+func sseOpHandler(auth *Auth, rm *RoomManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.CheckOrigin(r, "sse_op") {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		claims, err := auth.ValidateRequest(r)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn := rm.sseSession(r.URL.Query().Get("sessionId"))
+		if conn == nil {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+		if conn.userID != claims.UserID {
+			http.Error(w, "session belongs to another user", http.StatusForbidden)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, rm.melody.Config.MaxMessageSize))
+		if err != nil {
+			http.Error(w, "op too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		rm.HandleMessage(conn, body)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSSESecret = []byte("sse-secret")
+
+// sseClient reads an SSE stream into an embedded testClient, so the usual
+// waitForOp / findEventsOfType helpers work on it.
+type sseClient struct {
+	testClient
+	base   string
+	cookie string
+	cancel context.CancelFunc
+}
+
+func sseCookie(t *testing.T, userID, firstName, permission string) string {
+	return signTestJWT(t, testSSESecret, &Claims{UserID: userID, FirstName: firstName, LastName: permission})
+}
+
+// setupSSEServer mounts the SSE endpoints for rooms.
+func setupSSEServer(rooms *RoomManager) *httptest.Server {
+	auth := &Auth{jwtSecret: testSSESecret}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/sse", sseHandler(auth, rooms))
+	mux.HandleFunc("/ws/sse/op", sseOpHandler(auth, rooms))
+	return httptest.NewServer(mux)
+}
+
+func dialSSE(t *testing.T, server *httptest.Server, userID, firstName, permission string) *sseClient {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &sseClient{base: server.URL, cookie: sseCookie(t, userID, firstName, permission), cancel: cancel}
+	c.done = make(chan struct{})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/ws/sse", nil)
+	req.AddCookie(&http.Cookie{Name: "moodio_access_token", Value: c.cookie})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to open sse stream: %v %v", resp, err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	sessionID := make(chan string, 1)
+	go func() {
+		defer close(c.done)
+		defer resp.Body.Close()
+		sc := bufio.NewScanner(resp.Body)
+		var event string
+		var data []string
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			case line == "" && data != nil:
+				frame := json.RawMessage(strings.Join(data, "\n"))
+				if event == "session" {
+					var s struct {
+						SessionID string `json:"sessionId"`
+					}
+					json.Unmarshal(frame, &s)
+					sessionID <- s.SessionID
+				} else {
+					c.mu.Lock()
+					c.messages = append(c.messages, frame)
+					c.mu.Unlock()
+				}
+				event, data = "", nil
+			}
+		}
+	}()
+	select {
+	case c.sessionID = <-sessionID:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no session event on the sse stream")
+	}
+	return c
+}
+
+// post sends op to the op endpoint with cookie (the stream owner's if empty)
+// and returns the status code.
+func (c *sseClient) post(t *testing.T, op map[string]any, cookie string) int {
+	t.Helper()
+	if cookie == "" {
+		cookie = c.cookie
+	}
+	body, _ := json.Marshal(op)
+	req, _ := http.NewRequest(http.MethodPost, c.base+"/ws/sse/op?sessionId="+c.sessionID, bytes.NewReader(body))
+	req.AddCookie(&http.Cookie{Name: "moodio_access_token", Value: cookie})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (c *sseClient) close() {
+	c.cancel()
+	<-c.done
+}
+
+func TestSSE_SharesTopicsWithWebSockets(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	sseServer := setupSSEServer(rooms)
+	defer sseServer.Close()
+	topic := "desktop:sse"
+
+	alice := dialSSE(t, sseServer, "u-alice", "Alice", "editor")
+	defer alice.close()
+	// The server hello follows the session event; SSE frames are JSON only,
+	// so no binary encodings are offered.
+	var hello HelloMsg
+	json.Unmarshal(alice.waitForOp(t, OpHello, ""), &hello)
+	if hello.SessionID != alice.sessionID || slices.Contains(hello.Features, "encoding:msgpack") {
+		t.Fatalf("unexpected sse hello: %+v", hello)
+	}
+	if code := alice.post(t, map[string]any{"op": "subscribe", "topic": topic, "ref": "s1"}, ""); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+	var ack SubscribedAck
+	json.Unmarshal(alice.waitForOp(t, OpSubscribed, "s1"), &ack)
+	if ack.SessionID != alice.sessionID || ack.Permission != "editor" {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	time.Sleep(100 * time.Millisecond)
+	if len(alice.findEventsOfType(EventSessionJoined, topic)) != 1 {
+		t.Fatal("sse session should see the websocket session join")
+	}
+
+	bob.publish(t, topic, "cursor_move", map[string]any{"x": 1})
+	alice.post(t, map[string]any{"op": "publish", "topic": topic, "type": "asset_moved", "payload": map[string]any{"id": "a1"}}, "")
+	time.Sleep(100 * time.Millisecond)
+	if len(alice.findEventsOfType("cursor_move", topic)) != 1 {
+		t.Error("sse session should receive websocket publishes")
+	}
+	if len(bob.findEventsOfType("asset_moved", topic)) != 1 {
+		t.Error("websocket session should receive sse publishes")
+	}
+
+	// Op errors come back on the stream, like on a websocket.
+	alice.post(t, map[string]any{"op": "publish", "topic": "desktop:other", "type": "asset_moved", "ref": "p2"}, "")
+	if code := errorCode(alice.waitForOp(t, OpError, "p2")); code != ErrCodeNotSubscribed {
+		t.Fatalf("expected not_subscribed on the stream, got %s", code)
+	}
+
+	alice.close()
+	time.Sleep(100 * time.Millisecond)
+	if len(bob.findEventsOfType(EventSessionLeft, topic)) != 1 {
+		t.Fatal("closing the stream should leave the session's topics")
+	}
+	if rooms.sseSession(alice.sessionID) != nil {
+		t.Fatal("closed sse session should be forgotten")
+	}
+}
+
+func TestSSE_OpEndpointChecksSession(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	sseServer := setupSSEServer(rooms)
+	defer sseServer.Close()
+
+	alice := dialSSE(t, sseServer, "u-alice", "Alice", "editor")
+	defer alice.close()
+	ping := map[string]any{"op": "ping", "ts": 1}
+
+	if code := alice.post(t, ping, sseCookie(t, "u-mallory", "Mallory", "")); code != http.StatusForbidden {
+		t.Errorf("another user's cookie: got %d, want 403", code)
+	}
+	if code := alice.post(t, ping, "bogus"); code != http.StatusUnauthorized {
+		t.Errorf("bad cookie: got %d, want 401", code)
+	}
+	unknown := &sseClient{base: alice.base, cookie: alice.cookie}
+	unknown.sessionID = "session_missing"
+	if code := unknown.post(t, ping, ""); code != http.StatusNotFound {
+		t.Errorf("unknown session: got %d, want 404", code)
+	}
+	if code := alice.post(t, ping, ""); code != http.StatusAccepted {
+		t.Errorf("own session: got %d, want 202", code)
+	}
+	alice.waitForOp(t, OpPong, "")
+
+	resp, err := http.Get(sseServer.URL + "/ws/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("stream without cookie: got %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestWriteSSEFrame_SplitsLines(t *testing.T) {
+	var buf bytes.Buffer
+	writeSSEFrame(&buf, "", []byte("{\"a\":\n1}"))
+	if got := buf.String(); got != "data: {\"a\":\ndata: 1}\n\n" {
+		t.Fatalf("unexpected frame %q", got)
+	}
+}
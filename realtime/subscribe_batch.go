@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// handleSubscribeBatch handles a subscribe with a topics list, e.g. for a
+// tab opening a project. Each topic goes through the checks of a single
+// subscribe, except that the whole op takes one rate-limit token. Topics
+// that need authorizing are authorized concurrently, so with
+// AUTHORIZE_BATCH_WINDOW set they go to Next.js as one batched request.
+// The reply is one subscribed_batch frame; session_joined broadcasts and
+// ydoc sync requests follow it.
+func (rm *RoomManager) handleSubscribeBatch(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	switch {
+	case op.Topic != "":
+		writeError(s, ErrorMsg{Op: OpError, Topic: op.Topic, Code: ErrCodeBadRequest,
+			Message: "set topic or topics, not both", Ref: op.Ref})
+		return
+	case len(op.Topics) == 0:
+		writeError(s, ErrorMsg{Op: OpError, Code: ErrCodeBadRequest, Message: "topics is empty", Ref: op.Ref})
+		return
+	case len(op.Topics) > MaxTopicsPerSession:
+		writeError(s, ErrorMsg{Op: OpError, Code: ErrCodeBadRequest, Message: "too many topics", Ref: op.Ref})
+		return
+	}
+	if !keys.Subs.TryConsume() {
+		writeError(s, ErrorMsg{Op: OpError, Code: ErrCodeRateLimited,
+			Message: "too many subscribe requests", Ref: op.Ref})
+		return
+	}
+
+	results := make([]any, len(op.Topics))
+	permissions := make([]string, len(op.Topics))
+	var toAuthorize []int
+	seen := make(map[string]bool, len(op.Topics))
+	free := MaxTopicsPerSession - keys.Subs.Len()
+	for i, topic := range op.Topics {
+		if _, _, err := parseTopic(topic); err != nil {
+			results[i] = ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeBadRequest, Message: err.Error()}
+			continue
+		}
+		if seen[topic] {
+			results[i] = ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeBadRequest, Message: "duplicate topic"}
+			continue
+		}
+		seen[topic] = true
+		if entry, ok := keys.Subs.Get(topic); ok {
+			// Already subscribed: ack again, as a single subscribe would.
+			results[i] = rm.subscribedAck(keys, topic, entry.Permission, "")
+			continue
+		}
+		if free <= 0 {
+			results[i] = ErrorMsg{Op: OpError, Topic: topic, Code: ErrCodeRateLimited,
+				Message: "too many topics on this connection"}
+			continue
+		}
+		free--
+		if permission, ok := rm.authCache.Get(authzCacheKey{SessionID: keys.SessionID, Topic: topic}); ok {
+			permissions[i] = permission
+			continue
+		}
+		toAuthorize = append(toAuthorize, i)
+	}
+
+	errs := make([]error, len(op.Topics))
+	var wg sync.WaitGroup
+	for _, i := range toAuthorize {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			permissions[i], errs[i] = rm.authorizeTopic(keys, op.Topics[i])
+		}()
+	}
+	wg.Wait()
+
+	var joined []int
+	for i, topic := range op.Topics {
+		if results[i] != nil {
+			continue
+		}
+		if err := errs[i]; err != nil {
+			code := errorCodeFor(err)
+			results[i] = ErrorMsg{Op: OpError, Topic: topic, Code: code, Message: err.Error()}
+			logf(regionLocal, "[sub-deny] session=%s topic=%s code=%s err=%v",
+				truncateID(keys.SessionID), topicIDForLog(topic), code, err)
+			continue
+		}
+		rm.authCache.Put(authzCacheKey{SessionID: keys.SessionID, Topic: topic}, permissions[i])
+		keys.Subs.Add(topic, permissions[i])
+		rm.addToTopic(topic, s)
+		results[i] = rm.subscribedAck(keys, topic, permissions[i], "")
+		joined = append(joined, i)
+	}
+
+	data, err := json.Marshal(SubscribeBatchAck{Op: OpSubscribedBatch, Results: results, Ref: op.Ref})
+	if err != nil {
+		logf(regionLocal, "error marshalling subscribed_batch ack: %v", err)
+	} else {
+		_ = writeFrame(s, data)
+	}
+
+	for _, i := range joined {
+		rm.announceSubscribe(s, keys, op.Topics[i], permissions[i])
+	}
+}
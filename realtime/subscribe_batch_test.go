@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testSubscribeBatchAck struct {
+	Op      string            `json:"op"`
+	Results []json.RawMessage `json:"results"`
+	Ref     string            `json:"ref"`
+}
+
+func (tc *testClient) subscribeBatch(t *testing.T, ref string, topics ...string) testSubscribeBatchAck {
+	t.Helper()
+	tc.sendRaw(t, map[string]any{"op": "subscribe", "topics": topics, "ref": ref})
+	var ack testSubscribeBatchAck
+	if err := json.Unmarshal(tc.waitForOp(t, OpSubscribedBatch, ref), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if len(ack.Results) != len(topics) {
+		t.Fatalf("expected %d results, got %d", len(topics), len(ack.Results))
+	}
+	return ack
+}
+
+func TestSubscribeBatch_PerTopicResults(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	var calls atomic.Int32
+	rooms.authorizeOverride = func(c *Claims, topic string) (string, error) {
+		calls.Add(1)
+		if topic == "desktop:denied" {
+			return "", ErrTopicForbidden
+		}
+		return "editor", nil
+	}
+
+	bob := connectAndSubscribe(t, server, "desktop:a", "u-bob", "Bob", "")
+	defer bob.close()
+
+	alice := dialRaw(t, server, "u-alice", "Alice", "")
+	defer alice.close()
+	alice.subscribe(t, "desktop:b")
+	calls.Store(0)
+	ack := alice.subscribeBatch(t, "b1", "desktop:a", "desktop:denied", "bogus", "desktop:b", "desktop:a")
+
+	wantOps := []string{OpSubscribed, OpError, OpError, OpSubscribed, OpError}
+	wantCodes := []string{"", ErrCodeForbidden, ErrCodeBadRequest, "", ErrCodeBadRequest}
+	for i, raw := range ack.Results {
+		var r struct {
+			Op    string `json:"op"`
+			Topic string `json:"topic"`
+			Code  string `json:"code"`
+			Ref   string `json:"ref"`
+		}
+		json.Unmarshal(raw, &r)
+		if r.Op != wantOps[i] || r.Code != wantCodes[i] || r.Ref != "" {
+			t.Errorf("result %d: %s", i, raw)
+		}
+	}
+	var first SubscribedAck
+	json.Unmarshal(ack.Results[0], &first)
+	if first.Topic != "desktop:a" || len(first.Sessions) != 1 || first.Sessions[0].UserID != "u-bob" {
+		t.Errorf("ack for desktop:a should list bob: %s", ack.Results[0])
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("expected authorize for desktop:a and desktop:denied only, got %d calls", got)
+	}
+
+	waitFor(t, func() bool { return len(bob.findEventsOfType(EventSessionJoined, "desktop:a")) > 0 })
+	rooms.mu.RLock()
+	_, leaked := rooms.topics["desktop:denied"]
+	rooms.mu.RUnlock()
+	if leaked {
+		t.Error("denied topic should not have membership")
+	}
+}
+
+func TestSubscribeBatch_Limits(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	c := dialRaw(t, server, "u1", "Alice", "")
+	defer c.close()
+
+	c.sendRaw(t, map[string]any{"op": "subscribe", "topic": "desktop:a", "topics": []string{"desktop:b"}, "ref": "both"})
+	if code := errorCode(c.waitForOp(t, OpError, "both")); code != ErrCodeBadRequest {
+		t.Errorf("topic and topics: got %s", code)
+	}
+	c.sendRaw(t, map[string]any{"op": "subscribe", "topics": []string{}, "ref": "empty"})
+	if code := errorCode(c.waitForOp(t, OpError, "empty")); code != ErrCodeBadRequest {
+		t.Errorf("empty topics: got %s", code)
+	}
+
+	// Fill the connection but for two slots; the third new topic is refused.
+	var topics []string
+	for i := 0; i < MaxTopicsPerSession-2; i++ {
+		topics = append(topics, "desktop:t"+string(rune('a'+i/26))+string(rune('a'+i%26)))
+	}
+	c.subscribeBatch(t, "fill", topics...)
+	ack := c.subscribeBatch(t, "over", "desktop:x", "desktop:y", "desktop:z", topics[0])
+	for i, want := range []string{"", "", ErrCodeRateLimited, ""} {
+		if got := errorCode(ack.Results[i]); got != want {
+			t.Errorf("result %d: code %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestSubscribeBatch_OneAuthorizeRequest(t *testing.T) {
+	secret := []byte("batch-test-secret")
+	nextjs := newFakeBatchNextJS(t, secret)
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.authorizeOverride = nil
+	rooms.authzBatcher = newAuthzBatcher(10*time.Millisecond, &Auth{jwtSecret: secret}, nextjs.URL)
+
+	c := dialRaw(t, server, "u1", "Alice", "")
+	defer c.close()
+	ack := c.subscribeBatch(t, "b1", "desktop:a", "desktop:b", "desktop:denied", "production-table:c")
+	for i, want := range []string{"", "", ErrCodeForbidden, ""} {
+		if got := errorCode(ack.Results[i]); got != want {
+			t.Errorf("result %d: code %q, want %q", i, got, want)
+		}
+	}
+	if batches, singles := nextjs.batchCalls.Load(), nextjs.singleCalls.Load(); batches != 1 || singles != 0 {
+		t.Fatalf("expected one batch request, got %d batch and %d single calls", batches, singles)
+	}
+}
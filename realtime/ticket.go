@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Connect tickets let clients that can't send the access token cookie or
+// an Authorization header (browser WebSocket and EventSource APIs outside
+// the app's origin, embedded webviews) authenticate a handshake. Next.js
+// issues one per connection attempt: an HS256 JWT signed with
+// JWT_ACCESS_SECRET carrying the user's identity plus aud, jti, iat and an
+// exp at most maxConnectTicketTTL later. The relay redeems it once.
+const (
+	connectTicketAudience = "realtime-connect"
+	connectTicketParam    = "ticket"
+	maxConnectTicketTTL   = 60 * time.Second
+)
+
+// ticketStore remembers redeemed ticket IDs until their tickets expire.
+// The zero value is ready to use. It is per relay: a ticket replayed
+// against another region within its lifetime is not caught.
+type ticketStore struct {
+	mu   sync.Mutex
+	used map[string]int64 // jti -> exp (unix seconds)
+}
+
+// redeem marks jti used, reporting false if it already was.
+func (ts *ticketStore) redeem(jti string, exp int64, now time.Time) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.used == nil {
+		ts.used = make(map[string]int64)
+	}
+	for id, e := range ts.used {
+		if e < now.Unix() {
+			delete(ts.used, id)
+		}
+	}
+	if _, ok := ts.used[jti]; ok {
+		return false
+	}
+	ts.used[jti] = exp
+	return true
+}
+
+// RedeemTicket validates a connect ticket and consumes it. Errors never
+// include the ticket.
+func (a *Auth) RedeemTicket(ticket string, now time.Time) (*Claims, error) {
+	claims, err := a.parseJWT(ticket)
+	if err != nil {
+		return nil, fmt.Errorf("connect ticket: %w", err)
+	}
+	switch {
+	case !claims.Aud.contains(connectTicketAudience):
+		return nil, fmt.Errorf("connect ticket: wrong audience")
+	case claims.Jti == "":
+		return nil, fmt.Errorf("connect ticket: missing jti")
+	case claims.Exp == 0 || claims.Iat == 0:
+		return nil, fmt.Errorf("connect ticket: missing exp or iat")
+	case time.Duration(claims.Exp-claims.Iat)*time.Second > maxConnectTicketTTL:
+		return nil, fmt.Errorf("connect ticket: lifetime over %s", maxConnectTicketTTL)
+	}
+	if !a.tickets.redeem(claims.Jti, claims.Exp, now) {
+		return nil, fmt.Errorf("connect ticket: already used")
+	}
+	return claims, nil
+}
+
+// release forgets that jti was redeemed.
+func (ts *ticketStore) release(jti string) {
+	ts.mu.Lock()
+	delete(ts.used, jti)
+	ts.mu.Unlock()
+}
+
+// ReleaseTicket hands back the connect ticket claims were redeemed from, if
+// any, for a handshake refused after authentication (a per-user connection
+// limit) so the client can retry with the same ticket.
+func (a *Auth) ReleaseTicket(claims *Claims) {
+	if claims.Aud.contains(connectTicketAudience) && claims.Jti != "" {
+		a.tickets.release(claims.Jti)
+	}
+}
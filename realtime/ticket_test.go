@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTicketSecret = []byte("ticket-secret")
+
+func testTicketClaims(jti string, ttl time.Duration) *Claims {
+	now := time.Now()
+	return &Claims{
+		UserID:    "user-1",
+		FirstName: "Alice",
+		Aud:       audience{connectTicketAudience},
+		Jti:       jti,
+		Iat:       now.Unix(),
+		Exp:       now.Add(ttl).Unix(),
+	}
+}
+
+func TestRedeemTicket_Rejects(t *testing.T) {
+	a := &Auth{jwtSecret: testTicketSecret}
+	cases := map[string]func(c *Claims){
+		"wrong audience": func(c *Claims) { c.Aud = audience{"someone-else"} },
+		"no audience":    func(c *Claims) { c.Aud = nil },
+		"missing jti":    func(c *Claims) { c.Jti = "" },
+		"missing iat":    func(c *Claims) { c.Iat = 0 },
+		"long lifetime":  func(c *Claims) { c.Exp = c.Iat + 3600 },
+		"expired": func(c *Claims) {
+			c.Iat = time.Now().Add(-time.Minute).Unix()
+			c.Exp = c.Iat + 30
+		},
+	}
+	for name, mutate := range cases {
+		c := testTicketClaims("t-"+name, 30*time.Second)
+		mutate(c)
+		ticket := signTestJWT(t, testTicketSecret, c)
+		_, err := a.RedeemTicket(ticket, time.Now())
+		if err == nil {
+			t.Errorf("%s: expected rejection", name)
+			continue
+		}
+		if strings.Contains(err.Error(), ticket) {
+			t.Errorf("%s: error leaks the ticket: %v", name, err)
+		}
+	}
+}
+
+func TestRedeemTicket_ListAudience(t *testing.T) {
+	a := &Auth{jwtSecret: testTicketSecret}
+	c := testTicketClaims("t-list", 30*time.Second)
+	c.Aud = audience{"moodio", connectTicketAudience}
+	got, err := a.RedeemTicket(signTestJWT(t, testTicketSecret, c), time.Now())
+	if err != nil || got.UserID != "user-1" {
+		t.Fatalf("unexpected %+v %v", got, err)
+	}
+}
+
+func TestTicketStore_ForgetsExpiredTickets(t *testing.T) {
+	var ts ticketStore
+	now := time.Now()
+	if !ts.redeem("a", now.Add(time.Second).Unix(), now) {
+		t.Fatal("first redeem should succeed")
+	}
+	if ts.redeem("a", now.Add(time.Second).Unix(), now) {
+		t.Fatal("second redeem should fail")
+	}
+	ts.redeem("b", now.Add(time.Minute).Unix(), now.Add(5*time.Second))
+	if _, ok := ts.used["a"]; ok || len(ts.used) != 1 {
+		t.Fatalf("expired ids should be pruned, have %v", ts.used)
+	}
+}
+
+func TestValidateJWT_RefusesConnectTicket(t *testing.T) {
+	a := &Auth{jwtSecret: testTicketSecret}
+	ticket := signTestJWT(t, testTicketSecret, testTicketClaims("t-bearer", 30*time.Second))
+	if _, err := a.validateJWT(ticket); err == nil {
+		t.Fatal("a connect ticket must not pass as an access token")
+	}
+	r := httptest.NewRequest("GET", "/ws/connection", nil)
+	r.Header.Set("Authorization", "Bearer "+ticket)
+	if _, err := a.ValidateHandshake(r); err == nil {
+		t.Fatal("a connect ticket must not pass as a bearer token")
+	}
+}
+
+func TestValidateHandshake_StripsTicketFromURL(t *testing.T) {
+	a := &Auth{jwtSecret: testTicketSecret}
+	ticket := signTestJWT(t, testTicketSecret, testTicketClaims("t-strip", 30*time.Second))
+	r := httptest.NewRequest("GET", "/ws/connection?ticket="+ticket+"&v=2", nil)
+	if _, err := a.ValidateHandshake(r); err != nil {
+		t.Fatalf("ValidateHandshake: %v", err)
+	}
+	if strings.Contains(r.URL.String(), ticket) || r.URL.Query().Get("v") != "2" {
+		t.Fatalf("ticket should be removed from the URL, got %s", r.URL)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// CapabilityUserPresence switches a session from per-session presence
+	// events to per-user ones: it receives user_joined / user_left (first
+	// tab in, last tab out) instead of session_joined / session_left, and
+	// its subscribed acks carry a users list next to sessions.
+	CapabilityUserPresence = "user_presence"
+
+	EventUserJoined = "user_joined"
+	EventUserLeft   = "user_left"
+)
+
+func init() {
+	knownCapabilities[CapabilityUserPresence] = true
+}
+
+// UserInfo aggregates a user's sessions in one topic.
+type UserInfo struct {
+	UserID    string `json:"userId"`
+	FirstName string `json:"firstName"`
+	Email     string `json:"email"`
+	Service   bool   `json:"service,omitempty"`
+	Sessions  int    `json:"sessions"`
+}
+
+// aggregateUsers folds a session list into users, in first-seen order.
+func aggregateUsers(sessions []SessionInfo) []UserInfo {
+	users := make([]UserInfo, 0, len(sessions))
+	index := make(map[string]int, len(sessions))
+	for _, info := range sessions {
+		if i, ok := index[info.UserID]; ok {
+			users[i].Sessions++
+			continue
+		}
+		index[info.UserID] = len(users)
+		users = append(users, UserInfo{
+			UserID:    info.UserID,
+			FirstName: info.FirstName,
+			Email:     info.Email,
+			Service:   info.Service,
+			Sessions:  1,
+		})
+	}
+	return users
+}
+
+// userSessionCount counts userID's sessions in topic, local and remote,
+// ignoring the session IDs in exclude.
+func (rm *RoomManager) userSessionCount(topic, userID string, exclude map[string]bool) int {
+	n := 0
+	rm.mu.RLock()
+	for sess := range rm.topics[topic] {
+		k := getSessionKeys(sess)
+		if k != nil && k.Claims != nil && k.Claims.UserID == userID && !exclude[k.SessionID] {
+			n++
+		}
+	}
+	rm.mu.RUnlock()
+
+	rm.remoteMu.RLock()
+	for _, rs := range rm.remoteSessions[topic] {
+		if rs.UserID == userID && !exclude[rs.SessionID] {
+			n++
+		}
+	}
+	rm.remoteMu.RUnlock()
+
+	for _, info := range rm.heldSessions(topic) {
+		if info.UserID == userID && !exclude[info.SessionID] {
+			n++
+		}
+	}
+	return n
+}
+
+// userEventFor returns the user_joined / user_left event to pair with a
+// session_joined / session_left for info, or nil if the user's presence in
+// the topic did not change. Call after membership has been updated. exclude
+// holds sessions joining in the same batch (see emitPresenceCorrections).
+func (rm *RoomManager) userEventFor(topic, sessionEventType string, info SessionInfo, exclude map[string]bool) []byte {
+	if info.UserID == "" {
+		return nil
+	}
+	if exclude == nil {
+		exclude = map[string]bool{info.SessionID: true}
+	}
+	others := rm.userSessionCount(topic, info.UserID, exclude)
+	if others > 0 {
+		return nil
+	}
+
+	user := UserInfo{UserID: info.UserID, FirstName: info.FirstName, Email: info.Email, Service: info.Service}
+	eventType := EventUserLeft
+	if sessionEventType == EventSessionJoined {
+		eventType = EventUserJoined
+		user.Sessions = rm.userSessionCount(topic, info.UserID, nil)
+	}
+	evt := TopicEvent{
+		Op:        OpEvent,
+		Topic:     topic,
+		Type:      eventType,
+		SessionID: info.SessionID,
+		UserID:    info.UserID,
+		FirstName: info.FirstName,
+		Email:     info.Email,
+		Service:   info.Service,
+		Timestamp: time.Now().UnixMilli(),
+		Payload:   user,
+	}
+	data, err := json.Marshal(evt)
+	if err != nil {
+		logf(regionLocal, "error marshalling %s event: %v", eventType, err)
+		return nil
+	}
+	return data
+}
+
+// broadcastPresence delivers a session_joined / session_left to local
+// members of topic except sender. Members with the user_presence capability
+// get userEvt instead (nothing if it is nil). sessionEvt, not userEvt, is
+// federated when federate is set: every region derives its own user events.
+func (rm *RoomManager) broadcastPresence(topic string, sender sessionConn, sessionEvt, userEvt []byte, federate bool) {
+	sessionFrame := newOutFrame(sessionEvt)
+	var userFrame *outFrame
+	if userEvt != nil {
+		userFrame = newOutFrame(userEvt)
+	}
+
+	rm.mu.RLock()
+	for sess := range rm.topics[topic] {
+		if sess == sender {
+			continue
+		}
+		if k := getSessionKeys(sess); k != nil && k.HasCapability(CapabilityUserPresence) {
+			if userFrame != nil {
+				_ = userFrame.writeTo(sess)
+			}
+			continue
+		}
+		_ = sessionFrame.writeTo(sess)
+	}
+	rm.mu.RUnlock()
+
+	if federate && rm.federator != nil {
+		if err := rm.federator.Publish(topic, sessionEvt); err != nil {
+			logf(regionLocal, "[federation] publish error for topic=%s: %v", topicIDForLog(topic), err)
+		}
+	}
+}
+
+// broadcastLocalSessionEvent announces a local session joining or leaving
+// topic, locally and to federation.
+func (rm *RoomManager) broadcastLocalSessionEvent(s sessionConn, keys *SessionKeys, eventType, topic, permission string) {
+	evt := buildSessionEvent(eventType, keys, topic, permission)
+	if evt == nil {
+		return
+	}
+	info := SessionInfo{SessionID: keys.SessionID, UserID: keys.Claims.UserID, FirstName: keys.Claims.FirstName, Email: keys.Claims.Email,
+		Service: keys.Claims.IsService()}
+	if eventType == EventSessionJoined {
+		rm.announceJoin(topic, s, info, evt, true)
+		return
+	}
+	userEvt := rm.userEventFor(topic, eventType, info, nil)
+	rm.broadcastPresence(topic, s, evt, userEvt, true)
+	rm.notifyUserWebhook(topic, userEvt)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func userEvents(tc *testClient, eventType, topic string) []UserInfo {
+	var out []UserInfo
+	for _, raw := range tc.findEventsOfType(eventType, topic) {
+		var evt struct {
+			Payload UserInfo `json:"payload"`
+		}
+		_ = json.Unmarshal(raw, &evt)
+		out = append(out, evt.Payload)
+	}
+	return out
+}
+
+// TestUserPresence_FirstInLastOut — a user_presence observer sees one
+// user_joined for a user's first tab and one user_left for the last, and no
+// session-level churn; a legacy observer still sees every tab.
+func TestUserPresence_FirstInLastOut(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "desktop:users"
+
+	observer := dialHello(t, server, "u-obs", "Obs", CapabilityUserPresence)
+	defer observer.close()
+	observer.subscribe(t, topic)
+	legacy := connectAndSubscribe(t, server, topic, "u-legacy", "Legacy", "editor")
+	defer legacy.close()
+	observer.clearMessages()
+
+	tab1 := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	tab2 := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	waitFor(t, func() bool {
+		return legacy.sawSessionEvent(EventSessionJoined, topic, tab2.sessionID) &&
+			len(userEvents(observer, EventUserJoined, topic)) > 0
+	})
+	time.Sleep(settle)
+
+	joined := userEvents(observer, EventUserJoined, topic)
+	if len(joined) != 1 || joined[0].UserID != "u-alice" || joined[0].Sessions != 1 {
+		t.Fatalf("expected one user_joined for alice, got %+v", joined)
+	}
+	if n := len(observer.findEventsOfType(EventSessionJoined, topic)); n != 0 {
+		t.Fatalf("user_presence sessions must not get session_joined, got %d", n)
+	}
+	if n := len(legacy.findEventsOfType(EventSessionJoined, topic)); n != 2 {
+		t.Fatalf("legacy observer should see both tabs, got %d", n)
+	}
+
+	late := dialHello(t, server, "u-late", "Late", CapabilityUserPresence)
+	defer late.close()
+	late.subscribe(t, topic)
+	var ack SubscribedAck
+	_ = json.Unmarshal(late.waitForOp(t, OpSubscribed, ""), &ack)
+	if len(ack.Sessions) != 4 {
+		t.Errorf("ack should still list every session, got %d", len(ack.Sessions))
+	}
+	for _, u := range ack.Users {
+		if u.UserID == "u-alice" && u.Sessions != 2 {
+			t.Errorf("alice should be aggregated to 2 sessions, got %d", u.Sessions)
+		}
+	}
+	if len(ack.Users) != 3 {
+		t.Errorf("ack should list 3 users, got %+v", ack.Users)
+	}
+
+	tab2.close()
+	waitFor(t, func() bool { return legacy.sawSessionEvent(EventSessionLeft, topic, tab2.sessionID) })
+	time.Sleep(settle)
+	if n := len(userEvents(observer, EventUserLeft, topic)); n != 0 {
+		t.Fatalf("closing one of two tabs must not emit user_left, got %d", n)
+	}
+	tab1.close()
+	waitFor(t, func() bool { return len(userEvents(observer, EventUserLeft, topic)) > 0 })
+	time.Sleep(settle)
+	left := userEvents(observer, EventUserLeft, topic)
+	if len(left) != 1 || left[0].UserID != "u-alice" || left[0].Sessions != 0 {
+		t.Fatalf("expected one user_left for alice, got %+v", left)
+	}
+	if n := len(observer.findEventsOfType(EventSessionLeft, topic)); n != 0 {
+		t.Fatalf("user_presence sessions must not get session_left, got %d", n)
+	}
+}
+
+func TestUserPresence_AckWithoutCapabilityHasNoUsers(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+
+	tc := dialRaw(t, server, "u-a", "Alice", "editor")
+	defer tc.close()
+	tc.subscribe(t, "desktop:no-users")
+	if raw := tc.waitForOp(t, OpSubscribed, ""); json.Valid(raw) {
+		var env map[string]json.RawMessage
+		_ = json.Unmarshal(raw, &env)
+		if _, ok := env["users"]; ok {
+			t.Fatalf("users must be omitted for clients without user_presence: %s", raw)
+		}
+	}
+}
+
+// TestUserPresence_AcrossRegions — tabs of the same user on different relays
+// count as one user.
+func TestUserPresence_AcrossRegions(t *testing.T) {
+	fedUS, fedHK := newMockFederatorPair("us-east-2", "ap-northeast-1")
+
+	_, roomsUS, serverUS := setupTestServer()
+	defer serverUS.Close()
+	roomsUS.federator = fedUS
+	roomsUS.regionId = "us-east-2"
+
+	_, roomsHK, serverHK := setupTestServer()
+	defer serverHK.Close()
+	roomsHK.federator = fedHK
+	roomsHK.regionId = "ap-northeast-1"
+
+	topic := "desktop:users-fed"
+	observer := dialHello(t, serverHK, "u-obs", "Obs", CapabilityUserPresence)
+	defer observer.close()
+	observer.subscribe(t, topic)
+
+	usTab := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	waitFor(t, func() bool { return len(userEvents(observer, EventUserJoined, topic)) > 0 })
+	hkTab := connectAndSubscribe(t, serverHK, topic, "u-alice", "Alice", "editor")
+	waitFor(t, func() bool { _, ok := remoteSessionIDs(roomsUS, topic)[hkTab.sessionID]; return ok })
+	time.Sleep(settle)
+	if n := len(userEvents(observer, EventUserJoined, topic)); n != 1 {
+		t.Fatalf("expected one user_joined across regions, got %d", n)
+	}
+
+	usTab.close()
+	waitFor(t, func() bool { _, ok := remoteSessionIDs(roomsHK, topic)[usTab.sessionID]; return !ok })
+	time.Sleep(settle)
+	if n := len(userEvents(observer, EventUserLeft, topic)); n != 0 {
+		t.Fatalf("alice still has an HK tab, got %d user_left", n)
+	}
+	hkTab.close()
+	waitFor(t, func() bool { return len(userEvents(observer, EventUserLeft, topic)) > 0 })
+	time.Sleep(settle)
+	if n := len(userEvents(observer, EventUserLeft, topic)); n != 1 {
+		t.Fatalf("expected one user_left after the last tab, got %d", n)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook event names. Topic events are per relay: topic_active when the
+// topic gets its first local subscriber, topic_empty once it has neither
+// local subscribers nor sessions held by the leave grace period, whatever
+// other regions have. User events are first-in / last-out across all
+// regions, sent by the relay the user's session is on.
+const (
+	WebhookTopicActive = "topic_active"
+	WebhookTopicEmpty  = "topic_empty"
+	WebhookUserJoined  = "user_joined"
+	WebhookUserLeft    = "user_left"
+)
+
+var knownWebhookEvents = map[string]bool{
+	WebhookTopicActive: true,
+	WebhookTopicEmpty:  true,
+	WebhookUserJoined:  true,
+	WebhookUserLeft:    true,
+}
+
+// defaultWebhookEvents is used when WEBHOOK_EVENTS is unset.
+const defaultWebhookEvents = WebhookTopicActive + "," + WebhookTopicEmpty
+
+// HTTP headers on webhook requests. The signature is an HMAC-SHA256 over
+// "<timestamp>\n<body>" with WEBHOOK_SECRET, base64url without padding.
+const (
+	webhookHeaderEvent     = "Moodio-Webhook-Event"
+	webhookHeaderID        = "Moodio-Webhook-Id"
+	webhookHeaderTimestamp = "Moodio-Webhook-Ts"
+	webhookHeaderSignature = "Moodio-Webhook-Sig"
+)
+
+const (
+	defaultWebhookQueueSize = 1024
+	webhookMaxAttempts      = 5
+	webhookTimeout          = 5 * time.Second
+	webhookMaxBackoff       = 30 * time.Second
+)
+
+// webhookStats counts deliveries by outcome: delivered, retried, failed
+// (gave up) and dropped (queue full).
+var webhookStats = expvar.NewMap("webhooks")
+
+// WebhookPayload is the JSON body of a webhook request. User is set on user
+// events only.
+type WebhookPayload struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Topic     string    `json:"topic"`
+	Region    string    `json:"region"`
+	Timestamp int64     `json:"timestamp"`
+	User      *UserInfo `json:"user,omitempty"`
+}
+
+// parseWebhookEvents parses WEBHOOK_EVENTS, a comma-separated subset of
+// the webhook event names.
+func parseWebhookEvents(list string) (map[string]bool, error) {
+	events := make(map[string]bool)
+	for _, e := range strings.Split(list, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !knownWebhookEvents[e] {
+			return nil, fmt.Errorf("unknown webhook event %q", e)
+		}
+		events[e] = true
+	}
+	return events, nil
+}
+
+// webhookNotifier posts webhook payloads from a bounded in-memory queue on
+// one goroutine, so first attempts go out in the order events happened.
+// Failed deliveries (network errors, 408, 429 and 5xx) are retried with
+// exponential backoff: a timer puts them back on the queue, so a failing
+// event never holds up the ones behind it. Events (and retries) that find
+// the queue full are dropped and counted.
+type webhookNotifier struct {
+	url     string
+	secret  []byte
+	events  map[string]bool
+	client  *http.Client
+	backoff time.Duration // first retry delay, doubled per attempt
+
+	queue chan webhookDelivery
+}
+
+// webhookDelivery is a queued payload with the attempts made so far and
+// the delay before its next retry.
+type webhookDelivery struct {
+	payload  WebhookPayload
+	attempts int
+	delay    time.Duration
+}
+
+func newWebhookNotifier(url string, secret []byte, events map[string]bool, queueSize int) *webhookNotifier {
+	w := &webhookNotifier{
+		url:     url,
+		secret:  secret,
+		events:  events,
+		client:  &http.Client{Timeout: webhookTimeout},
+		backoff: time.Second,
+		queue:   make(chan webhookDelivery, queueSize),
+	}
+	go w.run()
+	return w
+}
+
+// Notify queues a payload if its event is enabled. Never blocks.
+func (w *webhookNotifier) Notify(p WebhookPayload) {
+	if !w.events[p.Event] {
+		return
+	}
+	w.enqueue(webhookDelivery{payload: p, delay: w.backoff})
+}
+
+func (w *webhookNotifier) enqueue(d webhookDelivery) {
+	select {
+	case w.queue <- d:
+	default:
+		webhookStats.Add("dropped", 1)
+	}
+}
+
+func (w *webhookNotifier) run() {
+	for d := range w.queue {
+		w.attempt(d)
+	}
+}
+
+// attempt makes one delivery attempt and, if it is worth retrying,
+// schedules the next one.
+func (w *webhookNotifier) attempt(d webhookDelivery) {
+	p := d.payload
+	body, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	d.attempts++
+	retry, err := w.deliver(p, body)
+	if err == nil {
+		webhookStats.Add("delivered", 1)
+		return
+	}
+	if !retry || d.attempts == webhookMaxAttempts {
+		webhookStats.Add("failed", 1)
+		logf(regionLocal, "[webhook] %s topic=%s failed after %d attempt(s): %v",
+			p.Event, topicIDForLog(p.Topic), d.attempts, err)
+		return
+	}
+	webhookStats.Add("retried", 1)
+	delay := d.delay
+	d.delay = min(delay*2, webhookMaxBackoff)
+	time.AfterFunc(delay, func() { w.enqueue(d) })
+}
+
+// deliver makes one attempt, reporting whether a failure is worth retrying.
+func (w *webhookNotifier) deliver(p WebhookPayload, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookHeaderEvent, p.Event)
+	req.Header.Set(webhookHeaderID, p.ID)
+	req.Header.Set(webhookHeaderTimestamp, ts)
+	req.Header.Set(webhookHeaderSignature, signWebhook(w.secret, ts, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func signWebhook(secret []byte, ts string, body []byte) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(ts))
+	m.Write([]byte{'\n'})
+	m.Write(body)
+	return base64URLEncode(m.Sum(nil))
+}
+
+// notifyWebhook queues event for topic if webhooks are configured.
+func (rm *RoomManager) notifyWebhook(event, topic string, user *UserInfo) {
+	if rm.webhooks == nil {
+		return
+	}
+	rm.webhooks.Notify(WebhookPayload{
+		ID:        uuid.NewString(),
+		Event:     event,
+		Topic:     topic,
+		Region:    rm.localRegion(),
+		Timestamp: time.Now().UnixMilli(),
+		User:      user,
+	})
+}
+
+// notifyTopicEmpty sends topic_empty if topic was reported active and now
+// has no local members and no held leaves. Callers run it after removing a
+// member or expiring a held leave. It takes leaveMu under mu.
+func (rm *RoomManager) notifyTopicEmpty(topic string) {
+	rm.mu.Lock()
+	if !rm.webhookTopics[topic] || rm.topics[topic] != nil || rm.hasHeldLeaves(topic) {
+		rm.mu.Unlock()
+		return
+	}
+	delete(rm.webhookTopics, topic)
+	rm.mu.Unlock()
+
+	rm.notifyWebhook(WebhookTopicEmpty, topic, nil)
+}
+
+// notifyUserWebhook sends user_joined / user_left for a local session when
+// userEvt (from userEventFor) says the user's presence changed.
+func (rm *RoomManager) notifyUserWebhook(topic string, userEvt []byte) {
+	if rm.webhooks == nil || userEvt == nil {
+		return
+	}
+	var evt struct {
+		Type    string   `json:"type"`
+		Payload UserInfo `json:"payload"`
+	}
+	if json.Unmarshal(userEvt, &evt) != nil {
+		return
+	}
+	rm.notifyWebhook(evt.Type, topic, &evt.Payload)
+}
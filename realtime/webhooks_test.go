@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testWebhookSecret = []byte("webhook-secret")
+
+// webhookReceiver records verified webhook payloads. status, if set, picks
+// the response code for the nth request (from 1).
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests int
+	payloads []WebhookPayload
+	status   func(n int) int
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	wr.requests++
+	n := wr.requests
+	wr.mu.Unlock()
+
+	if sig := signWebhook(testWebhookSecret, r.Header.Get(webhookHeaderTimestamp), body); sig != r.Header.Get(webhookHeaderSignature) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if wr.status != nil {
+		if code := wr.status(n); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+	}
+	var p WebhookPayload
+	if json.Unmarshal(body, &p) != nil || r.Header.Get(webhookHeaderEvent) != p.Event || r.Header.Get(webhookHeaderID) != p.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wr.mu.Lock()
+	wr.payloads = append(wr.payloads, p)
+	wr.mu.Unlock()
+}
+
+func (wr *webhookReceiver) events(topic string) []string {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	var out []string
+	for _, p := range wr.payloads {
+		if p.Topic == topic {
+			e := p.Event
+			if p.User != nil {
+				e += ":" + p.User.UserID
+			}
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func withWebhooks(t *testing.T, rooms *RoomManager, events string) *webhookReceiver {
+	t.Helper()
+	wr := &webhookReceiver{}
+	srv := httptest.NewServer(wr)
+	t.Cleanup(srv.Close)
+	enabled, err := parseWebhookEvents(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms.webhooks = newWebhookNotifier(srv.URL, testWebhookSecret, enabled, 16)
+	return wr
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWebhooks_TopicLifecycle(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	wr := withWebhooks(t, rooms, defaultWebhookEvents)
+	topic := "desktop:webhook-topic"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	alice.unsubscribe(t, topic)
+	alice.waitForOp(t, OpUnsubscribed, "")
+	alice.close()
+	time.Sleep(50 * time.Millisecond)
+	bob.close()
+	time.Sleep(200 * time.Millisecond)
+
+	if got := wr.events(topic); !equalStrings(got, []string{WebhookTopicActive, WebhookTopicEmpty}) {
+		t.Fatalf("expected one active and one empty, got %v", got)
+	}
+	wr.mu.Lock()
+	p := wr.payloads[0]
+	wr.mu.Unlock()
+	if p.ID == "" || p.Region != regionLocal || p.Timestamp == 0 || p.User != nil {
+		t.Fatalf("unexpected payload: %+v", p)
+	}
+}
+
+func TestWebhooks_TopicEmptyWaitsForHeldLeaves(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.leaveGrace = 300 * time.Millisecond
+	wr := withWebhooks(t, rooms, defaultWebhookEvents)
+	topic := "desktop:webhook-grace"
+
+	// A reload: the topic stays active throughout.
+	before := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	before.close()
+	waitFor(t, func() bool { return len(rooms.heldSessions(topic)) == 1 })
+	after := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	waitFor(t, func() bool { return len(rooms.heldSessions(topic)) == 0 })
+	time.Sleep(settle)
+	if got := wr.events(topic); !equalStrings(got, []string{WebhookTopicActive}) {
+		t.Fatalf("a reload should not flap the topic, got %v", got)
+	}
+
+	// A real leave: empty only once the held session expires.
+	after.close()
+	waitFor(t, func() bool { return len(rooms.heldSessions(topic)) == 1 })
+	time.Sleep(settle)
+	if got := wr.events(topic); len(got) != 1 {
+		t.Fatalf("topic_empty must wait for the held leave, got %v", got)
+	}
+	waitFor(t, func() bool {
+		return equalStrings(wr.events(topic), []string{WebhookTopicActive, WebhookTopicEmpty})
+	})
+}
+
+func TestWebhooks_UserJoinLeave(t *testing.T) {
+	us, hk, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	wrUS := withWebhooks(t, us, "user_joined,user_left")
+	wrHK := withWebhooks(t, hk, "user_joined,user_left")
+	topic := "desktop:webhook-user"
+
+	tab1 := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	tab2 := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	time.Sleep(200 * time.Millisecond)
+	tab1.close()
+	time.Sleep(100 * time.Millisecond)
+	tab2.close()
+	time.Sleep(200 * time.Millisecond)
+
+	if got := wrUS.events(topic); !equalStrings(got, []string{"user_joined:u-alice", "user_left:u-alice"}) {
+		t.Errorf("us: expected alice's first-in and last-out only, got %v", got)
+	}
+	if got := wrHK.events(topic); !equalStrings(got, []string{"user_joined:u-bob"}) {
+		t.Errorf("hk: expected only its own user's join, got %v", got)
+	}
+}
+
+func TestWebhooks_Retries(t *testing.T) {
+	wr := &webhookReceiver{status: func(n int) int {
+		if n <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	srv := httptest.NewServer(wr)
+	defer srv.Close()
+	w := newWebhookNotifier(srv.URL, testWebhookSecret, map[string]bool{WebhookTopicActive: true}, 4)
+	w.backoff = 10 * time.Millisecond
+
+	w.Notify(WebhookPayload{ID: "1", Event: WebhookTopicActive, Topic: "desktop:r"})
+	w.Notify(WebhookPayload{ID: "2", Event: WebhookTopicEmpty, Topic: "desktop:r"}) // not enabled
+	time.Sleep(200 * time.Millisecond)
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.requests != 3 || len(wr.payloads) != 1 || wr.payloads[0].ID != "1" {
+		t.Fatalf("expected delivery on the third attempt, got %d requests, %+v", wr.requests, wr.payloads)
+	}
+}
+
+func TestWebhooks_RetryDoesNotBlockQueue(t *testing.T) {
+	wr := &webhookReceiver{status: func(n int) int {
+		if n == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	srv := httptest.NewServer(wr)
+	defer srv.Close()
+	w := newWebhookNotifier(srv.URL, testWebhookSecret, map[string]bool{WebhookTopicActive: true}, 4)
+	w.backoff = 300 * time.Millisecond
+
+	w.Notify(WebhookPayload{ID: "1", Event: WebhookTopicActive, Topic: "desktop:r"})
+	w.Notify(WebhookPayload{ID: "2", Event: WebhookTopicActive, Topic: "desktop:r"})
+	waitFor(t, func() bool {
+		wr.mu.Lock()
+		defer wr.mu.Unlock()
+		return len(wr.payloads) == 2
+	})
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.payloads[0].ID != "2" || wr.payloads[1].ID != "1" {
+		t.Fatalf("the second event should go out while the first waits to retry, got %+v", wr.payloads)
+	}
+}
+
+func TestWebhooks_ClientErrorsAreNotRetried(t *testing.T) {
+	wr := &webhookReceiver{status: func(int) int { return http.StatusGone }}
+	srv := httptest.NewServer(wr)
+	defer srv.Close()
+	w := newWebhookNotifier(srv.URL, testWebhookSecret, map[string]bool{WebhookTopicActive: true}, 4)
+	w.backoff = 10 * time.Millisecond
+
+	w.Notify(WebhookPayload{ID: "1", Event: WebhookTopicActive, Topic: "desktop:r"})
+	time.Sleep(100 * time.Millisecond)
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.requests != 1 {
+		t.Fatalf("a 410 should not be retried, got %d requests", wr.requests)
+	}
+}
+
+func TestWebhooks_DropsWhenQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer srv.Close()
+	defer close(release)
+	w := newWebhookNotifier(srv.URL, testWebhookSecret, map[string]bool{WebhookTopicActive: true}, 2)
+
+	before := expvarInt(webhookStats, "dropped")
+	for i := 0; i < 10; i++ {
+		w.Notify(WebhookPayload{Event: WebhookTopicActive, Topic: "desktop:d"})
+	}
+	if got := expvarInt(webhookStats, "dropped") - before; got < 7 {
+		t.Fatalf("expected events beyond the queue to be dropped, got %d", got)
+	}
+}
+
+func TestParseWebhookEvents(t *testing.T) {
+	got, err := parseWebhookEvents(" topic_active, user_left ,")
+	if err != nil || len(got) != 2 || !got[WebhookTopicActive] || !got[WebhookUserLeft] {
+		t.Fatalf("unexpected %v %v", got, err)
+	}
+	if _, err := parseWebhookEvents("topic_active,topic_deleted"); err == nil {
+		t.Fatal("unknown events should be rejected")
+	}
+}
@@ -32,7 +32,7 @@ func buildHandshakeFixture(t *testing.T, secret []byte) *httptest.Server {
 	m.HandleDisconnect(func(s *melody.Session) { rooms.HandleDisconnect(s) })
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ws/connection", wsHandshakeHandler(auth, m))
+	mux.HandleFunc("/ws/connection", wsHandshakeHandler(auth, m, nil))
 
 	return httptest.NewServer(mux)
 }
@@ -168,3 +168,74 @@ func TestWSHandshake_ExpiredCookie(t *testing.T) {
 		t.Fatalf("expected 401, got %d", status)
 	}
 }
+
+// dialHandshake dials the fixture and returns the handshake status code
+// (101 on success).
+func dialHandshake(t *testing.T, srv *httptest.Server, query string, header http.Header) int {
+	t.Helper()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/connection" + query
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err == nil {
+		conn.Close()
+		return http.StatusSwitchingProtocols
+	}
+	if resp == nil {
+		t.Fatalf("dial failed without a response: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func TestWSHandshake_BearerHeader(t *testing.T) {
+	secret := []byte("handshake-test-secret")
+	srv := buildHandshakeFixture(t, secret)
+	defer srv.Close()
+
+	token := signTestJWT(t, secret, &Claims{UserID: "user-1", Exp: time.Now().Add(5 * time.Minute).Unix()})
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	if code := dialHandshake(t, srv, "", header); code != http.StatusSwitchingProtocols {
+		t.Fatalf("bearer token must upgrade, got %d", code)
+	}
+
+	// A bad bearer token is not rescued by a valid cookie.
+	header.Set("Authorization", "Bearer not-a-token")
+	header.Set("Cookie", "moodio_access_token="+token)
+	if code := dialHandshake(t, srv, "", header); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad bearer token, got %d", code)
+	}
+}
+
+// TestWSHandshake_OtherSchemeFallsBackToCookie — a proxy's Basic header
+// doesn't get in the way of the cookie.
+func TestWSHandshake_OtherSchemeFallsBackToCookie(t *testing.T) {
+	secret := []byte("handshake-test-secret")
+	srv := buildHandshakeFixture(t, secret)
+	defer srv.Close()
+
+	token := signTestJWT(t, secret, &Claims{UserID: "user-1", Exp: time.Now().Add(5 * time.Minute).Unix()})
+	header := http.Header{}
+	header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	header.Set("Cookie", "moodio_access_token="+token)
+	if code := dialHandshake(t, srv, "", header); code != http.StatusSwitchingProtocols {
+		t.Fatalf("a Basic header plus a valid cookie must upgrade, got %d", code)
+	}
+
+	header.Del("Cookie")
+	if code := dialHandshake(t, srv, "", header); code != http.StatusUnauthorized {
+		t.Fatalf("a Basic header alone must be rejected, got %d", code)
+	}
+}
+
+func TestWSHandshake_ConnectTicketIsSingleUse(t *testing.T) {
+	secret := []byte("handshake-test-secret")
+	srv := buildHandshakeFixture(t, secret)
+	defer srv.Close()
+
+	ticket := signTestJWT(t, secret, testTicketClaims("t-1", 30*time.Second))
+	if code := dialHandshake(t, srv, "?ticket="+ticket, nil); code != http.StatusSwitchingProtocols {
+		t.Fatalf("fresh ticket must upgrade, got %d", code)
+	}
+	if code := dialHandshake(t, srv, "?ticket="+ticket, nil); code != http.StatusUnauthorized {
+		t.Fatalf("replayed ticket must be rejected, got %d", code)
+	}
+}
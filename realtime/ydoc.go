@@ -0,0 +1,460 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"strings"
+	"time"
+)
+
+const (
+	// ydocNamespace topics carry one Yjs document each.
+	ydocNamespace = "ydoc"
+
+	// EventYDocState carries a relay's update log for a topic, in reply to a
+	// presence sync request. Never forwarded to clients as such.
+	EventYDocState = "ydoc_state"
+
+	// defaultYDocCompactAfter is how many updates a document's log may hold
+	// before the relay asks a member for the merged state.
+	defaultYDocCompactAfter = 256
+
+	// defaultYDocMaxUpdates and defaultYDocMaxBytes are the hard caps on a
+	// document's log (YDOC_MAX_UPDATES, YDOC_MAX_BYTES). Compaction depends
+	// on a member answering, so the log is refused growth past them.
+	defaultYDocMaxUpdates = 1024
+	defaultYDocMaxBytes   = 8 << 20
+
+	// ydocCompactRetry is how long a compaction request may go unanswered
+	// before another member is asked.
+	ydocCompactRetry = 10 * time.Second
+
+	// ydocStateChunkBytes bounds one ydoc_state message on the federation.
+	ydocStateChunkBytes = 256 << 10
+)
+
+// ydocStats counts updates refused because a document's log was at its cap
+// (rejected, sent by a local client) or relayed without being stored
+// (unstored, from another region).
+var ydocStats = expvar.NewMap("ydoc")
+
+// errYDocFull is returned by ydoc.add when the update would take the log
+// past its cap.
+var errYDocFull = errors.New("ydoc log full")
+
+func init() {
+	allowedTopicNamespaces[ydocNamespace] = true
+}
+
+// YSyncMsg is the server's half of the sync handshake. Step 1 carries the
+// relay's state vector; step 2 the updates the client's state vector lacks.
+type YSyncMsg struct {
+	Op          string   `json:"op"`
+	Topic       string   `json:"topic"`
+	Step        int      `json:"step"`
+	StateVector string   `json:"stateVector,omitempty"`
+	Updates     []string `json:"updates,omitempty"`
+	Ref         string   `json:"ref,omitempty"`
+}
+
+// YUpdateMsg relays a document update to other members and regions.
+type YUpdateMsg struct {
+	Op        string `json:"op"`
+	Topic     string `json:"topic"`
+	SessionID string `json:"sessionId,omitempty"`
+	Update    string `json:"update"`
+}
+
+type ydocStatePayload struct {
+	Updates []string `json:"updates"`
+}
+
+type ydocUpdate struct {
+	seq  uint64
+	data []byte
+	info yUpdateInfo
+}
+
+// ydoc is a topic's document, kept as the log of updates the relay has
+// seen. Updates are never applied here; a member's merged state replaces
+// the log when it grows past the compaction threshold. The log never holds
+// more than maxUpdates entries or maxBytes of update data.
+type ydoc struct {
+	updates []ydocUpdate
+	seen    map[[sha256.Size]byte]bool
+	nextSeq uint64
+	bytes   int
+
+	maxUpdates int
+	maxBytes   int
+	// refused is set when an update didn't fit, until the next compaction.
+	refused bool
+
+	// Pending compaction: updates up to compactSeq may be replaced by the
+	// state compactBy sends back.
+	compactSeq uint64
+	compactBy  string
+	compactAt  time.Time
+}
+
+func isYDocTopic(topic string) bool {
+	return strings.HasPrefix(topic, ydocNamespace+":")
+}
+
+func (doc *ydoc) ranges() []yClockRange {
+	var out []yClockRange
+	for _, u := range doc.updates {
+		out = append(out, u.info.Ranges...)
+	}
+	return out
+}
+
+// add appends an update. Returns false for an exact duplicate, and
+// errYDocFull when the log has no room for it.
+func (doc *ydoc) add(data []byte, info yUpdateInfo) (bool, error) {
+	sum := sha256.Sum256(data)
+	if doc.seen[sum] {
+		return false, nil
+	}
+	if len(doc.updates) >= doc.maxUpdates || doc.bytes+len(data) > doc.maxBytes {
+		doc.refused = true
+		return false, errYDocFull
+	}
+	doc.seen[sum] = true
+	doc.nextSeq++
+	doc.bytes += len(data)
+	doc.updates = append(doc.updates, ydocUpdate{seq: doc.nextSeq, data: data, info: info})
+	return true, nil
+}
+
+// diff returns the updates carrying something sv lacks, in log order.
+// Delete sets are not covered by state vectors, so updates with deletes
+// always go out; applying an update twice is harmless in Yjs.
+func (doc *ydoc) diff(sv map[uint64]uint64) [][]byte {
+	var out [][]byte
+	for _, u := range doc.updates {
+		missing := u.info.Deletes
+		for _, r := range u.info.Ranges {
+			if r.End > sv[r.Client] {
+				missing = true
+				break
+			}
+		}
+		if missing {
+			out = append(out, u.data)
+		}
+	}
+	return out
+}
+
+// compact replaces the updates covered by the pending compaction with
+// state, if state carries everything they did. Returns false otherwise.
+// The merged state is taken even over the byte cap: it is the smallest
+// form of the document the relay can hold.
+func (doc *ydoc) compact(state []byte, info yUpdateInfo) bool {
+	var covered []yClockRange
+	keep := doc.updates[:0:0]
+	for _, u := range doc.updates {
+		if u.seq <= doc.compactSeq {
+			covered = append(covered, u.info.Ranges...)
+		} else {
+			keep = append(keep, u)
+		}
+	}
+	have := stateVectorOf(info.Ranges)
+	for client, clock := range stateVectorOf(covered) {
+		if have[client] < clock {
+			return false
+		}
+	}
+
+	doc.nextSeq++
+	doc.updates = append([]ydocUpdate{{seq: doc.nextSeq, data: state, info: info}}, keep...)
+	doc.seen = map[[sha256.Size]byte]bool{sha256.Sum256(state): true}
+	doc.bytes = len(state)
+	for _, u := range keep {
+		doc.seen[sha256.Sum256(u.data)] = true
+		doc.bytes += len(u.data)
+	}
+	doc.compactSeq, doc.compactBy = 0, ""
+	doc.refused = false
+	return true
+}
+
+func (rm *RoomManager) ydocFor(topic string) *ydoc {
+	doc := rm.ydocs[topic]
+	if doc == nil {
+		doc = &ydoc{seen: make(map[[sha256.Size]byte]bool), maxUpdates: rm.ydocMaxUpdates, maxBytes: rm.ydocMaxBytes}
+		rm.ydocs[topic] = doc
+	}
+	return doc
+}
+
+// ydocOp runs the checks shared by ysync and yupdate. Returns false after
+// writing the error.
+func (rm *RoomManager) ydocOp(s sessionConn, keys *SessionKeys, op IncomingOp, write bool) bool {
+	entry, ok := keys.Subs.Get(op.Topic)
+	if !ok {
+		writeError(s, ErrorMsg{Op: OpError, Topic: op.Topic, Code: ErrCodeNotSubscribed, Ref: op.Ref})
+		return false
+	}
+	if !isYDocTopic(op.Topic) {
+		writeError(s, ErrorMsg{Op: OpError, Topic: op.Topic, Code: ErrCodeBadRequest, Message: "not a ydoc topic", Ref: op.Ref})
+		return false
+	}
+	if write && entry.Permission == "viewer" {
+		writeError(s, ErrorMsg{Op: OpError, Topic: op.Topic, Code: ErrCodeForbidden, Message: "viewers cannot edit", Ref: op.Ref})
+		return false
+	}
+	if write && !keys.Claims.mayPublish(OpYUpdate) {
+		writeError(s, ErrorMsg{Op: OpError, Topic: op.Topic, Code: ErrCodeForbidden, Message: "yupdate not allowed for this service account", Ref: op.Ref})
+		return false
+	}
+	return true
+}
+
+func (rm *RoomManager) handleYSync(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	switch op.Step {
+	case 1:
+		if !rm.ydocOp(s, keys, op, false) {
+			return
+		}
+		raw, err := base64.StdEncoding.DecodeString(op.StateVector)
+		var sv map[uint64]uint64
+		if err == nil {
+			sv, err = parseStateVector(raw)
+		}
+		if err != nil {
+			writeError(s, ErrorMsg{Op: OpError, Topic: op.Topic, Code: ErrCodeBadRequest, Message: "invalid stateVector", Ref: op.Ref})
+			return
+		}
+		rm.ydocMu.Lock()
+		var updates [][]byte
+		if doc := rm.ydocs[op.Topic]; doc != nil {
+			updates = doc.diff(sv)
+		}
+		rm.ydocMu.Unlock()
+
+		msg := YSyncMsg{Op: OpYSync, Topic: op.Topic, Step: 2, Ref: op.Ref}
+		for _, u := range updates {
+			msg.Updates = append(msg.Updates, base64.StdEncoding.EncodeToString(u))
+		}
+		if data, err := json.Marshal(msg); err == nil {
+			_ = writeFrame(s, data)
+		}
+	case 2:
+		rm.handleYUpdate(s, keys, op)
+	default:
+		writeError(s, ErrorMsg{Op: OpError, Topic: op.Topic, Code: ErrCodeBadRequest, Message: "step must be 1 or 2", Ref: op.Ref})
+	}
+}
+
+// handleYUpdate stores a client's update (a yupdate, or the step 2 answer
+// to the relay's step 1) and relays it to the other members and regions.
+func (rm *RoomManager) handleYUpdate(s sessionConn, keys *SessionKeys, op IncomingOp) {
+	if !rm.ydocOp(s, keys, op, true) {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(op.Update)
+	var info yUpdateInfo
+	if err == nil {
+		info, err = parseYUpdate(data)
+	}
+	if err != nil {
+		writeError(s, ErrorMsg{Op: OpError, Topic: op.Topic, Code: ErrCodeBadRequest, Message: "invalid update", Ref: op.Ref})
+		return
+	}
+
+	rm.ydocMu.Lock()
+	doc := rm.ydocFor(op.Topic)
+	if op.Step == 2 && doc.compactBy == keys.SessionID && doc.compact(data, info) {
+		n := len(doc.updates)
+		rm.ydocMu.Unlock()
+		logf(regionLocal, "[ydoc] topic=%s compacted to %d updates by session=%s",
+			topicIDForLog(op.Topic), n, truncateID(keys.SessionID))
+		return
+	}
+	added, err := doc.add(data, info)
+	compactWith := rm.ydocCompactTarget(doc, op.Topic, s)
+	rm.ydocMu.Unlock()
+
+	if compactWith != nil {
+		defer rm.requestYDocState(compactWith, op.Topic, true)
+	}
+	if err != nil {
+		// Not relayed either: members would hold an edit that late joiners
+		// can't sync. The client retries once compaction has made room.
+		ydocStats.Add("rejected", 1)
+		logf(regionLocal, "[ydoc] topic=%s log full; rejected update from session=%s",
+			topicIDForLog(op.Topic), truncateID(keys.SessionID))
+		writeError(s, ErrorMsg{Op: OpError, Topic: op.Topic, Code: ErrCodeRateLimited,
+			Message: "document log is full", Ref: op.Ref})
+		return
+	}
+	if added {
+		msg, err := json.Marshal(YUpdateMsg{Op: OpYUpdate, Topic: op.Topic, SessionID: keys.SessionID, Update: op.Update})
+		if err == nil {
+			rm.broadcastToTopic(op.Topic, s, msg)
+		}
+	}
+}
+
+// ydocCompactTarget picks the member to ask for the merged document when
+// the log is over the threshold or full and no request is pending:
+// preferred if set, else any local editor. Called with ydocMu held.
+func (rm *RoomManager) ydocCompactTarget(doc *ydoc, topic string, preferred sessionConn) sessionConn {
+	if len(doc.updates) <= rm.ydocCompactAfter && !doc.refused {
+		return nil
+	}
+	if doc.compactBy != "" && time.Since(doc.compactAt) < ydocCompactRetry {
+		return nil
+	}
+	target := preferred
+	if target == nil {
+		rm.mu.RLock()
+		for sess := range rm.topics[topic] {
+			k := getSessionKeys(sess)
+			if k == nil {
+				continue
+			}
+			if entry, ok := k.Subs.Get(topic); ok && entry.Permission != "viewer" {
+				target = sess
+				break
+			}
+		}
+		rm.mu.RUnlock()
+	}
+	if target == nil {
+		return nil
+	}
+	k := getSessionKeys(target)
+	if k == nil {
+		return nil
+	}
+	doc.compactSeq = doc.nextSeq
+	doc.compactBy = k.SessionID
+	doc.compactAt = time.Now()
+	return target
+}
+
+// requestYDocState sends a step 1 with the relay's state vector, which the
+// client answers with a step 2 holding everything the relay lacks. full
+// sends an empty state vector instead, asking for the whole document.
+func (rm *RoomManager) requestYDocState(s sessionConn, topic string, full bool) {
+	sv := map[uint64]uint64{}
+	if !full {
+		rm.ydocMu.Lock()
+		if doc := rm.ydocs[topic]; doc != nil {
+			sv = stateVectorOf(doc.ranges())
+		}
+		rm.ydocMu.Unlock()
+	}
+
+	msg, err := json.Marshal(YSyncMsg{Op: OpYSync, Topic: topic, Step: 1, StateVector: base64.StdEncoding.EncodeToString(encodeStateVector(sv))})
+	if err == nil {
+		_ = writeFrame(s, msg)
+	}
+}
+
+// applyRemoteYUpdate stores an update from another region and forwards it
+// to local members if it was new here.
+func (rm *RoomManager) applyRemoteYUpdate(topic, sourceRegion, update string, msg []byte) {
+	data, err := base64.StdEncoding.DecodeString(update)
+	var info yUpdateInfo
+	if err == nil {
+		info, err = parseYUpdate(data)
+	}
+	if err != nil {
+		logf(sourceRegion, "[federation] bad ydoc update for topic=%s: %v", topicIDForLog(topic), err)
+		return
+	}
+
+	rm.ydocMu.Lock()
+	doc := rm.ydocFor(topic)
+	added, err := doc.add(data, info)
+	compactWith := rm.ydocCompactTarget(doc, topic, nil)
+	rm.ydocMu.Unlock()
+
+	if err != nil {
+		// The sender's region already accepted it, so local members still
+		// get it; only this relay's log misses it.
+		ydocStats.Add("unstored", 1)
+		logf(sourceRegion, "[ydoc] topic=%s log full; relaying update without storing it", topicIDForLog(topic))
+		added = true
+	}
+	if added {
+		if msg == nil {
+			msg, _ = json.Marshal(YUpdateMsg{Op: OpYUpdate, Topic: topic, Update: update})
+		}
+		rm.broadcastToTopicLocal(topic, msg)
+	}
+	if compactWith != nil {
+		rm.requestYDocState(compactWith, topic, true)
+	}
+}
+
+// publishYDocState sends this relay's update log for topic to other
+// regions, in reply to a presence sync request, split into chunks.
+func (rm *RoomManager) publishYDocState(topic string) {
+	if !isYDocTopic(topic) {
+		return
+	}
+	rm.ydocMu.Lock()
+	var chunks [][]string
+	var chunk []string
+	size := 0
+	if doc := rm.ydocs[topic]; doc != nil {
+		for _, u := range doc.updates {
+			enc := base64.StdEncoding.EncodeToString(u.data)
+			if size > 0 && size+len(enc) > ydocStateChunkBytes {
+				chunks = append(chunks, chunk)
+				chunk, size = nil, 0
+			}
+			chunk = append(chunk, enc)
+			size += len(enc)
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	rm.ydocMu.Unlock()
+
+	for _, c := range chunks {
+		msg, err := json.Marshal(map[string]any{
+			"op":      OpEvent,
+			"type":    EventYDocState,
+			"topic":   topic,
+			"payload": ydocStatePayload{Updates: c},
+		})
+		if err != nil {
+			return
+		}
+		if err := rm.federator.Publish(topic, msg); err != nil {
+			logf(regionLocal, "[federation] ydoc state publish failed for topic=%s: %v", topicIDForLog(topic), err)
+			return
+		}
+	}
+}
+
+// applyYDocState merges a ydoc_state chunk from another region.
+func (rm *RoomManager) applyYDocState(topic, sourceRegion string, payload json.RawMessage) {
+	var state ydocStatePayload
+	if err := json.Unmarshal(payload, &state); err != nil {
+		logf(sourceRegion, "[federation] bad ydoc state for topic=%s: %v", topicIDForLog(topic), err)
+		return
+	}
+	for _, u := range state.Updates {
+		rm.applyRemoteYUpdate(topic, sourceRegion, u, nil)
+	}
+}
+
+// dropYDoc forgets a topic's document once no local member is left. The
+// relay is not the document's store of record.
+func (rm *RoomManager) dropYDoc(topic string) {
+	rm.ydocMu.Lock()
+	delete(rm.ydocs, topic)
+	rm.ydocMu.Unlock()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func b64(data []byte) string { return base64.StdEncoding.EncodeToString(data) }
+
+func (tc *testClient) yupdate(t *testing.T, topic string, update []byte) {
+	t.Helper()
+	tc.sendRaw(t, map[string]any{"op": OpYUpdate, "topic": topic, "update": b64(update)})
+}
+
+// ysync sends a step 1 with sv and returns the decoded updates of the reply.
+func (tc *testClient) ysync(t *testing.T, topic, ref string, sv map[uint64]uint64) [][]byte {
+	t.Helper()
+	tc.sendRaw(t, map[string]any{"op": OpYSync, "topic": topic, "step": 1, "stateVector": b64(encodeStateVector(sv)), "ref": ref})
+	var reply YSyncMsg
+	_ = json.Unmarshal(tc.waitForOp(t, OpYSync, ref), &reply)
+	if reply.Step != 2 {
+		t.Fatalf("expected step 2 reply, got %+v", reply)
+	}
+	out := make([][]byte, len(reply.Updates))
+	for i, u := range reply.Updates {
+		out[i], _ = base64.StdEncoding.DecodeString(u)
+	}
+	return out
+}
+
+func yupdatesFor(tc *testClient, topic string) []YUpdateMsg {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	var out []YUpdateMsg
+	for _, raw := range tc.messages {
+		var msg YUpdateMsg
+		if json.Unmarshal(raw, &msg) == nil && msg.Op == OpYUpdate && msg.Topic == topic {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func TestYDoc_SyncForLateJoiner(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "ydoc:comments-1"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	var step1 YSyncMsg
+	_ = json.Unmarshal(alice.waitForOp(t, OpYSync, ""), &step1)
+	if step1.Step != 1 || step1.StateVector != b64([]byte{0}) {
+		t.Fatalf("subscribe should be followed by the relay's (empty) step 1, got %+v", step1)
+	}
+
+	first, second, del := yTextInsert(1, 0, "hi"), yTextInsert(1, 2, "!"), yDelete(1, 0, 1)
+	alice.yupdate(t, topic, first)
+	alice.yupdate(t, topic, second)
+	alice.yupdate(t, topic, del)
+	alice.yupdate(t, topic, first) // duplicate: stored and relayed once
+
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "viewer")
+	defer bob.close()
+	_ = json.Unmarshal(bob.waitForOp(t, OpYSync, ""), &step1)
+	if sv, _ := base64.StdEncoding.DecodeString(step1.StateVector); string(sv) != string(encodeStateVector(map[uint64]uint64{1: 3})) {
+		t.Fatalf("relay step 1 should carry its state vector, got %x", sv)
+	}
+
+	if got := bob.ysync(t, topic, "s1", nil); len(got) != 3 {
+		t.Fatalf("empty state vector should get every update, got %d", len(got))
+	}
+	got := bob.ysync(t, topic, "s2", map[uint64]uint64{1: 2})
+	if len(got) != 2 || string(got[0]) != string(second) || string(got[1]) != string(del) {
+		t.Fatalf("state vector {1:2} should get the append and the delete, got %x", got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	carol := connectAndSubscribe(t, server, topic, "u-carol", "Carol", "editor")
+	defer carol.close()
+	alice.yupdate(t, topic, yTextInsert(1, 3, "?"))
+	time.Sleep(50 * time.Millisecond)
+	if msgs := yupdatesFor(carol, topic); len(msgs) != 1 || msgs[0].SessionID != alice.sessionID {
+		t.Fatalf("live updates should be relayed with the sender, got %+v", msgs)
+	}
+	if msgs := yupdatesFor(alice, topic); len(msgs) != 0 {
+		t.Fatalf("sender should not get its own updates, got %+v", msgs)
+	}
+}
+
+func TestYDoc_ClientStep2FillsRelay(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "ydoc:offline"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	alice.waitForOp(t, OpYSync, "")
+	offline := yTextInsert(4, 0, "written offline")
+	alice.sendRaw(t, map[string]any{"op": OpYSync, "topic": topic, "step": 2, "update": b64(offline)})
+	time.Sleep(50 * time.Millisecond)
+
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	if got := bob.ysync(t, topic, "s1", nil); len(got) != 1 || string(got[0]) != string(offline) {
+		t.Fatalf("the client's step 2 should reach later joiners, got %x", got)
+	}
+}
+
+func TestYDoc_Validation(t *testing.T) {
+	_, _, server := setupTestServer()
+	defer server.Close()
+	topic := "ydoc:checks"
+
+	viewer := connectAndSubscribe(t, server, topic, "u-view", "View", "viewer")
+	defer viewer.close()
+	viewer.sendRaw(t, map[string]any{"op": OpYUpdate, "topic": topic, "update": b64(yTextInsert(1, 0, "x")), "ref": "v1"})
+	if code := errorCode(viewer.waitForOp(t, OpError, "v1")); code != ErrCodeForbidden {
+		t.Errorf("viewer update should be forbidden, got %q", code)
+	}
+	viewer.ysync(t, topic, "v2", nil) // reading is fine
+
+	editor := connectAndSubscribe(t, server, topic, "u-ed", "Ed", "editor")
+	defer editor.close()
+	desk := "desktop:not-a-doc"
+	editor.subscribe(t, desk)
+	for ref, msg := range map[string]map[string]any{
+		"e1": {"op": OpYUpdate, "topic": topic, "update": "not base64!"},
+		"e2": {"op": OpYUpdate, "topic": topic, "update": b64([]byte{1, 1, 1})},
+		"e3": {"op": OpYSync, "topic": topic, "step": 1, "stateVector": b64([]byte{3, 1})},
+		"e4": {"op": OpYSync, "topic": topic, "step": 3},
+		"e5": {"op": OpYSync, "topic": desk, "step": 1},
+	} {
+		msg["ref"] = ref
+		editor.sendRaw(t, msg)
+		if code := errorCode(editor.waitForOp(t, OpError, ref)); code != ErrCodeBadRequest {
+			t.Errorf("%s: expected bad_request, got %q", ref, code)
+		}
+	}
+	editor.sendRaw(t, map[string]any{"op": OpYSync, "topic": "ydoc:other", "step": 1, "ref": "e6"})
+	if code := errorCode(editor.waitForOp(t, OpError, "e6")); code != ErrCodeNotSubscribed {
+		t.Errorf("expected not_subscribed, got %q", code)
+	}
+}
+
+func TestYDoc_Compaction(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.ydocCompactAfter = 3
+	topic := "ydoc:compact"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	alice.waitForOp(t, OpYSync, "")
+	alice.clearMessages()
+	for i, s := range []string{"a", "b", "c", "d"} {
+		alice.yupdate(t, topic, yTextInsert(1, uint64(i), s))
+	}
+
+	var req YSyncMsg
+	_ = json.Unmarshal(alice.waitForOp(t, OpYSync, ""), &req)
+	if req.Step != 1 || req.StateVector != b64([]byte{0}) {
+		t.Fatalf("over the threshold the relay should ask for the full state, got %+v", req)
+	}
+
+	// A reply that misses part of the log does not replace it.
+	alice.sendRaw(t, map[string]any{"op": OpYSync, "topic": topic, "step": 2, "update": b64(yTextInsert(1, 0, "ab"))})
+	merged := yTextInsert(1, 0, "abcd")
+	alice.sendRaw(t, map[string]any{"op": OpYSync, "topic": topic, "step": 2, "update": b64(merged)})
+	time.Sleep(50 * time.Millisecond)
+
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	got := bob.ysync(t, topic, "s1", nil)
+	if len(got) != 2 || string(got[0]) != string(merged) {
+		t.Fatalf("log should be the merged state plus the later update, got %d updates", len(got))
+	}
+}
+
+// TestYDoc_LogCaps — a full log refuses updates, asks for the merged
+// state, and takes updates again once compacted.
+func TestYDoc_LogCaps(t *testing.T) {
+	_, rooms, server := setupTestServer()
+	defer server.Close()
+	rooms.ydocMaxUpdates = 3
+	topic := "ydoc:caps"
+
+	alice := connectAndSubscribe(t, server, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	alice.waitForOp(t, OpYSync, "")
+	bob := connectAndSubscribe(t, server, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	alice.clearMessages()
+
+	for i, s := range []string{"a", "b", "c"} {
+		alice.yupdate(t, topic, yTextInsert(1, uint64(i), s))
+	}
+	waitFor(t, func() bool { return len(yupdatesFor(bob, topic)) == 3 })
+	before := expvarInt(ydocStats, "rejected")
+	alice.sendRaw(t, map[string]any{"op": OpYUpdate, "topic": topic, "update": b64(yTextInsert(1, 3, "d")), "ref": "u4"})
+	if code := errorCode(alice.waitForOp(t, OpError, "u4")); code != ErrCodeRateLimited {
+		t.Fatalf("an update past the cap should be rate_limited, got %q", code)
+	}
+	if got := expvarInt(ydocStats, "rejected") - before; got != 1 {
+		t.Errorf("refusal should be counted, got %d", got)
+	}
+	var req YSyncMsg
+	_ = json.Unmarshal(alice.waitForOp(t, OpYSync, ""), &req)
+	if req.Step != 1 || req.StateVector != b64([]byte{0}) {
+		t.Fatalf("a full log should ask for the merged state, got %+v", req)
+	}
+	time.Sleep(settle)
+	if n := len(yupdatesFor(bob, topic)); n != 3 {
+		t.Fatalf("a refused update must not be relayed, bob got %d", n)
+	}
+
+	alice.sendRaw(t, map[string]any{"op": OpYSync, "topic": topic, "step": 2, "update": b64(yTextInsert(1, 0, "abc"))})
+	alice.sendRaw(t, map[string]any{"op": OpYUpdate, "topic": topic, "update": b64(yTextInsert(1, 3, "d")), "ref": "u5"})
+	waitFor(t, func() bool { return len(yupdatesFor(bob, topic)) == 4 })
+
+	// The byte cap holds too.
+	rooms.ydocMu.Lock()
+	rooms.ydocs[topic].maxBytes = rooms.ydocs[topic].bytes
+	rooms.ydocMu.Unlock()
+	alice.sendRaw(t, map[string]any{"op": OpYUpdate, "topic": topic, "update": b64(yTextInsert(1, 4, "e")), "ref": "u6"})
+	if code := errorCode(alice.waitForOp(t, OpError, "u6")); code != ErrCodeRateLimited {
+		t.Fatalf("an update past the byte cap should be rate_limited, got %q", code)
+	}
+}
+
+func TestYDoc_Federated(t *testing.T) {
+	_, _, serverUS, serverHK := setupFederatedPair(t)
+	defer serverUS.Close()
+	defer serverHK.Close()
+	topic := "ydoc:fed"
+
+	alice := connectAndSubscribe(t, serverUS, topic, "u-alice", "Alice", "editor")
+	defer alice.close()
+	early := yTextInsert(1, 0, "early")
+	alice.yupdate(t, topic, early)
+	time.Sleep(50 * time.Millisecond)
+
+	// HK joins late: its first member gets the log via the presence sync.
+	bob := connectAndSubscribe(t, serverHK, topic, "u-bob", "Bob", "editor")
+	defer bob.close()
+	time.Sleep(200 * time.Millisecond)
+	if msgs := yupdatesFor(bob, topic); len(msgs) != 1 || msgs[0].Update != b64(early) {
+		t.Fatalf("bob should get the existing log from US, got %+v", msgs)
+	}
+
+	live := yTextInsert(1, 5, "+live")
+	alice.yupdate(t, topic, live)
+	bobsOwn := yTextInsert(2, 0, "from hk")
+	bob.yupdate(t, topic, bobsOwn)
+	time.Sleep(150 * time.Millisecond)
+
+	if msgs := yupdatesFor(bob, topic); len(msgs) != 2 || msgs[1].SessionID != alice.sessionID {
+		t.Fatalf("bob should get alice's live update, got %+v", msgs)
+	}
+	if msgs := yupdatesFor(alice, topic); len(msgs) != 1 || msgs[0].Update != b64(bobsOwn) {
+		t.Fatalf("alice should get bob's update, got %+v", msgs)
+	}
+
+	carol := connectAndSubscribe(t, serverHK, topic, "u-carol", "Carol", "editor")
+	defer carol.close()
+	if got := carol.ysync(t, topic, "s1", nil); len(got) != 3 {
+		t.Fatalf("HK's log should hold all three updates, got %d", len(got))
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"unicode/utf8"
+)
+
+// Just enough of the Yjs v1 update format (lib0 encoding) to tell which
+// clock ranges an update carries. The relay never applies updates; it keeps
+// them as opaque blobs and picks the ones a state vector is missing.
+
+var errYUpdateTruncated = errors.New("truncated yjs message")
+
+type yDecoder struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (d *yDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if d.pos >= len(d.buf) {
+		d.err = errYUpdateTruncated
+		return 0
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *yDecoder) skip(n uint64) {
+	if d.err != nil {
+		return
+	}
+	if n > uint64(len(d.buf)-d.pos) {
+		d.err = errYUpdateTruncated
+		return
+	}
+	d.pos += int(n)
+}
+
+func (d *yDecoder) varUint() uint64 {
+	var n uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b := d.byte()
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return n
+		}
+	}
+	d.err = errors.New("varuint overflow")
+	return 0
+}
+
+func (d *yDecoder) varInt() {
+	b := d.byte()
+	for b&0x80 != 0 && d.err == nil {
+		b = d.byte()
+	}
+}
+
+func (d *yDecoder) bytes() []byte {
+	n := d.varUint()
+	start := d.pos
+	d.skip(n)
+	if d.err != nil {
+		return nil
+	}
+	return d.buf[start:d.pos]
+}
+
+// any skips a lib0 "any" value.
+func (d *yDecoder) any() {
+	switch d.byte() {
+	case 127, 126, 121, 120: // undefined, null, false, true
+	case 125:
+		d.varInt()
+	case 124:
+		d.skip(4)
+	case 123, 122:
+		d.skip(8)
+	case 119, 116: // string, Uint8Array
+		d.bytes()
+	case 118:
+		for n := d.varUint(); n > 0 && d.err == nil; n-- {
+			d.bytes()
+			d.any()
+		}
+	case 117:
+		for n := d.varUint(); n > 0 && d.err == nil; n-- {
+			d.any()
+		}
+	default:
+		if d.err == nil {
+			d.err = errors.New("unknown any type")
+		}
+	}
+}
+
+// utf16Len is the length JavaScript reports for s, which is what Yjs counts
+// string content in.
+func utf16Len(s []byte) uint64 {
+	var n uint64
+	for len(s) > 0 {
+		r, size := utf8.DecodeRune(s)
+		s = s[size:]
+		n++
+		if r > 0xffff {
+			n++
+		}
+	}
+	return n
+}
+
+// itemContentLen skips an item's content and returns its clock length.
+func (d *yDecoder) itemContentLen(ref byte) uint64 {
+	switch ref {
+	case 1: // deleted
+		return d.varUint()
+	case 2: // JSON
+		n := d.varUint()
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			d.bytes()
+		}
+		return n
+	case 3, 5: // binary, embed
+		d.bytes()
+		return 1
+	case 4: // string
+		return utf16Len(d.bytes())
+	case 6: // format
+		d.bytes()
+		d.bytes()
+		return 1
+	case 7: // type
+		if t := d.varUint(); t == 3 || t == 5 { // XmlElement, XmlHook
+			d.bytes()
+		}
+		return 1
+	case 8: // any
+		n := d.varUint()
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			d.any()
+		}
+		return n
+	case 9: // doc
+		d.bytes()
+		d.any()
+		return 1
+	}
+	if d.err == nil {
+		d.err = errors.New("unknown item content")
+	}
+	return 0
+}
+
+// yClockRange is a run of structs [Start, End) from one client.
+type yClockRange struct {
+	Client, Start, End uint64
+}
+
+// yUpdateInfo summarizes a decoded update.
+type yUpdateInfo struct {
+	Ranges  []yClockRange
+	Deletes bool
+}
+
+// parseYUpdate decodes a Yjs v1 update. Skip structs (gaps in a merged
+// update) are not counted as carried.
+func parseYUpdate(update []byte) (yUpdateInfo, error) {
+	d := &yDecoder{buf: update}
+	var info yUpdateInfo
+	for groups := d.varUint(); groups > 0 && d.err == nil; groups-- {
+		structs := d.varUint()
+		client := d.varUint()
+		clock := d.varUint()
+		start := clock
+		for ; structs > 0 && d.err == nil; structs-- {
+			bits := d.byte()
+			switch bits & 0x1f {
+			case 0: // GC
+				clock += d.varUint()
+			case 10: // skip
+				if clock > start {
+					info.Ranges = append(info.Ranges, yClockRange{client, start, clock})
+				}
+				clock += d.varUint()
+				start = clock
+			default:
+				if bits&0x80 != 0 { // origin
+					d.varUint()
+					d.varUint()
+				}
+				if bits&0x40 != 0 { // right origin
+					d.varUint()
+					d.varUint()
+				}
+				if bits&0xc0 == 0 { // parent not derivable from origins
+					if d.varUint() == 1 {
+						d.bytes() // root type name
+					} else {
+						d.varUint()
+						d.varUint()
+					}
+					if bits&0x20 != 0 {
+						d.bytes() // parentSub
+					}
+				}
+				clock += d.itemContentLen(bits & 0x1f)
+			}
+		}
+		if clock > start {
+			info.Ranges = append(info.Ranges, yClockRange{client, start, clock})
+		}
+	}
+	for clients := d.varUint(); clients > 0 && d.err == nil; clients-- {
+		d.varUint()
+		for n := d.varUint(); n > 0 && d.err == nil; n-- {
+			d.varUint()
+			d.varUint()
+			info.Deletes = true
+		}
+	}
+	if d.err != nil {
+		return yUpdateInfo{}, d.err
+	}
+	if d.pos != len(update) {
+		return yUpdateInfo{}, errors.New("trailing bytes after yjs update")
+	}
+	return info, nil
+}
+
+// parseStateVector decodes a Yjs state vector (client -> next clock).
+func parseStateVector(sv []byte) (map[uint64]uint64, error) {
+	out := make(map[uint64]uint64)
+	if len(sv) == 0 {
+		return out, nil
+	}
+	d := &yDecoder{buf: sv}
+	for n := d.varUint(); n > 0 && d.err == nil; n-- {
+		client := d.varUint()
+		out[client] = d.varUint()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.pos != len(sv) {
+		return nil, errors.New("trailing bytes after state vector")
+	}
+	return out, nil
+}
+
+func appendVarUint(buf []byte, n uint64) []byte {
+	for n >= 0x80 {
+		buf = append(buf, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(buf, byte(n))
+}
+
+// encodeStateVector encodes sv the way Yjs does, highest client first.
+func encodeStateVector(sv map[uint64]uint64) []byte {
+	clients := make([]uint64, 0, len(sv))
+	for c := range sv {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] > clients[j] })
+	buf := appendVarUint(nil, uint64(len(clients)))
+	for _, c := range clients {
+		buf = appendVarUint(buf, c)
+		buf = appendVarUint(buf, sv[c])
+	}
+	return buf
+}
+
+// stateVectorOf returns, per client, the end of the contiguous run of
+// clocks from 0 covered by ranges. Like Yjs, anything after a gap does not
+// count.
+func stateVectorOf(ranges []yClockRange) map[uint64]uint64 {
+	sorted := append([]yClockRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Client != sorted[j].Client {
+			return sorted[i].Client < sorted[j].Client
+		}
+		return sorted[i].Start < sorted[j].Start
+	})
+	sv := make(map[uint64]uint64)
+	for _, r := range sorted {
+		if r.Start <= sv[r.Client] && r.End > sv[r.Client] {
+			sv[r.Client] = r.End
+		}
+	}
+	return sv
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func appendVarString(buf []byte, s string) []byte {
+	return append(appendVarUint(buf, uint64(len(s))), s...)
+}
+
+// yTextInsert encodes a v1 update that inserts text into the root text "t".
+// Clock 0 starts the text; later clocks append after (client, clock-1).
+func yTextInsert(client, clock uint64, text string) []byte {
+	b := appendVarUint(nil, 1) // one client
+	b = appendVarUint(b, 1)    // one struct
+	b = appendVarUint(b, client)
+	b = appendVarUint(b, clock)
+	if clock == 0 {
+		b = append(b, 0x04) // string content, parent follows
+		b = appendVarUint(b, 1)
+		b = appendVarString(b, "t")
+	} else {
+		b = append(b, 0x84) // string content, origin follows
+		b = appendVarUint(b, client)
+		b = appendVarUint(b, clock-1)
+	}
+	b = appendVarString(b, text)
+	return append(b, 0) // empty delete set
+}
+
+// yDelete encodes a delete-only v1 update.
+func yDelete(client, clock, length uint64) []byte {
+	b := []byte{0, 1}
+	b = appendVarUint(b, client)
+	b = appendVarUint(b, 1)
+	b = appendVarUint(b, clock)
+	return appendVarUint(b, length)
+}
+
+func TestParseYUpdate(t *testing.T) {
+	cases := []struct {
+		name string
+		hex  string
+		want yUpdateInfo
+	}{
+		// ytext.insert(0, "hi") from client 1.
+		{"text insert", "010101000401017402686900", yUpdateInfo{Ranges: []yClockRange{{1, 0, 2}}}},
+		// ymap.set("k", 1) on root map "m" from client 5.
+		{"map set", "01010500280101" + "6d016b017d0100", yUpdateInfo{Ranges: []yClockRange{{5, 0, 1}}}},
+		{"delete only", hex.EncodeToString(yDelete(7, 3, 2)), yUpdateInfo{Deletes: true}},
+		{"astral chars count twice", hex.EncodeToString(yTextInsert(2, 4, "a😀")), yUpdateInfo{Ranges: []yClockRange{{2, 4, 7}}}},
+		// GC run of 3, skip of 2, one JSON item of 2 entries: the skip splits the range.
+		{"gc and skip", "01030900" + "0003" + "0a02" + "8209020201610162" + "00", yUpdateInfo{Ranges: []yClockRange{{9, 0, 3}, {9, 5, 7}}}},
+	}
+	for _, tc := range cases {
+		data, _ := hex.DecodeString(tc.hex)
+		got, err := parseYUpdate(data)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	bad := yTextInsert(1, 0, "hello")
+	if _, err := parseYUpdate(bad[:len(bad)-3]); err == nil {
+		t.Error("truncated update should fail")
+	}
+	if _, err := parseYUpdate(append(bad, 0)); err == nil {
+		t.Error("trailing bytes should fail")
+	}
+	if _, err := parseYUpdate([]byte{1, 1, 1, 0, 0x1f}); err == nil {
+		t.Error("unknown content ref should fail")
+	}
+}
+
+func TestStateVector(t *testing.T) {
+	sv := map[uint64]uint64{1: 2, 300: 70000}
+	got, err := parseStateVector(encodeStateVector(sv))
+	if err != nil || !reflect.DeepEqual(got, sv) {
+		t.Fatalf("round trip: got %v, %v", got, err)
+	}
+	if got, err := parseStateVector(nil); err != nil || len(got) != 0 {
+		t.Fatalf("empty state vector: got %v, %v", got, err)
+	}
+	if _, err := parseStateVector([]byte{2, 1}); err == nil {
+		t.Fatal("truncated state vector should fail")
+	}
+
+	ranges := []yClockRange{{1, 2, 5}, {1, 0, 2}, {2, 3, 4}, {1, 8, 9}}
+	if got := stateVectorOf(ranges); !reflect.DeepEqual(got, map[uint64]uint64{1: 5}) {
+		t.Fatalf("state vector should stop at the first gap, got %v", got)
+	}
+}